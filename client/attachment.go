@@ -0,0 +1,207 @@
+package client
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+var (
+	ErrNotAttachment     = errors.New("message does not carry an attachment")
+	ErrInvalidAttachment = errors.New("attachment does not match the size or digest its message gives")
+)
+
+// UploadAttachment encrypts the file read from r under a new key as it
+// uploads it to the blob store, and returns the attachment to send in a
+// message made with MakeAttachmentMessage. A file r can seek in is read from
+// its start and uploaded in chunks, resuming when a transfer is cut off, if
+// the server takes resumable uploads.
+func (cli *Client) UploadAttachment(name string, mediaType string, r io.Reader) (types.Attachment, error) {
+	attachment := types.Attachment{
+		Name:      name,
+		MediaType: mediaType,
+		Key:       make([]byte, sizeContentKey),
+		ChunkSize: DefaultChunkSize,
+	}
+	if _, err := io.ReadFull(cryptorand.Reader, attachment.Key); err != nil {
+		return attachment, err
+	}
+	if file, ok := r.(io.ReadSeeker); ok {
+		err := cli.uploadAttachmentResumable(&attachment, file)
+		if err != errUploadsUnsupported {
+			return attachment, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return attachment, err
+		}
+	}
+	return attachment, cli.postAttachment(&attachment, r)
+}
+
+// postAttachment uploads the attachment in a single request.
+func (cli *Client) postAttachment(attachment *types.Attachment, r io.Reader) error {
+	// encrypted as the request body is sent, so the file is never held
+	// whole
+	body, pipe := io.Pipe()
+	digest := sha256.New()
+	encrypted := make(chan error, 1)
+	go func() {
+		chunks, err := newChunkWriter(io.MultiWriter(pipe, digest), attachment.Key, attachment.ChunkSize)
+		if err == nil {
+			attachment.Size, err = io.Copy(chunks, r)
+		}
+		if err == nil {
+			err = chunks.Close()
+		}
+		pipe.CloseWithError(err)
+		encrypted <- err
+	}()
+
+	request, err := cli.newRequest(http.MethodPost, "/blobs", nil)
+	if err != nil {
+		body.Close()
+		<-encrypted
+		return err
+	}
+	request.Body = body
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := http.DefaultClient.Do(request)
+	if encryptErr := <-encrypted; encryptErr != nil && err == nil {
+		err = encryptErr
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return errors.New("client.UploadAttachment status of " + response.Status)
+	}
+	var reference types.BlobReference
+	if err := json.NewDecoder(response.Body).Decode(&reference); err != nil {
+		return err
+	}
+	attachment.BlobID = reference.ID
+	attachment.Digest = digest.Sum(nil)
+	return nil
+}
+
+// uploadAttachmentResumable uploads the attachment with the resumable upload
+// protocol, encrypting the file once to learn the digest of the blob and
+// again from wherever the upload resumes. It fails with ErrFileChanged if the
+// file is not the same when encrypted again.
+func (cli *Client) uploadAttachmentResumable(attachment *types.Attachment, file io.ReadSeeker) error {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	attachment.Size = size
+	digests := make(chunkDigests)
+	open := func(offset int64) (io.ReadCloser, error) {
+		return encryptedFrom(file, attachment.Key, attachment.ChunkSize, offset, digests)
+	}
+	encrypted, err := open(0)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	blobSize, err := io.Copy(digest, encrypted)
+	if closeErr := encrypted.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	attachment.Digest = digest.Sum(nil)
+	reference, err := cli.uploadBlob(blobSize, attachment.Digest, open)
+	if err != nil {
+		return err
+	}
+	attachment.BlobID = reference.ID
+	return nil
+}
+
+// MakeAttachmentMessage makes a message carrying attachment, to be sent
+// encrypted like any other message.
+func MakeAttachmentMessage(to string, from string, attachment types.Attachment) (ClientMessage, error) {
+	content, err := json.Marshal(attachment)
+	if err != nil {
+		return ClientMessage{}, err
+	}
+	message := MakeClientMessage(to, from, string(content))
+	message.Attachment = true
+	return message, nil
+}
+
+// AttachmentOf returns the attachment a decrypted message carries.
+func AttachmentOf(message ClientMessage) (types.Attachment, error) {
+	var attachment types.Attachment
+	if !message.Attachment || message.Encrypted {
+		return attachment, ErrNotAttachment
+	}
+	if err := json.Unmarshal([]byte(message.Content), &attachment); err != nil {
+		return attachment, ErrNotAttachment
+	}
+	if len(attachment.Key) != sizeContentKey || attachment.ChunkSize <= 0 || attachment.ChunkSize > maxChunkSize {
+		return attachment, ErrNotAttachment
+	}
+	return attachment, nil
+}
+
+// OpenAttachment downloads the attachment and decrypts it as it is read. The
+// reader returns ErrInvalidStream for a blob that was altered, and
+// ErrInvalidAttachment at its end when the blob is not the one the message
+// refers to.
+func (cli *Client) OpenAttachment(attachment types.Attachment) (io.ReadCloser, error) {
+	request, err := cli.newRequest(http.MethodGet, "/blobs?id="+url.QueryEscape(attachment.BlobID), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, errors.New("client.OpenAttachment status of " + response.Status)
+	}
+	digest := sha256.New()
+	chunks, err := newChunkReader(io.TeeReader(response.Body, digest), attachment.Key, attachment.ChunkSize)
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return &attachmentReader{body: response.Body, chunks: chunks, digest: digest, attachment: attachment}, nil
+}
+
+// attachmentReader checks the size and digest of an attachment once it has
+// been read whole.
+type attachmentReader struct {
+	body       io.ReadCloser
+	chunks     *chunkReader
+	digest     hash.Hash
+	attachment types.Attachment
+	size       int64
+}
+
+func (reader *attachmentReader) Read(p []byte) (int, error) {
+	n, err := reader.chunks.Read(p)
+	reader.size += int64(n)
+	if err == io.EOF {
+		if reader.size != reader.attachment.Size || subtle.ConstantTimeCompare(reader.digest.Sum(nil), reader.attachment.Digest) != 1 {
+			return n, ErrInvalidAttachment
+		}
+	}
+	return n, err
+}
+
+func (reader *attachmentReader) Close() error {
+	return reader.body.Close()
+}
@@ -2,6 +2,10 @@ package client
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -9,9 +13,12 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/markpotocki/messenger/types"
@@ -23,8 +30,17 @@ const (
 	pathKey = "priv_key.gogob"
 )
 
+// KeyType selects the kind of key pair generated for a new client.
+type KeyType string
+
+const (
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeP256    KeyType = "p256"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
 func MakeClientMessage(to string, from string, content string) ClientMessage {
-	return ClientMessage(types.MakeMessage(from, to, content))
+	return ClientMessage{Message: types.MakeMessage(from, to, content)}
 }
 
 type principal struct {
@@ -33,26 +49,108 @@ type principal struct {
 }
 
 type Client struct {
-	PrivateKey *rsa.PrivateKey
+	PrivateKey crypto.Signer
 	ServerHost string
 	Principal  principal
+	// DeviceID tells the devices of one account apart. It is generated along
+	// with the key file and saved next to it.
+	DeviceID string
+	// Padding is the policy encrypted content is padded with, DefaultPadding
+	// when nil.
+	Padding PaddingPolicy
+	// JWE sends content encrypted to a key as a JWE rather than in the
+	// messenger envelope. Content sent over a ratchet session always uses
+	// the envelope.
+	JWE bool
+	// PostQuantum publishes a hybrid X25519 and ML-KEM-768 key with the
+	// encryption key when it is registered or rotated, so senders supporting
+	// it wrap message keys with it.
+	PostQuantum bool
+	// LegacyContent decrypts content the first clients encrypted whole with
+	// RSA PKCS #1 v1.5, for messages sent before LegacyCutover, when the
+	// contacts of the user stopped sending it; none is while it is zero.
+	// Legacy content is unauthenticated: anyone holding the public key can
+	// produce it and the time sent is whatever the message claims, so
+	// nothing ties it to its sender or its message. It is left encrypted
+	// unless this is set.
+	LegacyContent bool
+	LegacyCutover time.Time
+	keyPath       string
+	// passphrase encrypts the key file, nil when it is kept in plaintext.
+	passphrase []byte
+	// stateKey encrypts the state files, kept in the key file when it is
+	// encrypted; nil otherwise.
+	stateKey []byte
+	// previousKeys are the keys replaced by rotations, newest first, kept to
+	// decrypt messages sent to them.
+	previousKeys []crypto.Signer
 	// client http.Client
 }
 
 func MakeClient(keyPath string, serverHost string) *Client {
-	key, err := loadKey(keyPath)
-	if err != nil {
+	return MakeClientWithKeyType(keyPath, serverHost, KeyTypeRSA)
+}
+
+// MakeClientWithKeyType loads the key pair at keyPath, generating one of
+// keyType when there is none. New key files are kept in plaintext.
+func MakeClientWithKeyType(keyPath string, serverHost string, keyType KeyType) *Client {
+	return MakeClientWithPassphrase(keyPath, serverHost, keyType, nil)
+}
+
+// MakeClientWithPassphrase loads the key pair at keyPath, generating one of
+// keyType when there is none. The passphrase is asked for when the key file
+// is encrypted, and new key files are encrypted under it unless passphrase is
+// nil.
+func MakeClientWithPassphrase(keyPath string, serverHost string, keyType KeyType, passphrase PassphraseFunc) *Client {
+	keys, secret, stateKey, err := loadKeys(keyPath, passphrase)
+	if os.IsNotExist(err) {
 		utils.LogWarn("generating new key pair for client")
-		key, err = generateAndSaveKey(keyPath)
+		if passphrase != nil {
+			if secret, err = passphrase(true); err != nil {
+				panic(err)
+			}
+			if stateKey, err = newStateKey(); err != nil {
+				panic(err)
+			}
+		}
+		key, err := generateAndSaveKey(keyPath, keyType, secret, stateKey)
 		if err != nil {
 			panic(err)
 		}
+		keys = []crypto.Signer{key}
+	} else if err != nil {
+		panic(err)
+	} else if secret == nil && passphrase != nil {
+		utils.LogWarn("private key file is not encrypted, set a passphrase to protect it")
+	} else if secret != nil && stateKey == nil {
+		// a key file encrypted before the state files were gets a state key now
+		if stateKey, err = newStateKey(); err != nil {
+			panic(err)
+		}
+		if err := saveKeys(keyPath, keys, secret, stateKey); err != nil {
+			panic(err)
+		}
+	}
+	deviceID, err := loadDeviceID(keyPath + suffixDevice)
+	if err != nil {
+		panic(err)
 	}
 
-	return &Client{
-		PrivateKey: key,
-		ServerHost: serverHost,
+	cli := &Client{
+		PrivateKey:   keys[0],
+		ServerHost:   serverHost,
+		DeviceID:     deviceID,
+		keyPath:      keyPath,
+		passphrase:   secret,
+		stateKey:     stateKey,
+		previousKeys: keys[1:],
+	}
+	if stateKey != nil {
+		if err := cli.encryptStateFiles(); err != nil {
+			panic(err)
+		}
 	}
+	return cli
 }
 
 func (cli *Client) SetBasicAuth(username string, password string) {
@@ -61,40 +159,112 @@ func (cli *Client) SetBasicAuth(username string, password string) {
 }
 
 func (cli *Client) RegisterKey(userID string) error {
-	jwkKey, err := utils.MakeJWKSetFromRSAPublicKey(&cli.PrivateKey.PublicKey)
+	jwkKeys, err := utils.MakeJWKSetFromPrivateKey(cli.PrivateKey)
 	if err != nil {
 		return err
 	}
+	if cli.PostQuantum {
+		if err := cli.publishHybridKey(jwkKeys); err != nil {
+			return err
+		}
+	}
 
-	keyData, err := json.Marshal(jwkKey)
+	proof, err := cli.proveKeyPossession(jwkKeys)
 	if err != nil {
 		return err
 	}
-	buffer := bytes.NewBuffer(keyData)
+	registration := types.KeyRegistration{Keys: make([]jwk.Key, 0, jwkKeys.Len()), Proof: proof}
+	for i := 0; i < jwkKeys.Len(); i++ {
+		key, _ := jwkKeys.Get(i)
+		registration.Keys = append(registration.Keys, key)
+	}
 
-	request, err := http.NewRequest(http.MethodPost, cli.ServerHost+"/pubkey", buffer)
+	request, err := cli.newRequest(http.MethodPost, "/pubkey", registration)
 	if err != nil {
 		return err
 	}
-	request.SetBasicAuth(cli.Principal.Username, cli.Principal.Password)
 
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusCreated {
 		utils.LogError(fmt.Sprint("status of", resp.Status))
-		return errors.New("bad status")
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return ErrKeyRejected{Status: resp.StatusCode, Reason: strings.TrimSpace(string(reason))}
 	}
-	defer resp.Body.Close()
 	return nil
 }
 
-func (cli *Client) FetchPublicKeyByUserID(userID string) rsa.PublicKey {
+// RotateKey replaces the client's key pair with a new one of keyType and
+// registers it as the active key of the user. The replaced keys are kept in
+// the key file so messages sent to them can still be read, and the signed
+// prekey, if any, is signed again with the new key.
+func (cli *Client) RotateKey(keyType KeyType) error {
+	key, err := generateKey(keyType)
+	if err != nil {
+		return err
+	}
+	return cli.replaceKey(key)
+}
+
+// replaceKey makes key the client's key, keeping the replaced keys, and
+// registers it.
+func (cli *Client) replaceKey(key crypto.Signer) error {
+	keys := append([]crypto.Signer{key, cli.PrivateKey}, cli.previousKeys...)
+	if err := saveKeys(cli.keyPath, keys, cli.passphrase, cli.stateKey); err != nil {
+		return err
+	}
+	cli.PrivateKey = keys[0]
+	cli.previousKeys = keys[1:]
+
+	if err := cli.RegisterKey(cli.Principal.Username); err != nil {
+		return err
+	}
+	state, err := loadPrekeyState(cli.stateFile(suffixPrekeys))
+	if err != nil {
+		return err
+	}
+	if state.IdentityKey == nil {
+		return nil
+	}
+	return cli.PublishPrekeys(0)
+}
+
+// FetchPublicKeyByUserID returns the key used to encrypt messages to userID.
+// It panics when their keys differ from the ones pinned for them. Use
+// FetchEncryptionKeyByUserID to have messages record which key of the
+// recipient they were encrypted to.
+func (cli *Client) FetchPublicKeyByUserID(userID string) crypto.PublicKey {
+	keys, err := cli.fetchPinnedKeys(userID)
+	if err != nil {
+		panic(err)
+	}
+	pubKey, err := publicKeyForUse(userID, keys, utils.UseEncryption)
+	if err != nil {
+		panic(err)
+	}
+	return pubKey
+}
+
+// FetchEncryptionKeyByUserID returns the active JWK used to encrypt messages
+// to userID. Messages encrypted to it record its kid. The keys of userID are
+// pinned the first time they are fetched; ErrKeyChanged is returned when they
+// differ from the pinned keys, ErrKeyRevoked when the key was revoked.
+func (cli *Client) FetchEncryptionKeyByUserID(userID string) (jwk.Key, error) {
+	keys, err := cli.fetchPinnedKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	return findKeyForUse(userID, keys, utils.UseEncryption)
+}
+
+func (cli *Client) fetchPublicKeys(userID string) (jwk.Set, error) {
 	// build request
 	request, err := http.NewRequest(http.MethodGet, cli.ServerHost+"/pubkey", nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	request.SetBasicAuth(cli.Principal.Username, cli.Principal.Password)
 	query := request.URL.Query()
@@ -104,38 +274,60 @@ func (cli *Client) FetchPublicKeyByUserID(userID string) rsa.PublicKey {
 	// make request
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		panic("bad status of " + resp.Status)
+		return nil, errors.New("bad status of " + resp.Status)
 	}
 
-	jwkSet, err := jwk.ParseReader(resp.Body)
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	jwkSet, err := jwk.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if jwkSet.Len() == 0 {
+		return nil, errors.New("there is no jwkKeys in provided set")
 	}
 
-	jwkKey, ok := jwkSet.Get(0)
-	if !ok {
-		panic("there is no jwkKeys in provided set")
+	// the keys must be the latest logged for the user
+	var logged struct {
+		Log *types.KeyLogProof `json:"log"`
 	}
+	if err := json.Unmarshal(data, &logged); err != nil {
+		return nil, err
+	}
+	if err := cli.verifyKeyLog(userID, jwkSet, logged.Log); err != nil {
+		return nil, err
+	}
+	if err := dropUnsignedHybridKeys(userID, jwkSet); err != nil {
+		return nil, err
+	}
+	return jwkSet, nil
+}
 
-	pubKey, err := utils.MakePublicKeyFromJWK(jwkKey)
+// publicKeyForUse picks the raw key advertised for use, sig or enc, from the
+// key set of userID.
+func publicKeyForUse(userID string, keys jwk.Set, use string) (crypto.PublicKey, error) {
+	jwkKey, err := findKeyForUse(userID, keys, use)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return *pubKey
+	return utils.MakePublicKeyFromJWK(jwkKey)
 }
 
+// SendMessage signs and sends the message as is. A message that was not
+// encrypted by SendEncryptedMessage is first given its nonce and sequence.
 func (cli *Client) SendMessage(message ClientMessage) error {
-	marshMessage, err := json.Marshal(message)
+	message, err := cli.signMessage(message)
 	if err != nil {
 		return err
 	}
-	buffer := bytes.NewBuffer(marshMessage)
 
-	request, err := http.NewRequest(http.MethodPost, cli.ServerHost+"/messages", buffer)
-	request.SetBasicAuth(cli.Principal.Username, cli.Principal.Password)
+	request, err := cli.newRequest(http.MethodPost, "/messages", message)
 	if err != nil {
 		return err
 	}
@@ -144,38 +336,111 @@ func (cli *Client) SendMessage(message ClientMessage) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return errors.New(fmt.Sprint("bad status of", resp.Status))
 	}
 	return nil
 }
 
-func (cli *Client) SendEncryptedMessage(message ClientMessage, key *rsa.PublicKey) error {
-	msg, err := message.EncryptContent(key)
+// signMessage signs the message as sent from the client's device, stamping
+// it first when it was not.
+func (cli *Client) signMessage(message ClientMessage) (ClientMessage, error) {
+	var err error
+	if len(message.Nonce) == 0 {
+		message, err = cli.stampMessage(message)
+		if err != nil {
+			return message, err
+		}
+	}
+	message.FromDevice = cli.DeviceID
+	return message.Sign(cli.PrivateKey)
+}
+
+// SendEncryptedMessage encrypts the message over the session with its
+// recipient device when there is one, otherwise to key. When key is a
+// jwk.Key naming a device the message is addressed to that device.
+func (cli *Client) SendEncryptedMessage(message ClientMessage, key crypto.PublicKey) error {
+	msg, err := cli.encryptMessage(message, key)
 	if err != nil {
 		return err
 	}
-	msg.Encrypted = true
 	if err := cli.SendMessage(msg); err != nil {
 		return err
 	}
 	return nil
 }
 
+// encryptMessage stamps and encrypts the message as SendEncryptedMessage
+// sends it.
+func (cli *Client) encryptMessage(message ClientMessage, key crypto.PublicKey) (ClientMessage, error) {
+	if jwkKey, ok := key.(jwk.Key); ok {
+		if utils.IsRevokedJWK(jwkKey) {
+			return message, revokedKeyError(message.To, jwkKey)
+		}
+		if message.ToDevice == "" {
+			message.ToDevice = utils.JWKDevice(jwkKey)
+		}
+	}
+	message, err := cli.stampMessage(message)
+	if err != nil {
+		return message, err
+	}
+	// a session is only used with devices that read it
+	msg, ok := message, false
+	if sessionMessage, err := message.withAlgorithm(key, types.AlgorithmRatchet); err == nil {
+		if msg, ok, err = cli.encryptWithSession(sessionMessage); err != nil {
+			return message, err
+		}
+	}
+	if !ok {
+		msg, err = cli.encryptToKey(message, key)
+		if err != nil {
+			return message, err
+		}
+	}
+	msg.Encrypted = true
+	return msg, nil
+}
+
+// encryptToKey encrypts the content of the message to key in the format the
+// client sends.
+func (cli *Client) encryptToKey(message ClientMessage, key crypto.PublicKey) (ClientMessage, error) {
+	if cli.JWE {
+		return message.encryptContentJWE(key, cli.padding())
+	}
+	return message.encryptContent(key, cli.padding())
+}
+
+// GetMessages returns the messages of userID, decrypting the copies meant for
+// the client's device.
 func (cli *Client) GetMessages(userID string) ([]ClientMessage, error) {
-	request, err := http.NewRequest(http.MethodGet, cli.ServerHost+"/messages", nil)
+	return cli.getMessages(userID, "")
+}
+
+// GetGroupMessages returns the messages of userID sent to groupID, decrypted
+// as GetMessages does.
+func (cli *Client) GetGroupMessages(userID string, groupID string) ([]ClientMessage, error) {
+	return cli.getMessages(userID, groupID)
+}
+
+func (cli *Client) getMessages(userID string, groupID string) ([]ClientMessage, error) {
+	request, err := cli.newRequest(http.MethodGet, "/messages", nil)
 	if err != nil {
 		return nil, err
 	}
-	request.SetBasicAuth(cli.Principal.Username, cli.Principal.Password)
 	query := request.URL.Query()
 	query.Add("userID", userID)
+	if groupID != "" {
+		query.Add("groupID", groupID)
+	}
 	request.URL.RawQuery = query.Encode()
 
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
 		return nil, errors.New("client.GetMessages status of " + response.Status)
@@ -188,80 +453,414 @@ func (cli *Client) GetMessages(userID string) ([]ClientMessage, error) {
 		return nil, err
 	}
 
-	// decrypt
+	contacts, err := loadContactStore(cli.stateFile(suffixContacts))
+	if err != nil {
+		return nil, err
+	}
+	replays, err := loadReplayCache(cli.stateFile(suffixReplay))
+	if err != nil {
+		return nil, err
+	}
+
+	// unseal, verify the sender then decrypt, leaving replayed copies as they
+	// are
+	senderKeys := make(map[string]jwk.Set)
+	senderKeysChanged := make(map[string]bool)
+	contactsChanged := false
+	replaysChanged := false
 	for i, message := range messages {
-		m, _ := message.DecryptContent(cli.PrivateKey)
+		senderToken := ""
+		if message.Sealed {
+			if message.To != userID || (message.ToDevice != "" && message.ToDevice != cli.DeviceID) {
+				messages[i] = message
+				continue
+			}
+			unsealed, token, err := cli.unsealMessage(message)
+			if err != nil {
+				message.Err = err
+				messages[i] = message
+				continue
+			}
+			message, senderToken = unsealed, token
+		}
+		if err := replays.check(message); err != nil {
+			utils.LogWarn(err.Error())
+			message.Err = err
+			messages[i] = message
+			continue
+		}
+		keys, ok := senderKeys[message.From]
+		if !ok {
+			keys, err = cli.fetchPublicKeys(message.From)
+			if err != nil {
+				utils.LogWarn(fmt.Sprintf("unable to fetch public key for %s: %s", message.From, err))
+			} else if message.From != cli.Principal.Username {
+				changed, pinErr := contacts.pin(message.From, keys, time.Now())
+				contactsChanged = contactsChanged || changed
+				senderKeysChanged[message.From] = pinErr != nil
+			}
+			senderKeys[message.From] = keys
+		}
+		message.Verification = message.Verify(signingKeyForMessage(keys, message))
+		if message.Verification == Verified && signedByRevokedKey(keys, message) {
+			message.Verification = Revoked
+		}
+		if message.Verification == Verified {
+			replaysChanged = replays.record(message) || replaysChanged
+			// only the sender's own signature vouches for the token they sent
+			if senderToken != "" {
+				contactsChanged = contacts.setDeliveryToken(message.From, senderToken) || contactsChanged
+			}
+		}
+		message.KeyChanged = senderKeysChanged[message.From] || contacts.keyChanged(message.From, keys)
+		// only messages addressed to our device were encrypted to our key
+		toDevice := message.ToDevice == "" || message.ToDevice == cli.DeviceID
+		if message.To != userID || !toDevice || !message.Encrypted {
+			messages[i] = message
+			continue
+		}
+		// whoever forged it should not get to use up our keys
+		if message.Verification == Forged {
+			message.Err = ErrForgedMessage
+			messages[i] = message
+			continue
+		}
+		m, err := cli.decryptMessage(message)
+		if err != nil {
+			m.Err = err
+		}
 		messages[i] = m
 	}
+	if contactsChanged {
+		if err := contacts.save(cli.stateFile(suffixContacts)); err != nil {
+			return nil, err
+		}
+	}
+	if replaysChanged {
+		if err := replays.save(cli.stateFile(suffixReplay)); err != nil {
+			return nil, err
+		}
+	}
 
 	return messages, nil
 }
 
-func loadKey(keyPath string) (*rsa.PrivateKey, error) {
-	// load the file containing our private key
-	keyFile, err := os.Open(keyPath)
+// decryptMessage decrypts a message addressed to the client, with a ratchet
+// session or the private key depending on how it was sent. Session messages
+// can only be decrypted once, so their plaintext is kept in the history.
+func (cli *Client) decryptMessage(message ClientMessage) (ClientMessage, error) {
+	if err := message.checkEnvelope(); err != nil {
+		return message, err
+	}
+	if message.ContentType == types.ContentTypeJWE {
+		return cli.decryptWithPrivateKey(message)
+	}
+	// legacy content that is not an envelope was encrypted to the key
+	env, err := message.envelope()
+	if err != nil || env.Ratchet == nil {
+		return cli.decryptWithPrivateKey(message)
+	}
+	if message.EnvelopeVersion != types.EnvelopeVersionLegacy && message.Algorithm != types.AlgorithmRatchet {
+		return message, ErrMalformedEnvelope
+	}
+
+	file := cli.stateFile(suffixHistory)
+	history, err := loadMessageHistory(file)
+	if err != nil {
+		return message, err
+	}
+	if content, ok := history[message.ID]; ok {
+		message.Content = content
+		message.Encrypted = false
+		return message, nil
+	}
+	m, err := cli.decryptWithSession(message, env)
+	if err != nil {
+		return message, err
+	}
+	history[m.ID] = m.Content
+	if err := history.save(file); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// legacyCutover returns when legacy content stops being decrypted, zero when
+// none is.
+func (cli *Client) legacyCutover() time.Time {
+	if !cli.LegacyContent {
+		return time.Time{}
+	}
+	return cli.LegacyCutover
+}
+
+// decryptWithPrivateKey decrypts a message encrypted to one of the client's
+// keys, the key named by its KeyID or, when it names none, each key from the
+// newest. Content encapsulated to the client's hybrid KEM key is decrypted
+// with that.
+func (cli *Client) decryptWithPrivateKey(message ClientMessage) (ClientMessage, error) {
+	hybrid, err := loadHybridKey(cli.stateFile(suffixHybrid))
+	if err != nil {
+		return message, err
+	}
+	keys := append([]crypto.Signer{cli.PrivateKey}, cli.previousKeys...)
+	if message.KeyID != "" {
+		for _, key := range keys {
+			if keyID, err := utils.KeyID(key.Public()); err == nil && keyID == message.KeyID {
+				return message.decryptContent(key, hybrid, cli.legacyCutover())
+			}
+		}
+		return message, ErrUnknownKeyID{KeyID: message.KeyID}
+	}
+	var firstErr error
+	for _, key := range keys {
+		m, err := message.decryptContent(key, hybrid, cli.legacyCutover())
+		if err == nil {
+			return m, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return message, firstErr
+}
+
+// signingKeyForMessage picks the key a message claims to be signed with from
+// the sender's keys, their active signing key when it names none.
+func signingKeyForMessage(keys jwk.Set, message ClientMessage) crypto.PublicKey {
+	if keys == nil {
+		return nil
+	}
+	var jwkKey jwk.Key
+	var ok bool
+	if message.SignatureKeyID != "" {
+		jwkKey, ok = utils.FindJWKByID(keys, message.SignatureKeyID, utils.UseSignature)
+	} else {
+		jwkKey, ok = utils.FindJWK(keys, utils.UseSignature)
+	}
+	if !ok {
+		return nil
+	}
+	key, err := utils.MakePublicKeyFromJWK(jwkKey)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// newRequest builds a request to the server authenticated as the client's
+// principal.
+func (cli *Client) newRequest(method string, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewBuffer(data)
+	}
+	request, err := http.NewRequest(method, cli.ServerHost+path, reader)
 	if err != nil {
-		utils.LogError("unable to open private key file")
 		return nil, err
 	}
-	defer keyFile.Close()
-	data, err := ioutil.ReadAll(keyFile)
+	request.SetBasicAuth(cli.Principal.Username, cli.Principal.Password)
+	if cli.DeviceID != "" {
+		request.Header.Set(types.HeaderDeviceID, cli.DeviceID)
+	}
+	return request, nil
+}
+
+func (cli *Client) fetchDeviceSigningKey(userID string, deviceID string) (crypto.PublicKey, error) {
+	keys, err := cli.fetchPinnedKeys(userID)
 	if err != nil {
 		return nil, err
 	}
+	return deviceSigningKey(userID, keys, deviceID)
+}
+
+// deviceSigningKey picks the signing key of deviceID from the keys of userID.
+func deviceSigningKey(userID string, keys jwk.Set, deviceID string) (crypto.PublicKey, error) {
+	deviceKeys, ok := utils.JWKSetsByDevice(keys)[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("%s has no device %s", userID, deviceID)
+	}
+	return publicKeyForUse(userID, deviceKeys, utils.UseSignature)
+}
+
+// loadKeys returns the private keys in the key file, the current key first
+// followed by the keys it replaced. An encrypted key file is decrypted with
+// the passphrase, which is returned with the state key kept in the file;
+// both are nil for a plaintext key file.
+func loadKeys(keyPath string, passphrase PassphraseFunc) ([]crypto.Signer, []byte, []byte, error) {
+	// load the file containing our private key
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		utils.LogError("unable to open private key file")
+		return nil, nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemTypeEncryptedKeys {
+		keys, err := parseKeys(data)
+		return keys, nil, nil, err
+	}
+	if passphrase == nil {
+		return nil, nil, nil, ErrPassphraseRequired
+	}
+	secret, err := passphrase(false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	plaintext, err := decryptKeyBlock(block, secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keys, err := parseKeys(plaintext)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys, secret, parseStateKey(plaintext), nil
+}
+
+// parseKeys parses the private keys in data, either a JWK set or PEM blocks
+// in any format ParsePrivateKey detects. Other PEM blocks are skipped.
+func parseKeys(data []byte) ([]crypto.Signer, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJWKPrivateKeys(trimmed)
+	}
+	var keys []crypto.Signer
 	for len(data) != 0 {
 		block, rest := pem.Decode(data)
 		if block == nil {
-			utils.LogWarn("generating new keypair")
-			return generateAndSaveKey(keyPath)
-		}
-		switch block.Type {
-		case "RSA PRIVATE KEY":
-			pk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-			if err != nil {
-				return nil, err
+			if len(keys) != 0 && len(bytes.TrimSpace(data)) == 0 {
+				break
 			}
-			return pk, nil
+			return nil, errors.New("private key file is not PEM encoded")
 		}
 		data = rest
+		switch block.Type {
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", pemTypeOpenSSHPrivateKey:
+		default:
+			continue
+		}
+		key, err := parsePEMPrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
 	}
-	return nil, errors.New("unexpected end")
+	if len(keys) == 0 {
+		return nil, errors.New("unexpected end")
+	}
+	return keys, nil
 }
 
-func generateAndSaveKey(keyPath string) (*rsa.PrivateKey, error) {
-	privKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, sizeKey)
+	case KeyTypeP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		return privKey, err
+	default:
+		return nil, utils.ErrUnsupportedKey{Reason: fmt.Sprintf("key type %s", keyType)}
+	}
+}
+
+func privateKeyBlock(privKey crypto.Signer) (*pem.Block, error) {
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}, nil
+	case *ecdsa.PrivateKey:
+		privateKeyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: privateKeyBytes,
+		}, nil
+	default:
+		privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: privateKeyBytes,
+		}, nil
+	}
+}
+
+func generateAndSaveKey(keyPath string, keyType KeyType, passphrase []byte, stateKey []byte) (crypto.Signer, error) {
+	privKey, err := generateKey(keyType)
 	if err != nil {
 		utils.LogError("unable to generate private key")
 		return nil, err
 	}
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(privKey)
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(&privKey.PublicKey)
-	privateKeyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
+	if err := saveKeys(keyPath, []crypto.Signer{privKey}, passphrase, stateKey); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+// saveKeys writes the key file, the current key and its public key followed
+// by the keys it replaced. The private keys and the state key are encrypted
+// under passphrase unless it is nil. The file is replaced in one step so a
+// failed write never loses keys.
+func saveKeys(keyPath string, keys []crypto.Signer, passphrase []byte, stateKey []byte) error {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(keys[0].Public())
+	if err != nil {
+		utils.LogError("unable to encode public key")
+		return err
 	}
 	publicKeyBlock := &pem.Block{
 		Type:  "PUBLIC KEY",
 		Bytes: publicKeyBytes,
 	}
+	blocks := make([]*pem.Block, 0, len(keys)+1)
+	for i, key := range keys {
+		block, err := privateKeyBlock(key)
+		if err != nil {
+			utils.LogError("failed to encode private key")
+			return err
+		}
+		blocks = append(blocks, block)
+		if i == 0 {
+			blocks = append(blocks, publicKeyBlock)
+		}
+	}
+	if passphrase != nil {
+		// the public key stays readable next to the encrypted keys
+		var plaintext []byte
+		for _, block := range blocks {
+			if block != publicKeyBlock {
+				plaintext = append(plaintext, pem.EncodeToMemory(block)...)
+			}
+		}
+		if stateKey != nil {
+			plaintext = append(plaintext, pem.EncodeToMemory(&pem.Block{Type: pemTypeStateKey, Bytes: stateKey})...)
+		}
+		encrypted, err := encryptKeyBlocks(plaintext, passphrase)
+		if err != nil {
+			utils.LogError("failed to encrypt private key")
+			return err
+		}
+		blocks = []*pem.Block{encrypted, publicKeyBlock}
+	}
 
 	// file saving
-	fileKey, err := os.Create(keyPath)
-	if err != nil {
-		utils.LogError("unable to create private key file")
-		return nil, err
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
 	}
-	defer fileKey.Close()
-	err = pem.Encode(fileKey, privateKeyBlock)
-	if err != nil {
-		utils.LogError("failed to encode private key")
-		return nil, err
-	}
-	err = pem.Encode(fileKey, publicKeyBlock)
-	if err != nil {
-		utils.LogError("failed to encode public key")
-		return nil, err
+	if err := writeFileAtomic(keyPath, data); err != nil {
+		utils.LogError("unable to write private key file")
+		return err
 	}
-
-	return privKey, nil
+	return nil
 }
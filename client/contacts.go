@@ -0,0 +1,450 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixContacts = ".contacts"
+
+	// parameterLegacyKey is set by the client, never by the server, on keys
+	// of contacts that may only read the legacy envelope.
+	parameterLegacyKey = "legacy"
+
+	// safety numbers follow the layout of Signal's: each party contributes
+	// 30 digits derived from an iterated hash of their keys
+	fingerprintVersion    = 1
+	fingerprintIterations = 5200
+	fingerprintChunks     = 6
+	fingerprintChunkSize  = 5
+	safetyNumberGroupSize = 5
+)
+
+var ErrNoSigningKeys = errors.New("user has no active signing keys")
+
+// ErrKeyChanged is returned when the server hands out keys for a contact
+// other than the ones pinned for them. Nothing is encrypted to the new keys
+// until the change is accepted with AcceptKeyChange.
+type ErrKeyChanged struct {
+	UserID string
+	SeenAt time.Time
+}
+
+func (err ErrKeyChanged) Error() string {
+	return fmt.Sprintf("keys of %s changed at %s, accept the change before encrypting to them", err.UserID, err.SeenAt.Format(time.RFC3339))
+}
+
+// KeyChange records keys seen for a contact. AcceptedAt is zero while the
+// change waits to be accepted; the first keys seen are accepted on sight.
+type KeyChange struct {
+	Keys       []string
+	SeenAt     time.Time
+	AcceptedAt time.Time
+}
+
+// contact is what the client remembers about another user.
+type contact struct {
+	// Verified is set once the user has compared safety numbers with the
+	// contact. Fingerprint is the fingerprint of their keys at that point.
+	Verified    bool
+	VerifiedAt  time.Time
+	Fingerprint []byte
+	// PinnedKeys are the thumbprints of the keys trusted for the contact,
+	// pinned the first time their keys were seen.
+	PinnedKeys []string
+	KeyChanges []KeyChange
+	// DeliveryToken lets the client send the contact sealed messages.
+	DeliveryToken string
+	// AlgorithmsPinned is set on contacts first pinned once keys advertised
+	// their algorithms. Contacts without it may run clients from before
+	// then, and only their keys advertising none are sent the legacy
+	// envelope.
+	AlgorithmsPinned bool
+}
+
+// contactStore holds the contacts of a client by user ID. It is saved next to
+// the private key file.
+type contactStore map[string]*contact
+
+func loadContactStore(file stateFile) (contactStore, error) {
+	contacts := make(contactStore)
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return contacts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+func (contacts contactStore) save(file stateFile) error {
+	data, err := json.Marshal(contacts)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+// SafetyNumber returns the safety number of the client's user and userID, 60
+// digits in groups of five. Both users get the same number when the server
+// gave each of them the other's real keys, so reading it out in person or
+// over another channel detects a swapped key.
+func (cli *Client) SafetyNumber(userID string) (string, error) {
+	myKeys, err := cli.fetchPublicKeys(cli.Principal.Username)
+	if err != nil {
+		return "", err
+	}
+	theirKeys, err := cli.fetchPublicKeys(userID)
+	if err != nil {
+		return "", err
+	}
+	return safetyNumber(cli.Principal.Username, myKeys, userID, theirKeys)
+}
+
+// VerifyContact marks userID as verified, after the safety numbers were
+// compared, pinning their current keys and accepting any pending change.
+// Messages from them are flagged with KeyChanged when their keys change
+// afterwards.
+func (cli *Client) VerifyContact(userID string) error {
+	keys, err := cli.fetchPublicKeys(userID)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := keysFingerprint(userID, keys)
+	if err != nil {
+		return err
+	}
+
+	file := cli.stateFile(suffixContacts)
+	contacts, err := loadContactStore(file)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := contacts.accept(userID, keys, now); err != nil {
+		return err
+	}
+	c := contacts[userID]
+	c.Verified = true
+	c.VerifiedAt = now
+	c.Fingerprint = fingerprint
+	return contacts.save(file)
+}
+
+// IsVerifiedContact reports whether userID was marked verified.
+func (cli *Client) IsVerifiedContact(userID string) bool {
+	contacts, err := loadContactStore(cli.stateFile(suffixContacts))
+	if err != nil {
+		return false
+	}
+	c, ok := contacts[userID]
+	return ok && c.Verified
+}
+
+// AcceptKeyChange pins the keys the server now hands out for userID,
+// accepting a change reported by ErrKeyChanged.
+func (cli *Client) AcceptKeyChange(userID string) error {
+	keys, err := cli.fetchPublicKeys(userID)
+	if err != nil {
+		return err
+	}
+	file := cli.stateFile(suffixContacts)
+	contacts, err := loadContactStore(file)
+	if err != nil {
+		return err
+	}
+	if err := contacts.accept(userID, keys, time.Now()); err != nil {
+		return err
+	}
+	return contacts.save(file)
+}
+
+// KeyHistory returns the keys seen for userID over time, oldest first.
+func (cli *Client) KeyHistory(userID string) ([]KeyChange, error) {
+	contacts, err := loadContactStore(cli.stateFile(suffixContacts))
+	if err != nil {
+		return nil, err
+	}
+	c, ok := contacts[userID]
+	if !ok {
+		return nil, nil
+	}
+	return c.KeyChanges, nil
+}
+
+// fetchPinnedKeys fetches the keys of userID, pinning them when they are the
+// first seen. ErrKeyChanged is returned when they differ from the pinned
+// keys.
+func (cli *Client) fetchPinnedKeys(userID string) (jwk.Set, error) {
+	keys, err := cli.fetchPublicKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	file := cli.stateFile(suffixContacts)
+	contacts, err := loadContactStore(file)
+	if err != nil {
+		return nil, err
+	}
+	changed, pinErr := contacts.pin(userID, keys, time.Now())
+	if changed {
+		if err := contacts.save(file); err != nil {
+			return nil, err
+		}
+	}
+	if pinErr != nil {
+		return nil, pinErr
+	}
+	if err := markLegacyKeys(keys, !contacts[userID].AlgorithmsPinned); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// markLegacyKeys marks the keys advertising no algorithms when legacy is set,
+// for a contact pinned before keys advertised them, so withAlgorithm sends
+// them the legacy envelope. A mark the server put on any key is removed.
+func markLegacyKeys(keys jwk.Set, legacy bool) error {
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if legacy && utils.JWKAlgorithms(key) == nil {
+			if err := key.Set(parameterLegacyKey, true); err != nil {
+				return err
+			}
+		} else if _, ok := key.Get(parameterLegacyKey); ok {
+			if err := key.Remove(parameterLegacyKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pin checks keys against those pinned for userID, pinning them when none
+// are. A change is recorded the first time it is seen. It reports whether
+// the store was modified.
+func (contacts contactStore) pin(userID string, keys jwk.Set, now time.Time) (bool, error) {
+	thumbprints, err := keyThumbprints(keys)
+	if err != nil {
+		return false, err
+	}
+	c, ok := contacts[userID]
+	if !ok {
+		c = &contact{}
+		contacts[userID] = c
+	}
+	if c.PinnedKeys == nil {
+		c.AlgorithmsPinned = true
+		c.PinnedKeys = thumbprints
+		c.KeyChanges = append(c.KeyChanges, KeyChange{Keys: thumbprints, SeenAt: now, AcceptedAt: now})
+		return true, nil
+	}
+	if equalStrings(c.PinnedKeys, thumbprints) {
+		return false, nil
+	}
+	last := &c.KeyChanges[len(c.KeyChanges)-1]
+	if last.AcceptedAt.IsZero() && equalStrings(last.Keys, thumbprints) {
+		return false, ErrKeyChanged{UserID: userID, SeenAt: last.SeenAt}
+	}
+	c.KeyChanges = append(c.KeyChanges, KeyChange{Keys: thumbprints, SeenAt: now})
+	return true, ErrKeyChanged{UserID: userID, SeenAt: now}
+}
+
+// accept pins keys for userID, recording when they were accepted.
+func (contacts contactStore) accept(userID string, keys jwk.Set, now time.Time) error {
+	thumbprints, err := keyThumbprints(keys)
+	if err != nil {
+		return err
+	}
+	c, ok := contacts[userID]
+	if !ok {
+		c = &contact{AlgorithmsPinned: true}
+		contacts[userID] = c
+	}
+	c.PinnedKeys = thumbprints
+	if n := len(c.KeyChanges); n > 0 && equalStrings(c.KeyChanges[n-1].Keys, thumbprints) {
+		if c.KeyChanges[n-1].AcceptedAt.IsZero() {
+			c.KeyChanges[n-1].AcceptedAt = now
+		}
+		return nil
+	}
+	c.KeyChanges = append(c.KeyChanges, KeyChange{Keys: thumbprints, SeenAt: now, AcceptedAt: now})
+	return nil
+}
+
+// keyThumbprints returns the sorted thumbprints of every key in the set,
+// covering the hybrid KEM keys published with them. Retired keys are included
+// since signatures are still checked against them.
+func keyThumbprints(keys jwk.Set) ([]string, error) {
+	thumbprints := make([]string, 0, keys.Len())
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		thumbprint, err := keyThumbprint(key)
+		if err != nil {
+			return nil, err
+		}
+		thumbprints = append(thumbprints, base64.RawURLEncoding.EncodeToString(thumbprint))
+	}
+	sort.Strings(thumbprints)
+	return thumbprints, nil
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// keyChanged reports whether the keys of a verified contact differ from the
+// keys they were verified with.
+func (contacts contactStore) keyChanged(userID string, keys jwk.Set) bool {
+	c, ok := contacts[userID]
+	if !ok || !c.Verified || keys == nil {
+		return false
+	}
+	fingerprint, err := keysFingerprint(userID, keys)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(fingerprint, c.Fingerprint)
+}
+
+// safetyNumber combines the displayable fingerprints of both users, the lower
+// first so the order of the users does not matter.
+func safetyNumber(userID string, keys jwk.Set, otherUserID string, otherKeys jwk.Set) (string, error) {
+	fingerprint, err := keysFingerprint(userID, keys)
+	if err != nil {
+		return "", err
+	}
+	otherFingerprint, err := keysFingerprint(otherUserID, otherKeys)
+	if err != nil {
+		return "", err
+	}
+	halves := []string{displayableFingerprint(fingerprint), displayableFingerprint(otherFingerprint)}
+	sort.Strings(halves)
+	digits := halves[0] + halves[1]
+
+	groups := make([]string, 0, len(digits)/safetyNumberGroupSize)
+	for i := 0; i < len(digits); i += safetyNumberGroupSize {
+		groups = append(groups, digits[i:i+safetyNumberGroupSize])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// keysFingerprint hashes the thumbprints of the active keys of a user, every
+// device included, along with their user ID. Encryption and key agreement
+// keys are covered as well as signing keys, since they are what messages are
+// encrypted to. The hash is iterated to make finding another key set with the
+// same fingerprint costly.
+func keysFingerprint(userID string, keys jwk.Set) ([]byte, error) {
+	var thumbprints [][]byte
+	signing := false
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if !utils.IsActiveJWK(key) {
+			continue
+		}
+		signing = signing || (key.KeyUsage() != utils.UseEncryption && !utils.IsKeyAgreementJWK(key))
+		thumbprint, err := keyThumbprint(key)
+		if err != nil {
+			return nil, err
+		}
+		thumbprints = append(thumbprints, thumbprint)
+	}
+	if !signing {
+		return nil, ErrNoSigningKeys
+	}
+	sort.Slice(thumbprints, func(i, j int) bool {
+		return bytes.Compare(thumbprints[i], thumbprints[j]) < 0
+	})
+
+	var identity bytes.Buffer
+	for _, thumbprint := range thumbprints {
+		writeField(&identity, thumbprint)
+	}
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, fingerprintVersion)
+	hash := sha512.New()
+	hash.Write(version)
+	hash.Write(identity.Bytes())
+	hash.Write([]byte(userID))
+	digest := hash.Sum(nil)
+	for i := 0; i < fingerprintIterations; i++ {
+		hash.Reset()
+		hash.Write(digest)
+		hash.Write(identity.Bytes())
+		digest = hash.Sum(nil)
+	}
+	return digest, nil
+}
+
+// keyThumbprint returns the RFC 7638 thumbprint of a key. The thumbprint
+// leaves out parameters outside the key itself, so the hybrid KEM key and the
+// algorithms published with it, if any, are hashed in with the thumbprint.
+func keyThumbprint(key jwk.Key) ([]byte, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	hybridKey, err := utils.JWKHybridKey(key)
+	if err != nil {
+		return nil, err
+	}
+	algorithms := utils.JWKAlgorithms(key)
+	if hybridKey == nil && algorithms == nil {
+		return thumbprint, nil
+	}
+	var buffer bytes.Buffer
+	writeField(&buffer, thumbprint)
+	if hybridKey != nil {
+		writeField(&buffer, []byte(utils.ParameterHybridKey))
+		writeField(&buffer, hybridKey)
+	}
+	if algorithms != nil {
+		writeField(&buffer, []byte(utils.ParameterAlgorithms))
+		for _, algorithm := range algorithms {
+			writeField(&buffer, []byte(algorithm))
+		}
+	}
+	digest := sha256.Sum256(buffer.Bytes())
+	return digest[:], nil
+}
+
+// displayableFingerprint turns the first 30 bytes of a fingerprint into 30
+// digits, five for every five bytes.
+func displayableFingerprint(fingerprint []byte) string {
+	var builder strings.Builder
+	for i := 0; i < fingerprintChunks; i++ {
+		chunk := fingerprint[i*fingerprintChunkSize : (i+1)*fingerprintChunkSize]
+		var value uint64
+		for _, b := range chunk {
+			value = value<<8 | uint64(b)
+		}
+		fmt.Fprintf(&builder, "%05d", value%100000)
+	}
+	return builder.String()
+}
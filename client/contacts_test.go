@@ -0,0 +1,187 @@
+package client
+
+import (
+	"encoding/base64"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// testActiveKeySet returns the key set the server would hand out for a new
+// key of keyType.
+func testActiveKeySet(t *testing.T, keyType KeyType) jwk.Set {
+	privKey, err := generateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := utils.MakeJWKSetFromPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if err := key.Set(utils.ParameterActive, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestSafetyNumber(t *testing.T) {
+	aliceKeys := testActiveKeySet(t, KeyTypeEd25519)
+	bobKeys := testActiveKeySet(t, KeyTypeP256)
+
+	number, err := safetyNumber("alice", aliceKeys, "bob", bobKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\d{5}( \d{5}){11}$`).MatchString(number) {
+		t.Errorf("safety number %q is not 12 groups of 5 digits", number)
+	}
+
+	// both sides compute the same number
+	reversed, err := safetyNumber("bob", bobKeys, "alice", aliceKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != reversed {
+		t.Errorf("safety numbers differ between users: %q and %q", number, reversed)
+	}
+
+	// a swapped key changes the number
+	swapped, err := safetyNumber("alice", aliceKeys, "bob", testActiveKeySet(t, KeyTypeP256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number == swapped {
+		t.Error("safety number did not change with a different key")
+	}
+
+	// so does a swapped encryption key next to the same signing key
+	swappedEncryption := jwk.NewSet()
+	otherKeys := testActiveKeySet(t, KeyTypeP256)
+	for i := 0; i < bobKeys.Len(); i++ {
+		key, _ := bobKeys.Get(i)
+		if key.KeyUsage() == utils.UseEncryption {
+			key, _ = utils.FindJWK(otherKeys, utils.UseEncryption)
+		}
+		swappedEncryption.Add(key)
+	}
+	swapped, err = safetyNumber("alice", aliceKeys, "bob", swappedEncryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number == swapped {
+		t.Error("safety number did not change with a different encryption key")
+	}
+
+	if _, err := safetyNumber("alice", aliceKeys, "bob", jwk.NewSet()); err != ErrNoSigningKeys {
+		t.Errorf("expected ErrNoSigningKeys but got %v", err)
+	}
+}
+
+func TestContactKeyChanged(t *testing.T) {
+	bobKeys := testActiveKeySet(t, KeyTypeEd25519)
+	fingerprint, err := keysFingerprint("bob", bobKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contacts := make(contactStore)
+	if contacts.keyChanged("bob", testActiveKeySet(t, KeyTypeEd25519)) {
+		t.Error("unknown contact flagged")
+	}
+	contacts["bob"] = &contact{Verified: true, Fingerprint: fingerprint}
+	if contacts.keyChanged("bob", bobKeys) {
+		t.Error("verified contact flagged with the keys they were verified with")
+	}
+	if !contacts.keyChanged("bob", testActiveKeySet(t, KeyTypeEd25519)) {
+		t.Error("verified contact not flagged after their keys changed")
+	}
+}
+
+func TestContactPinning(t *testing.T) {
+	bobKeys := testActiveKeySet(t, KeyTypeEd25519)
+	contacts := make(contactStore)
+	firstSeen := time.Now()
+
+	changed, err := contacts.pin("bob", bobKeys, firstSeen)
+	if err != nil || !changed {
+		t.Fatalf("first keys not pinned: %v %v", changed, err)
+	}
+	if changed, err := contacts.pin("bob", bobKeys, firstSeen.Add(time.Minute)); err != nil || changed {
+		t.Errorf("pinned keys reported as changed: %v %v", changed, err)
+	}
+
+	// a hybrid KEM key published with the same keys is a change too
+	pinned, err := keyThumbprints(bobKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid, err := generateHybridKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybridPublic, err := hybrid.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, _ := utils.FindJWK(bobKeys, utils.UseEncryption)
+	if err := encKey.Set(utils.ParameterHybridKey, base64.RawURLEncoding.EncodeToString(hybridPublic)); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := keyThumbprints(bobKeys); equalStrings(changed, pinned) {
+		t.Error("pinned thumbprints do not cover the hybrid KEM key")
+	}
+	if err := encKey.Remove(utils.ParameterHybridKey); err != nil {
+		t.Fatal(err)
+	}
+	// so is stripping the algorithms advertised with them
+	algorithms := utils.JWKAlgorithms(encKey)
+	if err := encKey.Remove(utils.ParameterAlgorithms); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := keyThumbprints(bobKeys); equalStrings(changed, pinned) {
+		t.Error("pinned thumbprints do not cover the advertised algorithms")
+	}
+	if err := encKey.Set(utils.ParameterAlgorithms, algorithms); err != nil {
+		t.Fatal(err)
+	}
+	if !contacts["bob"].AlgorithmsPinned {
+		t.Error("contact pinned now is not marked as pinned with algorithms")
+	}
+
+	newKeys := testActiveKeySet(t, KeyTypeP256)
+	changeSeen := firstSeen.Add(time.Hour)
+	changed, err = contacts.pin("bob", newKeys, changeSeen)
+	if _, ok := err.(ErrKeyChanged); !ok || !changed {
+		t.Fatalf("expected ErrKeyChanged but got %v %v", changed, err)
+	}
+	// seeing the same change again reports when it was first seen
+	changed, err = contacts.pin("bob", newKeys, changeSeen.Add(time.Minute))
+	if keyChanged, ok := err.(ErrKeyChanged); !ok || changed || !keyChanged.SeenAt.Equal(changeSeen) {
+		t.Errorf("expected ErrKeyChanged seen at %s but got %v %v", changeSeen, changed, err)
+	}
+
+	accepted := changeSeen.Add(time.Hour)
+	if err := contacts.accept("bob", newKeys, accepted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := contacts.pin("bob", newKeys, accepted); err != nil {
+		t.Errorf("accepted keys still reported as changed: %v", err)
+	}
+
+	history := contacts["bob"].KeyChanges
+	if len(history) != 2 {
+		t.Fatalf("expected 2 key changes but got %d", len(history))
+	}
+	if !history[0].AcceptedAt.Equal(firstSeen) {
+		t.Errorf("first keys accepted at %s expected %s", history[0].AcceptedAt, firstSeen)
+	}
+	if !history[1].SeenAt.Equal(changeSeen) || !history[1].AcceptedAt.Equal(accepted) {
+		t.Errorf("change seen at %s accepted at %s expected %s and %s", history[1].SeenAt, history[1].AcceptedAt, changeSeen, accepted)
+	}
+}
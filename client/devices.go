@@ -0,0 +1,143 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixDevice = ".device"
+	sizeDeviceID = 12
+)
+
+// loadDeviceID reads the device ID saved at path, generating and saving one
+// when there is none.
+func loadDeviceID(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id := make([]byte, sizeDeviceID)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	deviceID := base64.RawURLEncoding.EncodeToString(id)
+	if err := ioutil.WriteFile(path, []byte(deviceID), 0600); err != nil {
+		return "", err
+	}
+	return deviceID, nil
+}
+
+// FetchDevices lists the devices registered to userID.
+func (cli *Client) FetchDevices(userID string) ([]types.Device, error) {
+	request, err := cli.newRequest(http.MethodGet, "/devices", nil)
+	if err != nil {
+		return nil, err
+	}
+	query := request.URL.Query()
+	query.Add("userID", userID)
+	request.URL.RawQuery = query.Encode()
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("client.FetchDevices status of " + response.Status)
+	}
+	var devices []types.Device
+	if err := json.NewDecoder(response.Body).Decode(&devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// RemoveDevice removes one of the devices of the client's account, such as a
+// lost laptop. Messages are no longer encrypted to it.
+func (cli *Client) RemoveDevice(deviceID string) error {
+	request, err := cli.newRequest(http.MethodDelete, "/devices", nil)
+	if err != nil {
+		return err
+	}
+	query := request.URL.Query()
+	query.Add("deviceID", deviceID)
+	request.URL.RawQuery = query.Encode()
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return errors.New("client.RemoveDevice status of " + response.Status)
+	}
+	return nil
+}
+
+// SendEncryptedMessageToUser sends a copy of the message to every device of
+// its recipient, each encrypted over the session with that device when there
+// is one, otherwise to the device's key. Each copy has its own ID. Nothing is
+// sent when the keys of the recipient differ from the ones pinned for them.
+// Devices whose key was revoked are skipped; ErrKeyRevoked is returned when
+// every device was.
+func (cli *Client) SendEncryptedMessageToUser(message ClientMessage) error {
+	return cli.sendToEveryDevice(message, func(deviceMessage ClientMessage, key jwk.Key) error {
+		return cli.SendEncryptedMessage(deviceMessage, key)
+	})
+}
+
+// sendToEveryDevice sends a copy of the message to each device of its
+// recipient with send, skipping devices whose key was revoked.
+func (cli *Client) sendToEveryDevice(message ClientMessage, send func(ClientMessage, jwk.Key) error) error {
+	keys, err := cli.fetchPinnedKeys(message.To)
+	if err != nil {
+		return err
+	}
+	devices := utils.JWKSetsByDevice(keys)
+	deviceIDs := make([]string, 0, len(devices))
+	for deviceID := range devices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	var revokedErr error
+	sent := 0
+	for _, deviceID := range deviceIDs {
+		key, err := findKeyForUse(message.To, devices[deviceID], utils.UseEncryption)
+		if _, ok := err.(ErrKeyRevoked); ok {
+			utils.LogWarn(fmt.Sprintf("not sending to device %s of %s: %s", deviceID, message.To, err))
+			revokedErr = err
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("device %s of %s: %w", deviceID, message.To, err)
+		}
+		deviceMessage := message
+		deviceMessage.ID = types.MakeMessageID()
+		deviceMessage.ToDevice = deviceID
+		if err := send(deviceMessage, key); err != nil {
+			return err
+		}
+		sent++
+	}
+	if sent == 0 && revokedErr != nil {
+		return revokedErr
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/utils"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	infoECDHES = "messenger ECDH-ES content key"
+)
+
+var ErrInvalidEphemeralKey = errors.New("ephemeral public key is not a valid point")
+
+// ecdhEphemeral runs the sender half of ECDH-ES against a P-256 or X25519
+// recipient key. It returns the derived content key and the encoded
+// ephemeral public key the recipient needs to derive it again.
+func ecdhEphemeral(toPublicKey crypto.PublicKey) ([]byte, []byte, error) {
+	switch key := toPublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, nil, utils.ErrUnsupportedKey{Reason: "only P-256 is supported for EC keys"}
+		}
+		ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared := p256Shared(ephemeral.D, key.X, key.Y)
+		ephemeralPublic := elliptic.Marshal(elliptic.P256(), ephemeral.X, ephemeral.Y)
+		recipientPublic := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+		contentKey, err := deriveContentKey(shared, ephemeralPublic, recipientPublic)
+		return contentKey, ephemeralPublic, err
+	case x25519.PublicKey:
+		ephemeralPublic, ephemeral, err := x25519.GenerateKey(cryptorand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared, err := curve25519.X25519(ephemeral.Seed(), key)
+		if err != nil {
+			return nil, nil, err
+		}
+		contentKey, err := deriveContentKey(shared, ephemeralPublic, key)
+		return contentKey, ephemeralPublic, err
+	default:
+		return nil, nil, utils.ErrUnsupportedKey{Reason: fmt.Sprintf("key agreement with %T", toPublicKey)}
+	}
+}
+
+// ecdhStatic runs the recipient half of ECDH-ES, deriving the content key
+// from our private key and the sender's ephemeral public key. Ed25519 keys
+// use the X25519 key derived from the same seed.
+func ecdhStatic(myPrivateKey crypto.Signer, ephemeralPublic []byte) ([]byte, error) {
+	switch key := myPrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		x, y := elliptic.Unmarshal(elliptic.P256(), ephemeralPublic)
+		if x == nil {
+			return nil, ErrInvalidEphemeralKey
+		}
+		shared := p256Shared(key.D, x, y)
+		recipientPublic := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+		return deriveContentKey(shared, ephemeralPublic, recipientPublic)
+	case ed25519.PrivateKey:
+		x25519Key := utils.X25519PrivateKeyFromEd25519(key)
+		if len(ephemeralPublic) != x25519.PublicKeySize {
+			return nil, ErrInvalidEphemeralKey
+		}
+		shared, err := curve25519.X25519(x25519Key.Seed(), ephemeralPublic)
+		if err != nil {
+			return nil, ErrInvalidEphemeralKey
+		}
+		return deriveContentKey(shared, ephemeralPublic, x25519Key.Public().(x25519.PublicKey))
+	default:
+		return nil, utils.ErrUnsupportedKey{Reason: fmt.Sprintf("key agreement with %T", myPrivateKey)}
+	}
+}
+
+func p256Shared(scalar *big.Int, x *big.Int, y *big.Int) []byte {
+	sharedX, _ := elliptic.P256().ScalarMult(x, y, scalar.Bytes())
+	shared := make([]byte, 32)
+	return sharedX.FillBytes(shared)
+}
+
+// deriveContentKey expands an ECDH shared secret into a content key bound to
+// both public keys of the exchange.
+func deriveContentKey(shared []byte, ephemeralPublic []byte, recipientPublic []byte) ([]byte, error) {
+	info := append([]byte(infoECDHES), ephemeralPublic...)
+	info = append(info, recipientPublic...)
+	contentKey := make([]byte, sizeContentKey)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), contentKey); err != nil {
+		return nil, err
+	}
+	return contentKey, nil
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// supportedAlgorithms are the algorithms the client encrypts content with, in
+// the order it prefers them.
+var supportedAlgorithms = []string{
+	types.AlgorithmRatchet,
+	types.AlgorithmHybridA256GCM,
+	types.AlgorithmECDHESA256GCM,
+	types.AlgorithmRSAOAEPA256GCM,
+}
+
+// ErrLegacyContent is returned for any legacy content that is not decrypted,
+// whatever the reason, so the padding of a ciphertext is not revealed to
+// whoever sent it.
+var ErrLegacyContent = errors.New("legacy content could not be decrypted")
+
+// ErrUnsupportedEnvelope is returned for content in an envelope version, or
+// encrypted with an algorithm, the client does not know.
+type ErrUnsupportedEnvelope struct {
+	Version   int
+	Algorithm string
+}
+
+func (err ErrUnsupportedEnvelope) Error() string {
+	return fmt.Sprintf("unsupported envelope version %d with algorithm %q", err.Version, err.Algorithm)
+}
+
+// ErrNoCommonAlgorithm is returned when a recipient key advertises none of
+// the algorithms the client can encrypt to it with.
+type ErrNoCommonAlgorithm struct {
+	KeyID      string
+	Algorithms []string
+}
+
+func (err ErrNoCommonAlgorithm) Error() string {
+	return fmt.Sprintf("key %s only supports %v, none of which this client sends", err.KeyID, err.Algorithms)
+}
+
+// withAlgorithm records the envelope version and algorithm the message is
+// encrypted with for toPublicKey, picking the best of candidates the key
+// advertises. A jwk.Key of a contact pinned before keys advertised their
+// algorithms, marked by fetchPinnedKeys, is sent the legacy envelope it
+// reads; any other jwk.Key advertising no algorithms gets
+// ErrNoCommonAlgorithm, so stripping them cannot force the legacy envelope.
+// Raw keys advertise nothing and get the current version.
+func (message ClientMessage) withAlgorithm(toPublicKey crypto.PublicKey, candidates ...string) (ClientMessage, error) {
+	var advertised []string
+	key, isJWK := toPublicKey.(jwk.Key)
+	if isJWK {
+		advertised = utils.JWKAlgorithms(key)
+		if _, legacy := key.Get(parameterLegacyKey); legacy && advertised == nil {
+			message.EnvelopeVersion = types.EnvelopeVersionLegacy
+			message.Algorithm = ""
+			return message, nil
+		}
+	}
+	for _, algorithm := range supportedAlgorithms {
+		if !containsString(candidates, algorithm) {
+			continue
+		}
+		if !isJWK || containsString(advertised, algorithm) {
+			message.EnvelopeVersion = types.EnvelopeVersion
+			message.Algorithm = algorithm
+			return message, nil
+		}
+	}
+	keyID := ""
+	if isJWK {
+		keyID = key.KeyID()
+	}
+	return message, ErrNoCommonAlgorithm{KeyID: keyID, Algorithms: advertised}
+}
+
+// checkEnvelope returns ErrUnsupportedEnvelope unless the client reads the
+// envelope version and algorithm of the message.
+func (message ClientMessage) checkEnvelope() error {
+	switch message.EnvelopeVersion {
+	case types.EnvelopeVersionLegacy:
+		if message.Algorithm == "" || message.Algorithm == types.AlgorithmRSAPKCS1v15 {
+			return nil
+		}
+	case types.EnvelopeVersion1:
+		if containsString(supportedAlgorithms, message.Algorithm) {
+			return nil
+		}
+	}
+	return ErrUnsupportedEnvelope{Version: message.EnvelopeVersion, Algorithm: message.Algorithm}
+}
+
+// algorithm names the algorithm the envelope was sealed with.
+func (env envelope) algorithm() string {
+	switch {
+	case env.Ratchet != nil:
+		return types.AlgorithmRatchet
+	case len(env.KEM) > 0:
+		return types.AlgorithmHybridA256GCM
+	case len(env.Key) > 0:
+		return types.AlgorithmRSAOAEPA256GCM
+	default:
+		return types.AlgorithmECDHESA256GCM
+	}
+}
+
+// keyAlgorithm picks the algorithm content encrypted to publicKey with the
+// envelope uses.
+func keyAlgorithm(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return types.AlgorithmRSAOAEPA256GCM, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", utils.ErrUnsupportedKey{Reason: "only P-256 is supported for EC keys"}
+		}
+		return types.AlgorithmECDHESA256GCM, nil
+	case x25519.PublicKey:
+		return types.AlgorithmECDHESA256GCM, nil
+	default:
+		return "", utils.ErrUnsupportedKey{Reason: fmt.Sprintf("key agreement with %T", publicKey)}
+	}
+}
+
+// decryptLegacy decrypts content the first clients encrypted whole with RSA
+// PKCS #1 v1.5, before they signed their messages. Nothing binds it to the
+// message carrying it, so it is only decrypted for messages sent before
+// cutover, never when cutover is zero, and every failure is the same
+// ErrLegacyContent.
+func (message ClientMessage) decryptLegacy(myPrivateKey crypto.Signer, cutover time.Time) (ClientMessage, error) {
+	if !message.TimeSent.Before(cutover) {
+		return message, ErrLegacyContent
+	}
+	rsaKey, ok := myPrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return message, ErrLegacyContent
+	}
+	unencoded, err := base64.URLEncoding.DecodeString(message.Content)
+	if err != nil {
+		return message, ErrLegacyContent
+	}
+	decryptedContent, err := rsa.DecryptPKCS1v15(cryptorand.Reader, rsaKey, unencoded)
+	if err != nil {
+		return message, ErrLegacyContent
+	}
+	message.Content = string(decryptedContent)
+	message.Encrypted = false
+	return message, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestDecryptLegacyContent(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, &privKey.PublicKey, []byte("Hello!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := MakeClientMessage("ROOT", "MEP", base64.URLEncoding.EncodeToString(ciphertext))
+	legacy.Encrypted = true
+	cutover := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	legacy.TimeSent = cutover.Add(-time.Hour)
+	labelled := legacy
+	labelled.Algorithm = types.AlgorithmRSAPKCS1v15
+
+	// the first clients did not sign their messages
+	for name, message := range map[string]ClientMessage{"Unlabelled": legacy, "Labelled": labelled} {
+		t.Run(name, func(t *testing.T) {
+			decrypted, err := message.DecryptLegacyContent(privKey, cutover)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decrypted.Content != "Hello!" || decrypted.Encrypted {
+				t.Errorf("expected %q actual %q", "Hello!", decrypted.Content)
+			}
+		})
+	}
+
+	t.Run("NotAllowed", func(t *testing.T) {
+		if _, err := labelled.DecryptContent(privKey); err != ErrLegacyContent {
+			t.Errorf("expected ErrLegacyContent but got %v", err)
+		}
+		if _, err := labelled.DecryptLegacyContent(privKey, time.Time{}); err != ErrLegacyContent {
+			t.Errorf("expected ErrLegacyContent without a cutover but got %v", err)
+		}
+	})
+	afterCutover := labelled
+	afterCutover.TimeSent = cutover
+	badPadding := labelled
+	badPadding.Content = base64.URLEncoding.EncodeToString(make([]byte, len(ciphertext)))
+	refused := map[string]ClientMessage{"AfterCutover": afterCutover, "BadPadding": badPadding}
+	for name, message := range refused {
+		t.Run(name, func(t *testing.T) {
+			if _, err := message.DecryptLegacyContent(privKey, cutover); err != ErrLegacyContent {
+				t.Errorf("expected ErrLegacyContent but got %v", err)
+			}
+		})
+	}
+}
+
+func TestEncryptContentNegotiatesAlgorithm(t *testing.T) {
+	privKey, err := generateKey(KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := utils.MakeJWKSetFromPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertising, ok := utils.FindJWK(keys, utils.UseEncryption)
+	if !ok {
+		t.Fatal("no encryption key")
+	}
+	// round trip through JSON as keys fetched from the server are
+	data, err := json.Marshal(advertising)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if advertising, err = jwk.ParseKey(data); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := advertising.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Remove(utils.ParameterAlgorithms); err != nil {
+		t.Fatal(err)
+	}
+	// only keys of contacts pinned before algorithms were advertised get the
+	// legacy envelope
+	stripped, err := legacy.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacySet := jwk.NewSet()
+	legacySet.Add(legacy)
+	if err := markLegacyKeys(legacySet, true); err != nil {
+		t.Fatal(err)
+	}
+	// nor any the server marks itself
+	serverMarked, err := legacy.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverMarkedSet := jwk.NewSet()
+	serverMarkedSet.Add(serverMarked)
+	if err := markLegacyKeys(serverMarkedSet, false); err != nil {
+		t.Fatal(err)
+	}
+	rsaOnly, err := advertising.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsaOnly.Set(utils.ParameterAlgorithms, []string{types.AlgorithmRSAOAEPA256GCM}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		key               interface{}
+		expectedVersion   int
+		expectedAlgorithm string
+		expectedError     bool
+	}{
+		{"Advertised", advertising, types.EnvelopeVersion, types.AlgorithmECDHESA256GCM, false},
+		{"Raw", privKey.Public(), types.EnvelopeVersion, types.AlgorithmECDHESA256GCM, false},
+		{"Legacy", legacy, types.EnvelopeVersionLegacy, "", false},
+		{"Stripped", stripped, 0, "", true},
+		{"ServerMarked", serverMarked, 0, "", true},
+		{"NoCommonAlgorithm", rsaOnly, 0, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypted, err := MakeClientMessage("ROOT", "MEP", "Hello!").EncryptContent(test.key)
+			if test.expectedError {
+				if _, ok := err.(ErrNoCommonAlgorithm); !ok {
+					t.Errorf("expected ErrNoCommonAlgorithm actual %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted.EnvelopeVersion != test.expectedVersion || encrypted.Algorithm != test.expectedAlgorithm {
+				t.Errorf("expected %d %q actual %d %q", test.expectedVersion, test.expectedAlgorithm, encrypted.EnvelopeVersion, encrypted.Algorithm)
+			}
+			decrypted, err := encrypted.DecryptContent(privKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decrypted.Content != "Hello!" {
+				t.Errorf("expected %q actual %q", "Hello!", decrypted.Content)
+			}
+		})
+	}
+}
+
+func TestDecryptContentEnvelopeVersion(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := MakeClientMessage("ROOT", "MEP", "secret").EncryptContent(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		tamper        func(message *ClientMessage)
+		expectedError error
+	}{
+		{"FutureVersion", func(message *ClientMessage) { message.EnvelopeVersion = types.EnvelopeVersion + 1 }, ErrUnsupportedEnvelope{Version: types.EnvelopeVersion + 1, Algorithm: types.AlgorithmRSAOAEPA256GCM}},
+		{"UnknownAlgorithm", func(message *ClientMessage) { message.Algorithm = "ROT13" }, ErrUnsupportedEnvelope{Version: types.EnvelopeVersion, Algorithm: "ROT13"}},
+		{"OtherAlgorithm", func(message *ClientMessage) { message.Algorithm = types.AlgorithmECDHESA256GCM }, ErrMalformedEnvelope},
+		// passing the message off as legacy drops the version from the
+		// associated data
+		{"Downgraded", func(message *ClientMessage) {
+			message.EnvelopeVersion = types.EnvelopeVersionLegacy
+			message.Algorithm = ""
+		}, ErrTamperedEnvelope{ID: encrypted.ID}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := encrypted
+			test.tamper(&message)
+			if _, err := message.DecryptContent(privKey); err != test.expectedError {
+				t.Errorf("expected %v actual %v", test.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// CreateGroup makes a group with the client's user as its admin and members
+// as its other members.
+func (cli *Client) CreateGroup(name string, members []string) (types.Group, error) {
+	var group types.Group
+	err := cli.groupRequest(http.MethodPost, "/groups", types.GroupRequest{Name: name, Members: members}, &group)
+	return group, err
+}
+
+// FetchGroups returns the groups the client's user is a member of.
+func (cli *Client) FetchGroups() ([]types.Group, error) {
+	var groups []types.Group
+	err := cli.getJSON("/groups", nil, &groups)
+	return groups, err
+}
+
+// FetchGroup returns the group with groupID, which the client's user must be
+// a member of.
+func (cli *Client) FetchGroup(groupID string) (types.Group, error) {
+	var group types.Group
+	err := cli.getJSON("/groups", map[string]string{"id": groupID}, &group)
+	return group, err
+}
+
+// SetGroupMember adds userID to the group with role, or changes the role they
+// have in it. Only admins of the group may.
+func (cli *Client) SetGroupMember(groupID string, userID string, role string) (types.Group, error) {
+	var group types.Group
+	err := cli.groupRequest(http.MethodPost, "/groups/members", types.GroupMemberRequest{GroupID: groupID, UserID: userID, Role: role}, &group)
+	return group, err
+}
+
+// RemoveGroupMember removes userID from the group. Admins may remove anyone,
+// members only themselves.
+func (cli *Client) RemoveGroupMember(groupID string, userID string) error {
+	path := "/groups/members?groupID=" + url.QueryEscape(groupID) + "&userID=" + url.QueryEscape(userID)
+	request, err := cli.newRequest(http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return errors.New("client.RemoveGroupMember status of " + response.Status)
+	}
+	return nil
+}
+
+// CreateGroupInvite makes an invite link to the group. Anyone given its token
+// joins the group with JoinGroup until it expires.
+func (cli *Client) CreateGroupInvite(groupID string) (types.GroupInvite, error) {
+	var invite types.GroupInvite
+	err := cli.groupRequest(http.MethodPost, "/groups/invites", types.GroupInvite{GroupID: groupID}, &invite)
+	return invite, err
+}
+
+// JoinGroup joins the group of the invite with token as a member.
+func (cli *Client) JoinGroup(token string) (types.Group, error) {
+	var group types.Group
+	err := cli.groupRequest(http.MethodPost, "/groups/join", types.JoinGroupRequest{Token: token}, &group)
+	return group, err
+}
+
+// SendGroupMessage sends the message to every other member of the group,
+// encrypting a copy to each of their devices as SendEncryptedMessageToUser
+// does. The server fans the copies out to the inbox of each member. Members
+// whose keys were all revoked are left out.
+func (cli *Client) SendGroupMessage(groupID string, message ClientMessage) error {
+	group, err := cli.FetchGroup(groupID)
+	if err != nil {
+		return err
+	}
+	message.GroupID = group.ID
+	copies := make([]ClientMessage, 0)
+	for _, member := range group.Members {
+		if member.UserID == cli.Principal.Username {
+			continue
+		}
+		memberMessage := message
+		memberMessage.To = member.UserID
+		err := cli.sendToEveryDevice(memberMessage, func(deviceMessage ClientMessage, key jwk.Key) error {
+			encrypted, err := cli.encryptMessage(deviceMessage, key)
+			if err != nil {
+				return err
+			}
+			signed, err := cli.signMessage(encrypted)
+			if err != nil {
+				return err
+			}
+			copies = append(copies, signed)
+			return nil
+		})
+		if _, ok := err.(ErrKeyRevoked); ok {
+			utils.LogWarn(fmt.Sprintf("not sending to %s in group %s: %s", member.UserID, group.Name, err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(copies) == 0 {
+		return nil
+	}
+
+	request, err := cli.newRequest(http.MethodPost, "/groups/messages", copies)
+	if err != nil {
+		return err
+	}
+	utils.LogInfo("sending group message")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("client.SendGroupMessage status of " + response.Status)
+	}
+	return nil
+}
+
+// groupRequest makes a request of a groups endpoint and decodes the response
+// into value.
+func (cli *Client) groupRequest(method string, path string, body interface{}, value interface{}) error {
+	request, err := cli.newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return errors.New("client.groupRequest " + path + " status of " + response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"crypto/mlkem"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/utils"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	suffixHybrid = ".kem"
+
+	infoHybrid = "messenger X25519MLKEM768 content key"
+	// infoHybridCombined derives the content key from the hybrid KEM and
+	// the classical wrap together.
+	infoHybridCombined = "messenger X25519MLKEM768 and classical content key"
+	// sizeHybridCiphertext is the size of what the recipient needs to
+	// decapsulate: an ML-KEM-768 ciphertext followed by an ephemeral X25519
+	// public key.
+	sizeHybridCiphertext = mlkem.CiphertextSize768 + x25519.PublicKeySize
+)
+
+var (
+	ErrNoHybridKey          = errors.New("content was encrypted to a hybrid KEM key the client does not hold")
+	ErrInvalidHybridMessage = errors.New("hybrid KEM ciphertext is malformed")
+)
+
+// hybridKey is the private key of the hybrid KEM a client publishes with its
+// encryption key when PostQuantum is set. It outlives rotations of the key
+// pair so messages encapsulated to it keep decrypting, and is saved next to
+// the private key file.
+type hybridKey struct {
+	// MLKEM768 is the seed of the ML-KEM-768 decapsulation key.
+	MLKEM768 []byte
+	X25519   []byte
+}
+
+// loadHybridKey reads the hybrid KEM key in file, nil when there is none.
+func loadHybridKey(file stateFile) (*hybridKey, error) {
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var key hybridKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (key *hybridKey) save(file stateFile) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+func generateHybridKey() (*hybridKey, error) {
+	decapsulationKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	_, x25519Key, err := x25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &hybridKey{MLKEM768: decapsulationKey.Bytes(), X25519: x25519Key.Seed()}, nil
+}
+
+// publicKey returns the key senders encapsulate to, as published in
+// utils.ParameterHybridKey.
+func (key *hybridKey) publicKey() ([]byte, error) {
+	decapsulationKey, err := mlkem.NewDecapsulationKey768(key.MLKEM768)
+	if err != nil {
+		return nil, err
+	}
+	x25519Key, err := x25519.NewKeyFromSeed(key.X25519)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := append([]byte{}, decapsulationKey.EncapsulationKey().Bytes()...)
+	return append(publicKey, x25519Key.Public().(x25519.PublicKey)...), nil
+}
+
+// hybridEncapsulate derives a content key for the holder of publicKey. It
+// returns the key and the ciphertext they need to derive it again.
+func hybridEncapsulate(publicKey []byte) ([]byte, []byte, error) {
+	if len(publicKey) != utils.SizeHybridKey {
+		return nil, nil, utils.ErrUnsupportedKey{Reason: "hybrid KEM key is not an ML-KEM-768 and X25519 public key"}
+	}
+	encapsulationKey, err := mlkem.NewEncapsulationKey768(publicKey[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, nil, err
+	}
+	recipientX25519 := publicKey[mlkem.EncapsulationKeySize768:]
+	mlkemShared, mlkemCiphertext := encapsulationKey.Encapsulate()
+
+	ephemeralPublic, ephemeral, err := x25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	x25519Shared, err := curve25519.X25519(ephemeral.Seed(), recipientX25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	contentKey, err := combineHybrid(mlkemShared, x25519Shared, ephemeralPublic, recipientX25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contentKey, append(mlkemCiphertext, ephemeralPublic...), nil
+}
+
+// decapsulate derives the content key from a ciphertext made by
+// hybridEncapsulate.
+func (key *hybridKey) decapsulate(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) != sizeHybridCiphertext {
+		return nil, ErrInvalidHybridMessage
+	}
+	decapsulationKey, err := mlkem.NewDecapsulationKey768(key.MLKEM768)
+	if err != nil {
+		return nil, err
+	}
+	mlkemShared, err := decapsulationKey.Decapsulate(ciphertext[:mlkem.CiphertextSize768])
+	if err != nil {
+		return nil, ErrInvalidHybridMessage
+	}
+	x25519Key, err := x25519.NewKeyFromSeed(key.X25519)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublic := ciphertext[mlkem.CiphertextSize768:]
+	x25519Shared, err := curve25519.X25519(key.X25519, ephemeralPublic)
+	if err != nil {
+		return nil, ErrInvalidHybridMessage
+	}
+	return combineHybrid(mlkemShared, x25519Shared, ephemeralPublic, x25519Key.Public().(x25519.PublicKey))
+}
+
+// combineHybrid derives the content key from both shared secrets, binding the
+// X25519 exchange into it as X-Wing does. The ML-KEM ciphertext needs no
+// binding, ML-KEM already commits to it.
+func combineHybrid(mlkemShared []byte, x25519Shared []byte, ephemeralPublic []byte, recipientX25519 []byte) ([]byte, error) {
+	secret := append(append([]byte{}, mlkemShared...), x25519Shared...)
+	info := append([]byte(infoHybrid), ephemeralPublic...)
+	info = append(info, recipientX25519...)
+	contentKey := make([]byte, sizeContentKey)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), contentKey); err != nil {
+		return nil, err
+	}
+	return contentKey, nil
+}
+
+// publishHybridKey adds the client's hybrid KEM key, made on first use, to the
+// encryption key of keys.
+func (cli *Client) publishHybridKey(keys jwk.Set) error {
+	file := cli.stateFile(suffixHybrid)
+	key, err := loadHybridKey(file)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		if key, err = generateHybridKey(); err != nil {
+			return err
+		}
+		if err := key.save(file); err != nil {
+			return err
+		}
+	}
+	publicKey, err := key.publicKey()
+	if err != nil {
+		return err
+	}
+	encKey, ok := utils.FindJWK(keys, utils.UseEncryption)
+	if !ok {
+		return errors.New("there is no enc key in provided set")
+	}
+	return utils.SetJWKHybridKey(encKey, publicKey, cli.PrivateKey)
+}
+
+// dropUnsignedHybridKeys removes from keys of userID every hybrid KEM key the
+// signing key of its device did not sign, so content is never encapsulated to
+// a key slipped in by whoever served the keys.
+func dropUnsignedHybridKeys(userID string, keys jwk.Set) error {
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if _, ok := key.Get(utils.ParameterHybridKey); !ok {
+			continue
+		}
+		if err := utils.VerifyJWKHybridKey(keys, key); err != nil {
+			utils.LogWarn(fmt.Sprintf("ignoring hybrid KEM key of %s key %s: %s", userID, key.KeyID(), err))
+			if err := key.Remove(utils.ParameterHybridKey); err != nil {
+				return err
+			}
+			if err := key.Remove(utils.ParameterHybridKeySignature); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// combineContentKeys derives the content key of a hybrid envelope from the
+// key the hybrid KEM gave and the key wrapped to the recipient's encryption
+// key, so the content stays secret even if the hybrid KEM key is not the
+// recipient's.
+func combineContentKeys(hybridKey []byte, classicalKey []byte) ([]byte, error) {
+	secret := append(append([]byte{}, hybridKey...), classicalKey...)
+	contentKey := make([]byte, sizeContentKey)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(infoHybridCombined)), contentKey); err != nil {
+		return nil, err
+	}
+	return contentKey, nil
+}
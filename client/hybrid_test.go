@@ -0,0 +1,161 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestHybridEncapsulate(t *testing.T) {
+	key, err := generateHybridKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := key.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKey) != utils.SizeHybridKey {
+		t.Fatalf("expected a %d byte public key actual %d", utils.SizeHybridKey, len(publicKey))
+	}
+	contentKey, ciphertext, err := hybridEncapsulate(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decapsulated, err := key.decapsulate(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decapsulated) != string(contentKey) {
+		t.Error("decapsulated key does not match the encapsulated key")
+	}
+
+	// the X25519 half changed makes for another key
+	ciphertext[len(ciphertext)-1] ^= 1
+	if decapsulated, err := key.decapsulate(ciphertext); err == nil && string(decapsulated) == string(contentKey) {
+		t.Error("tampered ciphertext decapsulated to the same key")
+	}
+	if _, err := key.decapsulate(ciphertext[1:]); err != ErrInvalidHybridMessage {
+		t.Errorf("expected ErrInvalidHybridMessage actual %v", err)
+	}
+}
+
+func TestEncryptContentHybrid(t *testing.T) {
+	privKey, err := generateKey(KeyTypeRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid, err := generateHybridKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := hybrid.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := utils.MakeJWKSetFromPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, ok := utils.FindJWK(keys, utils.UseEncryption)
+	if !ok {
+		t.Fatal("no encryption key")
+	}
+	if err := utils.SetJWKHybridKey(encKey, publicKey, privKey); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := MakeClientMessage("ROOT", "MEP", "Hello!").EncryptContent(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Algorithm != types.AlgorithmHybridA256GCM {
+		t.Errorf("expected %q actual %q", types.AlgorithmHybridA256GCM, encrypted.Algorithm)
+	}
+	if _, err := encrypted.DecryptContent(privKey); err != ErrNoHybridKey {
+		t.Errorf("expected ErrNoHybridKey actual %v", err)
+	}
+	decrypted, err := encrypted.decryptContent(privKey, hybrid, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Content != "Hello!" {
+		t.Errorf("expected %q actual %q", "Hello!", decrypted.Content)
+	}
+
+	// the content key also needs the key wrapped to the encryption key
+	otherKey, err := generateKey(KeyTypeRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.decryptContent(otherKey, hybrid, time.Time{}); err == nil {
+		t.Error("decrypted with the hybrid KEM key alone")
+	}
+
+	// the algorithm cannot be swapped for the classical one of the key
+	downgraded := encrypted
+	downgraded.Algorithm = types.AlgorithmRSAOAEPA256GCM
+	if _, err := downgraded.decryptContent(privKey, hybrid, time.Time{}); err != ErrMalformedEnvelope {
+		t.Errorf("expected ErrMalformedEnvelope actual %v", err)
+	}
+}
+
+func TestDropUnsignedHybridKeys(t *testing.T) {
+	privKey, err := generateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid, err := generateHybridKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := hybrid.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testActiveKeySet(t, KeyTypeEd25519)
+	encKey, ok := utils.FindJWK(keys, utils.UseEncryption)
+	if !ok {
+		t.Fatal("no encryption key")
+	}
+	signed, err := utils.MakeJWKSetFromPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedKey, ok := utils.FindJWK(signed, utils.UseEncryption)
+	if !ok {
+		t.Fatal("no encryption key")
+	}
+	if err := utils.SetJWKHybridKey(signedKey, publicKey, privKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := dropUnsignedHybridKeys("bob", signed); err != nil {
+		t.Fatal(err)
+	}
+	if hybridKey, _ := utils.JWKHybridKey(signedKey); hybridKey == nil {
+		t.Error("hybrid KEM key signed by the user's signing key was dropped")
+	}
+
+	// a hybrid KEM key signed by someone else is never encapsulated to
+	if err := utils.SetJWKHybridKey(encKey, publicKey, privKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.VerifyJWKHybridKey(keys, encKey); err != utils.ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature actual %v", err)
+	}
+	if err := dropUnsignedHybridKeys("bob", keys); err != nil {
+		t.Fatal(err)
+	}
+	if hybridKey, _ := utils.JWKHybridKey(encKey); hybridKey != nil {
+		t.Error("hybrid KEM key signed by another key was kept")
+	}
+	encrypted, err := MakeClientMessage("bob", "alice", "Hello!").EncryptContent(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Algorithm == types.AlgorithmHybridA256GCM {
+		t.Error("content encapsulated to a dropped hybrid KEM key")
+	}
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	// headerMessage is the protected JWE header carrying the metadata of the
+	// message, so it is authenticated along with the content.
+	headerMessage = "msg"
+	// headerPadded is set in the protected JWE header when the payload was
+	// padded, a 0x80 byte and zeros following the content.
+	headerPadded = "pad"
+)
+
+// jweMessageHeader is the message metadata bound to JWE content, the fields
+// the envelope covers with its associated data. Other tooling producing
+// messages sets it to the metadata of the message the content goes in.
+type jweMessageHeader struct {
+	ID         types.MessageID `json:"id"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	TimeSent   time.Time       `json:"sent"`
+	FromDevice string          `json:"from_device,omitempty"`
+	Nonce      string          `json:"nonce,omitempty"`
+	Sequence   uint64          `json:"seq,string,omitempty"`
+	Version    int             `json:"v,omitempty"`
+	Algorithm  string          `json:"alg,omitempty"`
+	Attachment bool            `json:"att,omitempty"`
+	GroupID    string          `json:"grp,omitempty"`
+}
+
+func (message ClientMessage) jweHeader() jweMessageHeader {
+	return jweMessageHeader{
+		ID:         message.ID,
+		From:       message.From,
+		To:         message.To,
+		TimeSent:   message.TimeSent.UTC(),
+		FromDevice: message.FromDevice,
+		Nonce:      message.Nonce,
+		Sequence:   message.Sequence,
+		Version:    message.EnvelopeVersion,
+		Algorithm:  message.Algorithm,
+		Attachment: message.Attachment,
+		GroupID:    message.GroupID,
+	}
+}
+
+func (header jweMessageHeader) matches(message ClientMessage) bool {
+	return header.ID == message.ID &&
+		header.From == message.From &&
+		header.To == message.To &&
+		header.TimeSent.Equal(message.TimeSent) &&
+		header.FromDevice == message.FromDevice &&
+		header.Nonce == message.Nonce &&
+		header.Sequence == message.Sequence &&
+		header.Version == message.EnvelopeVersion &&
+		header.Algorithm == message.Algorithm &&
+		header.Attachment == message.Attachment &&
+		header.GroupID == message.GroupID
+}
+
+// EncryptContentJWE encrypts the content to toPublicKey as EncryptContent
+// does, but holds it as a JWE in compact serialization so other tooling can
+// read it: RSA-OAEP-256 for RSA keys, ECDH-ES for P-256 and X25519 keys, and
+// A256GCM for the content.
+func (message ClientMessage) EncryptContentJWE(toPublicKey crypto.PublicKey) (ClientMessage, error) {
+	return message.encryptContentJWE(toPublicKey, DefaultPadding)
+}
+
+func (message ClientMessage) encryptContentJWE(toPublicKey crypto.PublicKey, padding PaddingPolicy) (ClientMessage, error) {
+	negotiateWith := toPublicKey
+	headers := jwe.NewHeaders()
+	if key, ok := toPublicKey.(jwk.Key); ok {
+		raw, err := utils.MakePublicKeyFromJWK(key)
+		if err != nil {
+			return message, err
+		}
+		toPublicKey = raw
+		message.KeyID = key.KeyID()
+		if err := headers.Set(jwe.KeyIDKey, key.KeyID()); err != nil {
+			return message, err
+		}
+	}
+	alg, err := jweKeyAlgorithm(toPublicKey)
+	if err != nil {
+		return message, err
+	}
+	algorithm, err := keyAlgorithm(toPublicKey)
+	if err != nil {
+		return message, err
+	}
+	if message, err = message.withAlgorithm(negotiateWith, algorithm); err != nil {
+		return message, err
+	}
+	if err := headers.Set(headerMessage, message.jweHeader()); err != nil {
+		return message, err
+	}
+	if err := headers.Set(headerPadded, true); err != nil {
+		return message, err
+	}
+
+	content, err := jwe.Encrypt(pad([]byte(message.Content), padding), alg, toPublicKey, jwa.A256GCM, jwa.NoCompress, jwe.WithProtectedHeaders(headers))
+	if err != nil {
+		return message, err
+	}
+	message.Content = string(content)
+	message.ContentType = types.ContentTypeJWE
+	message.Encrypted = true
+	return message, nil
+}
+
+// decryptContentJWE decrypts JWE content with myPrivateKey. The metadata in
+// the protected header must match the message carrying the content.
+func (message ClientMessage) decryptContentJWE(myPrivateKey crypto.Signer) (ClientMessage, error) {
+	parsed, err := jwe.ParseString(message.Content)
+	if err != nil {
+		return message, ErrMalformedEnvelope
+	}
+	alg := parsed.ProtectedHeaders().Algorithm()
+	// Ed25519 keys agree on keys with the X25519 key of the same seed
+	var key interface{} = myPrivateKey
+	publicKey := myPrivateKey.Public()
+	if ed25519Key, ok := myPrivateKey.(ed25519.PrivateKey); ok {
+		x25519Key := utils.X25519PrivateKeyFromEd25519(ed25519Key)
+		key, publicKey = x25519Key, x25519Key.Public()
+	}
+	if expected, err := jweKeyAlgorithm(publicKey); err != nil || alg != expected {
+		return message, ErrMalformedEnvelope
+	}
+
+	decrypted, err := jwe.Decrypt([]byte(message.Content), alg, key)
+	if err != nil {
+		return message, ErrTamperedEnvelope{ID: message.ID}
+	}
+	header, ok := parsed.ProtectedHeaders().Get(headerMessage)
+	if !ok {
+		return message, ErrTamperedEnvelope{ID: message.ID}
+	}
+	// custom headers are decoded generically, back to JSON and into the
+	// header type
+	data, err := json.Marshal(header)
+	if err != nil {
+		return message, err
+	}
+	var bound jweMessageHeader
+	if err := json.Unmarshal(data, &bound); err != nil || !bound.matches(message) {
+		return message, ErrTamperedEnvelope{ID: message.ID}
+	}
+	if padded, _ := parsed.ProtectedHeaders().Get(headerPadded); padded == true {
+		if decrypted, err = unpad(decrypted); err != nil {
+			return message, err
+		}
+	}
+	message.Content = string(decrypted)
+	message.ContentType = ""
+	message.Encrypted = false
+	return message, nil
+}
+
+// jweKeyAlgorithm picks the key management algorithm for content encrypted
+// to publicKey.
+func jweKeyAlgorithm(publicKey crypto.PublicKey) (jwa.KeyEncryptionAlgorithm, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jwa.RSA_OAEP_256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", utils.ErrUnsupportedKey{Reason: "only P-256 is supported for EC keys"}
+		}
+		return jwa.ECDH_ES, nil
+	case x25519.PublicKey:
+		return jwa.ECDH_ES, nil
+	default:
+		return "", utils.ErrUnsupportedKey{Reason: fmt.Sprintf("JWE key management with %T", publicKey)}
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestEncryptDecryptContentJWE(t *testing.T) {
+	tests := []struct {
+		keyType KeyType
+		alg     jwa.KeyEncryptionAlgorithm
+	}{
+		{KeyTypeRSA, jwa.RSA_OAEP_256},
+		{KeyTypeP256, jwa.ECDH_ES},
+		{KeyTypeEd25519, jwa.ECDH_ES},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.keyType), func(t *testing.T) {
+			privKey, err := generateKey(test.keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := utils.MakeJWKSetFromPrivateKey(privKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pubKey, ok := utils.FindJWK(keys, utils.UseEncryption)
+			if !ok {
+				t.Fatal("no encryption key")
+			}
+
+			message := MakeClientMessage("ROOT", "MEP", "Hello!")
+			encrypted, err := message.EncryptContentJWE(pubKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted.ContentType != types.ContentTypeJWE || !encrypted.Encrypted {
+				t.Errorf("encrypted message is not marked as JWE, content type %q", encrypted.ContentType)
+			}
+			if strings.Count(encrypted.Content, ".") != 4 {
+				t.Error("content is not in compact serialization")
+			}
+			parsed, err := jwe.ParseString(encrypted.Content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers := parsed.ProtectedHeaders()
+			if headers.Algorithm() != test.alg || headers.ContentEncryption() != jwa.A256GCM {
+				t.Errorf("expected %s/%s actual %s/%s", test.alg, jwa.A256GCM, headers.Algorithm(), headers.ContentEncryption())
+			}
+			if headers.KeyID() != pubKey.KeyID() || encrypted.KeyID != pubKey.KeyID() {
+				t.Errorf("expected kid %s actual header %s message %s", pubKey.KeyID(), headers.KeyID(), encrypted.KeyID)
+			}
+
+			decrypted, err := encrypted.DecryptContent(privKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decrypted.Content != message.Content || decrypted.Encrypted {
+				t.Errorf("expected %q actual %q", message.Content, decrypted.Content)
+			}
+		})
+	}
+}
+
+func TestDecryptContentJWETamperedMetadata(t *testing.T) {
+	privKey, err := generateKey(KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := testPublicKeyForUse(t, privKey, utils.UseEncryption)
+	encrypted, err := MakeClientMessage("ROOT", "MEP", "secret").EncryptContentJWE(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := MakeClientMessage("ROOT", "MEP", "other").EncryptContentJWE(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(message *ClientMessage)
+	}{
+		{"To", func(message *ClientMessage) { message.To = "EVE" }},
+		{"From", func(message *ClientMessage) { message.From = "EVE" }},
+		{"TimeSent", func(message *ClientMessage) { message.TimeSent = message.TimeSent.Add(time.Hour) }},
+		{"ID", func(message *ClientMessage) { message.ID = "1" }},
+		{"Sequence", func(message *ClientMessage) { message.Sequence++ }},
+		{"MovedContent", func(message *ClientMessage) { message.Content = other.Content }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := encrypted
+			test.tamper(&message)
+			_, err := message.DecryptContent(privKey)
+			if _, ok := err.(ErrTamperedEnvelope); !ok {
+				t.Errorf("expected ErrTamperedEnvelope actual %v", err)
+			}
+		})
+	}
+}
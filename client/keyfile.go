@@ -0,0 +1,408 @@
+package client
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// EnvPassphrase holds the passphrase of the key file.
+	EnvPassphrase = "MESSENGER_PASSPHRASE"
+	// EnvPassphraseCommand names a command, such as a password manager or
+	// agent, printing the passphrase of the key file.
+	EnvPassphraseCommand = "MESSENGER_PASSPHRASE_COMMAND"
+
+	pemTypeEncryptedKeys  = "MESSENGER ENCRYPTED PRIVATE KEYS"
+	pemTypeStateKey       = "MESSENGER STATE KEY"
+	pemTypeEncryptedState = "MESSENGER ENCRYPTED STATE"
+	kdfScrypt             = "scrypt"
+
+	// scrypt parameters recommended for interactive logins, about 32 MiB of
+	// memory per derivation
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+	sizeScryptSalt = 16
+	// key files asking for more than 256 MiB of memory or 16 times the work
+	// are refused rather than derived
+	maxScryptMemory = 256 << 20
+	maxScryptP      = 16
+
+	sizeStateKey = 32
+)
+
+var (
+	ErrPassphraseRequired = errors.New("key file is encrypted and no passphrase was given")
+	ErrWrongPassphrase    = errors.New("passphrase does not decrypt the key file")
+	ErrEmptyPassphrase    = errors.New("passphrase must not be empty")
+	ErrStateNotEncrypted  = errors.New("state file is not encrypted although the key file is")
+	ErrInvalidStateFile   = errors.New("state file does not decrypt under the state key")
+)
+
+// stateSuffixes name the files the client keeps its state in next to the key
+// file. The device ID is left out; it is no secret.
+var stateSuffixes = []string{
+	suffixPrekeys, suffixSessions, suffixHistory, suffixContacts, suffixReplay,
+	suffixKeyLog, suffixHybrid, suffixMLS, suffixDelivery,
+}
+
+// PassphraseFunc returns the passphrase of the key file. newPassphrase is set
+// when the passphrase is about to protect a new key file, so a prompt can ask
+// for it twice.
+type PassphraseFunc func(newPassphrase bool) ([]byte, error)
+
+// DefaultPassphrase reads the passphrase from EnvPassphrase, from the output
+// of EnvPassphraseCommand, or else prompts for it on the terminal.
+func DefaultPassphrase(newPassphrase bool) ([]byte, error) {
+	if passphrase := os.Getenv(EnvPassphrase); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if command := os.Getenv(EnvPassphraseCommand); command != "" {
+		return PassphraseFromCommand(command)(newPassphrase)
+	}
+	return PromptPassphrase(newPassphrase)
+}
+
+// PassphraseFromCommand runs command through the shell and uses the first
+// line it prints as the passphrase.
+func PassphraseFromCommand(command string) PassphraseFunc {
+	return func(bool) ([]byte, error) {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("passphrase command failed: %w", err)
+		}
+		line := strings.SplitN(string(output), "\n", 2)[0]
+		passphrase := strings.TrimSuffix(line, "\r")
+		if passphrase == "" {
+			return nil, ErrEmptyPassphrase
+		}
+		return []byte(passphrase), nil
+	}
+}
+
+// PromptPassphrase asks for the passphrase on the terminal, without echoing
+// it where the terminal allows. A new passphrase is asked for twice.
+func PromptPassphrase(newPassphrase bool) ([]byte, error) {
+	reader := bufio.NewReader(os.Stdin)
+	passphrase, err := promptLine(reader, "passphrase for the key file: ")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	if newPassphrase {
+		again, err := promptLine(reader, "repeat the passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if again != passphrase {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return []byte(passphrase), nil
+}
+
+func promptLine(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if setTerminalEcho(false) == nil {
+		defer func() {
+			setTerminalEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// setTerminalEcho turns echoing of the terminal on stdin on or off. It fails
+// when stdin is not a terminal or stty is missing.
+func setTerminalEcho(on bool) error {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// ChangePassphrase encrypts the key file under a new passphrase. It also
+// migrates a plaintext key file to an encrypted one, encrypting the state
+// files with it.
+func (cli *Client) ChangePassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return ErrEmptyPassphrase
+	}
+	stateKey := cli.stateKey
+	if stateKey == nil {
+		var err error
+		if stateKey, err = newStateKey(); err != nil {
+			return err
+		}
+	}
+	keys := append([]crypto.Signer{cli.PrivateKey}, cli.previousKeys...)
+	if err := saveKeys(cli.keyPath, keys, passphrase, stateKey); err != nil {
+		return err
+	}
+	cli.passphrase = passphrase
+	cli.stateKey = stateKey
+	return cli.encryptStateFiles()
+}
+
+// IsKeyFileEncrypted reports whether the key file of the client is protected
+// by a passphrase.
+func (cli *Client) IsKeyFileEncrypted() bool {
+	return cli.passphrase != nil
+}
+
+// encryptKeyBlocks encrypts PEM encoded private keys with AES-256-GCM under a
+// key derived from the passphrase with scrypt. The KDF parameters, salt and
+// nonce are kept in the headers of the block.
+func encryptKeyBlocks(plaintext []byte, passphrase []byte) (*pem.Block, error) {
+	salt := make([]byte, sizeScryptSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := keyFileCipher(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type: pemTypeEncryptedKeys,
+		Headers: map[string]string{
+			"KDF":   kdfScrypt,
+			"N":     strconv.Itoa(scryptN),
+			"R":     strconv.Itoa(scryptR),
+			"P":     strconv.Itoa(scryptP),
+			"Salt":  base64.StdEncoding.EncodeToString(salt),
+			"Nonce": base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, plaintext, []byte(pemTypeEncryptedKeys)),
+	}, nil
+}
+
+// decryptKeyBlock returns the PEM encoded private keys held by a block made
+// by encryptKeyBlocks.
+func decryptKeyBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if block.Headers["KDF"] != kdfScrypt {
+		return nil, fmt.Errorf("key file uses unknown KDF %q", block.Headers["KDF"])
+	}
+	var params [3]int
+	for i, name := range []string{"N", "R", "P"} {
+		value, err := strconv.Atoi(block.Headers[name])
+		if err != nil || value < 1 {
+			return nil, fmt.Errorf("key file has invalid scrypt parameter %s", name)
+		}
+		params[i] = value
+	}
+	// scrypt needs 128 * N * r bytes of memory, checked without overflowing
+	if params[0] > maxScryptMemory/128/params[1] || params[2] > maxScryptP {
+		return nil, errors.New("key file asks for more scrypt work than allowed")
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := keyFileCipher(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("key file has an invalid nonce")
+	}
+	plaintext, err := gcm.Open(nil, nonce, block.Bytes, []byte(pemTypeEncryptedKeys))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func keyFileCipher(passphrase []byte, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, sizeContentKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newStateKey returns a random key for the state files. It is kept in the
+// encrypted key file, so the passphrase protects the state as well, and
+// survives passphrase changes without the state being encrypted again.
+func newStateKey() ([]byte, error) {
+	stateKey := make([]byte, sizeStateKey)
+	if _, err := rand.Read(stateKey); err != nil {
+		return nil, err
+	}
+	return stateKey, nil
+}
+
+// parseStateKey returns the state key among the PEM blocks of a decrypted key
+// file, nil when it has none.
+func parseStateKey(data []byte) []byte {
+	for len(data) != 0 {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type == pemTypeStateKey && len(block.Bytes) == sizeStateKey {
+			return block.Bytes
+		}
+		data = rest
+	}
+	return nil
+}
+
+// stateFile is a file the client keeps state in next to its key file. When
+// the key file is encrypted the state is encrypted as well, with AES-256-GCM
+// under the state key, binding the suffix of the file so files cannot be
+// swapped for each other.
+type stateFile struct {
+	path   string
+	suffix string
+	key    []byte
+}
+
+func (cli *Client) stateFile(suffix string) stateFile {
+	return stateFile{path: cli.keyPath + suffix, suffix: suffix, key: cli.stateKey}
+}
+
+// read returns the content of the file, or an error satisfying os.IsNotExist
+// when there is none.
+func (file stateFile) read() ([]byte, error) {
+	data, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	encrypted := block != nil && block.Type == pemTypeEncryptedState
+	if file.key == nil {
+		if encrypted {
+			return nil, ErrPassphraseRequired
+		}
+		return data, nil
+	}
+	if !encrypted {
+		return nil, ErrStateNotEncrypted
+	}
+	gcm, err := stateCipher(file.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, ErrInvalidStateFile
+	}
+	plaintext, err := gcm.Open(nil, nonce, block.Bytes, file.associatedData())
+	if err != nil {
+		return nil, ErrInvalidStateFile
+	}
+	return plaintext, nil
+}
+
+// write replaces the content of the file in one step, so a failed write
+// never loses the state it held.
+func (file stateFile) write(data []byte) error {
+	if file.key != nil {
+		gcm, err := stateCipher(file.key)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:    pemTypeEncryptedState,
+			Headers: map[string]string{"Nonce": base64.StdEncoding.EncodeToString(nonce)},
+			Bytes:   gcm.Seal(nil, nonce, data, file.associatedData()),
+		})
+	}
+	return writeFileAtomic(file.path, data)
+}
+
+func (file stateFile) associatedData() []byte {
+	return []byte(pemTypeEncryptedState + file.suffix)
+}
+
+func stateCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptStateFiles encrypts the state files still kept in plaintext, those
+// written before the key file was encrypted.
+func (cli *Client) encryptStateFiles() error {
+	for _, suffix := range stateSuffixes {
+		file := cli.stateFile(suffix)
+		if _, err := file.read(); err != ErrStateNotEncrypted {
+			continue
+		}
+		plain := file
+		plain.key = nil
+		data, err := plain.read()
+		if err != nil {
+			return err
+		}
+		if err := file.write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path once it is on disk.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
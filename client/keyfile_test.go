@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func testPassphrase(passphrase string) PassphraseFunc {
+	return func(bool) ([]byte, error) {
+		return []byte(passphrase), nil
+	}
+}
+
+func TestEncryptedKeyFile(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key")
+	cli := MakeClientWithPassphrase(keyPath, "", KeyTypeEd25519, testPassphrase("correct horse"))
+	if !cli.IsKeyFileEncrypted() {
+		t.Error("new key file is not encrypted")
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("BEGIN PRIVATE KEY")) {
+		t.Error("key file holds a plaintext private key")
+	}
+
+	keys, _, _, err := loadKeys(keyPath, testPassphrase("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cli.PrivateKey, keys[0]) {
+		t.Error("key file decrypted to a different key")
+	}
+	if _, _, _, err := loadKeys(keyPath, testPassphrase("wrong horse")); err != ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase but got %v", err)
+	}
+	if _, _, _, err := loadKeys(keyPath, nil); err != ErrPassphraseRequired {
+		t.Errorf("expected ErrPassphraseRequired but got %v", err)
+	}
+
+	// rotated keys stay encrypted under the same passphrase
+	key, err := generateKey(KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveKeys(keyPath, []crypto.Signer{key, cli.PrivateKey}, cli.passphrase, cli.stateKey); err != nil {
+		t.Fatal(err)
+	}
+	keys, _, _, err = loadKeys(keyPath, testPassphrase("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("expected 2 keys but got %d", len(keys))
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key")
+	cli := MakeClientWithKeyType(keyPath, "", KeyTypeEd25519)
+	if cli.IsKeyFileEncrypted() {
+		t.Error("key file made without a passphrase is encrypted")
+	}
+	if err := cli.ChangePassphrase(nil); err != ErrEmptyPassphrase {
+		t.Errorf("expected ErrEmptyPassphrase but got %v", err)
+	}
+
+	// a plaintext key file is migrated
+	if err := cli.ChangePassphrase([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, _, err := loadKeys(keyPath, testPassphrase("first")); err != nil || string(secret) != "first" {
+		t.Errorf("migrated key file not encrypted under the passphrase: %v", err)
+	}
+
+	if err := cli.ChangePassphrase([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := loadKeys(keyPath, testPassphrase("first")); err != ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase for the old passphrase but got %v", err)
+	}
+	reloaded := MakeClientWithPassphrase(keyPath, "", KeyTypeEd25519, testPassphrase("second"))
+	if reloaded.DeviceID != cli.DeviceID || !reloaded.IsKeyFileEncrypted() {
+		t.Error("client did not load the key file with the new passphrase")
+	}
+}
+
+func TestEncryptedStateFiles(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key")
+	cli := MakeClientWithKeyType(keyPath, "", KeyTypeEd25519)
+	history := messageHistory{"message": "meet at noon"}
+	if err := history.save(cli.stateFile(suffixHistory)); err != nil {
+		t.Fatal(err)
+	}
+
+	// state written before the passphrase was set is encrypted with the key
+	// file
+	if err := cli.ChangePassphrase([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(keyPath + suffixHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("meet at noon")) {
+		t.Error("history kept in plaintext under an encrypted key file")
+	}
+
+	// and stays readable after the passphrase changes
+	if err := cli.ChangePassphrase([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := MakeClientWithPassphrase(keyPath, "", KeyTypeEd25519, testPassphrase("second"))
+	loaded, err := loadMessageHistory(reloaded.stateFile(suffixHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded["message"] != "meet at noon" {
+		t.Errorf("expected the history to survive but got %v", loaded)
+	}
+
+	// a state file is bound to its name
+	if err := ioutil.WriteFile(keyPath+suffixSessions, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSessionStore(reloaded.stateFile(suffixSessions)); err != ErrInvalidStateFile {
+		t.Errorf("expected ErrInvalidStateFile but got %v", err)
+	}
+}
+
+func TestKeyFileScryptLimits(t *testing.T) {
+	block, err := encryptKeyBlocks([]byte("keys"), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Headers["N"] = strconv.Itoa(1 << 30)
+	if _, err := decryptKeyBlock(block, []byte("passphrase")); err == nil {
+		t.Error("key file asking for 128 GiB of memory was derived")
+	}
+}
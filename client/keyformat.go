@@ -0,0 +1,301 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyFormat is an encoding of a key pair the client imports and exports.
+type KeyFormat string
+
+const (
+	// KeyFormatPEM is the encoding of the key file: PKCS#1 for RSA, SEC 1
+	// for P-256 and PKCS#8 for Ed25519 private keys, PKIX public keys.
+	KeyFormatPEM KeyFormat = "pem"
+	// KeyFormatPKCS8 encodes every private key as PKCS#8, public keys as
+	// PKIX.
+	KeyFormatPKCS8 KeyFormat = "pkcs8"
+	// KeyFormatJWK encodes the private key as a JWK and the public keys as
+	// the JWK set the client registers.
+	KeyFormatJWK KeyFormat = "jwk"
+	// KeyFormatOpenSSH encodes the private key in the unencrypted
+	// openssh-key-v1 format and the public key as an authorized_keys line.
+	KeyFormatOpenSSH KeyFormat = "openssh"
+
+	pemTypeOpenSSHPrivateKey = "OPENSSH PRIVATE KEY"
+	openSSHMagic             = "openssh-key-v1\x00"
+	openSSHBlockSize         = 8
+	minRSAKeySize            = 2048
+)
+
+// ImportKey replaces the client's key pair with a private key managed
+// elsewhere, in any of the formats of KeyFormat, and registers it as the
+// active key of the user. The passphrase is asked for when the key is an
+// encrypted OpenSSH key. The replaced keys are kept as with RotateKey.
+func (cli *Client) ImportKey(data []byte, passphrase PassphraseFunc) error {
+	key, err := ParsePrivateKey(data, passphrase)
+	if err != nil {
+		return err
+	}
+	if current, ok := cli.PrivateKey.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && current.Equal(key.Public()) {
+		return errors.New("the key is already the client's key")
+	}
+	return cli.replaceKey(key)
+}
+
+// ExportKeyPair encodes the client's private key and public key in format.
+func (cli *Client) ExportKeyPair(format KeyFormat) ([]byte, []byte, error) {
+	private, err := MarshalPrivateKey(cli.PrivateKey, format)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := MarshalPublicKey(cli.PrivateKey, format)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+// ParsePrivateKey parses a private key, detecting its format: a JWK, or a PEM
+// encoded PKCS#1, SEC 1, PKCS#8 or OpenSSH key. The key must be an RSA key of
+// at least 2048 bits, a P-256 key or an Ed25519 key.
+func ParsePrivateKey(data []byte, passphrase PassphraseFunc) (crypto.Signer, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		keys, err := parseJWKPrivateKeys(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) != 1 {
+			return nil, fmt.Errorf("expected one private key but got %d", len(keys))
+		}
+		return keys[0], nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key is neither a JWK nor PEM encoded")
+	}
+	key, err := parsePEMPrivateKey(block)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok || passphrase == nil {
+		return key, err
+	}
+	secret, err := passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(data, secret)
+	if err != nil {
+		return nil, err
+	}
+	return supportedPrivateKey(raw)
+}
+
+// MarshalPrivateKey encodes a private key in format.
+func MarshalPrivateKey(key crypto.Signer, format KeyFormat) ([]byte, error) {
+	switch format {
+	case KeyFormatPEM:
+		block, err := privateKeyBlock(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(block), nil
+	case KeyFormatPKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	case KeyFormatJWK:
+		jwkKey, err := jwk.New(key)
+		if err != nil {
+			return nil, err
+		}
+		keyID, err := utils.KeyID(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		if err := jwkKey.Set(jwk.KeyIDKey, keyID); err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(jwkKey, "", "  ")
+	case KeyFormatOpenSSH:
+		block, err := openSSHPrivateKeyBlock(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(block), nil
+	default:
+		return nil, fmt.Errorf("unknown key format %q", format)
+	}
+}
+
+// MarshalPublicKey encodes the public key of a private key in format.
+func MarshalPublicKey(key crypto.Signer, format KeyFormat) ([]byte, error) {
+	switch format {
+	case KeyFormatPEM, KeyFormatPKCS8:
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	case KeyFormatJWK:
+		keys, err := utils.MakeJWKSetFromPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(keys, "", "  ")
+	case KeyFormatOpenSSH:
+		publicKey, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return ssh.MarshalAuthorizedKey(publicKey), nil
+	default:
+		return nil, fmt.Errorf("unknown key format %q", format)
+	}
+}
+
+// parsePEMPrivateKey parses a PKCS#1, SEC 1, PKCS#8 or OpenSSH private key
+// block.
+func parsePEMPrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var raw interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		raw, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		raw, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		raw, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case pemTypeOpenSSHPrivateKey:
+		raw, err = ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return supportedPrivateKey(raw)
+}
+
+// parseJWKPrivateKeys parses a private JWK or a JWK set of private keys.
+func parseJWKPrivateKeys(data []byte) ([]crypto.Signer, error) {
+	set, err := jwk.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]crypto.Signer, 0, set.Len())
+	for i := 0; i < set.Len(); i++ {
+		jwkKey, _ := set.Get(i)
+		var raw interface{}
+		if err := jwkKey.Raw(&raw); err != nil {
+			return nil, err
+		}
+		key, err := supportedPrivateKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// supportedPrivateKey checks raw is a private key the client can use.
+func supportedPrivateKey(raw interface{}) (crypto.Signer, error) {
+	switch key := raw.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < minRSAKeySize {
+			return nil, utils.ErrUnsupportedKey{Reason: fmt.Sprintf("RSA keys must be at least %d bits", minRSAKeySize)}
+		}
+		return key, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, utils.ErrUnsupportedKey{Reason: "only P-256 is supported for EC keys"}
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ed25519.PrivateKey:
+		return *key, nil
+	default:
+		return nil, utils.ErrUnsupportedKey{Reason: fmt.Sprintf("private key type %T", raw)}
+	}
+}
+
+// openSSHPrivateKeyBlock encodes an unencrypted private key in the
+// openssh-key-v1 format described in PROTOCOL.key of OpenSSH.
+func openSSHPrivateKeyBlock(key crypto.Signer) (*pem.Block, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		k.Precompute()
+		fields = ssh.Marshal(struct {
+			N, E, D, Iqmp, P, Q *big.Int
+		}{k.N, big.NewInt(int64(k.E)), k.D, k.Precomputed.Qinv, k.Primes[0], k.Primes[1]})
+	case *ecdsa.PrivateKey:
+		fields = ssh.Marshal(struct {
+			Curve string
+			Pub   []byte
+			D     *big.Int
+		}{"nistp256", elliptic.Marshal(k.Curve, k.X, k.Y), k.D})
+	case ed25519.PrivateKey:
+		fields = ssh.Marshal(struct {
+			Pub  []byte
+			Priv []byte
+		}{k.Public().(ed25519.PublicKey), k})
+	default:
+		return nil, utils.ErrUnsupportedKey{Reason: fmt.Sprintf("private key type %T", key)}
+	}
+	fields = append(fields, ssh.Marshal(struct{ Comment string }{""})...)
+
+	// the check integers let a reader tell a wrong passphrase apart
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check)
+	private := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Rest    []byte `ssh:"rest"`
+	}{checkInt, checkInt, publicKey.Type(), fields})
+	for i := 1; len(private)%openSSHBlockSize != 0; i++ {
+		private = append(private, byte(i))
+	}
+
+	envelope := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, publicKey.Marshal(), private})
+	return &pem.Block{
+		Type:  pemTypeOpenSSHPrivateKey,
+		Bytes: append([]byte(openSSHMagic), envelope...),
+	}, nil
+}
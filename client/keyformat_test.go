@@ -0,0 +1,112 @@
+package client
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyFormats(t *testing.T) {
+	formats := []KeyFormat{KeyFormatPEM, KeyFormatPKCS8, KeyFormatJWK, KeyFormatOpenSSH}
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeP256, KeyTypeEd25519} {
+		key, err := generateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range formats {
+			t.Run(string(keyType)+"/"+string(format), func(t *testing.T) {
+				private, err := MarshalPrivateKey(key, format)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := ParsePrivateKey(private, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(key.Public(), parsed.Public()) {
+					t.Error("parsed key differs from the exported key")
+				}
+
+				// the key file is read in any format
+				keyPath := filepath.Join(t.TempDir(), "key")
+				if err := ioutil.WriteFile(keyPath, private, 0600); err != nil {
+					t.Fatal(err)
+				}
+				keys, _, _, err := loadKeys(keyPath, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(key.Public(), keys[0].Public()) {
+					t.Error("key file holds a different key")
+				}
+
+				if _, err := MarshalPublicKey(key, format); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+
+		// OpenSSH reads the exported key pair
+		private, err := MarshalPrivateKey(key, KeyFormatOpenSSH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.ParsePrivateKey(private)
+		if err != nil {
+			t.Fatalf("ssh could not parse %s key: %s", keyType, err)
+		}
+		public, err := MarshalPublicKey(key, KeyFormatOpenSSH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorized, _, _, _, err := ssh.ParseAuthorizedKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(signer.PublicKey().Marshal(), authorized.Marshal()) {
+			t.Errorf("authorized key does not match the %s private key", keyType)
+		}
+	}
+}
+
+func TestParsePrivateKeyUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Garbage", []byte("not a key")},
+		{"PublicKey", func() []byte {
+			key, err := generateKey(KeyTypeP256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			public, err := MarshalPublicKey(key, KeyFormatPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return public
+		}()},
+		{"PublicJWK", func() []byte {
+			key, err := generateKey(KeyTypeEd25519)
+			if err != nil {
+				t.Fatal(err)
+			}
+			public, err := MarshalPublicKey(key, KeyFormatJWK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return public
+		}()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := ParsePrivateKey(test.data, nil)
+			if err == nil {
+				t.Errorf("parsed %T from %s", key, test.name)
+			}
+		})
+	}
+}
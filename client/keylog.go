@@ -0,0 +1,199 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixKeyLog = ".keylog"
+)
+
+// ErrKeyLogProofMissing is returned when keys come without a key transparency
+// log proof from a server the client has already seen a log from.
+var ErrKeyLogProofMissing = errors.New("keys are not proven to be in the key transparency log")
+
+// ErrKeyLog is returned when the key transparency log does not back the keys
+// handed out by the server, or contradicts a tree head seen earlier.
+type ErrKeyLog struct {
+	Reason string
+}
+
+func (err ErrKeyLog) Error() string {
+	return fmt.Sprintf("key transparency log check failed: %s", err.Reason)
+}
+
+// keyLogState is what the client remembers of the key transparency log: the
+// key of the log, pinned the first time it is fetched, and the largest tree
+// head seen so far.
+type keyLogState struct {
+	PublicKey json.RawMessage
+	TreeHead  *types.SignedTreeHead
+}
+
+func loadKeyLogState(file stateFile) (*keyLogState, error) {
+	state := &keyLogState{}
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (state *keyLogState) save(file stateFile) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+// UpdateTreeHead fetches the current head of the key transparency log and
+// checks it is consistent with the heads seen before.
+func (cli *Client) UpdateTreeHead() (types.SignedTreeHead, error) {
+	var head types.SignedTreeHead
+	if err := cli.getJSON("/log/head", nil, &head); err != nil {
+		return head, err
+	}
+	file := cli.stateFile(suffixKeyLog)
+	state, err := loadKeyLogState(file)
+	if err != nil {
+		return head, err
+	}
+	if err := cli.checkTreeHead(state, head); err != nil {
+		return head, err
+	}
+	return head, state.save(file)
+}
+
+// verifyKeyLog checks that keys, handed out by the server for userID, are the
+// latest keys logged for them.
+func (cli *Client) verifyKeyLog(userID string, keys jwk.Set, proof *types.KeyLogProof) error {
+	file := cli.stateFile(suffixKeyLog)
+	state, err := loadKeyLogState(file)
+	if err != nil {
+		return err
+	}
+	if proof == nil {
+		if state.PublicKey != nil {
+			return ErrKeyLogProofMissing
+		}
+		// the server does not run a log
+		return nil
+	}
+
+	var entry types.KeyLogEntry
+	if err := json.Unmarshal(proof.Entry, &entry); err != nil {
+		return ErrKeyLog{Reason: "malformed log entry"}
+	}
+	if entry.UserID != userID {
+		return ErrKeyLog{Reason: fmt.Sprintf("log entry is for %s not %s", entry.UserID, userID)}
+	}
+	loggedKeys, err := utils.LoggedKeys(keys)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(entry.Keys, loggedKeys) {
+		return ErrKeyLog{Reason: fmt.Sprintf("keys of %s differ from the ones logged", userID)}
+	}
+	if err := cli.checkTreeHead(state, proof.TreeHead); err != nil {
+		return err
+	}
+	leafHash := utils.MerkleLeafHash(proof.Entry)
+	if err := utils.VerifyMerkleInclusion(leafHash, proof.Index, proof.TreeHead.Size, proof.AuditPath, proof.TreeHead.RootHash); err != nil {
+		return ErrKeyLog{Reason: err.Error()}
+	}
+	return state.save(file)
+}
+
+// checkTreeHead verifies the signature of head and that it is consistent with
+// the largest head seen so far, which it replaces when larger.
+func (cli *Client) checkTreeHead(state *keyLogState, head types.SignedTreeHead) error {
+	if state.PublicKey == nil {
+		var key json.RawMessage
+		if err := cli.getJSON("/log/key", nil, &key); err != nil {
+			return err
+		}
+		state.PublicKey = key
+	}
+	logKey, err := jwk.ParseKey(state.PublicKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := utils.MakePublicKeyFromJWK(logKey)
+	if err != nil {
+		return err
+	}
+	if err := utils.Verify(publicKey, types.TreeHeadBytes(head), head.Signature); err != nil {
+		return ErrKeyLog{Reason: "tree head signature is not valid"}
+	}
+
+	seen := state.TreeHead
+	if seen == nil {
+		state.TreeHead = &head
+		return nil
+	}
+	// a head older than the one seen must still be a prefix of it
+	older, newer := *seen, head
+	if head.Size < seen.Size {
+		older, newer = head, *seen
+	}
+	if older.Size != newer.Size {
+		var consistency types.KeyLogConsistency
+		query := map[string]string{
+			"first":  strconv.FormatUint(older.Size, 10),
+			"second": strconv.FormatUint(newer.Size, 10),
+		}
+		if err := cli.getJSON("/log/consistency", query, &consistency); err != nil {
+			return err
+		}
+		if err := utils.VerifyMerkleConsistency(older.Size, newer.Size, older.RootHash, newer.RootHash, consistency.Proof); err != nil {
+			return ErrKeyLog{Reason: fmt.Sprintf("tree heads of size %d and %d are not consistent", older.Size, newer.Size)}
+		}
+	} else if err := utils.VerifyMerkleConsistency(older.Size, newer.Size, older.RootHash, newer.RootHash, nil); err != nil {
+		return ErrKeyLog{Reason: fmt.Sprintf("two tree heads of size %d differ", head.Size)}
+	}
+	if head.Size > seen.Size {
+		state.TreeHead = &head
+	}
+	return nil
+}
+
+// getJSON makes a GET request to path and decodes the JSON response into
+// value.
+func (cli *Client) getJSON(path string, params map[string]string, value interface{}) error {
+	request, err := cli.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	query := request.URL.Query()
+	for name, param := range params {
+		query.Add(name, param)
+	}
+	request.URL.RawQuery = query.Encode()
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("client.getJSON " + path + " status of " + response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// ErrKeyRejected is returned when the server refuses to register keys, with
+// the reason it gave, such as keys its key policy does not accept.
+type ErrKeyRejected struct {
+	Status int
+	Reason string
+}
+
+func (err ErrKeyRejected) Error() string {
+	return fmt.Sprintf("server refused the keys with status %d: %s", err.Status, err.Reason)
+}
+
+// proveKeyPossession answers a challenge from the server by signing it with
+// each signing key in keys, all of which belong to the client's private key.
+// It returns nil when the server does not ask for proof.
+func (cli *Client) proveKeyPossession(keys jwk.Set) (*types.KeyPossessionProof, error) {
+	request, err := cli.newRequest(http.MethodPost, "/pubkey/challenge", nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("client.proveKeyPossession status of " + response.Status)
+	}
+	var challenge types.KeyChallenge
+	if err := json.NewDecoder(response.Body).Decode(&challenge); err != nil {
+		return nil, err
+	}
+
+	deviceID := cli.DeviceID
+	if deviceID == "" {
+		deviceID = types.DefaultDeviceID
+	}
+	proof := types.KeyPossessionProof{Nonce: challenge.Nonce, Signatures: make(map[string][]byte)}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if key.KeyUsage() != utils.UseSignature {
+			continue
+		}
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := utils.Sign(cli.PrivateKey, types.KeyPossessionBytes(cli.Principal.Username, deviceID, challenge.Nonce, thumbprint))
+		if err != nil {
+			return nil, err
+		}
+		proof.Signatures[key.KeyID()] = signature
+	}
+	return &proof, nil
+}
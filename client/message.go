@@ -1,35 +1,357 @@
 package client
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	cryptorand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 
+	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
 )
 
-type ClientMessage types.Message
+const (
+	sizeContentKey = 32 // AES-256
+	// fieldAttachment ends the associated data of messages carrying an
+	// attachment, so text cannot be passed off as one or the other way
+	// round.
+	fieldAttachment = "attachment"
+	// fieldGroup precedes the group of a group message in its associated
+	// data, so a copy cannot be moved into another conversation.
+	fieldGroup = "group"
+)
+
+var (
+	ErrMalformedEnvelope = errors.New("encrypted content is not a valid envelope")
+	ErrSessionEnvelope   = errors.New("content was encrypted with a session and cannot be decrypted with the private key")
+)
+
+// ClientMessage is a message as seen by the client. Verification and
+// KeyChanged are local state filled in when messages are retrieved and are
+// never sent to the server. KeyChanged is set on messages from a contact
+// whose keys differ from the pinned keys or from the keys they were verified
+// with. SealedID is the ID of the sealed message a message arrived in.
+type ClientMessage struct {
+	types.Message
+	Verification Verification    `json:"-"`
+	KeyChanged   bool            `json:"-"`
+	Err          error           `json:"-"`
+	SealedID     types.MessageID `json:"-"`
+}
+
+// ErrTamperedEnvelope is returned when encrypted content does not
+// authenticate against the metadata of the message carrying it, either
+// because To, From, TimeSent, ID, FromDevice, Nonce, Sequence, the group or
+// the envelope version and algorithm were changed or because the content was lifted from
+// another message.
+type ErrTamperedEnvelope struct {
+	ID types.MessageID
+}
+
+func (err ErrTamperedEnvelope) Error() string {
+	return fmt.Sprintf("message %s failed authentication, its metadata or content was altered", err.ID)
+}
+
+// ErrUnknownKeyID is returned for messages encrypted to a key the client does
+// not hold, such as a key rotated away on another machine.
+type ErrUnknownKeyID struct {
+	KeyID string
+}
 
-func (message ClientMessage) EncryptContent(toPublicKey *rsa.PublicKey) (ClientMessage, error) {
-	encrpytedContent, err := rsa.EncryptPKCS1v15(cryptorand.Reader, toPublicKey, []byte(message.Content))
+func (err ErrUnknownKeyID) Error() string {
+	return fmt.Sprintf("message was encrypted to unknown key %s", err.KeyID)
+}
+
+// envelope is the wire form of encrypted message content. The content is
+// sealed with a fresh AES-256-GCM key per message, so content length is not
+// bound by the size of the recipient's key. For RSA recipients the key is
+// wrapped with RSA-OAEP; for P-256 and X25519 recipients it is derived with
+// ECDH-ES from the ephemeral key sent along with the content. Recipients
+// publishing a hybrid KEM key have it derived from the KEM ciphertext
+// together with that wrapped key.
+//
+// Messages sent over a ratchet session carry the ratchet header instead, and
+// the X3DH header until the recipient has replied.
+//
+// Padded is set when the plaintext was padded before encryption so its
+// length does not show; envelopes from before padding leave it unset. It is
+// not authenticated, so it is only read for legacy envelopes: the content of
+// versioned envelopes is always padded.
+type envelope struct {
+	Key          []byte         `json:"key,omitempty"`
+	EphemeralKey []byte         `json:"epk,omitempty"`
+	KEM          []byte         `json:"kem,omitempty"`
+	Nonce        []byte         `json:"nonce,omitempty"`
+	Ratchet      *ratchetHeader `json:"ratchet,omitempty"`
+	X3DH         *x3dhHeader    `json:"x3dh,omitempty"`
+	Padded       bool           `json:"pad,omitempty"`
+	Ciphertext   []byte         `json:"ciphertext"`
+}
+
+// EncryptContent encrypts the content to toPublicKey, either a raw public key
+// or a jwk.Key, padded with DefaultPadding. The kid of a jwk.Key is recorded
+// in KeyID so the recipient knows which of their keys to decrypt with, and
+// the envelope version and algorithm are picked from those it advertises.
+func (message ClientMessage) EncryptContent(toPublicKey crypto.PublicKey) (ClientMessage, error) {
+	return message.encryptContent(toPublicKey, DefaultPadding)
+}
+
+func (message ClientMessage) encryptContent(toPublicKey crypto.PublicKey, padding PaddingPolicy) (ClientMessage, error) {
+	negotiateWith := toPublicKey
+	var hybridKey []byte
+	if key, ok := toPublicKey.(jwk.Key); ok {
+		raw, err := utils.MakePublicKeyFromJWK(key)
+		if err != nil {
+			return message, err
+		}
+		if hybridKey, err = utils.JWKHybridKey(key); err != nil {
+			return message, err
+		}
+		toPublicKey = raw
+		message.KeyID = key.KeyID()
+	}
+	algorithm, err := keyAlgorithm(toPublicKey)
 	if err != nil {
 		return message, err
 	}
-	message.Content = base64.URLEncoding.EncodeToString(encrpytedContent)
+	candidates := []string{algorithm}
+	if hybridKey != nil {
+		candidates = append(candidates, types.AlgorithmHybridA256GCM)
+	}
+	if message, err = message.withAlgorithm(negotiateWith, candidates...); err != nil {
+		return message, err
+	}
+	var env envelope
+	var contentKey []byte
+	contentKey, err = env.wrapContentKey(toPublicKey)
+	if err != nil {
+		return message, err
+	}
+	if message.Algorithm == types.AlgorithmHybridA256GCM {
+		var kemKey []byte
+		if kemKey, env.KEM, err = hybridEncapsulate(hybridKey); err != nil {
+			return message, err
+		}
+		if contentKey, err = combineContentKeys(kemKey, contentKey); err != nil {
+			return message, err
+		}
+	}
+	aead, err := newContentCipher(contentKey)
+	if err != nil {
+		return message, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(cryptorand.Reader, nonce); err != nil {
+		return message, err
+	}
+
+	env.Nonce = nonce
+	env.Padded = true
+	env.Ciphertext = aead.Seal(nil, nonce, pad([]byte(message.Content), padding), message.associatedData())
+	data, err := json.Marshal(env)
+	if err != nil {
+		return message, err
+	}
+	message.Content = base64.URLEncoding.EncodeToString(data)
 	message.Encrypted = true
 	return message, nil
 }
 
-func (message ClientMessage) DecryptContent(myPrivateKey *rsa.PrivateKey) (ClientMessage, error) {
-	unencoded, err := base64.URLEncoding.DecodeString(message.Content)
+// DecryptContent decrypts content encrypted to myPrivateKey in any envelope
+// version the client reads. Legacy RSA PKCS #1 v1.5 content is refused with
+// ErrLegacyContent, see DecryptLegacyContent. Content encapsulated to a
+// hybrid KEM key is decrypted by the client holding it.
+func (message ClientMessage) DecryptContent(myPrivateKey crypto.Signer) (ClientMessage, error) {
+	return message.decryptContent(myPrivateKey, nil, time.Time{})
+}
+
+// DecryptLegacyContent decrypts content as DecryptContent does, and legacy
+// RSA PKCS #1 v1.5 content of messages sent before cutover as well. Legacy
+// content is unauthenticated, see Client.LegacyContent.
+func (message ClientMessage) DecryptLegacyContent(myPrivateKey crypto.Signer, cutover time.Time) (ClientMessage, error) {
+	return message.decryptContent(myPrivateKey, nil, cutover)
+}
+
+// decryptContent decrypts the content as DecryptContent does, decrypting
+// legacy content only of messages sent before legacyCutover.
+func (message ClientMessage) decryptContent(myPrivateKey crypto.Signer, hybrid *hybridKey, legacyCutover time.Time) (ClientMessage, error) {
+	if err := message.checkEnvelope(); err != nil {
+		return message, err
+	}
+	if message.ContentType == types.ContentTypeJWE {
+		return message.decryptContentJWE(myPrivateKey)
+	}
+	if message.Algorithm == types.AlgorithmRSAPKCS1v15 {
+		return message.decryptLegacy(myPrivateKey, legacyCutover)
+	}
+	env, err := message.envelope()
+	if err != nil {
+		// content from before the envelope is not JSON
+		if message.EnvelopeVersion == types.EnvelopeVersionLegacy {
+			return message.decryptLegacy(myPrivateKey, legacyCutover)
+		}
+		return message, ErrMalformedEnvelope
+	}
+	if env.Ratchet != nil {
+		return message, ErrSessionEnvelope
+	}
+	if message.EnvelopeVersion != types.EnvelopeVersionLegacy && env.algorithm() != message.Algorithm {
+		return message, ErrMalformedEnvelope
+	}
+
+	var contentKey []byte
+	if len(env.KEM) > 0 {
+		if hybrid == nil {
+			return message, ErrNoHybridKey
+		}
+		contentKey, err = hybrid.decapsulate(env.KEM)
+		// envelopes from before the classical wrap was mixed in carry none
+		if err == nil && (len(env.Key) > 0 || len(env.EphemeralKey) > 0) {
+			var classicalKey []byte
+			if classicalKey, err = env.unwrapContentKey(myPrivateKey); err == nil {
+				contentKey, err = combineContentKeys(contentKey, classicalKey)
+			}
+		}
+	} else {
+		contentKey, err = env.unwrapContentKey(myPrivateKey)
+	}
 	if err != nil {
 		return message, err
 	}
-	decryptedContent, err := rsa.DecryptPKCS1v15(cryptorand.Reader, myPrivateKey, unencoded)
+	aead, err := newContentCipher(contentKey)
 	if err != nil {
 		return message, err
 	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return message, ErrMalformedEnvelope
+	}
+	decryptedContent, err := aead.Open(nil, env.Nonce, env.Ciphertext, message.associatedData())
+	if err != nil {
+		return message, ErrTamperedEnvelope{ID: message.ID}
+	}
+	if message.paddedContent(env) {
+		if decryptedContent, err = unpad(decryptedContent); err != nil {
+			return message, err
+		}
+	}
 	message.Content = string(decryptedContent)
 	message.Encrypted = false
 	return message, nil
 }
+
+// paddedContent reports whether the plaintext in env was padded.
+func (message ClientMessage) paddedContent(env envelope) bool {
+	return env.Padded || message.EnvelopeVersion != types.EnvelopeVersionLegacy
+}
+
+func (message ClientMessage) envelope() (envelope, error) {
+	var env envelope
+	unencoded, err := base64.URLEncoding.DecodeString(message.Content)
+	if err != nil {
+		return env, err
+	}
+	err = json.Unmarshal(unencoded, &env)
+	return env, err
+}
+
+// wrapContentKey picks the content key for a message to toPublicKey and
+// records in the envelope what the recipient needs to recover it.
+func (env *envelope) wrapContentKey(toPublicKey crypto.PublicKey) ([]byte, error) {
+	if rsaKey, ok := toPublicKey.(*rsa.PublicKey); ok {
+		contentKey := make([]byte, sizeContentKey)
+		if _, err := io.ReadFull(cryptorand.Reader, contentKey); err != nil {
+			return nil, err
+		}
+		wrappedKey, err := rsa.EncryptOAEP(sha256.New(), cryptorand.Reader, rsaKey, contentKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		env.Key = wrappedKey
+		return contentKey, nil
+	}
+	contentKey, ephemeralPublic, err := ecdhEphemeral(toPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	env.EphemeralKey = ephemeralPublic
+	return contentKey, nil
+}
+
+func (env envelope) unwrapContentKey(myPrivateKey crypto.Signer) ([]byte, error) {
+	if rsaKey, ok := myPrivateKey.(*rsa.PrivateKey); ok {
+		if len(env.Key) == 0 {
+			return nil, ErrMalformedEnvelope
+		}
+		return rsa.DecryptOAEP(sha256.New(), cryptorand.Reader, rsaKey, env.Key, nil)
+	}
+	if len(env.EphemeralKey) == 0 {
+		return nil, ErrMalformedEnvelope
+	}
+	return ecdhStatic(myPrivateKey, env.EphemeralKey)
+}
+
+// associatedData is the canonical encoding of the message metadata. It is
+// bound to the ciphertext as AEAD associated data so the envelope cannot be
+// changed or the content moved to another message without detection. Every
+// field is length prefixed so no two distinct messages share an encoding.
+// Versioned envelopes add the version and algorithm, so a message cannot be
+// passed off as one in another envelope; legacy envelopes keep the encoding
+// they were sent with, as do messages without an attachment or group.
+// Messages carrying a nonce add the sending device, nonce and sequence;
+// messages from before replay protection carry none and are encoded without.
+func (message ClientMessage) associatedData() []byte {
+	var buffer bytes.Buffer
+	writeField(&buffer, []byte(message.ID))
+	writeField(&buffer, []byte(message.From))
+	writeField(&buffer, []byte(message.To))
+	timeSent := make([]byte, 8)
+	binary.BigEndian.PutUint64(timeSent, uint64(message.TimeSent.UnixNano()))
+	writeField(&buffer, timeSent)
+	if message.Nonce != "" {
+		writeField(&buffer, []byte(message.FromDevice))
+		writeField(&buffer, []byte(message.Nonce))
+		sequence := make([]byte, 8)
+		binary.BigEndian.PutUint64(sequence, message.Sequence)
+		writeField(&buffer, sequence)
+	}
+	if message.EnvelopeVersion != types.EnvelopeVersionLegacy {
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, uint64(message.EnvelopeVersion))
+		writeField(&buffer, version)
+		writeField(&buffer, []byte(message.Algorithm))
+	}
+	if message.Attachment {
+		writeField(&buffer, []byte(fieldAttachment))
+	}
+	if message.GroupID != "" {
+		writeField(&buffer, []byte(fieldGroup))
+		writeField(&buffer, []byte(message.GroupID))
+	}
+	return buffer.Bytes()
+}
+
+func writeField(buffer *bytes.Buffer, field []byte) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(field)))
+	buffer.Write(length)
+	buffer.Write(field)
+}
+
+func newContentCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
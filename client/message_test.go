@@ -0,0 +1,242 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestEncryptDecryptContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"Empty", ""},
+		{"Short", "Hello!"},
+		// longer than a single RSA-2048 block can hold
+		{"Long", strings.Repeat("the quick brown fox ", 1000)},
+	}
+
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeP256, KeyTypeEd25519} {
+		privKey, err := generateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey := testPublicKeyForUse(t, privKey, utils.UseEncryption)
+
+		for _, test := range tests {
+			t.Run(string(keyType)+"-"+test.name, func(t *testing.T) {
+				message := MakeClientMessage("ROOT", "MEP", test.content)
+				encrypted, err := message.EncryptContent(pubKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !encrypted.Encrypted {
+					t.Error("encrypted message is not marked encrypted")
+				}
+				if len(test.content) > 0 && strings.Contains(encrypted.Content, test.content) {
+					t.Error("encrypted content contains the plaintext")
+				}
+
+				decrypted, err := encrypted.DecryptContent(privKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decrypted.Content != test.content {
+					t.Errorf("decrypted content does not match, got %d bytes expected %d", len(decrypted.Content), len(test.content))
+				}
+				if decrypted.Encrypted {
+					t.Error("decrypted message is still marked encrypted")
+				}
+			})
+		}
+	}
+}
+
+// testPublicKeyForUse returns the key other users would fetch from the
+// server for use.
+func testPublicKeyForUse(t *testing.T, privKey crypto.Signer, use string) crypto.PublicKey {
+	keys, err := utils.MakeJWKSetFromPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := publicKeyForUse("", keys, use)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubKey
+}
+
+func TestDecryptContentWrongKey(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := MakeClientMessage("ROOT", "MEP", "secret").EncryptContent(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.DecryptContent(otherKey); err == nil {
+		t.Error("expected decryption with the wrong key to fail")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeP256, KeyTypeEd25519} {
+		privKey, err := generateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKey, err := generateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey := testPublicKeyForUse(t, privKey, utils.UseSignature)
+		signed, err := MakeClientMessage("ROOT", "MEP", "Hello!").Sign(privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tamperedFrom := signed
+		tamperedFrom.From = "ROOT"
+		tamperedContent := signed
+		tamperedContent.Content = "Goodbye!"
+		unsigned := signed
+		unsigned.Signature = ""
+
+		tests := []struct {
+			name     string
+			message  ClientMessage
+			key      crypto.PublicKey
+			expected Verification
+		}{
+			{"Verified", signed, pubKey, Verified},
+			{"WrongKey", signed, otherKey.Public(), Forged},
+			{"TamperedFrom", tamperedFrom, pubKey, Forged},
+			{"TamperedContent", tamperedContent, pubKey, Forged},
+			{"Unsigned", unsigned, pubKey, Unverified},
+			{"NoKey", signed, nil, Unverified},
+		}
+
+		for _, test := range tests {
+			t.Run(string(keyType)+"-"+test.name, func(t *testing.T) {
+				if actual := test.message.Verify(test.key); actual != test.expected {
+					t.Errorf("expected %s actual %s", test.expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestDecryptContentTamperedMetadata(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := MakeClientMessage("ROOT", "MEP", "secret").EncryptContent(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := MakeClientMessage("ROOT", "MEP", "other").EncryptContent(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(message *ClientMessage)
+	}{
+		{"To", func(message *ClientMessage) { message.To = "EVE" }},
+		{"From", func(message *ClientMessage) { message.From = "EVE" }},
+		{"TimeSent", func(message *ClientMessage) { message.TimeSent = message.TimeSent.Add(time.Hour) }},
+		{"ID", func(message *ClientMessage) { message.ID = "1" }},
+		{"MovedContent", func(message *ClientMessage) { message.Content = other.Content }},
+		{"Attachment", func(message *ClientMessage) { message.Attachment = true }},
+		{"GroupID", func(message *ClientMessage) { message.GroupID = "group" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := encrypted
+			test.tamper(&message)
+			_, err := message.DecryptContent(privKey)
+			if _, ok := err.(ErrTamperedEnvelope); !ok {
+				t.Errorf("expected ErrTamperedEnvelope actual %v", err)
+			}
+		})
+	}
+}
+
+// TestVerifyDecryptBeforeReplayProtection reads a message as clients sent it
+// before nonces and sequences, its associated data covering only the ID,
+// From, To and TimeSent.
+func TestVerifyDecryptBeforeReplayProtection(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, sizeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := MakeClientMessage("ROOT", "MEP", "")
+	message.FromDevice = "laptop"
+	var associatedData bytes.Buffer
+	writeField(&associatedData, []byte(message.ID))
+	writeField(&associatedData, []byte(message.From))
+	writeField(&associatedData, []byte(message.To))
+	timeSent := make([]byte, 8)
+	binary.BigEndian.PutUint64(timeSent, uint64(message.TimeSent.UnixNano()))
+	writeField(&associatedData, timeSent)
+
+	var env envelope
+	contentKey, err := env.wrapContentKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newContentCipher(contentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		t.Fatal(err)
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, []byte("Hello!"), associatedData.Bytes())
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Content = base64.URLEncoding.EncodeToString(data)
+	message.Encrypted = true
+
+	var signed bytes.Buffer
+	signed.Write(associatedData.Bytes())
+	writeField(&signed, []byte(message.Content))
+	signature, err := utils.Sign(privKey, signed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Signature = base64.URLEncoding.EncodeToString(signature)
+
+	if verification := message.Verify(&privKey.PublicKey); verification != Verified {
+		t.Errorf("expected %s actual %s", Verified, verification)
+	}
+	decrypted, err := message.DecryptContent(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Content != "Hello!" {
+		t.Errorf("expected %q actual %q", "Hello!", decrypted.Content)
+	}
+}
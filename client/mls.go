@@ -0,0 +1,688 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixMLS = ".mls"
+	// KeyPackageLifetime is how long a published KeyPackage can be used to
+	// add the client to a group.
+	KeyPackageLifetime   = 30 * 24 * time.Hour
+	maxMLSCommitAttempts = 3
+)
+
+var ErrUnknownMLSGroup = errors.New("client is not a member of the MLS group")
+
+// ErrMLSStalled is returned when sending to a group the client can no longer
+// follow: a commit it could not process moved the group on without it. The
+// client reads nothing sent after until it is welcomed to the group again.
+var ErrMLSStalled = errors.New("MLS group moved on with a commit the client could not process")
+
+// ErrMLSKeysUnavailable is returned when the keys the credentials of a commit
+// are checked against cannot be fetched. The commit is not skipped, it is
+// processed again on the next sync.
+type ErrMLSKeysUnavailable struct {
+	Err error
+}
+
+func (err ErrMLSKeysUnavailable) Error() string {
+	return fmt.Sprintf("keys to check MLS credentials against are unavailable: %s", err.Err)
+}
+
+func (err ErrMLSKeysUnavailable) Unwrap() error {
+	return err.Err
+}
+
+// mlsKeyPackageSecrets are the private keys of a published KeyPackage, kept
+// until a welcome for it arrives.
+type mlsKeyPackageSecrets struct {
+	KeyPackage    types.MLSKeyPackage
+	InitKey       []byte
+	EncryptionKey []byte
+}
+
+// mlsHistoryMessage is an application message of a group as it was read.
+// Message keys are deleted once used, so the plaintext is kept instead.
+type mlsHistoryMessage struct {
+	Seq        uint64
+	From       string
+	FromDevice string
+	Received   time.Time
+	Content    string `json:",omitempty"`
+	Err        string `json:",omitempty"`
+}
+
+// mlsSkippedCommit is a commit of a group the client did not apply, because
+// it could not be processed or came after one that could not.
+type mlsSkippedCommit struct {
+	Seq    uint64
+	Epoch  uint64
+	Sender string
+	Err    string
+}
+
+// mlsGroupState is the client's view of a group: the epoch it is in, the
+// epoch its own commit starts once the delivery service orders it, and the
+// messages read so far.
+type mlsGroupState struct {
+	Group      *mlsGroup
+	Pending    *mlsGroup `json:",omitempty"`
+	PendingSeq uint64    `json:",omitempty"`
+	// Outbox holds what the client sent by the sequence number the delivery
+	// service gave it, as the client cannot decrypt its own messages.
+	Outbox  map[uint64]string
+	History []mlsHistoryMessage
+	Skipped []mlsSkippedCommit `json:",omitempty"`
+	// Stalled is set once a commit was skipped. The delivery service moved
+	// the group on with it and takes no other commit for the epoch, so the
+	// client sends nothing more to the group.
+	Stalled bool `json:",omitempty"`
+	LastSeq uint64
+	Removed bool
+}
+
+// mlsState holds the client's MLS signature key, the secrets of its
+// KeyPackages by KeyPackageRef and its groups. It is saved next to the
+// private key file.
+type mlsState struct {
+	SignatureKey []byte
+	KeyPackages  map[string]mlsKeyPackageSecrets
+	Groups       map[string]*mlsGroupState
+}
+
+func loadMLSState(file stateFile) (*mlsState, error) {
+	state := &mlsState{
+		KeyPackages: make(map[string]mlsKeyPackageSecrets),
+		Groups:      make(map[string]*mlsGroupState),
+	}
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (state *mlsState) save(file stateFile) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+// signatureKey returns the seed of the MLS signature key, generating it on
+// first use.
+func (state *mlsState) signatureKey() ([]byte, error) {
+	if state.SignatureKey == nil {
+		seed, err := mlsRandom(ed25519.SeedSize)
+		if err != nil {
+			return nil, err
+		}
+		state.SignatureKey = seed
+	}
+	return state.SignatureKey, nil
+}
+
+// mlsCredential vouches for the MLS signature key with the client's signing
+// key.
+func (cli *Client) mlsCredential(seed []byte) (types.MLSCredential, error) {
+	signatureKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	signature, err := utils.Sign(cli.PrivateKey, types.MLSCredentialBytes(cli.Principal.Username, cli.DeviceID, signatureKey))
+	if err != nil {
+		return types.MLSCredential{}, err
+	}
+	return types.MLSCredential{UserID: cli.Principal.Username, DeviceID: cli.DeviceID, Signature: signature}, nil
+}
+
+// mlsCredentialCheck verifies credentials against the signing keys the
+// devices registered, fetching each once.
+func (cli *Client) mlsCredentialCheck() mlsCredentialCheck {
+	keys := make(map[types.MLSDevice]crypto.PublicKey)
+	return func(leaf types.MLSLeafNode) error {
+		device := types.MLSDevice{UserID: leaf.Credential.UserID, DeviceID: leaf.Credential.DeviceID}
+		key, ok := keys[device]
+		if !ok {
+			deviceKeys, err := cli.fetchPinnedKeys(device.UserID)
+			if err != nil {
+				return ErrMLSKeysUnavailable{Err: err}
+			}
+			if key, err = deviceSigningKey(device.UserID, deviceKeys, device.DeviceID); err != nil {
+				return err
+			}
+			keys[device] = key
+		}
+		signed := types.MLSCredentialBytes(device.UserID, device.DeviceID, leaf.SignatureKey)
+		if err := utils.Verify(key, signed, leaf.Credential.Signature); err != nil {
+			return fmt.Errorf("MLS credential of %s: %w", device.UserID, err)
+		}
+		return nil
+	}
+}
+
+// PublishKeyPackages publishes count new KeyPackages so the client can be
+// added to MLS groups while offline. KeyPackages that expired unused are
+// forgotten.
+func (cli *Client) PublishKeyPackages(count int) error {
+	file := cli.stateFile(suffixMLS)
+	state, err := loadMLSState(file)
+	if err != nil {
+		return err
+	}
+	seed, err := state.signatureKey()
+	if err != nil {
+		return err
+	}
+	credential, err := cli.mlsCredential(seed)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for ref, secrets := range state.KeyPackages {
+		if now.After(secrets.KeyPackage.LeafNode.Lifetime.NotAfter) {
+			delete(state.KeyPackages, ref)
+		}
+	}
+	lifetime := types.MLSLifetime{NotBefore: now.Add(-time.Hour).Truncate(time.Second), NotAfter: now.Add(KeyPackageLifetime).Truncate(time.Second)}
+	keyPackages := make([]types.MLSKeyPackage, 0, count)
+	for i := 0; i < count; i++ {
+		keyPackage, initKey, encryptionKey, err := newMLSKeyPackage(seed, credential, lifetime)
+		if err != nil {
+			return err
+		}
+		ref := base64.RawURLEncoding.EncodeToString(mlsKeyPackageRef(keyPackage))
+		state.KeyPackages[ref] = mlsKeyPackageSecrets{KeyPackage: keyPackage, InitKey: initKey, EncryptionKey: encryptionKey}
+		keyPackages = append(keyPackages, keyPackage)
+	}
+
+	request, err := cli.newRequest(http.MethodPost, "/mls/keypackages", keyPackages)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return errors.New("client.PublishKeyPackages status of " + response.Status)
+	}
+	return state.save(file)
+}
+
+// TopUpKeyPackages publishes count more KeyPackages when fewer than minimum
+// are left on the server.
+func (cli *Client) TopUpKeyPackages(minimum int, count int) error {
+	var remaining types.KeyPackageCount
+	if err := cli.getJSON("/mls/keypackages", nil, &remaining); err != nil {
+		return err
+	}
+	if remaining.KeyPackages >= minimum {
+		return nil
+	}
+	return cli.PublishKeyPackages(count)
+}
+
+// fetchKeyPackage takes a KeyPackage of a device from the server and checks
+// that it is valid and vouched for by the device.
+func (cli *Client) fetchKeyPackage(userID string, deviceID string, check mlsCredentialCheck) (types.MLSKeyPackage, error) {
+	var keyPackage types.MLSKeyPackage
+	if err := cli.getJSON("/mls/keypackage", map[string]string{"userID": userID, "deviceID": deviceID}, &keyPackage); err != nil {
+		return types.MLSKeyPackage{}, err
+	}
+	credential := keyPackage.LeafNode.Credential
+	if credential.UserID != userID || credential.DeviceID != deviceID {
+		return types.MLSKeyPackage{}, fmt.Errorf("KeyPackage for %s is for device %s of %s", userID, credential.DeviceID, credential.UserID)
+	}
+	if err := validateMLSKeyPackage(keyPackage, check, time.Now()); err != nil {
+		return types.MLSKeyPackage{}, fmt.Errorf("KeyPackage for %s: %w", userID, err)
+	}
+	return keyPackage, nil
+}
+
+// CreateMLSGroup starts an MLS group for the server group groupID with the
+// client as its only member. Others are added with AddMLSMembers.
+func (cli *Client) CreateMLSGroup(groupID string) error {
+	file := cli.stateFile(suffixMLS)
+	state, err := loadMLSState(file)
+	if err != nil {
+		return err
+	}
+	if existing, ok := state.Groups[groupID]; ok && !existing.Removed {
+		return fmt.Errorf("already a member of MLS group %s", groupID)
+	}
+	seed, err := state.signatureKey()
+	if err != nil {
+		return err
+	}
+	credential, err := cli.mlsCredential(seed)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	keyPackage, _, encryptionKey, err := newMLSKeyPackage(seed, credential, types.MLSLifetime{NotBefore: now, NotAfter: now.Add(KeyPackageLifetime)})
+	if err != nil {
+		return err
+	}
+	group, err := newMLSGroup(groupID, seed, keyPackage.LeafNode, encryptionKey)
+	if err != nil {
+		return err
+	}
+	state.Groups[groupID] = &mlsGroupState{Group: group, Outbox: make(map[uint64]string)}
+	return state.save(file)
+}
+
+// AddMLSMembers adds every device of the users to the MLS group, taking a
+// KeyPackage of each from the server. Devices already in the group and
+// devices without KeyPackages left are skipped. The users must be members of
+// the server group.
+func (cli *Client) AddMLSMembers(groupID string, userIDs ...string) error {
+	check := cli.mlsCredentialCheck()
+	return cli.commitMLS(groupID, func(group *mlsGroup) ([]uint32, []types.MLSKeyPackage, []types.MLSDevice, error) {
+		present := make(map[types.MLSDevice]bool)
+		for _, leaf := range group.members() {
+			present[types.MLSDevice{UserID: leaf.Credential.UserID, DeviceID: leaf.Credential.DeviceID}] = true
+		}
+		adds := make([]types.MLSKeyPackage, 0)
+		welcomeTo := make([]types.MLSDevice, 0)
+		for _, userID := range userIDs {
+			devices, err := cli.FetchDevices(userID)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, device := range devices {
+				member := types.MLSDevice{UserID: userID, DeviceID: device.ID}
+				if present[member] {
+					continue
+				}
+				keyPackage, err := cli.fetchKeyPackage(userID, device.ID, check)
+				if err != nil {
+					utils.LogWarn(fmt.Sprintf("not adding device %s of %s to MLS group %s: %s", device.ID, userID, groupID, err))
+					continue
+				}
+				present[member] = true
+				adds = append(adds, keyPackage)
+				welcomeTo = append(welcomeTo, member)
+			}
+		}
+		if len(adds) == 0 {
+			return nil, nil, nil, errMLSNothingToCommit
+		}
+		return nil, adds, welcomeTo, nil
+	})
+}
+
+// RemoveMLSMembers removes every device of the users from the MLS group.
+// They can read nothing sent to it after.
+func (cli *Client) RemoveMLSMembers(groupID string, userIDs ...string) error {
+	return cli.commitMLS(groupID, func(group *mlsGroup) ([]uint32, []types.MLSKeyPackage, []types.MLSDevice, error) {
+		removes := make([]uint32, 0)
+		for index, leaf := range group.members() {
+			for _, userID := range userIDs {
+				if leaf.Credential.UserID == userID && index != group.LeafIndex {
+					removes = append(removes, index)
+				}
+			}
+		}
+		if len(removes) == 0 {
+			return nil, nil, nil, errMLSNothingToCommit
+		}
+		return removes, nil, nil, nil
+	})
+}
+
+// UpdateMLSKeys replaces the client's keys in the MLS group, so that a
+// compromise of the keys it held before reveals nothing sent after.
+func (cli *Client) UpdateMLSKeys(groupID string) error {
+	return cli.commitMLS(groupID, func(group *mlsGroup) ([]uint32, []types.MLSKeyPackage, []types.MLSDevice, error) {
+		return nil, nil, nil, nil
+	})
+}
+
+// commitMLS commits the proposals propose returns for the current epoch of
+// the group, none when it returns errMLSNothingToCommit. When another
+// member's commit is ordered first the group is synced and the commit made
+// again.
+func (cli *Client) commitMLS(groupID string, propose func(group *mlsGroup) ([]uint32, []types.MLSKeyPackage, []types.MLSDevice, error)) error {
+	file := cli.stateFile(suffixMLS)
+	for attempt := 1; ; attempt++ {
+		state, err := loadMLSState(file)
+		if err != nil {
+			return err
+		}
+		groupState, err := cli.syncMLSGroup(state, groupID)
+		if saveErr := state.save(file); err == nil {
+			err = saveErr
+		}
+		if err != nil {
+			return err
+		}
+		if groupState.Removed {
+			return ErrMLSRemoved
+		}
+		if groupState.Stalled {
+			return ErrMLSStalled
+		}
+		removes, adds, welcomeTo, err := propose(groupState.Group)
+		if err == errMLSNothingToCommit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		next, message, welcome, err := groupState.Group.commit(removes, adds)
+		if err != nil {
+			return err
+		}
+		post := types.MLSPost{Message: types.MLSMessage{GroupID: groupID, Epoch: groupState.Group.Epoch, Handshake: true}}
+		if post.Message.Message, err = json.Marshal(message); err != nil {
+			return err
+		}
+		if welcome != nil {
+			if post.Welcome, err = json.Marshal(welcome); err != nil {
+				return err
+			}
+			post.WelcomeTo = welcomeTo
+		}
+		posted, err := cli.postMLSMessage(post)
+		if err == errMLSEpochConflict && attempt < maxMLSCommitAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		groupState.Pending = next
+		groupState.PendingSeq = posted.Seq
+		_, err = cli.syncMLSGroup(state, groupID)
+		if saveErr := state.save(file); err == nil {
+			err = saveErr
+		}
+		return err
+	}
+}
+
+var (
+	errMLSEpochConflict   = errors.New("the MLS group moved on to another epoch")
+	errMLSNothingToCommit = errors.New("nothing to commit to the MLS group")
+)
+
+// postMLSMessage posts to the delivery service of the group, returning the
+// message as it was ordered.
+func (cli *Client) postMLSMessage(post types.MLSPost) (types.MLSMessage, error) {
+	request, err := cli.newRequest(http.MethodPost, "/mls/messages", post)
+	if err != nil {
+		return types.MLSMessage{}, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return types.MLSMessage{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusConflict {
+		return types.MLSMessage{}, errMLSEpochConflict
+	}
+	if response.StatusCode != http.StatusCreated {
+		return types.MLSMessage{}, errors.New("client.postMLSMessage status of " + response.Status)
+	}
+	var posted types.MLSMessage
+	if err := json.NewDecoder(response.Body).Decode(&posted); err != nil {
+		return types.MLSMessage{}, err
+	}
+	return posted, nil
+}
+
+// SendMLSMessage encrypts content to the MLS group in its current epoch.
+func (cli *Client) SendMLSMessage(groupID string, content string) error {
+	file := cli.stateFile(suffixMLS)
+	for attempt := 1; ; attempt++ {
+		state, err := loadMLSState(file)
+		if err != nil {
+			return err
+		}
+		groupState, err := cli.syncMLSGroup(state, groupID)
+		if err == nil && groupState.Removed {
+			err = ErrMLSRemoved
+		}
+		if err == nil && groupState.Stalled {
+			err = ErrMLSStalled
+		}
+		var message mlsPrivateMessage
+		if err == nil {
+			message, err = groupState.Group.encrypt([]byte(content), cli.padding())
+		}
+		// the message key is used up whether or not the message is sent
+		if saveErr := state.save(file); err == nil {
+			err = saveErr
+		}
+		if err != nil {
+			return err
+		}
+		post := types.MLSPost{Message: types.MLSMessage{GroupID: groupID, Epoch: message.Epoch}}
+		if post.Message.Message, err = json.Marshal(message); err != nil {
+			return err
+		}
+		utils.LogInfo("sending MLS message")
+		posted, err := cli.postMLSMessage(post)
+		if err == errMLSEpochConflict && attempt < maxMLSCommitAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		groupState.Outbox[posted.Seq] = content
+		return state.save(file)
+	}
+}
+
+// GetMLSMessages joins the MLS groups the client was welcomed to, then
+// returns the messages of the group read so far, processing the commits and
+// messages the delivery service ordered since the last call.
+func (cli *Client) GetMLSMessages(groupID string) ([]ClientMessage, error) {
+	if _, err := cli.AcceptMLSWelcomes(); err != nil {
+		return nil, err
+	}
+	file := cli.stateFile(suffixMLS)
+	state, err := loadMLSState(file)
+	if err != nil {
+		return nil, err
+	}
+	groupState, err := cli.syncMLSGroup(state, groupID)
+	if saveErr := state.save(file); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]ClientMessage, 0, len(groupState.History))
+	for _, entry := range groupState.History {
+		message := ClientMessage{Message: types.Message{
+			From:       entry.From,
+			To:         cli.Principal.Username,
+			TimeSent:   entry.Received,
+			Content:    entry.Content,
+			FromDevice: entry.FromDevice,
+			GroupID:    groupID,
+		}}
+		if entry.Err != "" {
+			message.Err = errors.New(entry.Err)
+		} else {
+			// the sender's leaf signed the message and their device vouched
+			// for the leaf
+			message.Verification = Verified
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// AcceptMLSWelcomes joins the groups the client's device was added to,
+// returning their IDs. Welcomes that cannot be used are logged and dropped.
+func (cli *Client) AcceptMLSWelcomes() ([]string, error) {
+	var welcomes []types.MLSWelcome
+	if err := cli.getJSON("/mls/welcomes", nil, &welcomes); err != nil {
+		return nil, err
+	}
+	if len(welcomes) == 0 {
+		return nil, nil
+	}
+	file := cli.stateFile(suffixMLS)
+	state, err := loadMLSState(file)
+	if err != nil {
+		return nil, err
+	}
+	check := cli.mlsCredentialCheck()
+	joined := make([]string, 0)
+	for _, received := range welcomes {
+		group, err := cli.joinMLSWelcome(state, received, check)
+		if err != nil {
+			utils.LogWarn(fmt.Sprintf("unable to join MLS group %s: %s", received.GroupID, err))
+			continue
+		}
+		state.Groups[received.GroupID] = &mlsGroupState{Group: group, Outbox: make(map[uint64]string), LastSeq: received.Seq}
+		joined = append(joined, received.GroupID)
+	}
+	return joined, state.save(file)
+}
+
+func (cli *Client) joinMLSWelcome(state *mlsState, received types.MLSWelcome, check mlsCredentialCheck) (*mlsGroup, error) {
+	var welcome mlsWelcome
+	if err := json.Unmarshal(received.Welcome, &welcome); err != nil {
+		return nil, ErrMLSMalformed
+	}
+	for _, secrets := range welcome.Secrets {
+		ref := base64.RawURLEncoding.EncodeToString(secrets.NewMember)
+		keyPackage, ok := state.KeyPackages[ref]
+		if !ok {
+			continue
+		}
+		group, err := joinMLSGroup(welcome, secrets.NewMember, keyPackage.KeyPackage, keyPackage.InitKey, keyPackage.EncryptionKey, state.SignatureKey, check)
+		if err != nil {
+			return nil, err
+		}
+		if group.GroupID != received.GroupID {
+			return nil, ErrMLSMalformed
+		}
+		delete(state.KeyPackages, ref)
+		return group, nil
+	}
+	return nil, ErrMLSNotWelcomed
+}
+
+// syncMLSGroup processes the messages the delivery service ordered after the
+// last one the client saw. Commits move the group to their epoch; the
+// client's own is taken from Pending rather than processed. A commit that
+// cannot be processed is recorded in Skipped and stalls the group, which
+// stays in its epoch, so one bad commit does not stop the client reading
+// what it still can.
+func (cli *Client) syncMLSGroup(state *mlsState, groupID string) (*mlsGroupState, error) {
+	groupState, ok := state.Groups[groupID]
+	if !ok {
+		return nil, ErrUnknownMLSGroup
+	}
+	if groupState.Removed {
+		return groupState, nil
+	}
+	var messages []types.MLSMessage
+	params := map[string]string{"groupID": groupID, "after": strconv.FormatUint(groupState.LastSeq, 10)}
+	if err := cli.getJSON("/mls/messages", params, &messages); err != nil {
+		return groupState, err
+	}
+	check := cli.mlsCredentialCheck()
+	for _, message := range messages {
+		if message.Handshake {
+			err := groupState.processCommit(message, check)
+			var unavailable ErrMLSKeysUnavailable
+			if errors.As(err, &unavailable) {
+				return groupState, err
+			}
+			if err != nil {
+				utils.LogWarn(fmt.Sprintf("skipping %s", err))
+				groupState.Skipped = append(groupState.Skipped, mlsSkippedCommit{Seq: message.Seq, Epoch: message.Epoch, Sender: message.Sender, Err: err.Error()})
+				groupState.Stalled = true
+			}
+			groupState.LastSeq = message.Seq
+			if groupState.Removed {
+				break
+			}
+			continue
+		}
+		groupState.History = append(groupState.History, groupState.processApplication(message))
+		groupState.LastSeq = message.Seq
+	}
+	return groupState, nil
+}
+
+func (groupState *mlsGroupState) processCommit(message types.MLSMessage, check mlsCredentialCheck) error {
+	if groupState.Pending != nil && message.Seq == groupState.PendingSeq {
+		pending := groupState.Pending
+		groupState.Pending, groupState.PendingSeq = nil, 0
+		if message.Epoch != groupState.Group.Epoch {
+			return fmt.Errorf("MLS commit %d of group %s: %w", message.Seq, message.GroupID, ErrMLSWrongEpoch)
+		}
+		groupState.Group = pending
+		return nil
+	}
+	var commit mlsPublicMessage
+	if err := json.Unmarshal(message.Message, &commit); err != nil {
+		return ErrMLSMalformed
+	}
+	next, err := groupState.Group.processCommit(commit, check, time.Now())
+	if err == ErrMLSRemoved {
+		groupState.Removed = true
+		groupState.Pending = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("MLS commit %d of group %s: %w", message.Seq, message.GroupID, err)
+	}
+	groupState.Group = next
+	return nil
+}
+
+func (groupState *mlsGroupState) processApplication(message types.MLSMessage) mlsHistoryMessage {
+	entry := mlsHistoryMessage{Seq: message.Seq, From: message.Sender, Received: message.Received}
+	if content, ok := groupState.Outbox[message.Seq]; ok {
+		delete(groupState.Outbox, message.Seq)
+		entry.FromDevice = groupState.Group.Tree.leaf(groupState.Group.LeafIndex).Credential.DeviceID
+		entry.Content = content
+		return entry
+	}
+	var private mlsPrivateMessage
+	if err := json.Unmarshal(message.Message, &private); err != nil {
+		entry.Err = ErrMLSMalformed.Error()
+		return entry
+	}
+	working, err := groupState.Group.clone()
+	if err != nil {
+		entry.Err = err.Error()
+		return entry
+	}
+	sender, data, err := working.decrypt(private)
+	if err != nil {
+		entry.Err = err.Error()
+		return entry
+	}
+	groupState.Group = working
+	entry.From = sender.Credential.UserID
+	entry.FromDevice = sender.Credential.DeviceID
+	entry.Content = string(data)
+	return entry
+}
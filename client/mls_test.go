@@ -0,0 +1,234 @@
+package client
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestMLSTreeMath(t *testing.T) {
+	tests := []struct {
+		name     string
+		actual   uint32
+		expected uint32
+	}{
+		{"Level", mlsLevel(7), 3},
+		{"Left", mlsLeft(7), 3},
+		{"Right", mlsRight(7), 11},
+		{"ParentOfLeaf", mlsParent(4), 5},
+		{"ParentOfParent", mlsParent(5), 3},
+		{"ParentOfRightSubtree", mlsParent(11), 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.actual != test.expected {
+				t.Errorf("expected %d but got %d", test.expected, test.actual)
+			}
+		})
+	}
+
+	tree := make(mlsTree, 15)
+	if root := tree.root(); root != 7 {
+		t.Errorf("expected root 7 but got %d", root)
+	}
+	path := tree.directPath(mlsLeafNodeIndex(2))
+	if len(path) != 3 || path[0] != 5 || path[1] != 3 || path[2] != 7 {
+		t.Errorf("unexpected direct path %v", path)
+	}
+
+	// the tree grows to fit new leaves and shrinks once its right half is
+	// empty
+	tree = newMLSTree(types.MLSLeafNode{EncryptionKey: []byte{0}})
+	for i := byte(1); i < 5; i++ {
+		tree.addLeaf(types.MLSLeafNode{EncryptionKey: []byte{i}})
+	}
+	if tree.leafCount() != 8 {
+		t.Errorf("expected 8 leaves but got %d", tree.leafCount())
+	}
+	tree.removeLeaf(4)
+	if tree.leafCount() != 4 {
+		t.Errorf("expected 4 leaves after removing the last but got %d", tree.leafCount())
+	}
+	if index := tree.addLeaf(types.MLSLeafNode{EncryptionKey: []byte{5}}); index != 4 {
+		t.Errorf("expected leaf 4 to be reused but got %d", index)
+	}
+}
+
+type testMLSMember struct {
+	seed          []byte
+	keyPackage    types.MLSKeyPackage
+	initKey       []byte
+	encryptionKey []byte
+	group         *mlsGroup
+}
+
+// testMLSCheck accepts every credential; credentials are checked against the
+// server in the e2e tests.
+func testMLSCheck(types.MLSLeafNode) error {
+	return nil
+}
+
+func testMakeMLSMember(t *testing.T, userID string) *testMLSMember {
+	seed, err := mlsRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	credential := types.MLSCredential{UserID: userID, DeviceID: "device"}
+	keyPackage, initKey, encryptionKey, err := newMLSKeyPackage(seed, credential, types.MLSLifetime{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateMLSKeyPackage(keyPackage, testMLSCheck, now); err != nil {
+		t.Fatal(err)
+	}
+	return &testMLSMember{seed: seed, keyPackage: keyPackage, initKey: initKey, encryptionKey: encryptionKey}
+}
+
+// testMLSCommit commits as committer, moving it to the next epoch, and has
+// each of the others process the commit, returning the commit.
+func testMLSCommit(t *testing.T, committer *testMLSMember, removes []uint32, adds []*testMLSMember, others ...*testMLSMember) mlsPublicMessage {
+	keyPackages := make([]types.MLSKeyPackage, 0, len(adds))
+	for _, member := range adds {
+		keyPackages = append(keyPackages, member.keyPackage)
+	}
+	next, message, welcome, err := committer.group.commit(removes, keyPackages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committer.group = next
+	for _, member := range others {
+		next, err := member.group.processCommit(message, testMLSCheck, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		member.group = next
+	}
+	for _, member := range adds {
+		group, err := joinMLSGroup(*welcome, mlsKeyPackageRef(member.keyPackage), member.keyPackage, member.initKey, member.encryptionKey, member.seed, testMLSCheck)
+		if err != nil {
+			t.Fatal(err)
+		}
+		member.group = group
+	}
+	return message
+}
+
+func testMLSExchange(t *testing.T, sender *testMLSMember, text string, recipients ...*testMLSMember) {
+	message, err := sender.group.encrypt([]byte(text), DefaultPadding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipient := range recipients {
+		_, data, err := recipient.group.decrypt(message)
+		if err != nil {
+			t.Errorf("decrypting %q: %s", text, err)
+			continue
+		}
+		if string(data) != text {
+			t.Errorf("expected %q but got %q", text, data)
+		}
+	}
+}
+
+func testMLSSameEpoch(t *testing.T, members ...*testMLSMember) {
+	for _, member := range members[1:] {
+		if member.group.Epoch != members[0].group.Epoch || !mlsEqual(member.group.Secrets.EpochAuthenticator, members[0].group.Secrets.EpochAuthenticator) {
+			t.Fatalf("members disagree on epoch %d and %d", members[0].group.Epoch, member.group.Epoch)
+		}
+	}
+}
+
+func TestMLSGroup(t *testing.T) {
+	alice := testMakeMLSMember(t, "alice")
+	bob := testMakeMLSMember(t, "bob")
+	carol := testMakeMLSMember(t, "carol")
+	dave := testMakeMLSMember(t, "dave")
+	var err error
+	alice.group, err = newMLSGroup("team", alice.seed, alice.keyPackage.LeafNode, alice.encryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMLSCommit(t, alice, nil, []*testMLSMember{bob, carol})
+	testMLSSameEpoch(t, alice, bob, carol)
+	testMLSExchange(t, alice, "hello", bob, carol)
+
+	// members added by another member can read the group too
+	testMLSCommit(t, bob, nil, []*testMLSMember{dave}, alice, carol)
+	testMLSSameEpoch(t, alice, bob, carol, dave)
+	testMLSExchange(t, dave, "hi all", alice, bob, carol)
+
+	// messages arrive out of order but are read once
+	first, err := alice.group.encrypt([]byte("first"), DefaultPadding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := alice.group.encrypt([]byte("second"), DefaultPadding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []mlsPrivateMessage{second, first} {
+		if _, _, err := dave.group.decrypt(message); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, _, err := dave.group.decrypt(first); err != ErrMLSKeyUsed {
+		t.Errorf("expected %v but got %v", ErrMLSKeyUsed, err)
+	}
+
+	// a commit altered in transit is refused
+	next, message, _, err := carol.group.commit(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := message
+	tampered.MembershipTag = append([]byte{}, message.MembershipTag...)
+	tampered.MembershipTag[0] ^= 1
+	if _, err := alice.group.processCommit(tampered, testMLSCheck, time.Now()); err != ErrMLSAuthentication {
+		t.Errorf("expected %v but got %v", ErrMLSAuthentication, err)
+	}
+
+	// a removed member learns it and cannot read what follows
+	carol.group = next
+	for _, member := range []*testMLSMember{alice, bob, dave} {
+		if member.group, err = member.group.processCommit(message, testMLSCheck, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removal := testMLSCommit(t, carol, []uint32{bob.group.LeafIndex}, nil, alice, dave)
+	testMLSSameEpoch(t, alice, carol, dave)
+	if _, err := bob.group.processCommit(removal, testMLSCheck, time.Now()); err != ErrMLSRemoved {
+		t.Errorf("expected %v but got %v", ErrMLSRemoved, err)
+	}
+	after, err := carol.group.encrypt([]byte("without bob"), DefaultPadding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bob.group.decrypt(after); err == nil {
+		t.Error("a removed member decrypted a message sent after the removal")
+	}
+	testMLSExchange(t, alice, "bye bob", carol, dave)
+}
+
+func TestMLSRatchetTooFarOut(t *testing.T) {
+	secret, err := mlsRandom(mlsHashSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratchet := &mlsRatchet{Secret: secret}
+	if _, err := ratchet.get(maxSkippedMessageKeys + 1); err != ErrMLSTooFarOut {
+		t.Errorf("expected ErrMLSTooFarOut but got %v", err)
+	}
+	// with a skipped key held, the last generation must not wrap the count
+	// of keys to skip around to a small number
+	ratchet.Skipped = map[uint32][]byte{7: ratchet.keyAndNonce(7)}
+	if _, err := ratchet.get(math.MaxUint32); err != ErrMLSTooFarOut {
+		t.Errorf("expected ErrMLSTooFarOut but got %v", err)
+	}
+	if ratchet.Generation != 0 || len(ratchet.Skipped) != 1 {
+		t.Errorf("ratchet moved to generation %d with %d skipped keys", ratchet.Generation, len(ratchet.Skipped))
+	}
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/hpke"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The client speaks MLS with the cipher suite
+// MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519 of RFC 9420. Signed and
+// hashed structures are encoded as the RFC encodes them; messages travel as
+// JSON like everything else the client sends, so groups are not meant to
+// be shared with other MLS implementations.
+const (
+	mlsVersion           = 1 // mls10
+	mlsCipherSuite       = 1
+	mlsLabelPrefix       = "MLS 1.0 "
+	mlsHashSize          = sha256.Size
+	mlsKeySize           = 16 // AES-128-GCM
+	mlsNonceSize         = 12
+	mlsKEMOutput         = 32 // X25519
+	mlsReuseGuard        = 4
+	mlsWireFormatPublic  = 1
+	mlsWireFormatPrivate = 2
+)
+
+var ErrMLSMalformed = errors.New("MLS message or state is malformed")
+
+var (
+	mlsKEM  = hpke.DHKEM(ecdh.X25519())
+	mlsKDF  = hpke.HKDFSHA256()
+	mlsAEAD = hpke.AES128GCM()
+)
+
+// mlsWriter encodes values in the TLS presentation language as RFC 9420
+// uses it, vectors prefixed with their length as a variable-size integer.
+type mlsWriter struct {
+	bytes.Buffer
+}
+
+func (w *mlsWriter) uint8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *mlsWriter) uint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *mlsWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *mlsWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+// length writes the variable-size length of a vector. Nothing the client
+// encodes comes near the 2^30 bytes the encoding allows.
+func (w *mlsWriter) length(n int) {
+	switch {
+	case n < 1<<6:
+		w.uint8(uint8(n))
+	case n < 1<<14:
+		w.uint16(uint16(n) | 0x4000)
+	default:
+		w.uint32(uint32(n) | 0x80000000)
+	}
+}
+
+func (w *mlsWriter) opaque(v []byte) {
+	w.length(len(v))
+	w.Write(v)
+}
+
+// vector writes what encode writes as a vector.
+func (w *mlsWriter) vector(encode func(w *mlsWriter)) {
+	var inner mlsWriter
+	encode(&inner)
+	w.opaque(inner.Bytes())
+}
+
+func (w *mlsWriter) optional(present bool) {
+	if present {
+		w.uint8(1)
+	} else {
+		w.uint8(0)
+	}
+}
+
+func mlsHash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func mlsExtract(salt []byte, ikm []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, mlsHashSize)
+	}
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+// mlsExpandWithLabel is ExpandWithLabel of RFC 9420.
+func mlsExpandWithLabel(secret []byte, label string, context []byte, length int) []byte {
+	var info mlsWriter
+	info.uint16(uint16(length))
+	info.opaque([]byte(mlsLabelPrefix + label))
+	info.opaque(context)
+	output := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info.Bytes()), output); err != nil {
+		// HKDF only fails past 255 hashes of output
+		panic(err)
+	}
+	return output
+}
+
+func mlsDeriveSecret(secret []byte, label string) []byte {
+	return mlsExpandWithLabel(secret, label, nil, mlsHashSize)
+}
+
+// mlsRefHash is RefHash of RFC 9420, naming a KeyPackage.
+func mlsRefHash(label string, value []byte) []byte {
+	var input mlsWriter
+	input.opaque([]byte(label))
+	input.opaque(value)
+	return mlsHash(input.Bytes())
+}
+
+func mlsMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func mlsSignContent(label string, content []byte) []byte {
+	var signContent mlsWriter
+	signContent.opaque([]byte(mlsLabelPrefix + label))
+	signContent.opaque(content)
+	return signContent.Bytes()
+}
+
+// mlsSignWithLabel is SignWithLabel of RFC 9420, with an Ed25519 key given
+// by its seed.
+func mlsSignWithLabel(seed []byte, label string, content []byte) ([]byte, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrMLSMalformed
+	}
+	return ed25519.Sign(ed25519.NewKeyFromSeed(seed), mlsSignContent(label, content)), nil
+}
+
+func mlsVerifyWithLabel(publicKey []byte, label string, content []byte, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, mlsSignContent(label, content), signature)
+}
+
+// mlsCiphertext is an HPKECiphertext of RFC 9420.
+type mlsCiphertext struct {
+	KEMOutput  []byte
+	Ciphertext []byte
+}
+
+func (ciphertext mlsCiphertext) encode(w *mlsWriter) {
+	w.opaque(ciphertext.KEMOutput)
+	w.opaque(ciphertext.Ciphertext)
+}
+
+func mlsEncryptContext(label string, context []byte) []byte {
+	var info mlsWriter
+	info.opaque([]byte(mlsLabelPrefix + label))
+	info.opaque(context)
+	return info.Bytes()
+}
+
+// mlsEncryptWithLabel is EncryptWithLabel of RFC 9420, HPKE in base mode to
+// an X25519 public key.
+func mlsEncryptWithLabel(publicKey []byte, label string, context []byte, plaintext []byte) (mlsCiphertext, error) {
+	key, err := mlsKEM.NewPublicKey(publicKey)
+	if err != nil {
+		return mlsCiphertext{}, err
+	}
+	sealed, err := hpke.Seal(key, mlsKDF, mlsAEAD, mlsEncryptContext(label, context), plaintext)
+	if err != nil {
+		return mlsCiphertext{}, err
+	}
+	return mlsCiphertext{KEMOutput: sealed[:mlsKEMOutput], Ciphertext: sealed[mlsKEMOutput:]}, nil
+}
+
+func mlsDecryptWithLabel(privateKey []byte, label string, context []byte, ciphertext mlsCiphertext) ([]byte, error) {
+	key, err := mlsKEM.NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext.KEMOutput) != mlsKEMOutput {
+		return nil, ErrMLSMalformed
+	}
+	sealed := append(append([]byte{}, ciphertext.KEMOutput...), ciphertext.Ciphertext...)
+	return hpke.Open(key, mlsKDF, mlsAEAD, mlsEncryptContext(label, context), sealed)
+}
+
+// mlsGenerateKeyPair returns a new HPKE key pair as its private and public
+// key bytes.
+func mlsGenerateKeyPair() ([]byte, []byte, error) {
+	key, err := mlsKEM.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mlsKeyPairBytes(key)
+}
+
+// mlsDeriveKeyPair derives the key pair of a tree node from its node secret.
+func mlsDeriveKeyPair(secret []byte) ([]byte, []byte, error) {
+	key, err := mlsKEM.DeriveKeyPair(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mlsKeyPairBytes(key)
+}
+
+func mlsKeyPairBytes(key hpke.PrivateKey) ([]byte, []byte, error) {
+	private, err := key.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, key.PublicKey().Bytes(), nil
+}
+
+// mlsAEADSeal and mlsAEADOpen encrypt with the AES-128-GCM keys of the key
+// schedule.
+func mlsAEADSeal(key []byte, nonce []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func mlsAEADOpen(key []byte, nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,958 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+const (
+	mlsSenderMember        = 1
+	mlsContentApplication  = 1
+	mlsContentCommit       = 3
+	mlsProposalByValue     = 1
+	mlsProposalAdd         = 1
+	mlsProposalRemove      = 3
+	mlsSenderDataSize      = 4 + 4 + mlsReuseGuard
+	mlsKeyPackageRefLabel  = "MLS 1.0 KeyPackage Reference"
+	mlsWelcomeSecretsLabel = "Welcome"
+)
+
+var (
+	ErrMLSAuthentication = errors.New("MLS message failed authentication")
+	ErrMLSWrongEpoch     = errors.New("MLS message is not for the current epoch of the group")
+	ErrMLSRemoved        = errors.New("removed from the MLS group")
+	ErrMLSNotWelcomed    = errors.New("MLS welcome is not for any KeyPackage of the client")
+)
+
+// mlsCredentialCheck checks that the credential of a leaf was issued by the
+// device it names.
+type mlsCredentialCheck func(leaf types.MLSLeafNode) error
+
+// mlsGroup is the state of a member of an MLS group in one epoch: the
+// ratchet tree with the private keys the member knows of it, the transcript
+// and the secrets of the epoch. It is replaced as a whole by the next epoch,
+// processing working on a copy.
+type mlsGroup struct {
+	GroupID   string
+	Epoch     uint64
+	Tree      mlsTree
+	LeafIndex uint32
+	// SignatureKey is the seed of the Ed25519 key of the member's leaf.
+	SignatureKey []byte
+	// PrivateKeys are those of the member's leaf and of the nodes above it
+	// it knows, by node index.
+	PrivateKeys             map[uint32][]byte
+	ConfirmedTranscriptHash []byte
+	InterimTranscriptHash   []byte
+	Secrets                 mlsEpochSecrets
+	SecretTree              mlsSecretTree
+}
+
+type mlsUpdatePathNode struct {
+	EncryptionKey []byte
+	Secrets       []mlsCiphertext
+}
+
+// mlsUpdatePath gives the committer a new leaf and new keys up the tree,
+// each encrypted to the members below the other side of the node.
+type mlsUpdatePath struct {
+	LeafNode types.MLSLeafNode
+	Nodes    []mlsUpdatePathNode
+}
+
+// mlsCommit carries its proposals by value; removes are applied before adds.
+type mlsCommit struct {
+	Removes []uint32              `json:",omitempty"`
+	Adds    []types.MLSKeyPackage `json:",omitempty"`
+	Path    *mlsUpdatePath        `json:",omitempty"`
+}
+
+type mlsFramedContent struct {
+	GroupID           string
+	Epoch             uint64
+	Sender            uint32
+	AuthenticatedData []byte `json:",omitempty"`
+	ContentType       uint8
+	ApplicationData   []byte     `json:",omitempty"`
+	Commit            *mlsCommit `json:",omitempty"`
+}
+
+// mlsPublicMessage carries commits, signed by the committer and tagged with
+// the membership key so only members can send them.
+type mlsPublicMessage struct {
+	Content         mlsFramedContent
+	Signature       []byte
+	ConfirmationTag []byte
+	MembershipTag   []byte
+}
+
+// mlsPrivateMessage carries application messages, encrypted along with
+// their sender.
+type mlsPrivateMessage struct {
+	GroupID             string
+	Epoch               uint64
+	ContentType         uint8
+	AuthenticatedData   []byte `json:",omitempty"`
+	EncryptedSenderData []byte
+	Ciphertext          []byte
+}
+
+type mlsPrivateContent struct {
+	ApplicationData []byte
+	Signature       []byte
+}
+
+// mlsGroupInfo describes the epoch a welcome is for, the ratchet tree
+// included, signed by the member who made it.
+type mlsGroupInfo struct {
+	GroupID                 string
+	Epoch                   uint64
+	TreeHash                []byte
+	ConfirmedTranscriptHash []byte
+	Tree                    mlsTree
+	ConfirmationTag         []byte
+	Signer                  uint32
+	Signature               []byte
+}
+
+type mlsGroupSecrets struct {
+	JoinerSecret []byte
+	PathSecret   []byte `json:",omitempty"`
+}
+
+type mlsEncryptedGroupSecrets struct {
+	NewMember []byte
+	Secrets   mlsCiphertext
+}
+
+// mlsWelcome lets the members added by a commit join the epoch it starts.
+type mlsWelcome struct {
+	Secrets            []mlsEncryptedGroupSecrets
+	EncryptedGroupInfo []byte
+}
+
+func (commit mlsCommit) encode(w *mlsWriter) {
+	w.vector(func(w *mlsWriter) {
+		for _, removed := range commit.Removes {
+			w.uint8(mlsProposalByValue)
+			w.uint16(mlsProposalRemove)
+			w.uint32(removed)
+		}
+		for _, keyPackage := range commit.Adds {
+			w.uint8(mlsProposalByValue)
+			w.uint16(mlsProposalAdd)
+			encodeMLSKeyPackage(w, keyPackage)
+		}
+	})
+	w.optional(commit.Path != nil)
+	if commit.Path != nil {
+		encodeMLSLeafNode(w, commit.Path.LeafNode)
+		w.vector(func(w *mlsWriter) {
+			for _, node := range commit.Path.Nodes {
+				w.opaque(node.EncryptionKey)
+				w.vector(func(w *mlsWriter) {
+					for _, secret := range node.Secrets {
+						secret.encode(w)
+					}
+				})
+			}
+		})
+	}
+}
+
+func (content mlsFramedContent) encode(w *mlsWriter) {
+	w.opaque([]byte(content.GroupID))
+	w.uint64(content.Epoch)
+	w.uint8(mlsSenderMember)
+	w.uint32(content.Sender)
+	w.opaque(content.AuthenticatedData)
+	w.uint8(content.ContentType)
+	switch content.ContentType {
+	case mlsContentApplication:
+		w.opaque(content.ApplicationData)
+	case mlsContentCommit:
+		content.Commit.encode(w)
+	}
+}
+
+// valid reports whether the content is a well formed application message or
+// commit, so it can be encoded.
+func (content mlsFramedContent) valid() bool {
+	switch content.ContentType {
+	case mlsContentApplication:
+		return content.Commit == nil
+	case mlsContentCommit:
+		return content.Commit != nil
+	}
+	return false
+}
+
+func mlsFramedContentTBS(wireFormat uint16, content mlsFramedContent, groupContext []byte) []byte {
+	var tbs mlsWriter
+	tbs.uint16(mlsVersion)
+	tbs.uint16(wireFormat)
+	content.encode(&tbs)
+	tbs.Write(groupContext)
+	return tbs.Bytes()
+}
+
+func (message mlsPublicMessage) tbm(groupContext []byte) []byte {
+	var tbm mlsWriter
+	tbm.Write(mlsFramedContentTBS(mlsWireFormatPublic, message.Content, groupContext))
+	tbm.opaque(message.Signature)
+	tbm.opaque(message.ConfirmationTag)
+	return tbm.Bytes()
+}
+
+func (message mlsPublicMessage) confirmedTranscriptHash(interimTranscriptHash []byte) []byte {
+	var input mlsWriter
+	input.Write(interimTranscriptHash)
+	input.uint16(mlsWireFormatPublic)
+	message.Content.encode(&input)
+	input.opaque(message.Signature)
+	return mlsHash(input.Bytes())
+}
+
+func (info mlsGroupInfo) tbs() []byte {
+	var tbs mlsWriter
+	tbs.Write(encodeMLSGroupContext(info.GroupID, info.Epoch, info.TreeHash, info.ConfirmedTranscriptHash))
+	tbs.vector(func(w *mlsWriter) {
+		w.uint16(mlsExtensionTree)
+		w.vector(func(w *mlsWriter) { encodeMLSTree(w, info.Tree) })
+	})
+	tbs.opaque(info.ConfirmationTag)
+	tbs.uint32(info.Signer)
+	return tbs.Bytes()
+}
+
+func encodeMLSKeyPackageContent(w *mlsWriter, keyPackage types.MLSKeyPackage) {
+	w.uint16(mlsVersion)
+	w.uint16(mlsCipherSuite)
+	w.opaque(keyPackage.InitKey)
+	encodeMLSLeafNode(w, keyPackage.LeafNode)
+	w.vector(func(w *mlsWriter) {})
+}
+
+func encodeMLSKeyPackage(w *mlsWriter, keyPackage types.MLSKeyPackage) {
+	encodeMLSKeyPackageContent(w, keyPackage)
+	w.opaque(keyPackage.Signature)
+}
+
+// mlsKeyPackageRef names a KeyPackage in the welcome of the commit adding
+// it.
+func mlsKeyPackageRef(keyPackage types.MLSKeyPackage) []byte {
+	var encoded mlsWriter
+	encodeMLSKeyPackage(&encoded, keyPackage)
+	return mlsRefHash(mlsKeyPackageRefLabel, encoded.Bytes())
+}
+
+func mlsRandom(size int) ([]byte, error) {
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func signMLSLeafNode(seed []byte, leaf *types.MLSLeafNode, groupID string, index uint32) error {
+	signature, err := mlsSignWithLabel(seed, "LeafNodeTBS", mlsLeafNodeTBS(*leaf, groupID, index))
+	if err != nil {
+		return err
+	}
+	leaf.Signature = signature
+	return nil
+}
+
+// newMLSKeyPackage makes a KeyPackage for the leaf signed with seed, returning
+// it with the private halves of its init and encryption keys.
+func newMLSKeyPackage(seed []byte, credential types.MLSCredential, lifetime types.MLSLifetime) (types.MLSKeyPackage, []byte, []byte, error) {
+	initPrivate, initPublic, err := mlsGenerateKeyPair()
+	if err != nil {
+		return types.MLSKeyPackage{}, nil, nil, err
+	}
+	encryptionPrivate, encryptionPublic, err := mlsGenerateKeyPair()
+	if err != nil {
+		return types.MLSKeyPackage{}, nil, nil, err
+	}
+	keyPackage := types.MLSKeyPackage{
+		InitKey: initPublic,
+		LeafNode: types.MLSLeafNode{
+			EncryptionKey: encryptionPublic,
+			SignatureKey:  ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey),
+			Credential:    credential,
+			Source:        types.MLSLeafNodeKeyPackage,
+			Lifetime:      &lifetime,
+		},
+	}
+	if err := signMLSLeafNode(seed, &keyPackage.LeafNode, "", 0); err != nil {
+		return types.MLSKeyPackage{}, nil, nil, err
+	}
+	var tbs mlsWriter
+	encodeMLSKeyPackageContent(&tbs, keyPackage)
+	keyPackage.Signature, err = mlsSignWithLabel(seed, "KeyPackageTBS", tbs.Bytes())
+	if err != nil {
+		return types.MLSKeyPackage{}, nil, nil, err
+	}
+	return keyPackage, initPrivate, encryptionPrivate, nil
+}
+
+// validateMLSLeaf checks the signature of a leaf at index in the group and
+// its credential.
+func validateMLSLeaf(leaf types.MLSLeafNode, groupID string, index uint32, check mlsCredentialCheck) error {
+	if !mlsVerifyWithLabel(leaf.SignatureKey, "LeafNodeTBS", mlsLeafNodeTBS(leaf, groupID, index), leaf.Signature) {
+		return ErrMLSAuthentication
+	}
+	return check(leaf)
+}
+
+func validateMLSKeyPackage(keyPackage types.MLSKeyPackage, check mlsCredentialCheck, now time.Time) error {
+	leaf := keyPackage.LeafNode
+	if leaf.Source != types.MLSLeafNodeKeyPackage || leaf.Lifetime == nil || mlsEqual(keyPackage.InitKey, leaf.EncryptionKey) {
+		return ErrMLSMalformed
+	}
+	if now.Before(leaf.Lifetime.NotBefore) || now.After(leaf.Lifetime.NotAfter) {
+		return errors.New("MLS KeyPackage has expired")
+	}
+	var tbs mlsWriter
+	encodeMLSKeyPackageContent(&tbs, keyPackage)
+	if !mlsVerifyWithLabel(leaf.SignatureKey, "KeyPackageTBS", tbs.Bytes(), keyPackage.Signature) {
+		return ErrMLSAuthentication
+	}
+	return validateMLSLeaf(leaf, "", 0, check)
+}
+
+// newMLSGroup starts a group at epoch 0 with the creator as its only member,
+// in the leaf of one of its KeyPackages.
+func newMLSGroup(groupID string, seed []byte, leaf types.MLSLeafNode, encryptionKey []byte) (*mlsGroup, error) {
+	epochSecret, err := mlsRandom(mlsHashSize)
+	if err != nil {
+		return nil, err
+	}
+	group := &mlsGroup{
+		GroupID:                 groupID,
+		Tree:                    newMLSTree(leaf),
+		SignatureKey:            seed,
+		PrivateKeys:             map[uint32][]byte{0: encryptionKey},
+		ConfirmedTranscriptHash: []byte{},
+	}
+	secrets, encryptionSecret := mlsEpochSchedule(epochSecret)
+	group.startEpoch(secrets, encryptionSecret)
+	group.InterimTranscriptHash = mlsInterimTranscriptHash(group.ConfirmedTranscriptHash, mlsMAC(secrets.ConfirmationKey, group.ConfirmedTranscriptHash))
+	return group, nil
+}
+
+func (group *mlsGroup) startEpoch(secrets mlsEpochSecrets, encryptionSecret []byte) {
+	group.Secrets = secrets
+	group.SecretTree = newMLSSecretTree(encryptionSecret, group.Tree)
+}
+
+func (group *mlsGroup) clone() (*mlsGroup, error) {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return nil, err
+	}
+	var clone mlsGroup
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
+func (group *mlsGroup) groupContext() []byte {
+	return encodeMLSGroupContext(group.GroupID, group.Epoch, group.Tree.treeHash(group.Tree.root()), group.ConfirmedTranscriptHash)
+}
+
+// members returns the leaves of the group by index.
+func (group *mlsGroup) members() map[uint32]types.MLSLeafNode {
+	members := make(map[uint32]types.MLSLeafNode)
+	for index := uint32(0); index < group.Tree.leafCount(); index++ {
+		if leaf := group.Tree.leaf(index); leaf != nil {
+			members[index] = *leaf
+		}
+	}
+	return members
+}
+
+// applyProposals applies the proposals of a commit to the tree, returning
+// the leaves of the members added.
+func (group *mlsGroup) applyProposals(commit mlsCommit) ([]uint32, error) {
+	for _, removed := range commit.Removes {
+		if removed == group.LeafIndex {
+			return nil, ErrMLSRemoved
+		}
+		if group.Tree.leaf(removed) == nil {
+			return nil, ErrMLSMalformed
+		}
+		group.Tree.removeLeaf(removed)
+	}
+	joiners := make([]uint32, 0, len(commit.Adds))
+	for _, keyPackage := range commit.Adds {
+		if _, ok := group.Tree.findLeaf(keyPackage.LeafNode.EncryptionKey); ok {
+			return nil, ErrMLSMalformed
+		}
+		joiners = append(joiners, group.Tree.addLeaf(keyPackage.LeafNode))
+	}
+	return joiners, nil
+}
+
+// setPath replaces the nodes on the direct path of leaf with the keys of an
+// UpdatePath.
+func (group *mlsGroup) setPath(leaf uint32, path []uint32, keys [][]byte, leafNode types.MLSLeafNode) {
+	x := mlsLeafNodeIndex(leaf)
+	for _, a := range group.Tree.directPath(x) {
+		group.Tree[a] = nil
+		delete(group.PrivateKeys, a)
+	}
+	for i, a := range path {
+		group.Tree[a] = &mlsNode{Parent: &mlsParentNode{EncryptionKey: keys[i]}}
+	}
+	group.Tree[x] = &mlsNode{Leaf: &leafNode}
+}
+
+// pruneKeys forgets the private keys of nodes that were blanked.
+func (group *mlsGroup) pruneKeys() {
+	for x := range group.PrivateKeys {
+		if x >= uint32(len(group.Tree)) || group.Tree[x] == nil {
+			delete(group.PrivateKeys, x)
+		}
+	}
+}
+
+// pathKeys derives the keys of the nodes of path from the secret of the
+// first, checking them against the tree, and returns the commit secret.
+func (group *mlsGroup) pathKeys(path []uint32, secret []byte) ([]byte, error) {
+	for i, a := range path {
+		if i > 0 {
+			secret = mlsDeriveSecret(secret, "path")
+		}
+		private, public, err := mlsDeriveKeyPair(mlsDeriveSecret(secret, "node"))
+		if err != nil {
+			return nil, err
+		}
+		if group.Tree[a] == nil || !mlsEqual(public, group.Tree.publicKey(a)) {
+			return nil, ErrMLSAuthentication
+		}
+		group.PrivateKeys[a] = private
+	}
+	return mlsDeriveSecret(secret, "path"), nil
+}
+
+func excludeMLSLeaves(resolution []uint32, leaves []uint32) []uint32 {
+	excluded := make([]uint32, 0, len(resolution))
+	for _, x := range resolution {
+		keep := true
+		for _, leaf := range leaves {
+			if x == mlsLeafNodeIndex(leaf) {
+				keep = false
+			}
+		}
+		if keep {
+			excluded = append(excluded, x)
+		}
+	}
+	return excluded
+}
+
+// commit makes a commit removing the leaves in removes and adding the
+// KeyPackages in adds, always with an UpdatePath so the committer's keys are
+// refreshed too. It returns the group in the epoch the commit starts, to be
+// used once the delivery service accepts the commit, and the welcome for the
+// members added.
+func (group *mlsGroup) commit(removes []uint32, adds []types.MLSKeyPackage) (*mlsGroup, mlsPublicMessage, *mlsWelcome, error) {
+	next, err := group.clone()
+	if err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+	commit := mlsCommit{Removes: removes, Adds: adds}
+	joiners, err := next.applyProposals(commit)
+	if err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+
+	// new keys from the leaf up, each path secret derived from the last
+	pathSecret, err := mlsRandom(mlsHashSize)
+	if err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+	leafPrivate, leafPublic, err := mlsDeriveKeyPair(mlsDeriveSecret(pathSecret, "node"))
+	if err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+	path := next.Tree.filteredDirectPath(next.LeafIndex)
+	pathSecrets := make([][]byte, len(path))
+	keys := make([][]byte, len(path))
+	privateKeys := map[uint32][]byte{mlsLeafNodeIndex(next.LeafIndex): leafPrivate}
+	secret := pathSecret
+	for i, a := range path {
+		secret = mlsDeriveSecret(secret, "path")
+		pathSecrets[i] = secret
+		private, public, err := mlsDeriveKeyPair(mlsDeriveSecret(secret, "node"))
+		if err != nil {
+			return nil, mlsPublicMessage{}, nil, err
+		}
+		privateKeys[a] = private
+		keys[i] = public
+	}
+	commitSecret := mlsDeriveSecret(secret, "path")
+
+	leaf := *next.Tree.leaf(next.LeafIndex)
+	leaf.EncryptionKey = leafPublic
+	leaf.Source = types.MLSLeafNodeCommit
+	leaf.Lifetime = nil
+	next.setPath(next.LeafIndex, path, keys, leaf)
+	next.PrivateKeys = privateKeys
+	signed := next.Tree.leaf(next.LeafIndex)
+	signed.ParentHash = next.Tree.setParentHashes(next.LeafIndex)
+	if err := signMLSLeafNode(next.SignatureKey, signed, next.GroupID, next.LeafIndex); err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+
+	// the path secrets are encrypted under the context of the new epoch as
+	// far as it is known
+	next.Epoch++
+	provisional := next.groupContext()
+	updatePath := &mlsUpdatePath{LeafNode: *signed}
+	x := mlsLeafNodeIndex(next.LeafIndex)
+	for i, a := range path {
+		node := mlsUpdatePathNode{EncryptionKey: keys[i]}
+		for _, r := range excludeMLSLeaves(next.Tree.resolution(next.Tree.copathChild(a, x)), joiners) {
+			ciphertext, err := mlsEncryptWithLabel(next.Tree.publicKey(r), "UpdatePathNode", provisional, pathSecrets[i])
+			if err != nil {
+				return nil, mlsPublicMessage{}, nil, err
+			}
+			node.Secrets = append(node.Secrets, ciphertext)
+		}
+		updatePath.Nodes = append(updatePath.Nodes, node)
+	}
+	commit.Path = updatePath
+
+	message := mlsPublicMessage{Content: mlsFramedContent{
+		GroupID:     group.GroupID,
+		Epoch:       group.Epoch,
+		Sender:      group.LeafIndex,
+		ContentType: mlsContentCommit,
+		Commit:      &commit,
+	}}
+	context := group.groupContext()
+	message.Signature, err = mlsSignWithLabel(group.SignatureKey, "FramedContentTBS", mlsFramedContentTBS(mlsWireFormatPublic, message.Content, context))
+	if err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+	next.ConfirmedTranscriptHash = message.confirmedTranscriptHash(group.InterimTranscriptHash)
+	newContext := next.groupContext()
+	joinerSecret := mlsJoinerSecret(group.Secrets.InitSecret, commitSecret, newContext)
+	memberSecret := mlsMemberSecret(joinerSecret)
+	secrets, encryptionSecret := mlsMemberSchedule(memberSecret, newContext)
+	next.startEpoch(secrets, encryptionSecret)
+	message.ConfirmationTag = mlsMAC(secrets.ConfirmationKey, next.ConfirmedTranscriptHash)
+	next.InterimTranscriptHash = mlsInterimTranscriptHash(next.ConfirmedTranscriptHash, message.ConfirmationTag)
+	message.MembershipTag = mlsMAC(group.Secrets.MembershipKey, message.tbm(context))
+
+	if len(adds) == 0 {
+		return next, message, nil, nil
+	}
+	welcome, err := next.welcome(adds, joiners, path, pathSecrets, joinerSecret, memberSecret, message.ConfirmationTag)
+	if err != nil {
+		return nil, mlsPublicMessage{}, nil, err
+	}
+	return next, message, welcome, nil
+}
+
+// welcome makes the welcome for the members a commit added. Each is given
+// the path secret of the lowest node above both them and the committer, so
+// they know the keys the committer set above them.
+func (group *mlsGroup) welcome(adds []types.MLSKeyPackage, joiners []uint32, path []uint32, pathSecrets [][]byte, joinerSecret []byte, memberSecret []byte, confirmationTag []byte) (*mlsWelcome, error) {
+	info := mlsGroupInfo{
+		GroupID:                 group.GroupID,
+		Epoch:                   group.Epoch,
+		TreeHash:                group.Tree.treeHash(group.Tree.root()),
+		ConfirmedTranscriptHash: group.ConfirmedTranscriptHash,
+		Tree:                    group.Tree,
+		ConfirmationTag:         confirmationTag,
+		Signer:                  group.LeafIndex,
+	}
+	var err error
+	info.Signature, err = mlsSignWithLabel(group.SignatureKey, "GroupInfoTBS", info.tbs())
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	key, nonce := mlsWelcomeKey(memberSecret)
+	welcome := &mlsWelcome{}
+	welcome.EncryptedGroupInfo, err = mlsAEADSeal(key, nonce, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, keyPackage := range adds {
+		secrets := mlsGroupSecrets{JoinerSecret: joinerSecret}
+		for j, a := range path {
+			if mlsIsAncestor(a, mlsLeafNodeIndex(joiners[i])) {
+				secrets.PathSecret = pathSecrets[j]
+				break
+			}
+		}
+		data, err := json.Marshal(secrets)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := mlsEncryptWithLabel(keyPackage.InitKey, mlsWelcomeSecretsLabel, welcome.EncryptedGroupInfo, data)
+		if err != nil {
+			return nil, err
+		}
+		welcome.Secrets = append(welcome.Secrets, mlsEncryptedGroupSecrets{NewMember: mlsKeyPackageRef(keyPackage), Secrets: ciphertext})
+	}
+	return welcome, nil
+}
+
+// validMLSTree checks that a tree received in a welcome is well formed, its
+// leaves at even indices and parents at odd ones.
+func validMLSTree(tree mlsTree) bool {
+	width := uint32(len(tree))
+	if width == 0 || (width+1)&width != 0 {
+		return false
+	}
+	for x, node := range tree {
+		if node == nil {
+			continue
+		}
+		leaf := x%2 == 0
+		if (node.Leaf != nil) != leaf || (node.Parent != nil) == leaf {
+			return false
+		}
+	}
+	return true
+}
+
+// joinMLSGroup joins a group from a welcome sent for the KeyPackage with
+// ref, whose init and encryption keys are given.
+func joinMLSGroup(welcome mlsWelcome, ref []byte, keyPackage types.MLSKeyPackage, initKey []byte, encryptionKey []byte, seed []byte, check mlsCredentialCheck) (*mlsGroup, error) {
+	var encrypted *mlsCiphertext
+	for i := range welcome.Secrets {
+		if mlsEqual(welcome.Secrets[i].NewMember, ref) {
+			encrypted = &welcome.Secrets[i].Secrets
+		}
+	}
+	if encrypted == nil {
+		return nil, ErrMLSNotWelcomed
+	}
+	data, err := mlsDecryptWithLabel(initKey, mlsWelcomeSecretsLabel, welcome.EncryptedGroupInfo, *encrypted)
+	if err != nil {
+		return nil, ErrMLSAuthentication
+	}
+	var secrets mlsGroupSecrets
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, ErrMLSMalformed
+	}
+	memberSecret := mlsMemberSecret(secrets.JoinerSecret)
+	key, nonce := mlsWelcomeKey(memberSecret)
+	data, err = mlsAEADOpen(key, nonce, welcome.EncryptedGroupInfo, nil)
+	if err != nil {
+		return nil, ErrMLSAuthentication
+	}
+	var info mlsGroupInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, ErrMLSMalformed
+	}
+
+	// the tree must be the one the group info is signed over, every leaf in
+	// it vouched for
+	if !validMLSTree(info.Tree) || !mlsEqual(info.Tree.treeHash(info.Tree.root()), info.TreeHash) {
+		return nil, ErrMLSMalformed
+	}
+	signer := info.Tree.leaf(info.Signer)
+	if signer == nil || !mlsVerifyWithLabel(signer.SignatureKey, "GroupInfoTBS", info.tbs(), info.Signature) {
+		return nil, ErrMLSAuthentication
+	}
+	group := &mlsGroup{
+		GroupID:                 info.GroupID,
+		Epoch:                   info.Epoch,
+		Tree:                    info.Tree,
+		SignatureKey:            seed,
+		ConfirmedTranscriptHash: info.ConfirmedTranscriptHash,
+	}
+	for index, leaf := range group.members() {
+		if err := validateMLSLeaf(leaf, group.GroupID, index, check); err != nil {
+			return nil, err
+		}
+	}
+	index, ok := group.Tree.findLeaf(keyPackage.LeafNode.EncryptionKey)
+	if !ok || !mlsEqual(group.Tree.leaf(index).SignatureKey, keyPackage.LeafNode.SignatureKey) {
+		return nil, ErrMLSMalformed
+	}
+	group.LeafIndex = index
+	group.PrivateKeys = map[uint32][]byte{mlsLeafNodeIndex(index): encryptionKey}
+	if secrets.PathSecret != nil {
+		path := group.Tree.filteredDirectPath(index)
+		for i, a := range path {
+			if mlsIsAncestor(a, mlsLeafNodeIndex(info.Signer)) {
+				if _, err := group.pathKeys(path[i:], secrets.PathSecret); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
+	epochSecrets, encryptionSecret := mlsMemberSchedule(memberSecret, group.groupContext())
+	if !mlsEqual(mlsMAC(epochSecrets.ConfirmationKey, group.ConfirmedTranscriptHash), info.ConfirmationTag) {
+		return nil, ErrMLSAuthentication
+	}
+	group.startEpoch(epochSecrets, encryptionSecret)
+	group.InterimTranscriptHash = mlsInterimTranscriptHash(group.ConfirmedTranscriptHash, info.ConfirmationTag)
+	return group, nil
+}
+
+// processCommit returns the group in the epoch started by a commit of
+// another member, or ErrMLSRemoved when the commit removes the client.
+func (group *mlsGroup) processCommit(message mlsPublicMessage, check mlsCredentialCheck, now time.Time) (*mlsGroup, error) {
+	content := message.Content
+	if content.GroupID != group.GroupID || content.ContentType != mlsContentCommit || !content.valid() {
+		return nil, ErrMLSMalformed
+	}
+	if content.Epoch != group.Epoch {
+		return nil, ErrMLSWrongEpoch
+	}
+	sender := group.Tree.leaf(content.Sender)
+	if sender == nil || content.Sender == group.LeafIndex {
+		return nil, ErrMLSMalformed
+	}
+	context := group.groupContext()
+	if !mlsEqual(mlsMAC(group.Secrets.MembershipKey, message.tbm(context)), message.MembershipTag) {
+		return nil, ErrMLSAuthentication
+	}
+	if !mlsVerifyWithLabel(sender.SignatureKey, "FramedContentTBS", mlsFramedContentTBS(mlsWireFormatPublic, content, context), message.Signature) {
+		return nil, ErrMLSAuthentication
+	}
+
+	commit := *content.Commit
+	for _, keyPackage := range commit.Adds {
+		if err := validateMLSKeyPackage(keyPackage, check, now); err != nil {
+			return nil, err
+		}
+	}
+	next, err := group.clone()
+	if err != nil {
+		return nil, err
+	}
+	joiners, err := next.applyProposals(commit)
+	if err != nil {
+		return nil, err
+	}
+	next.pruneKeys()
+
+	// the committer's new leaf keeps its identity
+	if commit.Path == nil {
+		return nil, ErrMLSMalformed
+	}
+	leaf := commit.Path.LeafNode
+	if leaf.Source != types.MLSLeafNodeCommit || leaf.Credential.UserID != sender.Credential.UserID || leaf.Credential.DeviceID != sender.Credential.DeviceID {
+		return nil, ErrMLSMalformed
+	}
+	if !mlsVerifyWithLabel(leaf.SignatureKey, "LeafNodeTBS", mlsLeafNodeTBS(leaf, group.GroupID, content.Sender), leaf.Signature) {
+		return nil, ErrMLSAuthentication
+	}
+	if !mlsEqual(leaf.SignatureKey, sender.SignatureKey) || !mlsEqual(leaf.Credential.Signature, sender.Credential.Signature) {
+		if err := check(leaf); err != nil {
+			return nil, err
+		}
+	}
+	path := next.Tree.filteredDirectPath(content.Sender)
+	if len(path) != len(commit.Path.Nodes) {
+		return nil, ErrMLSMalformed
+	}
+	keys := make([][]byte, len(path))
+	for i, node := range commit.Path.Nodes {
+		keys[i] = node.EncryptionKey
+	}
+	next.setPath(content.Sender, path, keys, leaf)
+	if !mlsEqual(next.Tree.setParentHashes(content.Sender), leaf.ParentHash) {
+		return nil, ErrMLSAuthentication
+	}
+
+	// the lowest node of the path above the client was encrypted to a node
+	// below it whose key the client knows
+	next.Epoch++
+	provisional := next.groupContext()
+	x := mlsLeafNodeIndex(content.Sender)
+	var commitSecret []byte
+	for i, a := range path {
+		if !mlsIsAncestor(a, mlsLeafNodeIndex(next.LeafIndex)) {
+			continue
+		}
+		resolution := excludeMLSLeaves(next.Tree.resolution(next.Tree.copathChild(a, x)), joiners)
+		if len(resolution) != len(commit.Path.Nodes[i].Secrets) {
+			return nil, ErrMLSMalformed
+		}
+		for j, r := range resolution {
+			private, ok := next.PrivateKeys[r]
+			if !ok {
+				continue
+			}
+			secret, err := mlsDecryptWithLabel(private, "UpdatePathNode", provisional, commit.Path.Nodes[i].Secrets[j])
+			if err != nil {
+				return nil, ErrMLSAuthentication
+			}
+			if commitSecret, err = next.pathKeys(path[i:], secret); err != nil {
+				return nil, err
+			}
+			break
+		}
+		break
+	}
+	if commitSecret == nil {
+		return nil, ErrMLSMalformed
+	}
+
+	next.ConfirmedTranscriptHash = message.confirmedTranscriptHash(group.InterimTranscriptHash)
+	newContext := next.groupContext()
+	secrets, encryptionSecret := mlsMemberSchedule(mlsMemberSecret(mlsJoinerSecret(group.Secrets.InitSecret, commitSecret, newContext)), newContext)
+	if !mlsEqual(mlsMAC(secrets.ConfirmationKey, next.ConfirmedTranscriptHash), message.ConfirmationTag) {
+		return nil, ErrMLSAuthentication
+	}
+	next.startEpoch(secrets, encryptionSecret)
+	next.InterimTranscriptHash = mlsInterimTranscriptHash(next.ConfirmedTranscriptHash, message.ConfirmationTag)
+	return next, nil
+}
+
+func mlsSenderDataAAD(groupID string, epoch uint64, contentType uint8) []byte {
+	var aad mlsWriter
+	aad.opaque([]byte(groupID))
+	aad.uint64(epoch)
+	aad.uint8(contentType)
+	return aad.Bytes()
+}
+
+func mlsPrivateContentAAD(message mlsPrivateMessage) []byte {
+	var aad mlsWriter
+	aad.Write(mlsSenderDataAAD(message.GroupID, message.Epoch, message.ContentType))
+	aad.opaque(message.AuthenticatedData)
+	return aad.Bytes()
+}
+
+// senderDataKey derives the key and nonce hiding who sent a message from
+// the start of its ciphertext.
+func (group *mlsGroup) senderDataKey(ciphertext []byte) ([]byte, []byte) {
+	sample := ciphertext
+	if len(sample) > mlsHashSize {
+		sample = sample[:mlsHashSize]
+	}
+	return mlsExpandWithLabel(group.Secrets.SenderDataSecret, "key", sample, mlsKeySize), mlsExpandWithLabel(group.Secrets.SenderDataSecret, "nonce", sample, mlsNonceSize)
+}
+
+// encrypt makes an application message of data, padded to policy.
+func (group *mlsGroup) encrypt(data []byte, policy PaddingPolicy) (mlsPrivateMessage, error) {
+	content := mlsFramedContent{
+		GroupID:         group.GroupID,
+		Epoch:           group.Epoch,
+		Sender:          group.LeafIndex,
+		ContentType:     mlsContentApplication,
+		ApplicationData: data,
+	}
+	signature, err := mlsSignWithLabel(group.SignatureKey, "FramedContentTBS", mlsFramedContentTBS(mlsWireFormatPrivate, content, group.groupContext()))
+	if err != nil {
+		return mlsPrivateMessage{}, err
+	}
+	plaintext, err := json.Marshal(mlsPrivateContent{ApplicationData: data, Signature: signature})
+	if err != nil {
+		return mlsPrivateMessage{}, err
+	}
+
+	ratchet, err := group.SecretTree.ratchet(group.LeafIndex)
+	if err != nil {
+		return mlsPrivateMessage{}, err
+	}
+	generation, keyAndNonce := ratchet.next()
+	reuseGuard, err := mlsRandom(mlsReuseGuard)
+	if err != nil {
+		return mlsPrivateMessage{}, err
+	}
+	message := mlsPrivateMessage{GroupID: group.GroupID, Epoch: group.Epoch, ContentType: mlsContentApplication}
+	message.Ciphertext, err = mlsAEADSeal(keyAndNonce[:mlsKeySize], mlsReuseNonce(keyAndNonce[mlsKeySize:], reuseGuard), pad(plaintext, policy), mlsPrivateContentAAD(message))
+	if err != nil {
+		return mlsPrivateMessage{}, err
+	}
+
+	senderData := make([]byte, mlsSenderDataSize)
+	binary.BigEndian.PutUint32(senderData, group.LeafIndex)
+	binary.BigEndian.PutUint32(senderData[4:], generation)
+	copy(senderData[8:], reuseGuard)
+	key, nonce := group.senderDataKey(message.Ciphertext)
+	message.EncryptedSenderData, err = mlsAEADSeal(key, nonce, senderData, mlsSenderDataAAD(message.GroupID, message.Epoch, message.ContentType))
+	if err != nil {
+		return mlsPrivateMessage{}, err
+	}
+	return message, nil
+}
+
+func mlsReuseNonce(nonce []byte, reuseGuard []byte) []byte {
+	guarded := append([]byte{}, nonce...)
+	for i := range reuseGuard {
+		guarded[i] ^= reuseGuard[i]
+	}
+	return guarded
+}
+
+// decrypt opens an application message of another member, returning its
+// sender with the data. The message key is used up, so decrypt works on a
+// copy of the group that replaces it only when it succeeds.
+func (group *mlsGroup) decrypt(message mlsPrivateMessage) (types.MLSLeafNode, []byte, error) {
+	if message.GroupID != group.GroupID || message.ContentType != mlsContentApplication {
+		return types.MLSLeafNode{}, nil, ErrMLSMalformed
+	}
+	if message.Epoch != group.Epoch {
+		return types.MLSLeafNode{}, nil, ErrMLSWrongEpoch
+	}
+	key, nonce := group.senderDataKey(message.Ciphertext)
+	senderData, err := mlsAEADOpen(key, nonce, message.EncryptedSenderData, mlsSenderDataAAD(message.GroupID, message.Epoch, message.ContentType))
+	if err != nil || len(senderData) != mlsSenderDataSize {
+		return types.MLSLeafNode{}, nil, ErrMLSAuthentication
+	}
+	index := binary.BigEndian.Uint32(senderData)
+	generation := binary.BigEndian.Uint32(senderData[4:])
+	sender := group.Tree.leaf(index)
+	if sender == nil || index == group.LeafIndex {
+		return types.MLSLeafNode{}, nil, ErrMLSMalformed
+	}
+
+	ratchet, err := group.SecretTree.ratchet(index)
+	if err != nil {
+		return types.MLSLeafNode{}, nil, err
+	}
+	keyAndNonce, err := ratchet.get(generation)
+	if err != nil {
+		return types.MLSLeafNode{}, nil, err
+	}
+	padded, err := mlsAEADOpen(keyAndNonce[:mlsKeySize], mlsReuseNonce(keyAndNonce[mlsKeySize:], senderData[8:]), message.Ciphertext, mlsPrivateContentAAD(message))
+	if err != nil {
+		return types.MLSLeafNode{}, nil, ErrMLSAuthentication
+	}
+	plaintext, err := unpad(padded)
+	if err != nil {
+		return types.MLSLeafNode{}, nil, err
+	}
+	var private mlsPrivateContent
+	if err := json.Unmarshal(plaintext, &private); err != nil {
+		return types.MLSLeafNode{}, nil, ErrMLSMalformed
+	}
+	content := mlsFramedContent{
+		GroupID:           group.GroupID,
+		Epoch:             group.Epoch,
+		Sender:            index,
+		AuthenticatedData: message.AuthenticatedData,
+		ContentType:       mlsContentApplication,
+		ApplicationData:   private.ApplicationData,
+	}
+	if !mlsVerifyWithLabel(sender.SignatureKey, "FramedContentTBS", mlsFramedContentTBS(mlsWireFormatPrivate, content, group.groupContext()), private.Signature) {
+		return types.MLSLeafNode{}, nil, ErrMLSAuthentication
+	}
+	return *sender, private.ApplicationData, nil
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrMLSKeyUsed   = errors.New("MLS message key was already used")
+	ErrMLSTooFarOut = errors.New("MLS message is too far ahead of the last received")
+)
+
+// mlsEpochSecrets are the secrets of an epoch of a group that outlive the
+// processing of its commit.
+type mlsEpochSecrets struct {
+	SenderDataSecret   []byte
+	ExporterSecret     []byte
+	ConfirmationKey    []byte
+	MembershipKey      []byte
+	EpochAuthenticator []byte
+	InitSecret         []byte
+}
+
+// encodeMLSGroupContext encodes the GroupContext, which every key of an
+// epoch and every signature in it is bound to.
+func encodeMLSGroupContext(groupID string, epoch uint64, treeHash []byte, confirmedTranscriptHash []byte) []byte {
+	var context mlsWriter
+	context.uint16(mlsVersion)
+	context.uint16(mlsCipherSuite)
+	context.opaque([]byte(groupID))
+	context.uint64(epoch)
+	context.opaque(treeHash)
+	context.opaque(confirmedTranscriptHash)
+	context.vector(func(w *mlsWriter) {})
+	return context.Bytes()
+}
+
+// mlsJoinerSecret is where the key schedule of a new epoch starts from the
+// init secret of the last and the commit secret of its UpdatePath.
+func mlsJoinerSecret(initSecret []byte, commitSecret []byte, groupContext []byte) []byte {
+	return mlsExpandWithLabel(mlsExtract(initSecret, commitSecret), "joiner", groupContext, mlsHashSize)
+}
+
+// mlsMemberSecret mixes in the pre-shared keys of the epoch, of which the
+// client uses none.
+func mlsMemberSecret(joinerSecret []byte) []byte {
+	return mlsExtract(joinerSecret, make([]byte, mlsHashSize))
+}
+
+func mlsWelcomeKey(memberSecret []byte) ([]byte, []byte) {
+	welcomeSecret := mlsDeriveSecret(memberSecret, "welcome")
+	return mlsExpandWithLabel(welcomeSecret, "key", nil, mlsKeySize), mlsExpandWithLabel(welcomeSecret, "nonce", nil, mlsNonceSize)
+}
+
+// mlsEpochSchedule derives the secrets of an epoch and the encryption secret
+// its secret tree grows from.
+func mlsEpochSchedule(epochSecret []byte) (mlsEpochSecrets, []byte) {
+	return mlsEpochSecrets{
+		SenderDataSecret:   mlsDeriveSecret(epochSecret, "sender data"),
+		ExporterSecret:     mlsDeriveSecret(epochSecret, "exporter"),
+		ConfirmationKey:    mlsDeriveSecret(epochSecret, "confirm"),
+		MembershipKey:      mlsDeriveSecret(epochSecret, "membership"),
+		EpochAuthenticator: mlsDeriveSecret(epochSecret, "authentication"),
+		InitSecret:         mlsDeriveSecret(epochSecret, "init"),
+	}, mlsDeriveSecret(epochSecret, "encryption")
+}
+
+// mlsMemberSchedule runs the key schedule from the member secret.
+func mlsMemberSchedule(memberSecret []byte, groupContext []byte) (mlsEpochSecrets, []byte) {
+	return mlsEpochSchedule(mlsExpandWithLabel(memberSecret, "epoch", groupContext, mlsHashSize))
+}
+
+func mlsInterimTranscriptHash(confirmedTranscriptHash []byte, confirmationTag []byte) []byte {
+	var input mlsWriter
+	input.Write(confirmedTranscriptHash)
+	input.opaque(confirmationTag)
+	return mlsHash(input.Bytes())
+}
+
+func mlsEqual(a []byte, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// mlsRatchet is the application ratchet of one member in the secret tree.
+// Keys of generations skipped over are kept until they are used, up to
+// maxSkippedMessageKeys of them.
+type mlsRatchet struct {
+	Secret     []byte
+	Generation uint32
+	Skipped    map[uint32][]byte `json:",omitempty"`
+}
+
+func (ratchet *mlsRatchet) keyAndNonce(generation uint32) []byte {
+	context := make([]byte, 4)
+	binary.BigEndian.PutUint32(context, generation)
+	return append(mlsExpandWithLabel(ratchet.Secret, "key", context, mlsKeySize), mlsExpandWithLabel(ratchet.Secret, "nonce", context, mlsNonceSize)...)
+}
+
+func (ratchet *mlsRatchet) advance() {
+	context := make([]byte, 4)
+	binary.BigEndian.PutUint32(context, ratchet.Generation)
+	ratchet.Secret = mlsExpandWithLabel(ratchet.Secret, "secret", context, mlsHashSize)
+	ratchet.Generation++
+}
+
+// next returns the key and nonce of the next generation, for sending.
+func (ratchet *mlsRatchet) next() (uint32, []byte) {
+	generation := ratchet.Generation
+	keyAndNonce := ratchet.keyAndNonce(generation)
+	ratchet.advance()
+	return generation, keyAndNonce
+}
+
+// get returns the key and nonce of a generation once; it is forgotten after.
+func (ratchet *mlsRatchet) get(generation uint32) ([]byte, error) {
+	if generation < ratchet.Generation {
+		keyAndNonce, ok := ratchet.Skipped[generation]
+		if !ok {
+			return nil, ErrMLSKeyUsed
+		}
+		delete(ratchet.Skipped, generation)
+		return keyAndNonce, nil
+	}
+	if uint64(generation-ratchet.Generation)+uint64(len(ratchet.Skipped)) > maxSkippedMessageKeys {
+		return nil, ErrMLSTooFarOut
+	}
+	for ratchet.Generation < generation {
+		if ratchet.Skipped == nil {
+			ratchet.Skipped = make(map[uint32][]byte)
+		}
+		ratchet.Skipped[ratchet.Generation] = ratchet.keyAndNonce(ratchet.Generation)
+		ratchet.advance()
+	}
+	_, keyAndNonce := ratchet.next()
+	return keyAndNonce, nil
+}
+
+// mlsSecretTree hands out the message keys of an epoch. The secret of a
+// node is replaced by those of its children as soon as it is used, so keys
+// once deleted cannot be derived again.
+type mlsSecretTree struct {
+	Width    uint32
+	Nodes    map[uint32][]byte
+	Ratchets map[uint32]*mlsRatchet
+}
+
+func newMLSSecretTree(encryptionSecret []byte, tree mlsTree) mlsSecretTree {
+	return mlsSecretTree{
+		Width:    uint32(len(tree)),
+		Nodes:    map[uint32][]byte{tree.root(): encryptionSecret},
+		Ratchets: make(map[uint32]*mlsRatchet),
+	}
+}
+
+// ratchet returns the application ratchet of a leaf, deriving it down from
+// the lowest node above the leaf whose secret is still there.
+func (secrets *mlsSecretTree) ratchet(leaf uint32) (*mlsRatchet, error) {
+	if ratchet, ok := secrets.Ratchets[leaf]; ok {
+		return ratchet, nil
+	}
+	tree := make(mlsTree, secrets.Width)
+	x := mlsLeafNodeIndex(leaf)
+	if x >= secrets.Width {
+		return nil, ErrMLSMalformed
+	}
+	path := append([]uint32{x}, tree.directPath(x)...)
+	start := -1
+	for i, node := range path {
+		if _, ok := secrets.Nodes[node]; ok {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		return nil, ErrMLSKeyUsed
+	}
+	for i := start; i > 0; i-- {
+		node := path[i]
+		secret := secrets.Nodes[node]
+		delete(secrets.Nodes, node)
+		secrets.Nodes[mlsLeft(node)] = mlsExpandWithLabel(secret, "tree", []byte("left"), mlsHashSize)
+		secrets.Nodes[mlsRight(node)] = mlsExpandWithLabel(secret, "tree", []byte("right"), mlsHashSize)
+	}
+	ratchet := &mlsRatchet{Secret: mlsExpandWithLabel(secrets.Nodes[x], "application", nil, mlsHashSize)}
+	delete(secrets.Nodes, x)
+	secrets.Ratchets[leaf] = ratchet
+	return ratchet, nil
+}
@@ -0,0 +1,328 @@
+package client
+
+import (
+	"bytes"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+const (
+	// mlsCredentialDevice is the credential type of types.MLSCredential,
+	// from the range RFC 9420 leaves for private use.
+	mlsCredentialDevice = 0xF000
+	mlsNodeLeaf         = 1
+	mlsNodeParent       = 2
+	mlsExtensionTree    = 2 // ratchet_tree
+)
+
+// mlsParentNode is a node of the ratchet tree above the leaves. Members
+// below it who joined after its key was set are listed in UnmergedLeaves,
+// as they do not know its private key.
+type mlsParentNode struct {
+	EncryptionKey  []byte
+	ParentHash     []byte
+	UnmergedLeaves []uint32
+}
+
+// mlsNode is a node of the ratchet tree, either a leaf or a parent.
+type mlsNode struct {
+	Leaf   *types.MLSLeafNode `json:",omitempty"`
+	Parent *mlsParentNode     `json:",omitempty"`
+}
+
+// mlsTree is the ratchet tree of an MLS group laid out as an array, leaves
+// at even indices, as in Appendix C of RFC 9420. The tree is always full,
+// its leaf count a power of two; blank nodes are nil.
+type mlsTree []*mlsNode
+
+func newMLSTree(leaf types.MLSLeafNode) mlsTree {
+	return mlsTree{{Leaf: &leaf}}
+}
+
+func mlsLevel(x uint32) uint32 {
+	level := uint32(0)
+	for (x>>level)&1 == 1 {
+		level++
+	}
+	return level
+}
+
+func mlsLeft(x uint32) uint32 {
+	return x ^ (1 << (mlsLevel(x) - 1))
+}
+
+func mlsRight(x uint32) uint32 {
+	return x ^ (3 << (mlsLevel(x) - 1))
+}
+
+func mlsParent(x uint32) uint32 {
+	level := mlsLevel(x)
+	b := (x >> (level + 1)) & 1
+	return (x | (1 << level)) ^ (b << (level + 1))
+}
+
+// mlsIsAncestor reports whether a is y or above it.
+func mlsIsAncestor(a uint32, y uint32) bool {
+	level := mlsLevel(a)
+	return y>>(level+1) == a>>(level+1)
+}
+
+func mlsLeafNodeIndex(leaf uint32) uint32 {
+	return 2 * leaf
+}
+
+func (tree mlsTree) leafCount() uint32 {
+	return (uint32(len(tree)) + 1) / 2
+}
+
+func (tree mlsTree) root() uint32 {
+	return tree.leafCount() - 1
+}
+
+func (tree mlsTree) leaf(leaf uint32) *types.MLSLeafNode {
+	index := mlsLeafNodeIndex(leaf)
+	if index >= uint32(len(tree)) || tree[index] == nil {
+		return nil
+	}
+	return tree[index].Leaf
+}
+
+// sibling returns the other child of the parent of x.
+func (tree mlsTree) sibling(x uint32) uint32 {
+	p := mlsParent(x)
+	if x < p {
+		return mlsRight(p)
+	}
+	return mlsLeft(p)
+}
+
+func (tree mlsTree) directPath(x uint32) []uint32 {
+	path := make([]uint32, 0)
+	for x != tree.root() {
+		x = mlsParent(x)
+		path = append(path, x)
+	}
+	return path
+}
+
+// copathChild returns the child of a on the side away from x, which a is
+// above.
+func (tree mlsTree) copathChild(a uint32, x uint32) uint32 {
+	if x < a {
+		return mlsRight(a)
+	}
+	return mlsLeft(a)
+}
+
+// resolution returns the nodes that together cover the members below x:
+// x itself with its unmerged leaves when it is not blank, otherwise the
+// resolutions of its children.
+func (tree mlsTree) resolution(x uint32) []uint32 {
+	node := tree[x]
+	if node != nil {
+		resolution := []uint32{x}
+		if node.Parent != nil {
+			for _, leaf := range node.Parent.UnmergedLeaves {
+				resolution = append(resolution, mlsLeafNodeIndex(leaf))
+			}
+		}
+		return resolution
+	}
+	if mlsLevel(x) == 0 {
+		return nil
+	}
+	return append(tree.resolution(mlsLeft(x)), tree.resolution(mlsRight(x))...)
+}
+
+// filteredDirectPath is the direct path of a leaf without the nodes whose
+// child away from the leaf covers nobody, which need no key.
+func (tree mlsTree) filteredDirectPath(leaf uint32) []uint32 {
+	x := mlsLeafNodeIndex(leaf)
+	filtered := make([]uint32, 0)
+	for _, a := range tree.directPath(x) {
+		if len(tree.resolution(tree.copathChild(a, x))) > 0 {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+// publicKey returns the encryption key of a node that is not blank.
+func (tree mlsTree) publicKey(x uint32) []byte {
+	if tree[x].Leaf != nil {
+		return tree[x].Leaf.EncryptionKey
+	}
+	return tree[x].Parent.EncryptionKey
+}
+
+// addLeaf puts leaf in the leftmost blank leaf, growing the tree when there
+// is none, and returns its index. It is unmerged at the parents above it.
+func (tree *mlsTree) addLeaf(leaf types.MLSLeafNode) uint32 {
+	index := uint32(0)
+	for ; index < tree.leafCount(); index++ {
+		if tree.leaf(index) == nil {
+			break
+		}
+	}
+	if index == tree.leafCount() {
+		*tree = append(*tree, make(mlsTree, len(*tree)+1)...)
+	}
+	x := mlsLeafNodeIndex(index)
+	(*tree)[x] = &mlsNode{Leaf: &leaf}
+	for _, a := range tree.directPath(x) {
+		if node := (*tree)[a]; node != nil {
+			node.Parent.UnmergedLeaves = append(node.Parent.UnmergedLeaves, index)
+		}
+	}
+	return index
+}
+
+// removeLeaf blanks a leaf and the nodes above it, whose keys it knew, and
+// drops the right half of the tree while it is empty.
+func (tree *mlsTree) removeLeaf(leaf uint32) {
+	x := mlsLeafNodeIndex(leaf)
+	(*tree)[x] = nil
+	for _, a := range tree.directPath(x) {
+		(*tree)[a] = nil
+	}
+	for tree.leafCount() > 1 {
+		empty := true
+		for index := tree.leafCount() / 2; index < tree.leafCount(); index++ {
+			if tree.leaf(index) != nil {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			break
+		}
+		*tree = (*tree)[:tree.root()]
+	}
+}
+
+// findLeaf returns the index of the leaf with encryptionKey.
+func (tree mlsTree) findLeaf(encryptionKey []byte) (uint32, bool) {
+	for index := uint32(0); index < tree.leafCount(); index++ {
+		if leaf := tree.leaf(index); leaf != nil && bytes.Equal(leaf.EncryptionKey, encryptionKey) {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// treeHash is the tree hash of the subtree under x of RFC 9420.
+func (tree mlsTree) treeHash(x uint32) []byte {
+	var input mlsWriter
+	if mlsLevel(x) == 0 {
+		input.uint8(mlsNodeLeaf)
+		input.uint32(x / 2)
+		input.optional(tree[x] != nil)
+		if tree[x] != nil {
+			encodeMLSLeafNode(&input, *tree[x].Leaf)
+		}
+		return mlsHash(input.Bytes())
+	}
+	input.uint8(mlsNodeParent)
+	input.optional(tree[x] != nil)
+	if tree[x] != nil {
+		encodeMLSParentNode(&input, *tree[x].Parent)
+	}
+	input.opaque(tree.treeHash(mlsLeft(x)))
+	input.opaque(tree.treeHash(mlsRight(x)))
+	return mlsHash(input.Bytes())
+}
+
+// setParentHashes chains the parent hashes down the filtered direct path of
+// a leaf whose path was just set, each parent hash covering the node above
+// along with the subtree beside the path, and returns the parent hash the
+// leaf signs.
+func (tree mlsTree) setParentHashes(leaf uint32) []byte {
+	x := mlsLeafNodeIndex(leaf)
+	path := tree.filteredDirectPath(leaf)
+	var parentHash []byte
+	for i := len(path) - 1; i >= 0; i-- {
+		node := tree[path[i]].Parent
+		node.ParentHash = parentHash
+		var input mlsWriter
+		input.opaque(node.EncryptionKey)
+		input.opaque(node.ParentHash)
+		input.opaque(tree.treeHash(tree.copathChild(path[i], x)))
+		parentHash = mlsHash(input.Bytes())
+	}
+	return parentHash
+}
+
+// encodeMLSLeafNode encodes a LeafNode as signed.
+func encodeMLSLeafNode(w *mlsWriter, leaf types.MLSLeafNode) {
+	encodeMLSLeafNodeContent(w, leaf)
+	w.opaque(leaf.Signature)
+}
+
+func encodeMLSLeafNodeContent(w *mlsWriter, leaf types.MLSLeafNode) {
+	w.opaque(leaf.EncryptionKey)
+	w.opaque(leaf.SignatureKey)
+	w.uint16(mlsCredentialDevice)
+	w.opaque([]byte(leaf.Credential.UserID))
+	w.opaque([]byte(leaf.Credential.DeviceID))
+	w.opaque(leaf.Credential.Signature)
+	// capabilities: the one version, cipher suite and credential type the
+	// client supports
+	w.vector(func(w *mlsWriter) { w.uint16(mlsVersion) })
+	w.vector(func(w *mlsWriter) { w.uint16(mlsCipherSuite) })
+	w.vector(func(w *mlsWriter) {})
+	w.vector(func(w *mlsWriter) {})
+	w.vector(func(w *mlsWriter) { w.uint16(mlsCredentialDevice) })
+	w.uint8(leaf.Source)
+	switch leaf.Source {
+	case types.MLSLeafNodeKeyPackage:
+		var lifetime types.MLSLifetime
+		if leaf.Lifetime != nil {
+			lifetime = *leaf.Lifetime
+		}
+		w.uint64(uint64(lifetime.NotBefore.Unix()))
+		w.uint64(uint64(lifetime.NotAfter.Unix()))
+	case types.MLSLeafNodeCommit:
+		w.opaque(leaf.ParentHash)
+	}
+	w.vector(func(w *mlsWriter) {})
+}
+
+// mlsLeafNodeTBS is what the signature of a leaf covers. Leaves of commits
+// and updates are bound to their group and position in it.
+func mlsLeafNodeTBS(leaf types.MLSLeafNode, groupID string, index uint32) []byte {
+	var tbs mlsWriter
+	encodeMLSLeafNodeContent(&tbs, leaf)
+	if leaf.Source != types.MLSLeafNodeKeyPackage {
+		tbs.opaque([]byte(groupID))
+		tbs.uint32(index)
+	}
+	return tbs.Bytes()
+}
+
+func encodeMLSParentNode(w *mlsWriter, node mlsParentNode) {
+	w.opaque(node.EncryptionKey)
+	w.opaque(node.ParentHash)
+	w.vector(func(w *mlsWriter) {
+		for _, leaf := range node.UnmergedLeaves {
+			w.uint32(leaf)
+		}
+	})
+}
+
+// encodeMLSTree encodes the tree as the ratchet_tree extension carries it.
+func encodeMLSTree(w *mlsWriter, tree mlsTree) {
+	w.vector(func(w *mlsWriter) {
+		for _, node := range tree {
+			w.optional(node != nil)
+			switch {
+			case node == nil:
+			case node.Leaf != nil:
+				w.uint8(mlsNodeLeaf)
+				encodeMLSLeafNode(w, *node.Leaf)
+			default:
+				w.uint8(mlsNodeParent)
+				encodeMLSParentNode(w, *node.Parent)
+			}
+		}
+	})
+}
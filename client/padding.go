@@ -0,0 +1,92 @@
+package client
+
+import (
+	"errors"
+	"math/bits"
+)
+
+const (
+	// paddingMarker ends the plaintext, followed by zeros up to the padded
+	// size as in ISO/IEC 7816-4.
+	paddingMarker = 0x80
+	// minPaddedSize is the size every padded plaintext reaches, so short
+	// messages all look alike.
+	minPaddedSize = 64
+)
+
+var ErrInvalidPadding = errors.New("decrypted content is not padded correctly")
+
+// PaddingPolicy returns the size plaintext of length bytes, including the
+// padding marker, is padded to before encryption. It must be at least length.
+type PaddingPolicy func(length int) int
+
+// DefaultPadding is the policy of EncryptContent and of clients that set no
+// policy of their own.
+var DefaultPadding PaddingPolicy = PadPadme
+
+// PadNone leaves the length of the plaintext showing.
+func PadNone(length int) int {
+	return length
+}
+
+// PadPowerOfTwo pads to the next power of two, leaking only the order of
+// magnitude of the length at the cost of up to doubling it.
+func PadPowerOfTwo(length int) int {
+	if length <= minPaddedSize {
+		return minPaddedSize
+	}
+	return 1 << bits.Len(uint(length-1))
+}
+
+// PadPadme pads to the sizes of the Padmé scheme of Nikitin et al., "Reducing
+// Metadata Leakage from Encrypted Files and Communication with PURBs", which
+// leaks O(log log L) bits of the length L for at most 12% overhead.
+func PadPadme(length int) int {
+	if length <= minPaddedSize {
+		return minPaddedSize
+	}
+	exponent := bits.Len(uint(length)) - 1
+	exponentBits := bits.Len(uint(exponent))
+	lastBits := exponent - exponentBits
+	mask := 1<<uint(lastBits) - 1
+	return (length + mask) &^ mask
+}
+
+// pad appends the padding marker and zeros up to the size policy asks for.
+func pad(plaintext []byte, policy PaddingPolicy) []byte {
+	if policy == nil {
+		policy = DefaultPadding
+	}
+	length := len(plaintext) + 1
+	size := policy(length)
+	if size < length {
+		size = length
+	}
+	padded := make([]byte, size)
+	copy(padded, plaintext)
+	padded[len(plaintext)] = paddingMarker
+	return padded
+}
+
+// unpad strips the padding added by pad.
+func unpad(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0:
+			continue
+		case paddingMarker:
+			return padded[:i], nil
+		default:
+			return nil, ErrInvalidPadding
+		}
+	}
+	return nil, ErrInvalidPadding
+}
+
+// padding returns the padding policy of the client.
+func (cli *Client) padding() PaddingPolicy {
+	if cli.Padding == nil {
+		return DefaultPadding
+	}
+	return cli.Padding
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PaddingPolicy
+		length   int
+		expected int
+	}{
+		{"NoneShort", PadNone, 7, 7},
+		{"PowerOfTwoShort", PadPowerOfTwo, 7, minPaddedSize},
+		{"PowerOfTwoExact", PadPowerOfTwo, 128, 128},
+		{"PowerOfTwo", PadPowerOfTwo, 129, 256},
+		{"PadmeShort", PadPadme, 1, minPaddedSize},
+		{"Padme100", PadPadme, 100, 104},
+		{"Padme1000", PadPadme, 1000, 1024},
+		{"Padme1025", PadPadme, 1025, 1088},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if size := test.policy(test.length); size != test.expected {
+				t.Errorf("padded %d bytes to %d, expected %d", test.length, size, test.expected)
+			}
+		})
+	}
+
+	// Padmé never adds more than 12%
+	for length := minPaddedSize; length < 1<<16; length += 97 {
+		if size := PadPadme(length); size < length || float64(size-length) > 0.12*float64(length) {
+			t.Fatalf("padded %d bytes to %d", length, size)
+		}
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, plaintext := range [][]byte{{}, []byte("Hello!"), {0, 0x80, 0}, bytes.Repeat([]byte{0x80}, 300)} {
+		for _, policy := range []PaddingPolicy{PadNone, PadPowerOfTwo, PadPadme} {
+			padded := pad(plaintext, policy)
+			unpadded, err := unpad(padded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unpadded, plaintext) {
+				t.Errorf("unpadded %x, expected %x", unpadded, plaintext)
+			}
+		}
+	}
+	if _, err := unpad([]byte{1, 2, 0}); err != ErrInvalidPadding {
+		t.Errorf("expected ErrInvalidPadding but got %v", err)
+	}
+}
+
+func TestPaddingHidesLength(t *testing.T) {
+	privKey, err := generateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := testPublicKeyForUse(t, privKey, utils.UseEncryption)
+
+	var lengths []int
+	for _, content := range []string{"", "ok", "see you at eight"} {
+		encrypted, err := MakeClientMessage("ROOT", "MEP", content).EncryptContent(pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the padding survives the trip through the /messages JSON
+		data, err := json.Marshal(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received ClientMessage
+		if err := json.Unmarshal(data, &received); err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := received.DecryptContent(privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted.Content != content {
+			t.Errorf("decrypted %q, expected %q", decrypted.Content, content)
+		}
+		lengths = append(lengths, len(strings.TrimRight(received.Content, "=")))
+	}
+	for _, length := range lengths[1:] {
+		if length != lengths[0] {
+			t.Errorf("short messages encrypted to different lengths %v", lengths)
+		}
+	}
+
+	// the padding flag is not authenticated, so clearing it changes nothing
+	encrypted, err := MakeClientMessage("ROOT", "MEP", "padded").EncryptContent(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := encrypted.envelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Padded = false
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted.Content = base64.URLEncoding.EncodeToString(data)
+	decrypted, err := encrypted.DecryptContent(privKey)
+	if err != nil || decrypted.Content != "padded" {
+		t.Errorf("expected %q after clearing the padding flag but got %q: %v", "padded", decrypted.Content, err)
+	}
+}
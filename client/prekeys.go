@@ -0,0 +1,237 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixPrekeys = ".prekeys"
+)
+
+var ErrUnknownPrekey = errors.New("prekey is unknown or already used")
+
+// prekeyState holds the private halves of everything a client has published
+// to /pubkey/prekeys. It is saved next to the private key file.
+type prekeyState struct {
+	IdentityKey         []byte
+	SignedPrekeys       map[uint32][]byte
+	CurrentSignedPrekey uint32
+	OneTimePrekeys      map[uint32][]byte
+	NextPrekeyID        uint32
+}
+
+func loadPrekeyState(file stateFile) (*prekeyState, error) {
+	state := &prekeyState{
+		SignedPrekeys:  make(map[uint32][]byte),
+		OneTimePrekeys: make(map[uint32][]byte),
+		NextPrekeyID:   1,
+	}
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (state *prekeyState) save(file stateFile) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+// identity returns the X3DH identity key, generating it on first use.
+func (state *prekeyState) identity() (x25519.PrivateKey, error) {
+	if state.IdentityKey == nil {
+		_, identityKey, err := x25519.GenerateKey(nil)
+		if err != nil {
+			return nil, err
+		}
+		state.IdentityKey = identityKey.Seed()
+	}
+	return x25519.NewKeyFromSeed(state.IdentityKey)
+}
+
+func (state *prekeyState) newPrekey() (types.Prekey, []byte, error) {
+	publicKey, privateKey, err := x25519.GenerateKey(nil)
+	if err != nil {
+		return types.Prekey{}, nil, err
+	}
+	prekey := types.Prekey{ID: state.NextPrekeyID, Key: publicKey}
+	state.NextPrekeyID++
+	return prekey, privateKey.Seed(), nil
+}
+
+// PublishPrekeys rotates the signed prekey and publishes count new one-time
+// prekeys.
+func (cli *Client) PublishPrekeys(count int) error {
+	file := cli.stateFile(suffixPrekeys)
+	state, err := loadPrekeyState(file)
+	if err != nil {
+		return err
+	}
+	identityKey, err := state.identity()
+	if err != nil {
+		return err
+	}
+	identityPublic := []byte(identityKey.Public().(x25519.PublicKey))
+
+	prekey, privateKey, err := state.newPrekey()
+	if err != nil {
+		return err
+	}
+	signature, err := utils.Sign(cli.PrivateKey, types.SignedPrekeyBytes(identityPublic, prekey))
+	if err != nil {
+		return err
+	}
+	// the previous signed prekey is kept so first messages sent before the
+	// rotation can still be read
+	previous := state.CurrentSignedPrekey
+	state.SignedPrekeys[prekey.ID] = privateKey
+	state.CurrentSignedPrekey = prekey.ID
+	for id := range state.SignedPrekeys {
+		if id != prekey.ID && id != previous {
+			delete(state.SignedPrekeys, id)
+		}
+	}
+
+	upload := types.PrekeyUpload{
+		IdentityKey:  identityPublic,
+		SignedPrekey: &types.SignedPrekey{Prekey: prekey, Signature: signature},
+	}
+	upload.OneTimePrekeys, err = state.newOneTimePrekeys(count)
+	if err != nil {
+		return err
+	}
+	if err := cli.uploadPrekeys(upload); err != nil {
+		return err
+	}
+	return state.save(file)
+}
+
+// TopUpPrekeys publishes count more one-time prekeys when fewer than minimum
+// are left on the server.
+func (cli *Client) TopUpPrekeys(minimum int, count int) error {
+	request, err := cli.newRequest(http.MethodGet, "/pubkey/prekeys", nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("client.TopUpPrekeys status of " + response.Status)
+	}
+	var remaining types.PrekeyCount
+	if err := json.NewDecoder(response.Body).Decode(&remaining); err != nil {
+		return err
+	}
+	if remaining.OneTimePrekeys >= minimum {
+		return nil
+	}
+
+	file := cli.stateFile(suffixPrekeys)
+	state, err := loadPrekeyState(file)
+	if err != nil {
+		return err
+	}
+	if state.IdentityKey == nil {
+		// nothing published yet, start from scratch
+		return cli.PublishPrekeys(count)
+	}
+	upload := types.PrekeyUpload{}
+	upload.OneTimePrekeys, err = state.newOneTimePrekeys(count)
+	if err != nil {
+		return err
+	}
+	if err := cli.uploadPrekeys(upload); err != nil {
+		return err
+	}
+	return state.save(file)
+}
+
+// FetchPrekeyBundle takes a prekey bundle for a device of userID from the
+// server and checks that it was signed by the signing key registered for the
+// device.
+func (cli *Client) FetchPrekeyBundle(userID string, deviceID string) (types.PrekeyBundle, error) {
+	request, err := cli.newRequest(http.MethodGet, "/pubkey/bundle", nil)
+	if err != nil {
+		return types.PrekeyBundle{}, err
+	}
+	query := request.URL.Query()
+	query.Add("userID", userID)
+	query.Add("deviceID", deviceID)
+	request.URL.RawQuery = query.Encode()
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return types.PrekeyBundle{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return types.PrekeyBundle{}, errors.New("client.FetchPrekeyBundle status of " + response.Status)
+	}
+	var bundle types.PrekeyBundle
+	if err := json.NewDecoder(response.Body).Decode(&bundle); err != nil {
+		return types.PrekeyBundle{}, err
+	}
+
+	if bundle.DeviceID != deviceID {
+		return types.PrekeyBundle{}, fmt.Errorf("prekey bundle for %s is for device %s", userID, bundle.DeviceID)
+	}
+	signingKey, err := cli.fetchDeviceSigningKey(userID, deviceID)
+	if err != nil {
+		return types.PrekeyBundle{}, err
+	}
+	signed := types.SignedPrekeyBytes(bundle.IdentityKey, bundle.SignedPrekey.Prekey)
+	if err := utils.Verify(signingKey, signed, bundle.SignedPrekey.Signature); err != nil {
+		return types.PrekeyBundle{}, fmt.Errorf("prekey bundle for %s: %w", userID, err)
+	}
+	return bundle, nil
+}
+
+func (state *prekeyState) newOneTimePrekeys(count int) ([]types.Prekey, error) {
+	prekeys := make([]types.Prekey, 0, count)
+	for i := 0; i < count; i++ {
+		prekey, privateKey, err := state.newPrekey()
+		if err != nil {
+			return nil, err
+		}
+		state.OneTimePrekeys[prekey.ID] = privateKey
+		prekeys = append(prekeys, prekey)
+	}
+	return prekeys, nil
+}
+
+func (cli *Client) uploadPrekeys(upload types.PrekeyUpload) error {
+	request, err := cli.newRequest(http.MethodPost, "/pubkey/prekeys", upload)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return errors.New("client.uploadPrekeys status of " + response.Status)
+	}
+	return nil
+}
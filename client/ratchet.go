@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lestrrat-go/jwx/x25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// maxSkippedMessageKeys bounds how far ahead of the last received message
+	// a peer may jump, and how many skipped keys a session keeps.
+	maxSkippedMessageKeys = 1000
+
+	infoRatchetRoot    = "messenger ratchet root"
+	infoRatchetMessage = "messenger ratchet message"
+)
+
+var (
+	ErrTooManySkippedMessages = errors.New("message is too far ahead of the session")
+	ErrSessionCannotSend      = errors.New("session has not received a message yet and cannot send")
+)
+
+// ratchetHeader is sent in the clear with every Double Ratchet message.
+type ratchetHeader struct {
+	DH            []byte `json:"dh"`
+	PreviousCount uint32 `json:"pn"`
+	Count         uint32 `json:"n"`
+}
+
+func (header ratchetHeader) bytes() []byte {
+	encoded := make([]byte, len(header.DH)+8)
+	copy(encoded, header.DH)
+	binary.BigEndian.PutUint32(encoded[len(header.DH):], header.PreviousCount)
+	binary.BigEndian.PutUint32(encoded[len(header.DH)+4:], header.Count)
+	return encoded
+}
+
+// ratchetSession is the Double Ratchet state of one session with a peer. A
+// new message key is derived for every message and deleted once used, so a
+// leaked key exposes neither earlier nor, after the next DH step, later
+// messages.
+type ratchetSession struct {
+	RootKey         []byte
+	DHSelf          []byte
+	DHRemote        []byte
+	SendChainKey    []byte
+	ReceiveChainKey []byte
+	SendCount       uint32
+	ReceiveCount    uint32
+	PreviousCount   uint32
+	// Skipped holds the keys of messages not yet received, indexed by the
+	// ratchet public key and message number.
+	Skipped        map[string][]byte
+	AssociatedData []byte
+	// X3DH is attached to outgoing messages until the peer replies, so they
+	// can set up their side of the session.
+	X3DH *x3dhHeader
+	// X3DHEphemeralKey identifies the X3DH run the session came from.
+	X3DHEphemeralKey []byte
+}
+
+// newInitiatorSession starts a session from an X3DH secret, using the peer's
+// signed prekey as their first ratchet key.
+func newInitiatorSession(secret []byte, associatedData []byte, header x3dhHeader, remote []byte) (*ratchetSession, error) {
+	_, dhSelf, err := x25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	session := &ratchetSession{
+		DHSelf:           dhSelf.Seed(),
+		DHRemote:         remote,
+		Skipped:          make(map[string][]byte),
+		AssociatedData:   associatedData,
+		X3DH:             &header,
+		X3DHEphemeralKey: header.EphemeralKey,
+	}
+	dhOut, err := curve25519.X25519(session.DHSelf, session.DHRemote)
+	if err != nil {
+		return nil, err
+	}
+	session.RootKey, session.SendChainKey, err = kdfRoot(secret, dhOut)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// newResponderSession starts the session of the recipient of a first
+// message, whose signed prekey is their first ratchet key.
+func newResponderSession(secret []byte, associatedData []byte, header x3dhHeader, signedPrekey []byte) *ratchetSession {
+	return &ratchetSession{
+		RootKey:          secret,
+		DHSelf:           signedPrekey,
+		Skipped:          make(map[string][]byte),
+		AssociatedData:   associatedData,
+		X3DHEphemeralKey: header.EphemeralKey,
+	}
+}
+
+func (session *ratchetSession) encrypt(plaintext []byte, associatedData []byte) (ratchetHeader, []byte, error) {
+	if session.SendChainKey == nil {
+		return ratchetHeader{}, nil, ErrSessionCannotSend
+	}
+	dhSelfPublic, err := curve25519.X25519(session.DHSelf, curve25519.Basepoint)
+	if err != nil {
+		return ratchetHeader{}, nil, err
+	}
+	header := ratchetHeader{
+		DH:            dhSelfPublic,
+		PreviousCount: session.PreviousCount,
+		Count:         session.SendCount,
+	}
+	var messageKey []byte
+	session.SendChainKey, messageKey = kdfChain(session.SendChainKey)
+	session.SendCount++
+
+	ciphertext, err := sealMessageKey(messageKey, plaintext, session.messageAssociatedData(header, associatedData))
+	return header, ciphertext, err
+}
+
+// decrypt decrypts a message of the session. The session is only changed
+// when the message authenticates, so forged or corrupt messages cannot
+// knock it out of step.
+func (session *ratchetSession) decrypt(header ratchetHeader, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	working, err := session.clone()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := working.decryptInPlace(header, ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	*session = *working
+	return plaintext, nil
+}
+
+func (session *ratchetSession) decryptInPlace(header ratchetHeader, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	messageAssociatedData := session.messageAssociatedData(header, associatedData)
+	index := skippedIndex(header.DH, header.Count)
+	if messageKey, ok := session.Skipped[index]; ok {
+		delete(session.Skipped, index)
+		return openMessageKey(messageKey, ciphertext, messageAssociatedData)
+	}
+
+	if !bytes.Equal(header.DH, session.DHRemote) {
+		if err := session.skip(header.PreviousCount); err != nil {
+			return nil, err
+		}
+		if err := session.dhRatchet(header); err != nil {
+			return nil, err
+		}
+	}
+	if err := session.skip(header.Count); err != nil {
+		return nil, err
+	}
+	var messageKey []byte
+	session.ReceiveChainKey, messageKey = kdfChain(session.ReceiveChainKey)
+	session.ReceiveCount++
+	return openMessageKey(messageKey, ciphertext, messageAssociatedData)
+}
+
+// skip stores the keys of messages on the receiving chain up to but not
+// including until, so they can be read if they arrive later.
+func (session *ratchetSession) skip(until uint32) error {
+	if session.ReceiveChainKey == nil {
+		return nil
+	}
+	if until > session.ReceiveCount+maxSkippedMessageKeys {
+		return ErrTooManySkippedMessages
+	}
+	for session.ReceiveCount < until {
+		if len(session.Skipped) >= maxSkippedMessageKeys {
+			return ErrTooManySkippedMessages
+		}
+		var messageKey []byte
+		session.ReceiveChainKey, messageKey = kdfChain(session.ReceiveChainKey)
+		session.Skipped[skippedIndex(session.DHRemote, session.ReceiveCount)] = messageKey
+		session.ReceiveCount++
+	}
+	return nil
+}
+
+func (session *ratchetSession) dhRatchet(header ratchetHeader) error {
+	session.PreviousCount = session.SendCount
+	session.SendCount = 0
+	session.ReceiveCount = 0
+	session.DHRemote = header.DH
+
+	dhOut, err := curve25519.X25519(session.DHSelf, session.DHRemote)
+	if err != nil {
+		return err
+	}
+	session.RootKey, session.ReceiveChainKey, err = kdfRoot(session.RootKey, dhOut)
+	if err != nil {
+		return err
+	}
+
+	_, dhSelf, err := x25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	session.DHSelf = dhSelf.Seed()
+	dhOut, err = curve25519.X25519(session.DHSelf, session.DHRemote)
+	if err != nil {
+		return err
+	}
+	session.RootKey, session.SendChainKey, err = kdfRoot(session.RootKey, dhOut)
+	return err
+}
+
+func (session *ratchetSession) messageAssociatedData(header ratchetHeader, associatedData []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(session.AssociatedData)
+	buffer.Write(header.bytes())
+	buffer.Write(associatedData)
+	return buffer.Bytes()
+}
+
+func (session *ratchetSession) clone() (*ratchetSession, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	var clone ratchetSession
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, err
+	}
+	if clone.Skipped == nil {
+		clone.Skipped = make(map[string][]byte)
+	}
+	return &clone, nil
+}
+
+func skippedIndex(dh []byte, count uint32) string {
+	return fmt.Sprintf("%s:%d", base64.RawURLEncoding.EncodeToString(dh), count)
+}
+
+// kdfRoot advances the root chain with the output of a DH exchange, giving
+// the new root key and a new sending or receiving chain key.
+func kdfRoot(rootKey []byte, dhOut []byte) ([]byte, []byte, error) {
+	output := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rootKey, []byte(infoRatchetRoot)), output); err != nil {
+		return nil, nil, err
+	}
+	return output[:32], output[32:], nil
+}
+
+// kdfChain advances a sending or receiving chain, giving the next chain key
+// and the message key for the current message.
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	nextChainKey := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+	return nextChainKey, messageKey
+}
+
+// messageCipher expands a message key into an AES-256-GCM key and nonce.
+// Every message key is used once, so the derived nonce never repeats.
+func messageCipher(messageKey []byte) ([]byte, []byte, error) {
+	output := make([]byte, sizeContentKey+12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, messageKey, nil, []byte(infoRatchetMessage)), output); err != nil {
+		return nil, nil, err
+	}
+	return output[:sizeContentKey], output[sizeContentKey:], nil
+}
+
+func sealMessageKey(messageKey []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, associatedData), nil
+}
+
+func openMessageKey(messageKey []byte, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, associatedData)
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testSessionPair runs X3DH between two clients and returns the initiator's
+// session and the responder's session, before any message was exchanged.
+func testSessionPair(t *testing.T) (*ratchetSession, *ratchetSession) {
+	dir := t.TempDir()
+	alice := &Client{keyPath: filepath.Join(dir, "alice")}
+	bob := &Client{keyPath: filepath.Join(dir, "bob")}
+	bundle := testPrekeyBundle(t, bob, true)
+
+	secret, associatedData, header, err := alice.initiateX3DH(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceSession, err := newInitiatorSession(secret, associatedData, header, bundle.SignedPrekey.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, associatedData, err = bob.respondX3DH(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadPrekeyState(bob.stateFile(suffixPrekeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSession := newResponderSession(secret, associatedData, header, state.SignedPrekeys[header.SignedPrekeyID])
+	return aliceSession, bobSession
+}
+
+type testRatchetMessage struct {
+	header     ratchetHeader
+	ciphertext []byte
+}
+
+func testRatchetEncrypt(t *testing.T, session *ratchetSession, plaintext string) testRatchetMessage {
+	header, ciphertext, err := session.encrypt([]byte(plaintext), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testRatchetMessage{header, ciphertext}
+}
+
+func testRatchetDecrypt(t *testing.T, session *ratchetSession, message testRatchetMessage, expected string) {
+	plaintext, err := session.decrypt(message.header, message.ciphertext, nil)
+	if err != nil {
+		t.Errorf("decrypting %q: %s", expected, err)
+		return
+	}
+	if string(plaintext) != expected {
+		t.Errorf("expected %q but got %q", expected, plaintext)
+	}
+}
+
+func TestRatchetConversation(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	if _, _, err := bob.encrypt([]byte("too early"), nil); err != ErrSessionCannotSend {
+		t.Errorf("expected ErrSessionCannotSend but got %v", err)
+	}
+
+	testRatchetDecrypt(t, bob, testRatchetEncrypt(t, alice, "hello bob"), "hello bob")
+	testRatchetDecrypt(t, bob, testRatchetEncrypt(t, alice, "are you there"), "are you there")
+	testRatchetDecrypt(t, alice, testRatchetEncrypt(t, bob, "hi alice"), "hi alice")
+	testRatchetDecrypt(t, bob, testRatchetEncrypt(t, alice, "good"), "good")
+	testRatchetDecrypt(t, alice, testRatchetEncrypt(t, bob, "bye"), "bye")
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	first := testRatchetEncrypt(t, alice, "first")
+	second := testRatchetEncrypt(t, alice, "second")
+	third := testRatchetEncrypt(t, alice, "third")
+	testRatchetDecrypt(t, bob, third, "third")
+	testRatchetDecrypt(t, bob, first, "first")
+
+	// a reply moves the ratchet on while second is still in flight
+	testRatchetDecrypt(t, alice, testRatchetEncrypt(t, bob, "reply"), "reply")
+	fourth := testRatchetEncrypt(t, alice, "fourth")
+	testRatchetDecrypt(t, bob, fourth, "fourth")
+	testRatchetDecrypt(t, bob, second, "second")
+
+	// message keys are deleted once used
+	if _, err := bob.decrypt(second.header, second.ciphertext, nil); err == nil {
+		t.Error("a message could be decrypted twice")
+	}
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	testRatchetDecrypt(t, bob, testRatchetEncrypt(t, alice, "first"), "first")
+	message := testRatchetEncrypt(t, alice, "far ahead")
+	message.header.Count += maxSkippedMessageKeys + 1
+	if _, err := bob.decrypt(message.header, message.ciphertext, nil); err != ErrTooManySkippedMessages {
+		t.Errorf("expected ErrTooManySkippedMessages but got %v", err)
+	}
+}
+
+func TestRatchetTampered(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	message := testRatchetEncrypt(t, alice, "hello bob")
+	message.ciphertext[0] ^= 0xff
+	if _, err := bob.decrypt(message.header, message.ciphertext, nil); err == nil {
+		t.Error("tampered message was decrypted")
+	}
+	// the forgery must not have moved the session on
+	message.ciphertext[0] ^= 0xff
+	testRatchetDecrypt(t, bob, message, "hello bob")
+
+	header, ciphertext, err := alice.encrypt([]byte("bound"), []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.decrypt(header, ciphertext, []byte("altered")); err == nil {
+		t.Error("message was decrypted with altered associated data")
+	}
+}
+
+func TestSessionMessages(t *testing.T) {
+	dir := t.TempDir()
+	alice := &Client{keyPath: filepath.Join(dir, "alice")}
+	bob := &Client{keyPath: filepath.Join(dir, "bob")}
+	bundle := testPrekeyBundle(t, bob, true)
+
+	secret, associatedData, header, err := alice.initiateX3DH(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := newInitiatorSession(secret, associatedData, header, bundle.SignedPrekey.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make(sessionStore)
+	sessions.activate(peerAddress("bob", ""), session)
+	if err := sessions.save(alice.stateFile(suffixSessions)); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, ok, err := alice.encryptWithSession(MakeClientMessage("bob", "alice", "hello bob"))
+	if err != nil || !ok {
+		t.Fatalf("encrypting with session: %v %v", ok, err)
+	}
+	// no session is set up from a message whose signature did not verify
+	if _, err := bob.decryptMessage(sent); err != ErrUnverifiedSession {
+		t.Errorf("expected ErrUnverifiedSession but got %v", err)
+	}
+	sent.Verification = Verified
+	// a forgery naming the same one-time prekey does not use it up
+	forged := sent
+	forged.ID = "forged"
+	if _, err := bob.decryptMessage(forged); err == nil {
+		t.Error("forged message was decrypted")
+	}
+	for i := 0; i < 2; i++ {
+		// the second read comes from the history, the key is gone
+		received, err := bob.decryptMessage(sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.Content != "hello bob" {
+			t.Errorf("expected %q but got %q", "hello bob", received.Content)
+		}
+	}
+	if !bob.HasSession("alice") {
+		t.Error("responder did not keep the session")
+	}
+
+	reply, ok, err := bob.encryptWithSession(MakeClientMessage("alice", "bob", "hi alice"))
+	if err != nil || !ok {
+		t.Fatalf("encrypting reply with session: %v %v", ok, err)
+	}
+	received, err := alice.decryptMessage(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Content != "hi alice" {
+		t.Errorf("expected %q but got %q", "hi alice", received.Content)
+	}
+
+	// the peer has replied so the X3DH header is no longer sent
+	sent, _, err = alice.encryptWithSession(MakeClientMessage("bob", "alice", "again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := sent.envelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.X3DH != nil {
+		t.Error("X3DH header still sent after the peer replied")
+	}
+	if _, err := sent.DecryptContent(nil); err != ErrSessionEnvelope {
+		t.Errorf("expected ErrSessionEnvelope but got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+const (
+	suffixReplay = ".replay"
+)
+
+// ErrReplayedMessage is reported on a message whose sender device and
+// sequence were already seen on another message, a captured copy posted
+// again under a new ID.
+type ErrReplayedMessage struct {
+	ID       types.MessageID
+	Original types.MessageID
+	Sequence uint64
+}
+
+func (err ErrReplayedMessage) Error() string {
+	return fmt.Sprintf("message %s replays message %s, sequence %d", err.ID, err.Original, err.Sequence)
+}
+
+// replayCache counts the messages the client sends and remembers the nonce
+// and ID of every message seen per sender device and sequence, along with
+// the ID of the sealed message it came in. The server hands out every
+// message again on each fetch, so a message seen before with the same IDs is
+// not a replay. It is saved next to the private key file.
+type replayCache struct {
+	// Sent is the sequence of the last copy the client sent.
+	Sent    uint64
+	Senders map[string]map[uint64]seenMessage
+}
+
+type seenMessage struct {
+	Nonce    string
+	ID       types.MessageID
+	SealedID types.MessageID
+}
+
+func loadReplayCache(file stateFile) (*replayCache, error) {
+	cache := &replayCache{Senders: make(map[string]map[uint64]seenMessage)}
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, err
+	}
+	if cache.Senders == nil {
+		cache.Senders = make(map[string]map[uint64]seenMessage)
+	}
+	return cache, nil
+}
+
+func (cache *replayCache) save(file stateFile) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+// check returns ErrReplayedMessage when the sequence of the message was
+// already seen from its sender device on another message. Messages without a
+// nonce predate replay protection and are not checked.
+func (cache *replayCache) check(message ClientMessage) error {
+	if len(message.Nonce) == 0 {
+		return nil
+	}
+	previous, ok := cache.Senders[peerAddress(message.From, message.FromDevice)][message.Sequence]
+	if !ok || (previous.ID == message.ID && previous.Nonce == message.Nonce && previous.SealedID == message.SealedID) {
+		return nil
+	}
+	return ErrReplayedMessage{ID: message.ID, Original: previous.ID, Sequence: message.Sequence}
+}
+
+// record remembers a message that passed check. Only messages whose
+// signature verified are recorded, so a forged message cannot take the
+// sequence of one still to come. It reports whether the cache changed.
+func (cache *replayCache) record(message ClientMessage) bool {
+	if len(message.Nonce) == 0 {
+		return false
+	}
+	address := peerAddress(message.From, message.FromDevice)
+	seen, ok := cache.Senders[address]
+	if !ok {
+		seen = make(map[uint64]seenMessage)
+		cache.Senders[address] = seen
+	}
+	if _, ok := seen[message.Sequence]; ok {
+		return false
+	}
+	seen[message.Sequence] = seenMessage{Nonce: message.Nonce, ID: message.ID, SealedID: message.SealedID}
+	return true
+}
+
+// stampMessage gives a copy of a message about to be sent the client's
+// device, a fresh nonce and the next sequence of the client.
+func (cli *Client) stampMessage(message ClientMessage) (ClientMessage, error) {
+	file := cli.stateFile(suffixReplay)
+	cache, err := loadReplayCache(file)
+	if err != nil {
+		return message, err
+	}
+	nonce := make([]byte, types.MessageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return message, err
+	}
+	cache.Sent++
+	if err := cache.save(file); err != nil {
+		return message, err
+	}
+	message.FromDevice = cli.DeviceID
+	message.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	message.Sequence = cache.Sent
+	return message, nil
+}
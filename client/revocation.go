@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// ErrKeyRevoked is returned instead of encrypting to a key its owner or an
+// admin revoked.
+type ErrKeyRevoked struct {
+	UserID    string
+	KeyID     string
+	Reason    string
+	RevokedAt time.Time
+}
+
+func (err ErrKeyRevoked) Error() string {
+	return fmt.Sprintf("key %s of %s was revoked at %s (%s)", err.KeyID, err.UserID, err.RevokedAt.Format(time.RFC3339), err.Reason)
+}
+
+// MakeRevocation makes a revocation of the client's current key signed by
+// that key. It can be made ahead of time and kept offline, to be sent with
+// RevokeKey from anywhere once the key is lost or compromised.
+func (cli *Client) MakeRevocation(reason string) (types.Revocation, error) {
+	if !types.IsRevocationReason(reason) {
+		return types.Revocation{}, fmt.Errorf("unknown revocation reason %q", reason)
+	}
+	keyID, err := utils.KeyID(cli.PrivateKey.Public())
+	if err != nil {
+		return types.Revocation{}, err
+	}
+	revocation := types.Revocation{
+		UserID: cli.Principal.Username,
+		KeyID:  keyID,
+		Reason: reason,
+	}
+	revocation.Signature, err = utils.Sign(cli.PrivateKey, types.RevocationBytes(revocation))
+	if err != nil {
+		return types.Revocation{}, err
+	}
+	return revocation, nil
+}
+
+// RevokeKey sends a revocation to the server. An admin may send an unsigned
+// revocation for the key of any user.
+func (cli *Client) RevokeKey(revocation types.Revocation) error {
+	request, err := cli.newRequest(http.MethodPost, "/pubkey/revoke", revocation)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return errors.New("client.RevokeKey status of " + response.Status)
+	}
+	return nil
+}
+
+// findKeyForUse returns the active key of userID for use, sig or enc, and
+// ErrKeyRevoked when that key was revoked.
+func findKeyForUse(userID string, keys jwk.Set, use string) (jwk.Key, error) {
+	if key, ok := utils.FindJWK(keys, use); ok {
+		return key, nil
+	}
+	if key, ok := utils.FindRevokedJWK(keys, use); ok {
+		return nil, revokedKeyError(userID, key)
+	}
+	return nil, fmt.Errorf("there is no %s key in provided set", use)
+}
+
+func revokedKeyError(userID string, key jwk.Key) ErrKeyRevoked {
+	revokedAt, reason, _ := utils.JWKRevocation(key)
+	return ErrKeyRevoked{
+		UserID:    userID,
+		KeyID:     key.KeyID(),
+		Reason:    reason,
+		RevokedAt: revokedAt,
+	}
+}
+
+// signedByRevokedKey reports whether the message was signed by a key revoked
+// before it was sent. A compromised key may have signed anything, so its
+// signatures are never trusted whenever they claim to have been made.
+func signedByRevokedKey(keys jwk.Set, message ClientMessage) bool {
+	if keys == nil || message.SignatureKeyID == "" {
+		return false
+	}
+	key, ok := utils.FindJWKByID(keys, message.SignatureKeyID, utils.UseSignature)
+	if !ok {
+		return false
+	}
+	revokedAt, reason, revoked := utils.JWKRevocation(key)
+	if !revoked {
+		return false
+	}
+	return reason == types.RevocationCompromised || !message.TimeSent.Before(revokedAt)
+}
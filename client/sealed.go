@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixDelivery = ".delivery"
+)
+
+// ErrNoDeliveryToken is returned when sending a sealed message to a user
+// whose delivery token the client does not know. They hand it out with
+// DeliveryToken and every sealed message they send carries it.
+type ErrNoDeliveryToken struct {
+	UserID string
+}
+
+func (err ErrNoDeliveryToken) Error() string {
+	return fmt.Sprintf("no delivery token for %s, ask them for it to send sealed messages", err.UserID)
+}
+
+// sealedContent is the plaintext of a sealed message: the message as it
+// would be sent unsealed, signed by its sender, and the delivery token of
+// the sender so the recipient can reply sealed.
+type sealedContent struct {
+	Message       types.Message
+	DeliveryToken string
+}
+
+// DeliveryToken returns the token contacts send sealed messages to the client's
+// user with, making and registering one with the server the first time.
+func (cli *Client) DeliveryToken() (string, error) {
+	data, err := cli.stateFile(suffixDelivery).read()
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	return cli.RotateDeliveryToken()
+}
+
+// RotateDeliveryToken replaces the delivery token of the client's user. Sealed
+// messages sent with the previous token are refused from then on; contacts
+// learn the new token from the next sealed message they receive.
+func (cli *Client) RotateDeliveryToken() (string, error) {
+	secret := make([]byte, types.DeliveryTokenSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	request, err := cli.newRequest(http.MethodPost, "/delivery", types.DeliveryToken{Token: token})
+	if err != nil {
+		return "", err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return "", errors.New("client.RotateDeliveryToken status of " + response.Status)
+	}
+	if err := cli.stateFile(suffixDelivery).write([]byte(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SetContactDeliveryToken records the delivery token userID handed out, so
+// sealed messages can be sent to them.
+func (cli *Client) SetContactDeliveryToken(userID string, token string) error {
+	file := cli.stateFile(suffixContacts)
+	contacts, err := loadContactStore(file)
+	if err != nil {
+		return err
+	}
+	contacts.setDeliveryToken(userID, token)
+	return contacts.save(file)
+}
+
+// SendSealedMessageToUser sends a copy of the message to every device of its
+// recipient as SendEncryptedMessageToUser does, each sealed so the server
+// does not learn who sent it. The recipient must have handed out their
+// delivery token.
+func (cli *Client) SendSealedMessageToUser(message ClientMessage) error {
+	contacts, err := loadContactStore(cli.stateFile(suffixContacts))
+	if err != nil {
+		return err
+	}
+	c, ok := contacts[message.To]
+	if !ok || c.DeliveryToken == "" {
+		return ErrNoDeliveryToken{UserID: message.To}
+	}
+	myToken, err := cli.DeliveryToken()
+	if err != nil {
+		return err
+	}
+	return cli.sendToEveryDevice(message, func(deviceMessage ClientMessage, key jwk.Key) error {
+		return cli.sendSealedMessage(deviceMessage, key, c.DeliveryToken, myToken)
+	})
+}
+
+// sendSealedMessage encrypts and signs the message, then encrypts it whole to
+// the key of the recipient device in a message that names only the
+// recipient.
+func (cli *Client) sendSealedMessage(message ClientMessage, key jwk.Key, token string, myToken string) error {
+	inner, err := cli.encryptMessage(message, key)
+	if err != nil {
+		return err
+	}
+	inner, err = cli.signMessage(inner)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(sealedContent{Message: inner.Message, DeliveryToken: myToken})
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, types.MessageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := ClientMessage{Message: types.Message{
+		To:       inner.To,
+		ToDevice: inner.ToDevice,
+		TimeSent: time.Now(),
+		ID:       types.MakeMessageID(),
+		Content:  string(content),
+		Nonce:    base64.RawURLEncoding.EncodeToString(nonce),
+		Sealed:   true,
+	}}
+	sealed, err = cli.encryptToKey(sealed, key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	// no credentials, the delivery token lets the message through
+	request, err := http.NewRequest(http.MethodPost, cli.ServerHost+"/messages/sealed", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(types.HeaderDeliveryToken, token)
+	utils.LogInfo("sending sealed message")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("client.SendSealedMessageToUser status of " + response.Status)
+	}
+	return nil
+}
+
+// unsealMessage decrypts a sealed message addressed to the client, returning
+// the message it carries and the delivery token of its sender. The sealed
+// message must be for the recipient the inner message was signed for.
+func (cli *Client) unsealMessage(sealed ClientMessage) (ClientMessage, string, error) {
+	opened, err := cli.decryptWithPrivateKey(sealed)
+	if err != nil {
+		return sealed, "", err
+	}
+	var content sealedContent
+	if err := json.Unmarshal([]byte(opened.Content), &content); err != nil {
+		return sealed, "", ErrMalformedEnvelope
+	}
+	message := ClientMessage{Message: content.Message, SealedID: sealed.ID}
+	if message.Sealed || message.To != sealed.To || message.ToDevice != sealed.ToDevice {
+		return sealed, "", ErrTamperedEnvelope{ID: sealed.ID}
+	}
+	return message, content.DeliveryToken, nil
+}
+
+// setDeliveryToken records the delivery token of userID. It reports whether
+// the store was modified.
+func (contacts contactStore) setDeliveryToken(userID string, token string) bool {
+	c, ok := contacts[userID]
+	if !ok {
+		c = &contact{}
+		contacts[userID] = c
+	}
+	if c.DeliveryToken == token {
+		return false
+	}
+	c.DeliveryToken = token
+	return true
+}
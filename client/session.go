@@ -0,0 +1,265 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	suffixSessions = ".sessions"
+	suffixHistory  = ".history"
+	// sessions kept per peer besides the active one, for messages still in
+	// flight when a peer starts a new session
+	retainedSessions = 2
+)
+
+var ErrNoSession = errors.New("no session could decrypt the message")
+
+// ErrUnverifiedSession is returned for a message that would start a session
+// but whose signature was not verified. Nothing vouches for the identity key
+// in its X3DH header, so no session is set up from it.
+var ErrUnverifiedSession = errors.New("only a verified message can start a session")
+
+// sessionStore holds the ratchet sessions of a client per peer device, the
+// active session first. It is saved next to the private key file.
+type sessionStore map[string][]*ratchetSession
+
+// peerAddress is the key of the sessions with a device of a user.
+func peerAddress(userID string, deviceID string) string {
+	return userID + "/" + deviceID
+}
+
+func loadSessionStore(file stateFile) (sessionStore, error) {
+	sessions := make(sessionStore)
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sessions sessionStore) save(file stateFile) error {
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
+
+func (sessions sessionStore) activate(address string, session *ratchetSession) {
+	peerSessions := append([]*ratchetSession{session}, sessions[address]...)
+	if len(peerSessions) > retainedSessions+1 {
+		peerSessions = peerSessions[:retainedSessions+1]
+	}
+	sessions[address] = peerSessions
+}
+
+// HasSession reports whether there is an established session with any
+// device of userID.
+func (cli *Client) HasSession(userID string) bool {
+	sessions, err := loadSessionStore(cli.stateFile(suffixSessions))
+	if err != nil {
+		return false
+	}
+	for address, peerSessions := range sessions {
+		if strings.HasPrefix(address, peerAddress(userID, "")) && len(peerSessions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// StartSession runs X3DH against a prekey bundle of each device of userID and
+// makes the results the active sessions with them. Messages sent by
+// SendEncryptedMessage use the sessions from then on. Devices that have not
+// published prekeys are skipped; an error is returned when no session could
+// be started.
+func (cli *Client) StartSession(userID string) error {
+	devices, err := cli.FetchDevices(userID)
+	if err != nil {
+		return err
+	}
+	file := cli.stateFile(suffixSessions)
+	sessions, err := loadSessionStore(file)
+	if err != nil {
+		return err
+	}
+
+	err = ErrNoSession
+	started := false
+	for _, device := range devices {
+		var session *ratchetSession
+		session, err = cli.startDeviceSession(userID, device.ID)
+		if err != nil {
+			utils.LogWarn(fmt.Sprintf("unable to start session with device %s of %s: %s", device.ID, userID, err))
+			continue
+		}
+		sessions.activate(peerAddress(userID, device.ID), session)
+		started = true
+	}
+	if !started {
+		return err
+	}
+	return sessions.save(file)
+}
+
+func (cli *Client) startDeviceSession(userID string, deviceID string) (*ratchetSession, error) {
+	bundle, err := cli.FetchPrekeyBundle(userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	secret, associatedData, header, err := cli.initiateX3DH(bundle)
+	if err != nil {
+		return nil, err
+	}
+	return newInitiatorSession(secret, associatedData, header, bundle.SignedPrekey.Key)
+}
+
+// encryptWithSession encrypts a message with the active session to its
+// recipient device. It reports false when there is no session.
+func (cli *Client) encryptWithSession(message ClientMessage) (ClientMessage, bool, error) {
+	file := cli.stateFile(suffixSessions)
+	sessions, err := loadSessionStore(file)
+	if err != nil {
+		return message, false, err
+	}
+	address := peerAddress(message.To, message.ToDevice)
+	if len(sessions[address]) == 0 {
+		return message, false, nil
+	}
+	session := sessions[address][0]
+
+	header, ciphertext, err := session.encrypt(pad([]byte(message.Content), cli.padding()), message.associatedData())
+	if err != nil {
+		return message, true, err
+	}
+	env := envelope{
+		Ratchet:    &header,
+		X3DH:       session.X3DH,
+		Padded:     true,
+		Ciphertext: ciphertext,
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return message, true, err
+	}
+	// the chain has moved on, persist before the message leaves
+	if err := sessions.save(file); err != nil {
+		return message, true, err
+	}
+	message.Content = base64.URLEncoding.EncodeToString(data)
+	message.Encrypted = true
+	return message, true, nil
+}
+
+// decryptWithSession decrypts a message sent over a ratchet session,
+// setting up the session first when the message starts one and its
+// signature verified.
+func (cli *Client) decryptWithSession(message ClientMessage, env envelope) (ClientMessage, error) {
+	file := cli.stateFile(suffixSessions)
+	sessions, err := loadSessionStore(file)
+	if err != nil {
+		return message, err
+	}
+
+	address := peerAddress(message.From, message.FromDevice)
+	peerSessions := sessions[address]
+	var started *ratchetSession
+	if env.X3DH != nil && !hasX3DHSession(peerSessions, *env.X3DH) {
+		if message.Verification != Verified {
+			return message, ErrUnverifiedSession
+		}
+		secret, associatedData, err := cli.respondX3DH(*env.X3DH)
+		if err != nil {
+			return message, err
+		}
+		state, err := loadPrekeyState(cli.stateFile(suffixPrekeys))
+		if err != nil {
+			return message, err
+		}
+		started = newResponderSession(secret, associatedData, *env.X3DH, state.SignedPrekeys[env.X3DH.SignedPrekeyID])
+		sessions.activate(address, started)
+		peerSessions = sessions[address]
+	}
+
+	for _, session := range peerSessions {
+		plaintext, err := session.decrypt(*env.Ratchet, env.Ciphertext, message.associatedData())
+		if err != nil {
+			continue
+		}
+		// the peer has replied so they have their side of the session
+		session.X3DH = nil
+		if err := sessions.save(file); err != nil {
+			return message, err
+		}
+		// the message decrypts and its sender signed it, so the one-time
+		// prekey it names is used
+		if session == started {
+			if err := cli.useOneTimePrekey(*env.X3DH); err != nil {
+				return message, err
+			}
+		}
+		if message.paddedContent(env) {
+			if plaintext, err = unpad(plaintext); err != nil {
+				return message, err
+			}
+		}
+		message.Content = string(plaintext)
+		message.Encrypted = false
+		return message, nil
+	}
+	return message, ErrNoSession
+}
+
+// hasX3DHSession reports whether one of the sessions was set up from the
+// given X3DH header.
+func hasX3DHSession(sessions []*ratchetSession, header x3dhHeader) bool {
+	for _, session := range sessions {
+		if bytes.Equal(session.X3DHEphemeralKey, header.EphemeralKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageHistory keeps the plaintext of messages read over a ratchet
+// session. Their keys are deleted once used, so the server's copy can never
+// be decrypted again.
+type messageHistory map[types.MessageID]string
+
+func loadMessageHistory(file stateFile) (messageHistory, error) {
+	history := make(messageHistory)
+	data, err := file.read()
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (history messageHistory) save(file stateFile) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return file.write(data)
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"errors"
+
+	"github.com/markpotocki/messenger/utils"
+)
+
+// Verification is the result of checking a message signature against the
+// sender's public key.
+type Verification int
+
+const (
+	// Unverified messages carry no signature or the sender's key could not be
+	// retrieved, so nothing can be said about who wrote them.
+	Unverified Verification = iota
+	// Verified messages were signed by the key registered for From.
+	Verified
+	// Forged messages carry a signature that does not match the key
+	// registered for From.
+	Forged
+	// Revoked messages were signed by a key of From that was revoked, after
+	// it was revoked or because it was compromised.
+	Revoked
+)
+
+// ErrForgedMessage is set on Forged messages instead of decrypting them.
+var ErrForgedMessage = errors.New("message signature does not match the sender's key")
+
+func (v Verification) String() string {
+	switch v {
+	case Verified:
+		return "verified"
+	case Forged:
+		return "forged"
+	case Revoked:
+		return "revoked"
+	default:
+		return "unverified"
+	}
+}
+
+// Sign signs the message as it will be sent, covering the content, From, To,
+// TimeSent and ID. The kid of the signing key is recorded in SignatureKeyID.
+func (message ClientMessage) Sign(myPrivateKey crypto.Signer) (ClientMessage, error) {
+	keyID, err := utils.KeyID(myPrivateKey.Public())
+	if err != nil {
+		return message, err
+	}
+	message.SignatureKeyID = keyID
+	signature, err := utils.Sign(myPrivateKey, message.signedBytes())
+	if err != nil {
+		return message, err
+	}
+	message.Signature = base64.URLEncoding.EncodeToString(signature)
+	return message, nil
+}
+
+// Verify checks the message signature against the sender's public key.
+func (message ClientMessage) Verify(fromPublicKey crypto.PublicKey) Verification {
+	if message.Signature == "" || fromPublicKey == nil {
+		return Unverified
+	}
+	signature, err := base64.URLEncoding.DecodeString(message.Signature)
+	if err != nil {
+		return Forged
+	}
+	if err := utils.Verify(fromPublicKey, message.signedBytes(), signature); err != nil {
+		return Forged
+	}
+	return Verified
+}
+
+// signedBytes is the canonical encoding of the signed fields, the message
+// metadata followed by the content as sent.
+func (message ClientMessage) signedBytes() []byte {
+	var buffer bytes.Buffer
+	buffer.Write(message.associatedData())
+	writeField(&buffer, []byte(message.Content))
+	return buffer.Bytes()
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// DefaultChunkSize is the size of the chunks attachments are encrypted
+	// in, the most either side holds in memory at once.
+	DefaultChunkSize = 64 * 1024
+	// maxChunkSize bounds the chunk size a sender may pick, so an attachment
+	// cannot make the recipient buffer more than this.
+	maxChunkSize = 1024 * 1024
+	// chunkFinal is set in the last byte of the nonce of the final chunk, so
+	// a stream cut at a chunk boundary does not decrypt.
+	chunkFinal = 0x01
+)
+
+var ErrInvalidStream = errors.New("encrypted stream was altered, reordered or cut short")
+
+// chunkNonce is the nonce of chunk number counter of a stream: the counter
+// followed by a byte marking the final chunk, as in the STREAM construction
+// of Hoang et al. Each stream has a key of its own, so nonces never repeat.
+func chunkNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if final {
+		nonce[len(nonce)-1] = chunkFinal
+	}
+	return nonce
+}
+
+// chunkWriter encrypts what is written to it in chunks of chunkSize bytes,
+// each sealed on its own, and writes them out. Close seals the final chunk,
+// which may be short or empty.
+type chunkWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	chunkSize int
+	counter   uint64
+	buffer    []byte
+	// check, when set, is given each chunk before it is sealed and stops
+	// the stream with the error it returns.
+	check func(counter uint64, plaintext []byte) error
+}
+
+func newChunkWriter(w io.Writer, key []byte, chunkSize int) (*chunkWriter, error) {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{w: w, aead: aead, chunkSize: chunkSize, buffer: make([]byte, 0, chunkSize)}, nil
+}
+
+func (writer *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more follows, the final chunk is
+		// sealed by Close
+		if len(writer.buffer) == writer.chunkSize {
+			if err := writer.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(writer.buffer[len(writer.buffer):writer.chunkSize], p)
+		writer.buffer = writer.buffer[:len(writer.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (writer *chunkWriter) Close() error {
+	return writer.seal(true)
+}
+
+func (writer *chunkWriter) seal(final bool) error {
+	if writer.check != nil {
+		if err := writer.check(writer.counter, writer.buffer); err != nil {
+			return err
+		}
+	}
+	chunk := writer.aead.Seal(nil, chunkNonce(writer.aead, writer.counter, final), writer.buffer, nil)
+	writer.counter++
+	writer.buffer = writer.buffer[:0]
+	_, err := writer.w.Write(chunk)
+	return err
+}
+
+// chunkReader decrypts a stream written by chunkWriter, returning io.EOF only
+// once the final chunk authenticated and nothing follows it.
+type chunkReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	chunkSize int
+	counter   uint64
+	chunk     []byte
+	plaintext []byte
+	done      bool
+}
+
+func newChunkReader(r io.Reader, key []byte, chunkSize int) (*chunkReader, error) {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{r: r, aead: aead, chunkSize: chunkSize, chunk: make([]byte, chunkSize+aead.Overhead())}, nil
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for len(reader.plaintext) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		if err := reader.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, reader.plaintext)
+	reader.plaintext = reader.plaintext[n:]
+	return n, nil
+}
+
+func (reader *chunkReader) open() error {
+	n, err := io.ReadFull(reader.r, reader.chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// a short chunk can only be the final one
+		plaintext, openErr := reader.aead.Open(reader.chunk[:0], chunkNonce(reader.aead, reader.counter, true), reader.chunk[:n], nil)
+		if openErr != nil {
+			return ErrInvalidStream
+		}
+		reader.plaintext, reader.done = plaintext, true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ciphertext := reader.chunk[:n]
+	if plaintext, openErr := reader.aead.Open(nil, chunkNonce(reader.aead, reader.counter, false), ciphertext, nil); openErr == nil {
+		reader.counter++
+		reader.plaintext = plaintext
+		return nil
+	}
+	// a full chunk may be the final one when the plaintext filled it, in
+	// which case nothing may follow
+	plaintext, openErr := reader.aead.Open(nil, chunkNonce(reader.aead, reader.counter, true), ciphertext, nil)
+	if openErr != nil {
+		return ErrInvalidStream
+	}
+	var next [1]byte
+	if n, _ := io.ReadFull(reader.r, next[:]); n != 0 {
+		return ErrInvalidStream
+	}
+	reader.plaintext, reader.done = plaintext, true
+	return nil
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChunkStream(t *testing.T) {
+	const chunkSize = 16
+	key := make([]byte, sizeContentKey)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(plaintext []byte) []byte {
+		var buffer bytes.Buffer
+		writer, err := newChunkWriter(&buffer, key, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// written unevenly to cross chunk boundaries
+		for len(plaintext) > 0 {
+			n := 5
+			if n > len(plaintext) {
+				n = len(plaintext)
+			}
+			if _, err := writer.Write(plaintext[:n]); err != nil {
+				t.Fatal(err)
+			}
+			plaintext = plaintext[n:]
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	decrypt := func(ciphertext []byte) ([]byte, error) {
+		reader, err := newChunkReader(bytes.NewReader(ciphertext), key, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ioutil.ReadAll(reader)
+	}
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 100} {
+		plaintext := bytes.Repeat([]byte{'a'}, size)
+		decrypted, err := decrypt(encrypt(plaintext))
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes decrypted to %d bytes with %v", size, len(decrypted), err)
+		}
+	}
+
+	chunk := chunkSize + 16 // GCM tag
+	ciphertext := encrypt(bytes.Repeat([]byte{'a'}, 3*chunkSize+1))
+	flipped := append([]byte{}, ciphertext...)
+	flipped[chunk+3] ^= 1
+	reordered := append(append(append([]byte{}, ciphertext[chunk:2*chunk]...), ciphertext[:chunk]...), ciphertext[2*chunk:]...)
+	tests := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"Flipped", flipped},
+		{"Reordered", reordered},
+		{"Truncated", ciphertext[:3*chunk]},
+		{"DroppedChunk", append(append([]byte{}, ciphertext[:chunk]...), ciphertext[2*chunk:]...)},
+		{"Extended", append(append([]byte{}, ciphertext...), 0)},
+		{"Empty", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decrypt(test.ciphertext); err != ErrInvalidStream {
+				t.Errorf("expected ErrInvalidStream but got %v", err)
+			}
+		})
+	}
+
+	// a stream whose final chunk is full refuses anything after it
+	full := encrypt(bytes.Repeat([]byte{'a'}, 2*chunkSize))
+	if _, err := decrypt(append(full, full[:chunk]...)); err != ErrInvalidStream {
+		t.Errorf("expected ErrInvalidStream but got %v", err)
+	}
+}
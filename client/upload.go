@@ -0,0 +1,209 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	// uploadChunkSize is the most sent in one request of a resumable upload.
+	uploadChunkSize = 4 << 20
+	// maxUploadRetries is how many times in a row an upload is resumed
+	// without getting further before it is given up.
+	maxUploadRetries = 5
+	// uploadRetryDelay grows the wait before each retry after the first.
+	uploadRetryDelay = time.Second
+)
+
+var (
+	ErrFileChanged        = errors.New("file changed while it was being uploaded")
+	errUploadsUnsupported = errors.New("server does not take resumable uploads")
+	errUploadConflict     = errors.New("server did not take the chunk and got no further")
+)
+
+// uploadBlob uploads a blob of size bytes with the resumable upload protocol.
+// open returns the blob from an offset on; it is called again from the
+// offset the server reached whenever a transfer fails. The server checks the
+// blob against digest before keeping it.
+func (cli *Client) uploadBlob(size int64, digest []byte, open func(offset int64) (io.ReadCloser, error)) (types.BlobReference, error) {
+	var upload types.Upload
+	status, err := cli.uploadRequest(http.MethodPost, "/uploads", types.UploadRequest{Size: size}, &upload)
+	if status == http.StatusNotFound {
+		return types.BlobReference{}, errUploadsUnsupported
+	}
+	if err != nil {
+		return types.BlobReference{}, err
+	}
+
+	failures := 0
+	for upload.Offset < upload.Size {
+		offset, err := cli.patchUpload(upload, open)
+		if err == nil {
+			upload.Offset = offset
+			failures = 0
+			continue
+		}
+		if errors.Is(err, ErrFileChanged) {
+			return types.BlobReference{}, err
+		}
+		failures++
+		if failures > maxUploadRetries {
+			return types.BlobReference{}, err
+		}
+		utils.LogWarn(fmt.Sprintf("upload %s cut off at offset %d, resuming: %s", upload.ID, upload.Offset, err.Error()))
+		time.Sleep(time.Duration(failures-1) * uploadRetryDelay)
+		// resumed from wherever the server got to, which may be short of
+		// what was sent
+		var resumed types.Upload
+		if _, err := cli.uploadRequest(http.MethodGet, "/uploads?id="+url.QueryEscape(upload.ID), nil, &resumed); err == nil {
+			if resumed.Offset > upload.Offset {
+				failures = 0
+			}
+			upload = resumed
+		}
+	}
+
+	var reference types.BlobReference
+	if _, err := cli.uploadRequest(http.MethodPost, "/uploads/finish", types.FinishUploadRequest{ID: upload.ID, Digest: digest}, &reference); err != nil {
+		return types.BlobReference{}, err
+	}
+	if reference.Size != size {
+		return types.BlobReference{}, fmt.Errorf("server kept %d bytes of a %d byte blob", reference.Size, size)
+	}
+	return reference, nil
+}
+
+// patchUpload sends the next chunk of the upload and returns the offset the
+// server reached. A conflict that leaves the upload where it was, as while
+// another request is still writing to it, is errUploadConflict so it is
+// retried like any other failure.
+func (cli *Client) patchUpload(upload types.Upload, open func(offset int64) (io.ReadCloser, error)) (int64, error) {
+	chunk, err := open(upload.Offset)
+	if err != nil {
+		return 0, err
+	}
+	defer chunk.Close()
+	length := upload.Size - upload.Offset
+	if length > uploadChunkSize {
+		length = uploadChunkSize
+	}
+	request, err := cli.newRequest(http.MethodPatch, "/uploads?id="+url.QueryEscape(upload.ID), nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Body = ioutil.NopCloser(io.LimitReader(chunk, length))
+	request.ContentLength = length
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set(types.HeaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	// a conflict tells where the upload is at, to go on from there
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusConflict {
+		return 0, errors.New("client.patchUpload status of " + response.Status)
+	}
+	offset, err := strconv.ParseInt(response.Header.Get(types.HeaderUploadOffset), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("client.patchUpload %s", err.Error())
+	}
+	if response.StatusCode == http.StatusConflict && offset <= upload.Offset {
+		return 0, errUploadConflict
+	}
+	return offset, nil
+}
+
+// uploadRequest makes a request of the upload protocol and decodes the
+// response into value, returning the status it was answered with.
+func (cli *Client) uploadRequest(method string, path string, body interface{}, value interface{}) (int, error) {
+	request, err := cli.newRequest(method, path, body)
+	if err != nil {
+		return 0, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return response.StatusCode, errors.New("client.uploadRequest " + path + " status of " + response.Status)
+	}
+	return response.StatusCode, json.NewDecoder(response.Body).Decode(value)
+}
+
+// encryptedFrom returns the file encrypted under key in chunks of chunkSize,
+// from offset into the ciphertext on. Chunk nonces only depend on where the
+// chunk is, so encrypting again from the start of a chunk gives the same
+// ciphertext as long as the file is unchanged; digests makes sure it is.
+func encryptedFrom(file io.ReadSeeker, key []byte, chunkSize int, offset int64, digests chunkDigests) (io.ReadCloser, error) {
+	body, pipe := io.Pipe()
+	chunks, err := newChunkWriter(pipe, key, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	chunks.check = digests.check
+	sealedSize := int64(chunkSize + chunks.aead.Overhead())
+	chunks.counter = uint64(offset / sealedSize)
+	if _, err := file.Seek(int64(chunks.counter)*int64(chunkSize), io.SeekStart); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(chunks, file)
+		if err == nil {
+			err = chunks.Close()
+		}
+		pipe.CloseWithError(err)
+	}()
+	reader := &encryptedReader{PipeReader: body, done: done}
+	if _, err := io.CopyN(ioutil.Discard, body, offset%sealedSize); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// chunkDigests holds the digest of each plaintext chunk of a file as it was
+// first encrypted. A chunk is only encrypted again if it is unchanged, so no
+// two plaintexts are ever sealed under the same key and nonce.
+type chunkDigests map[uint64][]byte
+
+func (digests chunkDigests) check(counter uint64, plaintext []byte) error {
+	digest := sha256.Sum256(plaintext)
+	seen, ok := digests[counter]
+	if !ok {
+		digests[counter] = digest[:]
+		return nil
+	}
+	if subtle.ConstantTimeCompare(seen, digest[:]) != 1 {
+		return ErrFileChanged
+	}
+	return nil
+}
+
+// encryptedReader waits on Close for the file to be left alone, so it can
+// be encrypted again from another offset.
+type encryptedReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (reader *encryptedReader) Close() error {
+	err := reader.PipeReader.Close()
+	<-reader.done
+	return err
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptedFrom(t *testing.T) {
+	const chunkSize = 16
+	key := make([]byte, sizeContentKey)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	file := bytes.NewReader(bytes.Repeat([]byte("0123456789"), 10))
+	digests := make(chunkDigests)
+	read := func(offset int64) []byte {
+		reader, err := encryptedFrom(file, key, chunkSize, offset, digests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	whole := read(0)
+	chunks, err := newChunkReader(bytes.NewReader(whole), key, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadAll(chunks)
+	if err != nil || len(decrypted) != 100 {
+		t.Fatalf("decrypted %d bytes with %v", len(decrypted), err)
+	}
+	// resumed anywhere, in a chunk or at its start, it goes on the same
+	for _, offset := range []int64{1, chunkSize + 16, chunkSize + 17, int64(len(whole)) - 1, int64(len(whole))} {
+		if resumed := read(offset); !bytes.Equal(resumed, whole[offset:]) {
+			t.Errorf("encryption from offset %d differs", offset)
+		}
+	}
+	// closing part way leaves the file to be read again
+	reader, err := encryptedFrom(file, key, chunkSize, 0, digests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if again := read(0); !bytes.Equal(again, whole) {
+		t.Error("encryption after closing part way differs")
+	}
+
+	// a file changed since is not encrypted again under the same nonces
+	changed := bytes.NewReader(bytes.Repeat([]byte("9876543210"), 10))
+	reader, err = encryptedFrom(changed, key, chunkSize, chunkSize+16, digests)
+	if err == nil {
+		_, err = ioutil.ReadAll(reader)
+		reader.Close()
+	}
+	if err != ErrFileChanged {
+		t.Errorf("expected ErrFileChanged but got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	infoX3DH = "messenger X3DH"
+)
+
+// x3dhHeader is sent by the initiator of a session so the recipient can run
+// their half of X3DH.
+type x3dhHeader struct {
+	IdentityKey     []byte  `json:"ik"`
+	EphemeralKey    []byte  `json:"ek"`
+	SignedPrekeyID  uint32  `json:"spk"`
+	OneTimePrekeyID *uint32 `json:"opk,omitempty"`
+}
+
+// initiateX3DH derives a shared secret with the owner of a verified prekey
+// bundle. It returns the secret, the associated data identifying both
+// parties and the header to send along with the first message.
+func (cli *Client) initiateX3DH(bundle types.PrekeyBundle) ([]byte, []byte, x3dhHeader, error) {
+	file := cli.stateFile(suffixPrekeys)
+	state, err := loadPrekeyState(file)
+	if err != nil {
+		return nil, nil, x3dhHeader{}, err
+	}
+	identityKey, err := state.identity()
+	if err != nil {
+		return nil, nil, x3dhHeader{}, err
+	}
+	if err := state.save(file); err != nil {
+		return nil, nil, x3dhHeader{}, err
+	}
+	ephemeralPublic, ephemeralKey, err := x25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, x3dhHeader{}, err
+	}
+
+	dhs := [][2][]byte{
+		{identityKey.Seed(), bundle.SignedPrekey.Key},
+		{ephemeralKey.Seed(), bundle.IdentityKey},
+		{ephemeralKey.Seed(), bundle.SignedPrekey.Key},
+	}
+	header := x3dhHeader{
+		IdentityKey:    identityKey.Public().(x25519.PublicKey),
+		EphemeralKey:   ephemeralPublic,
+		SignedPrekeyID: bundle.SignedPrekey.ID,
+	}
+	if bundle.OneTimePrekey != nil {
+		dhs = append(dhs, [2][]byte{ephemeralKey.Seed(), bundle.OneTimePrekey.Key})
+		id := bundle.OneTimePrekey.ID
+		header.OneTimePrekeyID = &id
+	}
+	secret, err := deriveX3DHSecret(dhs)
+	if err != nil {
+		return nil, nil, x3dhHeader{}, err
+	}
+	associatedData := append(append([]byte{}, header.IdentityKey...), bundle.IdentityKey...)
+	return secret, associatedData, header, nil
+}
+
+// respondX3DH derives the shared secret for a session started by someone
+// else. The one-time prekey used, if any, is left for useOneTimePrekey to
+// delete once the first message of the session decrypts, so that a forged
+// header cannot use it up.
+func (cli *Client) respondX3DH(header x3dhHeader) ([]byte, []byte, error) {
+	file := cli.stateFile(suffixPrekeys)
+	state, err := loadPrekeyState(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state.IdentityKey == nil {
+		return nil, nil, ErrUnknownPrekey
+	}
+	identityKey, err := state.identity()
+	if err != nil {
+		return nil, nil, err
+	}
+	signedPrekey, ok := state.SignedPrekeys[header.SignedPrekeyID]
+	if !ok {
+		return nil, nil, ErrUnknownPrekey
+	}
+
+	dhs := [][2][]byte{
+		{signedPrekey, header.IdentityKey},
+		{identityKey.Seed(), header.EphemeralKey},
+		{signedPrekey, header.EphemeralKey},
+	}
+	if header.OneTimePrekeyID != nil {
+		oneTimePrekey, ok := state.OneTimePrekeys[*header.OneTimePrekeyID]
+		if !ok {
+			return nil, nil, ErrUnknownPrekey
+		}
+		dhs = append(dhs, [2][]byte{oneTimePrekey, header.EphemeralKey})
+	}
+	secret, err := deriveX3DHSecret(dhs)
+	if err != nil {
+		return nil, nil, err
+	}
+	identityPublic := identityKey.Public().(x25519.PublicKey)
+	associatedData := append(append([]byte{}, header.IdentityKey...), identityPublic...)
+	return secret, associatedData, nil
+}
+
+// useOneTimePrekey deletes the one-time prekey a session was started with,
+// if any, so it can never be used again.
+func (cli *Client) useOneTimePrekey(header x3dhHeader) error {
+	if header.OneTimePrekeyID == nil {
+		return nil
+	}
+	file := cli.stateFile(suffixPrekeys)
+	state, err := loadPrekeyState(file)
+	if err != nil {
+		return err
+	}
+	delete(state.OneTimePrekeys, *header.OneTimePrekeyID)
+	return state.save(file)
+}
+
+// deriveX3DHSecret runs each Diffie-Hellman exchange, given as private and
+// public key pairs, and feeds the concatenated outputs through HKDF.
+func deriveX3DHSecret(dhs [][2][]byte) ([]byte, error) {
+	// 32 0xFF bytes separate X3DH inputs from those of any other protocol
+	input := bytes.Repeat([]byte{0xFF}, 32)
+	for _, dh := range dhs {
+		shared, err := curve25519.X25519(dh[0], dh[1])
+		if err != nil {
+			return nil, err
+		}
+		input = append(input, shared...)
+	}
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, input, make([]byte, sha256.Size), []byte(infoX3DH)), secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
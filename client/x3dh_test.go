@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+)
+
+// testPrekeyBundle publishes prekeys for cli to its local state only and
+// returns the bundle the server would hand out.
+func testPrekeyBundle(t *testing.T, cli *Client, withOneTimePrekey bool) types.PrekeyBundle {
+	file := cli.stateFile(suffixPrekeys)
+	state, err := loadPrekeyState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityKey, err := state.identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedPrekey, privateKey, err := state.newPrekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SignedPrekeys[signedPrekey.ID] = privateKey
+	bundle := types.PrekeyBundle{
+		IdentityKey:  identityKey.Public().(x25519.PublicKey),
+		SignedPrekey: types.SignedPrekey{Prekey: signedPrekey},
+	}
+	if withOneTimePrekey {
+		prekeys, err := state.newOneTimePrekeys(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle.OneTimePrekey = &prekeys[0]
+	}
+	if err := state.save(file); err != nil {
+		t.Fatal(err)
+	}
+	return bundle
+}
+
+func TestX3DH(t *testing.T) {
+	for _, withOneTimePrekey := range []bool{true, false} {
+		dir := t.TempDir()
+		alice := &Client{keyPath: filepath.Join(dir, "alice")}
+		bob := &Client{keyPath: filepath.Join(dir, "bob")}
+		bundle := testPrekeyBundle(t, bob, withOneTimePrekey)
+
+		aliceSecret, aliceAD, header, err := alice.initiateX3DH(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobSecret, bobAD, err := bob.respondX3DH(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(aliceSecret, bobSecret) {
+			t.Error("initiator and responder derived different secrets")
+		}
+		if !bytes.Equal(aliceAD, bobAD) {
+			t.Error("initiator and responder derived different associated data")
+		}
+
+		// one-time prekeys are only good for a single session
+		if err := bob.useOneTimePrekey(header); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = bob.respondX3DH(header)
+		if withOneTimePrekey && err != ErrUnknownPrekey {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+)
+
+func TestSendAttachment(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	// a file of several chunks, the last one short
+	file := make([]byte, 3*client.DefaultChunkSize+100)
+	if _, err := rand.Read(file); err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := client1.UploadAttachment("debug.log", "text/plain", bytes.NewReader(file))
+	if err != nil {
+		t.Log("failed to upload attachment")
+		t.Log(err)
+		t.FailNow()
+	}
+	message, err := client.MakeAttachmentMessage(userROOT.Username, userMEP.Username, attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send attachment message")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the server holds the file encrypted
+	blob, _, err := srv.Blobs.OpenBlob(attachment.BlobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, file[:64]) {
+		t.Log("blob holds the file in plaintext")
+		t.Fail()
+	}
+
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Err != nil || !msgs[0].Attachment {
+		t.Fatalf("expected 1 attachment message but got %d", len(msgs))
+	}
+	received, err := client.AttachmentOf(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Name != "debug.log" || received.MediaType != "text/plain" || received.Size != int64(len(file)) {
+		t.Logf("attachment arrived as %s (%s, %d bytes)", received.Name, received.MediaType, received.Size)
+		t.Fail()
+	}
+	reader, err := client2.OpenAttachment(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(downloaded, file) {
+		t.Logf("downloaded %d of %d bytes: %v", len(downloaded), len(file), err)
+		t.Fail()
+	}
+
+	// a blob other than the one the message refers to is refused
+	received.Digest[0] ^= 1
+	reader, err = client2.OpenAttachment(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(reader)
+	reader.Close()
+	if err != client.ErrInvalidAttachment {
+		t.Logf("expected ErrInvalidAttachment but got %v", err)
+		t.Fail()
+	}
+
+	// text cannot be passed off as an attachment
+	text := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if _, err := client.AttachmentOf(text); err != client.ErrNotAttachment {
+		t.Logf("expected ErrNotAttachment but got %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,112 @@
+package e2e
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+)
+
+func TestSendToEveryDevice(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	sender := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	laptop := testSetupClient(t, filepath.Join(keyDir, "laptop"), httpServer.URL, userROOT.Username, userROOTPassword)
+	desktop := testSetupClient(t, filepath.Join(keyDir, "desktop"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	devices, err := sender.FetchDevices(userROOT.Username)
+	if err != nil {
+		t.Log("failed to list devices")
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(devices) != 2 {
+		t.Logf("expected 2 devices but got %d", len(devices))
+		t.FailNow()
+	}
+
+	messageText := "Hello!"
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, messageText)
+	if err := sender.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send message to every device")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// each device gets its own copy and can read it
+	for _, device := range []*client.Client{laptop, desktop} {
+		msgs, err := device.GetMessages(userROOT.Username)
+		if err != nil {
+			t.Log("error while retrieving ROOT messages")
+			t.Log(err)
+			t.FailNow()
+		}
+		if len(msgs) != 1 {
+			t.Logf("device %s expected 1 message but got %d", device.DeviceID, len(msgs))
+			t.Fail()
+			continue
+		}
+		if msgs[0].ToDevice != device.DeviceID {
+			t.Logf("device %s got the copy for %s", device.DeviceID, msgs[0].ToDevice)
+			t.Fail()
+		}
+		if msgs[0].Err != nil || msgs[0].Content != messageText {
+			t.Logf("device %s could not read its copy: %v", device.DeviceID, msgs[0].Err)
+			t.Fail()
+		}
+		if msgs[0].Verification != client.Verified {
+			t.Logf("message signature is %s expected %s", msgs[0].Verification, client.Verified)
+			t.Fail()
+		}
+	}
+
+	// a removed device no longer gets copies
+	if err := laptop.RemoveDevice(desktop.DeviceID); err != nil {
+		t.Log("failed to remove device")
+		t.Log(err)
+		t.FailNow()
+	}
+	devices, err = sender.FetchDevices(userROOT.Username)
+	if err != nil {
+		t.Log("failed to list devices")
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(devices) != 1 || devices[0].ID != laptop.DeviceID {
+		t.Logf("expected only device %s but got %v", laptop.DeviceID, devices)
+		t.Fail()
+	}
+	if err := sender.AcceptKeyChange(userROOT.Username); err != nil {
+		t.Log("failed to accept key change")
+		t.Log(err)
+		t.FailNow()
+	}
+	message = client.MakeClientMessage(userROOT.Username, userMEP.Username, messageText)
+	if err := sender.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send message to every device")
+		t.Log(err)
+		t.FailNow()
+	}
+	msgs, err := desktop.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Log("error while retrieving ROOT messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(msgs) != 1 {
+		t.Logf("removed device expected 1 message but got %d", len(msgs))
+		t.Fail()
+	}
+}
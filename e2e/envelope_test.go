@@ -0,0 +1,101 @@
+package e2e
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestEnvelopeVersion(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if err := client1.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send message")
+		t.Log(err)
+		t.FailNow()
+	}
+	stored, err := srv.MessageStore.FindReceivedByUserID(userROOT.Username)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected 1 stored message but got %d: %v", len(stored), err)
+	}
+	if stored[0].EnvelopeVersion != types.EnvelopeVersion || stored[0].Algorithm != types.AlgorithmRSAOAEPA256GCM {
+		t.Logf("expected envelope %d %q but got %d %q", types.EnvelopeVersion, types.AlgorithmRSAOAEPA256GCM, stored[0].EnvelopeVersion, stored[0].Algorithm)
+		t.Fail()
+	}
+
+	// an unsigned message from the first clients, its content encrypted
+	// whole with PKCS #1 v1.5
+	rsaKey, ok := client2.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("expected an RSA key but got %T", client2.PrivateKey)
+	}
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, &rsaKey.PublicKey, []byte("Hello from the past!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := client.MakeClientMessage(userROOT.Username, userMEP.Username, base64.URLEncoding.EncodeToString(ciphertext))
+	legacy.Encrypted = true
+	legacy.TimeSent = time.Date(2025, time.June, 1, 0, 0, 0, 0, time.UTC)
+	if err := srv.MessageStore.Add(server.Message(legacy.Message)); err != nil {
+		t.Fatal(err)
+	}
+	// the same content is not decrypted for a message claiming to be newer
+	recent := client.MakeClientMessage(userROOT.Username, userMEP.Username, legacy.Content)
+	recent.Encrypted = true
+	if err := srv.MessageStore.Add(server.Message(recent.Message)); err != nil {
+		t.Fatal(err)
+	}
+
+	client2.LegacyCutover = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, legacyContent := range []bool{false, true} {
+		client2.LegacyContent = legacyContent
+		msgs, err := client2.GetMessages(userROOT.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 3 {
+			t.Fatalf("expected 3 messages but got %d", len(msgs))
+		}
+		for _, msg := range msgs {
+			switch {
+			case msg.ID == recent.ID || (msg.ID == legacy.ID && !legacyContent):
+				if msg.Err != client.ErrLegacyContent {
+					t.Logf("expected ErrLegacyContent for message %s with legacy content %t but got %v", msg.ID, legacyContent, msg.Err)
+					t.Fail()
+				}
+			case msg.ID == legacy.ID:
+				if msg.Err != nil || msg.Content != "Hello from the past!" {
+					t.Logf("expected %q but got %q: %v", "Hello from the past!", msg.Content, msg.Err)
+					t.Fail()
+				}
+			default:
+				if msg.Err != nil || msg.Content != "Hello!" {
+					t.Logf("expected %q but got %q: %v", "Hello!", msg.Content, msg.Err)
+					t.Fail()
+				}
+			}
+		}
+	}
+}
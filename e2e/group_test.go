@@ -0,0 +1,140 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestGroupMessages(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userFOOPassword := "FOOBAR"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+	userFOO := server.MakeUser("FOO", userFOOPassword, "foo@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT, userFOO})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	admin := testSetupClient(t, filepath.Join(keyDir, "mep"), httpServer.URL, userMEP.Username, userMEPPassword)
+	member := testSetupClient(t, filepath.Join(keyDir, "root"), httpServer.URL, userROOT.Username, userROOTPassword)
+	invited := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userFOO.Username, userFOOPassword)
+	// end set up
+
+	group, err := admin.CreateGroup("team", []string{userROOT.Username})
+	if err != nil {
+		t.Log("failed to create group")
+		t.Log(err)
+		t.FailNow()
+	}
+	invite, err := admin.CreateGroupInvite(group.ID)
+	if err != nil {
+		t.Log("failed to create invite")
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := member.CreateGroupInvite(group.ID); err == nil {
+		t.Log("a member who is not an admin created an invite")
+		t.Fail()
+	}
+	if _, err := invited.JoinGroup(invite.Token); err != nil {
+		t.Log("failed to join group with invite")
+		t.Log(err)
+		t.FailNow()
+	}
+	groups, err := invited.FetchGroups()
+	if err != nil || len(groups) != 1 || groups[0].Role(userFOO.Username) != types.GroupRoleMember {
+		t.Logf("unexpected groups %v after joining: %v", groups, err)
+		t.Fail()
+	}
+
+	// the group message reaches every member, apart from a direct message
+	messageText := "Hello team!"
+	if err := admin.SendGroupMessage(group.ID, client.MakeClientMessage("", userMEP.Username, messageText)); err != nil {
+		t.Log("failed to send group message")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := admin.SendEncryptedMessageToUser(client.MakeClientMessage(userROOT.Username, userMEP.Username, "just you")); err != nil {
+		t.Log("failed to send direct message")
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, recipient := range []*client.Client{member, invited} {
+		msgs, err := recipient.GetGroupMessages(recipient.Principal.Username, group.ID)
+		if err != nil {
+			t.Log("error while retrieving group messages")
+			t.Log(err)
+			t.FailNow()
+		}
+		if len(msgs) != 1 {
+			t.Logf("%s expected 1 group message but got %d", recipient.Principal.Username, len(msgs))
+			t.Fail()
+			continue
+		}
+		if msgs[0].GroupID != group.ID || msgs[0].Err != nil || msgs[0].Content != messageText {
+			t.Logf("%s could not read the group message: %v", recipient.Principal.Username, msgs[0].Err)
+			t.Fail()
+		}
+		if msgs[0].Verification != client.Verified {
+			t.Logf("message signature is %s expected %s", msgs[0].Verification, client.Verified)
+			t.Fail()
+		}
+	}
+	if msgs, err := member.GetMessages(userROOT.Username); err != nil || len(msgs) != 2 {
+		t.Logf("expected 2 messages without filtering by group but got %d: %v", len(msgs), err)
+		t.Fail()
+	}
+
+	// nor can a member post copies claiming to come from another device
+	forged := client.MakeClientMessage(userROOT.Username, userMEP.Username, "from my other device")
+	forged.GroupID = group.ID
+	forged.FromDevice = "other-device"
+	forged.Nonce = "forged"
+	data, err := json.Marshal([]types.Message{forged.Message})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, httpServer.URL+"/groups/messages", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(userMEP.Username, userMEPPassword)
+	request.Header.Set(types.HeaderDeviceID, admin.DeviceID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Logf("expected %d for a copy sent as another device but got %d", http.StatusBadRequest, response.StatusCode)
+		t.Fail()
+	}
+
+	// a removed member can no longer send to the group
+	if err := admin.RemoveGroupMember(group.ID, userFOO.Username); err != nil {
+		t.Log("failed to remove member")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := invited.SendGroupMessage(group.ID, client.MakeClientMessage("", userFOO.Username, "still here?")); err == nil {
+		t.Log("a removed member sent to the group")
+		t.Fail()
+	}
+	// and the last admin cannot leave while others remain
+	if err := admin.RemoveGroupMember(group.ID, userMEP.Username); err == nil {
+		t.Log("the last admin left the group")
+		t.Fail()
+	}
+}
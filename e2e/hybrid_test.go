@@ -0,0 +1,61 @@
+package e2e
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestHybridKEM(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	// end set up
+
+	// the recipient publishes a hybrid KEM key with their encryption key
+	client2 := client.MakeClient(filepath.Join(keyDir, "bar"), httpServer.URL)
+	client2.SetBasicAuth(userROOT.Username, userROOTPassword)
+	client2.PostQuantum = true
+	if err := client2.RegisterKey(userROOT.Username); err != nil {
+		t.Log("failed to publish hybrid KEM key")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if err := client1.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send message")
+		t.Log(err)
+		t.FailNow()
+	}
+	stored, err := srv.MessageStore.FindReceivedByUserID(userROOT.Username)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected 1 stored message but got %d: %v", len(stored), err)
+	}
+	if stored[0].Algorithm != types.AlgorithmHybridA256GCM {
+		t.Logf("expected algorithm %q but got %q", types.AlgorithmHybridA256GCM, stored[0].Algorithm)
+		t.Fail()
+	}
+
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Err != nil || msgs[0].Content != "Hello!" {
+		t.Logf("message did not decrypt: %+v", msgs)
+		t.Fail()
+	}
+}
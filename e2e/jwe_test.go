@@ -0,0 +1,80 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestJWEContent(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	client1.JWE = true
+	// end set up
+
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if err := client1.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send message")
+		t.Log(err)
+		t.FailNow()
+	}
+	stored, err := srv.MessageStore.FindReceivedByUserID(userROOT.Username)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected 1 stored message but got %d: %v", len(stored), err)
+	}
+	if stored[0].ContentType != types.ContentTypeJWE {
+		t.Logf("expected content type %q but got %q", types.ContentTypeJWE, stored[0].ContentType)
+		t.Fail()
+	}
+
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Err != nil || msgs[0].Content != "Hello!" {
+		t.Logf("message did not decrypt: %+v", msgs)
+		t.Fail()
+	}
+
+	// the server refuses content that is not the JWE it claims to be
+	invalid := stored[0]
+	invalid.ID = types.MakeMessageID()
+	invalid.Nonce = "other"
+	invalid.Content = "not a JWE"
+	data, err := json.Marshal(invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, httpServer.URL+"/messages", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(userMEP.Username, userMEPPassword)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Logf("expected %d for invalid JWE content but got %d", http.StatusBadRequest, response.StatusCode)
+		t.Fail()
+	}
+}
@@ -0,0 +1,106 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestKeyTransparencyLog(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	_, logKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyLog := server.MakeMemoryKeyLog(logKey)
+	srv.Keystore = server.MakeLoggedUserKeystore(server.MakeMemoryUserKeystore(), keyLog)
+	srv.KeyLog = keyLog
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	// logged keys are accepted
+	if _, err := client1.FetchEncryptionKeyByUserID(userROOT.Username); err != nil {
+		t.Log("failed to fetch logged keys")
+		t.Log(err)
+		t.FailNow()
+	}
+	head, err := client1.UpdateTreeHead()
+	if err != nil {
+		t.Log("failed to update tree head")
+		t.Log(err)
+		t.FailNow()
+	}
+	if head.Size != 2 {
+		t.Logf("expected a log of 2 entries but got %d", head.Size)
+		t.Fail()
+	}
+
+	// a key the server slips in without logging it is refused
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.New(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := jwk.NewSet()
+	set.Add(key)
+	unlogged := srv.Keystore.(*server.LoggedUserKeystore).UserKeystore
+	if err := unlogged.AddDevicePublicKey(userROOT.Username, "unlogged", set); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.FetchEncryptionKeyByUserID(userROOT.Username); !errors.As(err, &client.ErrKeyLog{}) {
+		t.Logf("expected ErrKeyLog for unlogged keys but got %v", err)
+		t.Fail()
+	}
+	if err := unlogged.DeleteDevicePublicKey(userROOT.Username, "unlogged"); err != nil {
+		t.Fatal(err)
+	}
+
+	// once a log was seen, keys must come with a proof
+	srv.KeyLog = nil
+	if _, err := client1.FetchEncryptionKeyByUserID(userROOT.Username); err != client.ErrKeyLogProofMissing {
+		t.Logf("expected ErrKeyLogProofMissing but got %v", err)
+		t.Fail()
+	}
+
+	// a log that rewrote its history is detected
+	forked := server.MakeMemoryKeyLog(logKey)
+	for i := 0; i < 3; i++ {
+		if err := forked.Append(types.KeyLogEntry{Operation: types.KeyLogAdd, UserID: userROOT.Username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.KeyLog = forked
+	if _, err := client1.UpdateTreeHead(); !errors.As(err, &client.ErrKeyLog{}) {
+		t.Logf("expected ErrKeyLog for a forked log but got %v", err)
+		t.Fail()
+	}
+
+	srv.KeyLog = keyLog
+	if _, err := client1.UpdateTreeHead(); err != nil {
+		t.Log("failed to update tree head")
+		t.Log(err)
+		t.Fail()
+	}
+}
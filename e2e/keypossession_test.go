@@ -0,0 +1,76 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+)
+
+func TestKeyRegistrationChecks(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userEVEPassword := "SNOOP"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+	userEVE := server.MakeUser("EVE", userEVEPassword, "eve@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT, userEVE})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	// end set up
+
+	// keys of another user cannot be registered without their private key
+	keys, err := srv.Keystore.PublicKeyByUserID(userMEP.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, httpServer.URL+"/pubkey", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(userEVE.Username, userEVEPassword)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Logf("expected %d for keys registered without proof but got %d", http.StatusForbidden, response.StatusCode)
+		t.Fail()
+	}
+
+	// keys the key policy refuses are rejected with the reason
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2 := client.MakeClient(filepath.Join(keyDir, "bar"), httpServer.URL)
+	client2.SetBasicAuth(userROOT.Username, userROOTPassword)
+	client2.PrivateKey = weakKey
+	var rejected client.ErrKeyRejected
+	if err := client2.RegisterKey(userROOT.Username); !errors.As(err, &rejected) || rejected.Status != http.StatusBadRequest {
+		t.Logf("expected ErrKeyRejected with status %d but got %v", http.StatusBadRequest, err)
+		t.Fail()
+	}
+	if _, err := srv.Keystore.PublicKeyByUserID(userROOT.Username); err == nil {
+		t.Log("weak key was registered")
+		t.Fail()
+	}
+}
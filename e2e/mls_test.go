@@ -0,0 +1,244 @@
+package e2e
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestMLSGroupMessages(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userFOOPassword := "FOOBAR"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+	userFOO := server.MakeUser("FOO", userFOOPassword, "foo@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT, userFOO})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	admin := testSetupClient(t, filepath.Join(keyDir, "mep"), httpServer.URL, userMEP.Username, userMEPPassword)
+	member := testSetupClient(t, filepath.Join(keyDir, "root"), httpServer.URL, userROOT.Username, userROOTPassword)
+	removed := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userFOO.Username, userFOOPassword)
+	for _, cli := range []*client.Client{admin, member, removed} {
+		if err := cli.TopUpKeyPackages(2, 5); err != nil {
+			t.Log("failed to publish KeyPackages")
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	// end set up
+
+	group, err := admin.CreateGroup("team", []string{userROOT.Username, userFOO.Username})
+	if err != nil {
+		t.Log("failed to create group")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := admin.CreateMLSGroup(group.ID); err != nil {
+		t.Log("failed to create MLS group")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := admin.AddMLSMembers(group.ID, userROOT.Username, userFOO.Username); err != nil {
+		t.Log("failed to add MLS members")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the message reaches every member welcomed to the group
+	messageText := "Hello team!"
+	if err := admin.SendMLSMessage(group.ID, messageText); err != nil {
+		t.Log("failed to send MLS message")
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, recipient := range []*client.Client{member, removed} {
+		msgs, err := recipient.GetMLSMessages(group.ID)
+		if err != nil {
+			t.Log("error while retrieving MLS messages")
+			t.Log(err)
+			t.FailNow()
+		}
+		if len(msgs) != 1 {
+			t.Logf("%s expected 1 MLS message but got %d", recipient.Principal.Username, len(msgs))
+			t.Fail()
+			continue
+		}
+		if msgs[0].GroupID != group.ID || msgs[0].Err != nil || msgs[0].Content != messageText || msgs[0].From != userMEP.Username {
+			t.Logf("%s could not read the MLS message: %v", recipient.Principal.Username, msgs[0].Err)
+			t.Fail()
+		}
+		if msgs[0].Verification != client.Verified {
+			t.Logf("message signature is %s expected %s", msgs[0].Verification, client.Verified)
+			t.Fail()
+		}
+	}
+
+	// members other than the creator commit too
+	if err := member.UpdateMLSKeys(group.ID); err != nil {
+		t.Log("failed to update MLS keys")
+		t.Log(err)
+		t.FailNow()
+	}
+	replyText := "Hi!"
+	if err := member.SendMLSMessage(group.ID, replyText); err != nil {
+		t.Log("failed to reply after updating keys")
+		t.Log(err)
+		t.FailNow()
+	}
+	if msgs, err := admin.GetMLSMessages(group.ID); err != nil || len(msgs) != 2 || msgs[1].Content != replyText {
+		t.Logf("expected the reply after the update but got %v: %v", msgs, err)
+		t.Fail()
+	}
+
+	// a removed member cannot read what is sent after
+	if err := admin.RemoveMLSMembers(group.ID, userFOO.Username); err != nil {
+		t.Log("failed to remove MLS member")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := admin.SendMLSMessage(group.ID, "without FOO"); err != nil {
+		t.Log("failed to send MLS message after removal")
+		t.Log(err)
+		t.FailNow()
+	}
+	if msgs, err := removed.GetMLSMessages(group.ID); err != nil || len(msgs) != 2 {
+		t.Logf("expected the removed member to keep the 2 messages before the removal but got %d: %v", len(msgs), err)
+		t.Fail()
+	}
+	if msgs, err := member.GetMLSMessages(group.ID); err != nil || len(msgs) != 3 || msgs[2].Content != "without FOO" {
+		t.Logf("expected 3 MLS messages after the removal but got %d: %v", len(msgs), err)
+		t.Fail()
+	}
+	// and a member of the server group cannot commit once removed from it
+	if err := admin.RemoveGroupMember(group.ID, userFOO.Username); err != nil {
+		t.Log("failed to remove member")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := removed.SendMLSMessage(group.ID, "still here?"); err == nil {
+		t.Log("a removed member sent to the MLS group")
+		t.Fail()
+	}
+}
+
+func TestMLSUnprocessableCommit(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userFOOPassword := "FOOBAR"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+	userFOO := server.MakeUser("FOO", userFOOPassword, "foo@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT, userFOO})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	admin := testSetupClient(t, filepath.Join(keyDir, "mep"), httpServer.URL, userMEP.Username, userMEPPassword)
+	member := testSetupClient(t, filepath.Join(keyDir, "root"), httpServer.URL, userROOT.Username, userROOTPassword)
+	joiner := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userFOO.Username, userFOOPassword)
+	for _, cli := range []*client.Client{admin, member, joiner} {
+		if err := cli.TopUpKeyPackages(2, 5); err != nil {
+			t.Log("failed to publish KeyPackages")
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	// end set up
+
+	group, err := admin.CreateGroup("team", []string{userROOT.Username, userFOO.Username})
+	if err != nil {
+		t.Log("failed to create group")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := admin.CreateMLSGroup(group.ID); err != nil {
+		t.Log("failed to create MLS group")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := admin.AddMLSMembers(group.ID, userROOT.Username); err != nil {
+		t.Log("failed to add MLS members")
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := member.GetMLSMessages(group.ID); err != nil {
+		t.Log("failed to join the MLS group")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the member adds FOO, whose key then changes, so the admin cannot check
+	// the credential of the KeyPackage and cannot process the commit
+	if err := member.AddMLSMembers(group.ID, userFOO.Username); err != nil {
+		t.Log("failed to add MLS members")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := joiner.RotateKey(client.KeyTypeRSA); err != nil {
+		t.Log("failed to rotate key")
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := admin.GetMLSMessages(group.ID); err != nil {
+		t.Log("failed to read the MLS group past the commit")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the admin does not fork the group with a commit of its own
+	if err := admin.UpdateMLSKeys(group.ID); !errors.Is(err, client.ErrMLSStalled) {
+		t.Logf("expected ErrMLSStalled committing but got %v", err)
+		t.Fail()
+	}
+	if err := admin.SendMLSMessage(group.ID, "anyone?"); !errors.Is(err, client.ErrMLSStalled) {
+		t.Logf("expected ErrMLSStalled sending but got %v", err)
+		t.Fail()
+	}
+	ordered, err := srv.MLS.MLSMessages(group.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := make(map[uint64]int)
+	for _, message := range ordered {
+		if message.Handshake {
+			commits[message.Epoch]++
+		}
+	}
+	for epoch, count := range commits {
+		if count != 1 {
+			t.Logf("expected 1 commit in epoch %d but got %d", epoch, count)
+			t.Fail()
+		}
+	}
+	// nor does the delivery service take one for the epoch the admin is in
+	replacement := types.MLSMessage{GroupID: group.ID, Epoch: 1, Handshake: true, Sender: userMEP.Username, Message: []byte("replacement")}
+	if _, err := srv.MLS.AddMLSMessage(types.MLSDevice{UserID: userMEP.Username, DeviceID: admin.DeviceID}, replacement, []byte("welcome"), nil, time.Now()); err == nil {
+		t.Log("a second commit was taken for the epoch")
+		t.Fail()
+	}
+
+	// the member goes on in the epoch its commit started
+	replyText := "Hi!"
+	if err := member.SendMLSMessage(group.ID, replyText); err != nil {
+		t.Log("failed to send after the commit")
+		t.Log(err)
+		t.FailNow()
+	}
+	if msgs, err := admin.GetMLSMessages(group.ID); err != nil || len(msgs) != 1 || msgs[0].Err == nil {
+		t.Logf("expected the stalled admin to be unable to read the reply but got %v: %v", msgs, err)
+		t.Fail()
+	}
+}
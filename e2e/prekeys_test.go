@@ -0,0 +1,82 @@
+package e2e
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/server"
+)
+
+func TestPublishAndConsumePrekeyBundles(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	if _, err := client1.FetchPrekeyBundle(userROOT.Username, client2.DeviceID); err == nil {
+		t.Log("expected no bundle before prekeys are published")
+		t.Fail()
+	}
+
+	oneTimePrekeys := 2
+	if err := client2.PublishPrekeys(oneTimePrekeys); err != nil {
+		t.Log("failed to publish prekeys")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// every bundle uses up a one-time prekey until none are left
+	seen := make(map[uint32]bool)
+	for i := 0; i <= oneTimePrekeys; i++ {
+		bundle, err := client1.FetchPrekeyBundle(userROOT.Username, client2.DeviceID)
+		if err != nil {
+			t.Log("failed to fetch prekey bundle")
+			t.Log(err)
+			t.FailNow()
+		}
+		if i == oneTimePrekeys {
+			if bundle.OneTimePrekey != nil {
+				t.Logf("expected one-time prekeys to be used up, got %d", bundle.OneTimePrekey.ID)
+				t.Fail()
+			}
+			continue
+		}
+		if bundle.OneTimePrekey == nil {
+			t.Logf("bundle %d has no one-time prekey", i)
+			t.FailNow()
+		}
+		if seen[bundle.OneTimePrekey.ID] {
+			t.Logf("one-time prekey %d handed out twice", bundle.OneTimePrekey.ID)
+			t.Fail()
+		}
+		seen[bundle.OneTimePrekey.ID] = true
+	}
+
+	// topping up makes one-time prekeys available again
+	if err := client2.TopUpPrekeys(1, oneTimePrekeys); err != nil {
+		t.Log("failed to top up prekeys")
+		t.Log(err)
+		t.FailNow()
+	}
+	bundle, err := client1.FetchPrekeyBundle(userROOT.Username, client2.DeviceID)
+	if err != nil {
+		t.Log("failed to fetch prekey bundle after top up")
+		t.Log(err)
+		t.FailNow()
+	}
+	if bundle.OneTimePrekey == nil || seen[bundle.OneTimePrekey.ID] {
+		t.Log("expected a fresh one-time prekey after top up")
+		t.Fail()
+	}
+}
@@ -0,0 +1,121 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestReplayedMessage(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if err := client1.SendEncryptedMessageToUser(message); err != nil {
+		t.Log("failed to send message")
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := client2.GetMessages(userROOT.Username); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := srv.MessageStore.FindReceivedByUserID(userROOT.Username)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected 1 stored message but got %d: %v", len(stored), err)
+	}
+	if stored[0].Nonce == "" || stored[0].Sequence == 0 {
+		t.Log("message was sent without a nonce and sequence")
+		t.Fail()
+	}
+
+	// the server refuses the captured message posted again
+	data, err := json.Marshal(stored[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, httpServer.URL+"/messages", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(userMEP.Username, userMEPPassword)
+	request.Header.Set(types.HeaderDeviceID, client1.DeviceID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusConflict {
+		t.Logf("expected %d for a replayed message but got %d", http.StatusConflict, response.StatusCode)
+		t.Fail()
+	}
+
+	// nor does anyone else get to send as the sender, or use up their nonces
+	forged := client.MakeClientMessage(userROOT.Username, userMEP.Username, "not from MEP")
+	forged.FromDevice = client1.DeviceID
+	forged.Nonce = "forged"
+	forged.Sequence = stored[0].Sequence + 1
+	data, err = json.Marshal(forged.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err = http.NewRequest(http.MethodPost, httpServer.URL+"/messages", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(userROOT.Username, userROOTPassword)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Logf("expected %d for a message sent as someone else but got %d", http.StatusBadRequest, response.StatusCode)
+		t.Fail()
+	}
+
+	// a copy slipped in under a new ID is reported by the client
+	replayed := stored[0]
+	replayed.ID = "replayed"
+	if err := srv.MessageStore.Add(replayed); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages but got %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		var replayErr client.ErrReplayedMessage
+		if msg.ID == replayed.ID {
+			if !errors.As(msg.Err, &replayErr) || replayErr.Original != stored[0].ID {
+				t.Logf("expected ErrReplayedMessage but got %v", msg.Err)
+				t.Fail()
+			}
+		} else if msg.Err != nil || msg.Content != "Hello!" {
+			t.Logf("original message no longer reads: %v", msg.Err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package e2e
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestRevokeKey(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userADMINPassword := "SUDO"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+	userADMIN := server.MakeAdminUser("ADMIN", userADMINPassword, "admin@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT, userADMIN})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	admin := testSetupClient(t, filepath.Join(keyDir, "admin"), httpServer.URL, userADMIN.Username, userADMINPassword)
+	// end set up
+
+	if _, err := client1.FetchEncryptionKeyByUserID(userROOT.Username); err != nil {
+		t.Log("failed to fetch key before revocation")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// a revocation signed by another key is refused
+	forged, err := client1.MakeRevocation(types.RevocationCompromised)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation, err := client2.MakeRevocation(types.RevocationSuperseded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.UserID = revocation.UserID
+	forged.KeyID = revocation.KeyID
+	if err := client1.RevokeKey(forged); err == nil {
+		t.Log("revocation signed by another key was accepted")
+		t.Fail()
+	}
+	// as is an unsigned one from a user who is not an admin
+	revocation.Signature = nil
+	if err := client1.RevokeKey(revocation); err == nil {
+		t.Log("unsigned revocation from a user was accepted")
+		t.Fail()
+	}
+
+	// the key signs its own revocation
+	revocation, err = client2.MakeRevocation(types.RevocationSuperseded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.RevokeKey(revocation); err != nil {
+		t.Log("failed to revoke key")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client2.RevokeKey(revocation); err == nil {
+		t.Log("revoking a key twice was accepted")
+		t.Fail()
+	}
+
+	// nothing is encrypted to the revoked key
+	var revokedErr client.ErrKeyRevoked
+	if _, err := client1.FetchEncryptionKeyByUserID(userROOT.Username); !errors.As(err, &revokedErr) {
+		t.Logf("expected ErrKeyRevoked but got %v", err)
+		t.FailNow()
+	}
+	if revokedErr.KeyID != revocation.KeyID || revokedErr.Reason != types.RevocationSuperseded {
+		t.Logf("revocation of %s for %s does not match the revocation sent", revokedErr.KeyID, revokedErr.Reason)
+		t.Fail()
+	}
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if err := client1.SendEncryptedMessageToUser(message); !errors.As(err, &client.ErrKeyRevoked{}) {
+		t.Logf("expected ErrKeyRevoked sending to a revoked key but got %v", err)
+		t.Fail()
+	}
+
+	// messages the revoked key signs afterwards are not trusted
+	reply := client.MakeClientMessage(userMEP.Username, userROOT.Username, "Hello?")
+	if err := client2.SendMessage(reply); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := client1.GetMessages(userMEP.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Verification != client.Revoked {
+		t.Logf("expected a message marked %s", client.Revoked)
+		t.Fail()
+	}
+
+	// an admin revokes keys without a signature
+	adminRevocation, err := client1.MakeRevocation(types.RevocationCompromised)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminRevocation.Signature = nil
+	if err := admin.RevokeKey(adminRevocation); err != nil {
+		t.Log("admin failed to revoke key")
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := client2.FetchEncryptionKeyByUserID(userMEP.Username); !errors.As(err, &client.ErrKeyRevoked{}) {
+		t.Logf("expected ErrKeyRevoked after admin revocation but got %v", err)
+		t.Fail()
+	}
+}
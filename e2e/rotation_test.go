@@ -0,0 +1,191 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+)
+
+func TestRotateKey(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2KeyPath := filepath.Join(keyDir, "bar")
+	client2 := testSetupClient(t, client2KeyPath, httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	send := func(from *client.Client, to string, messageText string) {
+		key, err := from.FetchEncryptionKeyByUserID(to)
+		if err != nil {
+			t.Log("failed to fetch encryption key")
+			t.Log(err)
+			t.FailNow()
+		}
+		message := client.MakeClientMessage(to, from.Principal.Username, messageText)
+		if err := from.SendEncryptedMessage(message, key); err != nil {
+			t.Log("failed to send message to server")
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	send(client1, userROOT.Username, "before rotation")
+	send(client2, userMEP.Username, "signed before rotation")
+	if err := client2.RotateKey(client.KeyTypeEd25519); err != nil {
+		t.Log("failed to rotate key")
+		t.Log(err)
+		t.FailNow()
+	}
+	// the rotated keys are not used until client1 accepts them
+	if _, err := client1.FetchEncryptionKeyByUserID(userROOT.Username); !errors.As(err, &client.ErrKeyChanged{}) {
+		t.Logf("expected ErrKeyChanged but got %v", err)
+		t.FailNow()
+	}
+	if err := client1.AcceptKeyChange(userROOT.Username); err != nil {
+		t.Log("failed to accept key change")
+		t.Log(err)
+		t.FailNow()
+	}
+	send(client1, userROOT.Username, "after rotation")
+
+	// a client loading the key file again has the old key too
+	client2 = client.MakeClient(client2KeyPath, httpServer.URL)
+	client2.SetBasicAuth(userROOT.Username, userROOTPassword)
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Log("error while retrieving ROOT messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	expected := map[string]bool{"before rotation": false, "after rotation": false}
+	keyIDs := make(map[string]bool)
+	for _, msg := range msgs {
+		if msg.To != userROOT.Username {
+			continue
+		}
+		if msg.Err != nil {
+			t.Logf("message failed to decrypt: %s", msg.Err)
+			t.Fail()
+			continue
+		}
+		if _, ok := expected[msg.Content]; !ok {
+			t.Logf("unexpected message %s", msg.Content)
+			t.Fail()
+		}
+		expected[msg.Content] = true
+		keyIDs[msg.KeyID] = true
+		if msg.Verification != client.Verified {
+			t.Logf("message signature is %s expected %s", msg.Verification, client.Verified)
+			t.Fail()
+		}
+	}
+	for messageText, received := range expected {
+		if !received {
+			t.Logf("message %s was not received", messageText)
+			t.Fail()
+		}
+	}
+	if len(keyIDs) != 2 || keyIDs[""] {
+		t.Logf("expected messages to record two different kids, got %v", keyIDs)
+		t.Fail()
+	}
+
+	// signatures made with the old key still verify
+	msgs, err = client1.GetMessages(userMEP.Username)
+	if err != nil {
+		t.Log("error while retrieving MEP messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, msg := range msgs {
+		if msg.From == userROOT.Username && msg.Verification != client.Verified {
+			t.Logf("message signature is %s expected %s", msg.Verification, client.Verified)
+			t.Fail()
+		}
+	}
+}
+
+func TestImportKey(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2KeyPath := filepath.Join(keyDir, "bar")
+	client2 := testSetupClient(t, client2KeyPath, httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	// a key managed elsewhere, handed over in OpenSSH format
+	_, sshKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := client.MarshalPrivateKey(sshKey, client.KeyFormatOpenSSH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.ImportKey(exported, nil); err != nil {
+		t.Log("failed to import key")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client1.AcceptKeyChange(userROOT.Username); err != nil {
+		t.Log("failed to accept key change")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	messageText := "to the imported key"
+	key, err := client1.FetchEncryptionKeyByUserID(userROOT.Username)
+	if err != nil {
+		t.Log("failed to fetch encryption key")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client1.SendEncryptedMessage(client.MakeClientMessage(userROOT.Username, userMEP.Username, messageText), key); err != nil {
+		t.Log("failed to send message to server")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the key file now holds the imported key
+	client2 = client.MakeClient(client2KeyPath, httpServer.URL)
+	client2.SetBasicAuth(userROOT.Username, userROOTPassword)
+	if !reflect.DeepEqual(client2.PrivateKey, sshKey) {
+		t.Log("key file does not hold the imported key")
+		t.Fail()
+	}
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Log("error while retrieving ROOT messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(msgs) != 1 || msgs[0].Err != nil || msgs[0].Content != messageText {
+		t.Logf("message to the imported key was not read: %v", msgs)
+		t.Fail()
+	}
+}
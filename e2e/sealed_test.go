@@ -0,0 +1,107 @@
+package e2e
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+)
+
+func TestSealedSender(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	// nothing is sealed without the recipient's delivery token
+	message := client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")
+	if err := client1.SendSealedMessageToUser(message); !errors.As(err, &client.ErrNoDeliveryToken{}) {
+		t.Logf("expected ErrNoDeliveryToken but got %v", err)
+		t.Fail()
+	}
+
+	// ROOT hands out their token
+	token, err := client2.DeliveryToken()
+	if err != nil {
+		t.Log("failed to make delivery token")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client1.SetContactDeliveryToken(userROOT.Username, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.SendSealedMessageToUser(message); err != nil {
+		t.Log("failed to send sealed message")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the server does not know who sent it
+	stored, err := srv.MessageStore.FindReceivedByUserID(userROOT.Username)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected 1 stored message but got %d: %v", len(stored), err)
+	}
+	if !stored[0].Sealed || stored[0].From != "" || stored[0].FromDevice != "" || stored[0].Signature != "" {
+		t.Log("sealed message names its sender to the server")
+		t.Fail()
+	}
+	if sent, _ := srv.MessageStore.FindSentByUserID(userMEP.Username); len(sent) != 0 {
+		t.Logf("expected no sent messages for %s but got %d", userMEP.Username, len(sent))
+		t.Fail()
+	}
+
+	// the recipient unseals it
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message but got %d", len(msgs))
+	}
+	if msgs[0].Err != nil || msgs[0].Content != "Hello!" || msgs[0].From != userMEP.Username {
+		t.Logf("sealed message read as %q from %s: %v", msgs[0].Content, msgs[0].From, msgs[0].Err)
+		t.Fail()
+	}
+	if msgs[0].Verification != client.Verified {
+		t.Logf("message signature is %s expected %s", msgs[0].Verification, client.Verified)
+		t.Fail()
+	}
+
+	// and replies sealed with the token that came with it
+	reply := client.MakeClientMessage(userMEP.Username, userROOT.Username, "Hello back!")
+	if err := client2.SendSealedMessageToUser(reply); err != nil {
+		t.Log("failed to reply sealed")
+		t.Log(err)
+		t.FailNow()
+	}
+	msgs, err = client1.GetMessages(userMEP.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Content != "Hello back!" || msgs[0].From != userROOT.Username {
+		t.Log("sealed reply was not read")
+		t.Fail()
+	}
+
+	// a rotated token cuts off senders holding the old one
+	if _, err := client2.RotateDeliveryToken(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.SendSealedMessageToUser(message); err == nil {
+		t.Log("sealed message sent with a rotated token")
+		t.Fail()
+	}
+}
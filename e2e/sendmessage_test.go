@@ -2,13 +2,18 @@ package e2e
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
-	"os"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/markpotocki/messenger/client"
 	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
 )
 
 func TestSendAndReceiveMessage(t *testing.T) {
@@ -28,11 +33,13 @@ func TestSendAndReceiveMessage(t *testing.T) {
 	srv.Start(context.TODO(), srvConfig)
 	serverHost := "http://localhost:8080"
 
+	// clients keep their keys and state in a directory removed after the test
+	keyDir := t.TempDir()
 	// client 1
-	client1KeyPath := "foo"
+	client1KeyPath := filepath.Join(keyDir, "foo")
 	client1 := testSetupClient(t, client1KeyPath, serverHost, userMEP.Username, userMEPPassword)
 	// client 2
-	client2KeyPath := "bar"
+	client2KeyPath := filepath.Join(keyDir, "bar")
 	client2 := testSetupClient(t, client2KeyPath, serverHost, userROOT.Username, userROOTPassword)
 	// end set up
 
@@ -41,7 +48,7 @@ func TestSendAndReceiveMessage(t *testing.T) {
 	testMessage := client.MakeClientMessage(client2.Principal.Username, client1.Principal.Username, messageText)
 	rootPubKey := client1.FetchPublicKeyByUserID(client2.Principal.Username)
 
-	err := client1.SendEncryptedMessage(testMessage, &rootPubKey)
+	err := client1.SendEncryptedMessage(testMessage, rootPubKey)
 	if err != nil {
 		t.Log("failed to send message to server")
 		t.Log(err)
@@ -65,18 +72,8 @@ func TestSendAndReceiveMessage(t *testing.T) {
 		t.Logf("to %s does not match user %s", msgs[0].To, client1.Principal.Username)
 		t.Fail()
 	}
-
-	// clean up
-	err = os.Remove(client1KeyPath)
-	if err != nil {
-		t.Log("clean up unsuccessful for client1")
-		t.Log(err)
-		t.Fail()
-	}
-	err = os.Remove(client2KeyPath)
-	if err != nil {
-		t.Log("clean up unsuccessful for client2")
-		t.Log(err)
+	if msgs[0].Verification != client.Verified {
+		t.Logf("message signature is %s expected %s", msgs[0].Verification, client.Verified)
 		t.Fail()
 	}
 
@@ -93,12 +90,63 @@ func TestSendAndReceiveMessage(t *testing.T) {
 		t.Logf("JWK Key\n%v", jwkKey)
 		t.Logf("RSA Key\n%v", rootPubKey)
 		t.Logf("RSA Converted to JWK\n%v", convertedRSAKey)
-		t.Logf("Client 2 Key\n%v", client2.PrivateKey.PublicKey)
+		t.Logf("Client 2 Key\n%v", client2.PrivateKey.Public())
 		t.Logf("Test Message Content\n%v", testMessage.Content)
 		t.Logf("Received Message Content\n%v", msgs[0].Content)
 	}
 }
 
+func TestGetMessagesOfAnotherUser(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	if err := client1.SendEncryptedMessageToUser(client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")); err != nil {
+		t.Log("failed to send message to server")
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// MEP asks for ROOT's messages, posing as ROOT's device
+	request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/messages?userID="+userROOT.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(userMEP.Username, userMEPPassword)
+	request.Header.Set(types.HeaderDeviceID, client2.DeviceID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Logf("expected %d for the messages of another user but got %d", http.StatusForbidden, response.StatusCode)
+		t.Fail()
+	}
+
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Log("error while retrieving ROOT messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(msgs) != 1 || msgs[0].Content != "Hello!" {
+		t.Logf("expected ROOT to read their message but got %v", msgs)
+		t.Fail()
+	}
+}
+
 // setupServer sets up a server and adds two dummy users to it for testing
 func testSetupServer(t *testing.T, users []server.User) *server.Server {
 	userStore := server.MakeMemoryUserStore()
@@ -112,10 +160,40 @@ func testSetupServer(t *testing.T, users []server.User) *server.Server {
 		}
 	}
 
+	_, logKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Log("failed to generate key transparency log key")
+		t.Log(err)
+		t.FailNow()
+	}
+	keyLog := server.MakeMemoryKeyLog(logKey)
+	blobs, err := server.MakeFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Log("failed to make blob store")
+		t.Log(err)
+		t.FailNow()
+	}
+	uploads, err := server.MakeFileUploadStore(t.TempDir(), server.DefaultUploadLifetime)
+	if err != nil {
+		t.Log("failed to make upload store")
+		t.Log(err)
+		t.FailNow()
+	}
+
 	srv := server.Server{
-		Keystore:     server.MakeMemoryUserKeystore(),
-		MessageStore: server.MakeMemoryMessageStore(),
-		UserStore:    userStore,
+		Keystore:       server.MakeLoggedUserKeystore(server.MakeMemoryUserKeystore(), keyLog),
+		PrekeyStore:    server.MakeMemoryPrekeyStore(),
+		MessageStore:   server.MakeMemoryMessageStore(),
+		UserStore:      userStore,
+		KeyLog:         keyLog,
+		ReplayCache:    server.MakeMemoryReplayCache(server.DefaultReplayWindow),
+		DeliveryTokens: server.MakeMemoryDeliveryTokenStore(),
+		KeyChallenges:  server.MakeMemoryKeyChallengeStore(server.DefaultKeyChallengeLifetime),
+		Blobs:          blobs,
+		Uploads:        uploads,
+		Groups:         server.MakeMemoryGroupStore(server.DefaultGroupInviteLifetime),
+		KeyPackages:    server.MakeMemoryKeyPackageStore(),
+		MLS:            server.MakeMemoryMLSDeliveryService(),
 	}
 	return &srv
 }
@@ -0,0 +1,234 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestSendAndReceiveSessionMessages(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	if err := client2.PublishPrekeys(1); err != nil {
+		t.Log("failed to publish prekeys")
+		t.Log(err)
+		t.FailNow()
+	}
+	// end set up
+
+	if err := client1.StartSession(userROOT.Username); err != nil {
+		t.Log("failed to start session")
+		t.Log(err)
+		t.FailNow()
+	}
+	messageTexts := []string{"Hello!", "Are you there?"}
+	for _, messageText := range messageTexts {
+		message := client.MakeClientMessage(userROOT.Username, userMEP.Username, messageText)
+		if err := client1.SendEncryptedMessageToUser(message); err != nil {
+			t.Log("failed to send message to server")
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	// messages stay readable after their session keys are used up
+	for i := 0; i < 2; i++ {
+		msgs, err := client2.GetMessages(userROOT.Username)
+		if err != nil {
+			t.Log("error while retrieving ROOT messages")
+			t.Log(err)
+			t.FailNow()
+		}
+		// ROOT has not sent anything yet, every message is to them
+		if len(msgs) != len(messageTexts) {
+			t.Logf("expected %d messages but got %d", len(messageTexts), len(msgs))
+			t.FailNow()
+		}
+		for j, msg := range msgs {
+			if msg.Err != nil {
+				t.Logf("message %d failed to decrypt: %s", j, msg.Err)
+				t.Fail()
+			}
+			if msg.Content != messageTexts[j] {
+				t.Logf("value %s does not match expected %s", msg.Content, messageTexts[j])
+				t.Fail()
+			}
+			if msg.Verification != client.Verified {
+				t.Logf("message signature is %s expected %s", msg.Verification, client.Verified)
+				t.Fail()
+			}
+		}
+	}
+
+	// the reply goes over the session set up by the first message
+	if !client2.HasSession(userMEP.Username) {
+		t.Log("expected ROOT to have a session with MEP")
+		t.FailNow()
+	}
+	replyText := "Yes!"
+	reply := client.MakeClientMessage(userMEP.Username, userROOT.Username, replyText)
+	if err := client2.SendEncryptedMessageToUser(reply); err != nil {
+		t.Log("failed to send reply to server")
+		t.Log(err)
+		t.FailNow()
+	}
+	msgs, err := client1.GetMessages(userMEP.Username)
+	if err != nil {
+		t.Log("error while retrieving MEP messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	replies := 0
+	for _, msg := range msgs {
+		if msg.To != userMEP.Username {
+			continue
+		}
+		replies++
+		if msg.Content != replyText {
+			t.Logf("value %s does not match expected %s", msg.Content, replyText)
+			t.Fail()
+		}
+	}
+	if replies != 1 {
+		t.Logf("expected 1 reply but got %d", replies)
+		t.Fail()
+	}
+}
+
+func TestUnsignedSessionMessage(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userFOOPassword := "FOOBAR"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+	userFOO := server.MakeUser("FOO", userFOOPassword, "foo@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT, userFOO})
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+	// the attacker's messages are kept back to be slipped in unsigned
+	var captured []types.Message
+	attackerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/messages" {
+			var message types.Message
+			if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			captured = append(captured, message)
+			return
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer attackerServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	attacker := testSetupClient(t, filepath.Join(keyDir, "baz"), attackerServer.URL, userFOO.Username, userFOOPassword)
+	if err := client2.PublishPrekeys(1); err != nil {
+		t.Log("failed to publish prekeys")
+		t.Log(err)
+		t.FailNow()
+	}
+	// end set up
+
+	if err := client1.StartSession(userROOT.Username); err != nil {
+		t.Log("failed to start session")
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client1.SendEncryptedMessageToUser(client.MakeClientMessage(userROOT.Username, userMEP.Username, "Hello!")); err != nil {
+		t.Log("failed to send message to server")
+		t.Log(err)
+		t.FailNow()
+	}
+	if msgs, err := client2.GetMessages(userROOT.Username); err != nil || len(msgs) != 1 || msgs[0].Err != nil {
+		t.Logf("expected to read the message starting the session but got %v: %v", msgs, err)
+		t.FailNow()
+	}
+
+	// the attacker starts a session of their own in the name of MEP's
+	// device, with a sequence MEP has not used yet
+	if err := attacker.StartSession(userROOT.Username); err != nil {
+		t.Log("failed to start attacker session")
+		t.Log(err)
+		t.FailNow()
+	}
+	attacker.DeviceID = client1.DeviceID
+	for _, text := range []string{"first", "it's MEP, reply here"} {
+		if err := attacker.SendEncryptedMessageToUser(client.MakeClientMessage(userROOT.Username, userMEP.Username, text)); err != nil {
+			t.Log("failed to send attacker message")
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	if len(captured) != 2 {
+		t.Fatalf("expected 2 captured messages but got %d", len(captured))
+	}
+	unsigned := captured[1]
+	unsigned.Signature = ""
+	unsigned.SignatureKeyID = ""
+	if err := srv.MessageStore.Add(server.Message(unsigned)); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil {
+		t.Log("error while retrieving ROOT messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, msg := range msgs {
+		if msg.ID == unsigned.ID && msg.Err != client.ErrUnverifiedSession {
+			t.Logf("expected ErrUnverifiedSession for the unsigned message but got %v with %q", msg.Err, msg.Content)
+			t.Fail()
+		}
+	}
+
+	// the reply still goes over the session MEP started
+	replyText := "Yes!"
+	if err := client2.SendEncryptedMessageToUser(client.MakeClientMessage(userMEP.Username, userROOT.Username, replyText)); err != nil {
+		t.Log("failed to send reply to server")
+		t.Log(err)
+		t.FailNow()
+	}
+	msgs, err = client1.GetMessages(userMEP.Username)
+	if err != nil {
+		t.Log("error while retrieving MEP messages")
+		t.Log(err)
+		t.FailNow()
+	}
+	replies := 0
+	for _, msg := range msgs {
+		if msg.To != userMEP.Username {
+			continue
+		}
+		replies++
+		if msg.Err != nil || msg.Content != replyText {
+			t.Logf("expected %q but got %q: %v", replyText, msg.Content, msg.Err)
+			t.Fail()
+		}
+	}
+	if replies != 1 {
+		t.Logf("expected 1 reply but got %d", replies)
+		t.Fail()
+	}
+}
@@ -0,0 +1,175 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/markpotocki/messenger/client"
+	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
+)
+
+// cutOffReader fails once limit bytes were read, as a dropped connection
+// does.
+type cutOffReader struct {
+	r     io.Reader
+	limit int64
+}
+
+func (reader *cutOffReader) Read(p []byte) (int, error) {
+	if reader.limit <= 0 {
+		return 0, errors.New("connection dropped")
+	}
+	if int64(len(p)) > reader.limit {
+		p = p[:reader.limit]
+	}
+	n, err := reader.r.Read(p)
+	reader.limit -= int64(n)
+	return n, err
+}
+
+func TestResumeUpload(t *testing.T) {
+	// set up
+	userMEPPassword := "HELLO"
+	userROOTPassword := "GOODBYE"
+	userMEP := server.MakeUser("MEP", userMEPPassword, "mep@example.foo")
+	userROOT := server.MakeUser("ROOT", userROOTPassword, "root@example.foo")
+
+	srv := testSetupServer(t, []server.User{userMEP, userROOT})
+	// the first chunks patched in are cut off part way, and the connection
+	// dropped
+	var mutex sync.Mutex
+	cuts := 0
+	handler := srv.Handler()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		cut := r.Method == http.MethodPatch && cuts < 2
+		if cut {
+			cuts++
+		}
+		mutex.Unlock()
+		if !cut {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		r.Body = ioutil.NopCloser(&cutOffReader{r: r.Body, limit: 1 << 20})
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		panic(http.ErrAbortHandler)
+	}))
+	defer httpServer.Close()
+
+	keyDir := t.TempDir()
+	client1 := testSetupClient(t, filepath.Join(keyDir, "foo"), httpServer.URL, userMEP.Username, userMEPPassword)
+	client2 := testSetupClient(t, filepath.Join(keyDir, "bar"), httpServer.URL, userROOT.Username, userROOTPassword)
+	// end set up
+
+	// larger than one request of the upload
+	file := make([]byte, 5<<20)
+	if _, err := rand.Read(file); err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := client1.UploadAttachment("capture.pcap", "application/vnd.tcpdump.pcap", bytes.NewReader(file))
+	if err != nil {
+		t.Log("failed to resume upload")
+		t.Log(err)
+		t.FailNow()
+	}
+	mutex.Lock()
+	if cuts != 2 {
+		t.Fatalf("expected 2 transfers cut off but got %d", cuts)
+	}
+	mutex.Unlock()
+	message, err := client.MakeAttachmentMessage(userROOT.Username, userMEP.Username, attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.SendEncryptedMessageToUser(message); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := client2.GetMessages(userROOT.Username)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message but got %d: %v", len(msgs), err)
+	}
+	received, err := client.AttachmentOf(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := client2.OpenAttachment(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(downloaded, file) {
+		t.Logf("downloaded %d of %d bytes: %v", len(downloaded), len(file), err)
+		t.Fail()
+	}
+
+	// files that cannot be read again are sent in one request
+	streamed, err := client1.UploadAttachment("stream.log", "text/plain", io.MultiReader(bytes.NewReader(file[:1000])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err = client2.OpenAttachment(streamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err = ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(downloaded, file[:1000]) {
+		t.Logf("downloaded %d of %d bytes: %v", len(downloaded), 1000, err)
+		t.Fail()
+	}
+
+	// the server keeps no blob that does not match its digest
+	do := func(method string, path string, body io.Reader, header map[string]string) *http.Response {
+		request, err := http.NewRequest(method, httpServer.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.SetBasicAuth(userMEP.Username, userMEPPassword)
+		for name, value := range header {
+			request.Header.Set(name, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	response := do(http.MethodPost, "/uploads", strings.NewReader(`{"Size":4}`), nil)
+	var upload types.Upload
+	err = json.NewDecoder(response.Body).Decode(&upload)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = do(http.MethodPatch, "/uploads?id="+upload.ID, strings.NewReader("blob"), map[string]string{types.HeaderUploadOffset: "0"})
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected %d for a chunk but got %d", http.StatusNoContent, response.StatusCode)
+	}
+	wrong := sha256.Sum256([]byte("other"))
+	finish, err := json.Marshal(types.FinishUploadRequest{ID: upload.ID, Digest: wrong[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = do(http.MethodPost, "/uploads/finish", bytes.NewReader(finish), nil)
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Logf("expected %d for a digest that does not match but got %d", http.StatusBadRequest, response.StatusCode)
+		t.Fail()
+	}
+}
@@ -2,15 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/markpotocki/messenger/client"
 	"github.com/markpotocki/messenger/server"
+	"github.com/markpotocki/messenger/types"
 	"github.com/markpotocki/messenger/utils"
 )
 
@@ -33,10 +44,35 @@ func main() {
 }
 
 func startServer() {
-	// the server
+	// the server, logging every change to the keys of users
+	_, logKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	keyLog := server.MakeMemoryKeyLog(logKey)
+	// encrypted attachments are kept in files under blobs
+	blobs, err := server.MakeFileBlobStore("blobs")
+	if err != nil {
+		panic(err)
+	}
+	// and under uploads until every chunk arrived
+	uploads, err := server.MakeFileUploadStore("uploads", server.DefaultUploadLifetime)
+	if err != nil {
+		panic(err)
+	}
 	srv := server.Server{
-		Keystore:     server.MakeMemoryUserKeystore(),
-		MessageStore: server.MakeMemoryMessageStore(),
+		Keystore:       server.MakeLoggedUserKeystore(server.MakeMemoryUserKeystore(), keyLog),
+		PrekeyStore:    server.MakeMemoryPrekeyStore(),
+		MessageStore:   server.MakeMemoryMessageStore(),
+		KeyLog:         keyLog,
+		ReplayCache:    server.MakeMemoryReplayCache(server.DefaultReplayWindow),
+		DeliveryTokens: server.MakeMemoryDeliveryTokenStore(),
+		KeyChallenges:  server.MakeMemoryKeyChallengeStore(server.DefaultKeyChallengeLifetime),
+		Blobs:          blobs,
+		Uploads:        uploads,
+		Groups:         server.MakeMemoryGroupStore(server.DefaultGroupInviteLifetime),
+		KeyPackages:    server.MakeMemoryKeyPackageStore(),
+		MLS:            server.MakeMemoryMLSDeliveryService(),
 	}
 	serverConfig := server.ServerConfig{
 		Address: "",
@@ -60,33 +96,387 @@ func startServer() {
 
 func startClient() {
 	flagSendMessages := flag.Bool("send", false, "set flag to send a message")
+	flagRotateKey := flag.Bool("rotate", false, "set flag to replace the key pair, keeping the old one to read older messages")
+	flagListDevices := flag.Bool("devices", false, "set flag to list the devices of the account")
+	flagRemoveDevice := flag.String("removedevice", "", "set to the ID of a device to remove from the account")
+	flagSafetyNumber := flag.String("safetynumber", "", "set to a user ID to print the safety number to compare with them")
+	flagVerifyContact := flag.String("verify", "", "set to a user ID to mark them verified once safety numbers match")
+	flagAcceptKeys := flag.String("accept", "", "set to a user ID to accept their changed keys")
+	flagKeyHistory := flag.String("history", "", "set to a user ID to list the keys seen for them")
+	flagTreeHead := flag.Bool("loghead", false, "set flag to check and print the head of the key transparency log")
+	flagChangePassphrase := flag.Bool("changepassphrase", false, "set flag to encrypt the key file under a new passphrase, also migrating a plaintext key file")
+	flagImportKey := flag.String("import", "", "set to the path of a PKCS#1, PKCS#8, JWK or OpenSSH private key to use as the key pair")
+	flagExportKey := flag.String("export", "", "set to pem, pkcs8, jwk or openssh to export the key pair in that format")
+	flagExportPath := flag.String("exportpath", "exported_key", "file the exported private key is written to, the public key goes to the same path with .pub")
+	flagRevocation := flag.String("revocation", "", "set to unspecified, compromised or superseded to write a revocation of the current key, signed by it, to -revocationpath")
+	flagRevocationPath := flag.String("revocationpath", "revocation.json", "file a revocation made with -revocation is written to")
+	flagRevokeKey := flag.String("revoke", "", "set to the path of a revocation to send it to the server, revoking its key")
+	flagSealed := flag.Bool("sealed", false, "set with -send to seal the message so the server does not learn who sent it")
+	flagDeliveryToken := flag.Bool("deliverytoken", false, "set flag to print the delivery token contacts need to send sealed messages")
+	flagContactToken := flag.String("contacttoken", "", "set to user=token to record the delivery token a contact handed out")
+	flagPadding := flag.String("padding", "padme", "padding of encrypted messages hiding their length: padme, pow2 or none")
+	flagJWE := flag.Bool("jwe", false, "set flag to send content encrypted to a key as a JWE other tooling can read")
+	flagPostQuantum := flag.Bool("pq", false, "set flag to publish a hybrid X25519 and ML-KEM-768 key when registering or rotating the key")
+	flagAttach := flag.String("attach", "", "set with -send to the path of a file to send encrypted as an attachment instead of -content")
+	flagSaveAttachments := flag.String("saveattachments", "", "set to a directory to save the attachments of received messages to")
+	flagGroups := flag.Bool("groups", false, "set flag to list the groups of the account")
+	flagCreateGroup := flag.String("creategroup", "", "set to the name of a group to create with -members as its members")
+	flagMembers := flag.String("members", "", "comma separated user IDs to add with -creategroup")
+	flagGroup := flag.String("group", "", "set to a group ID to send to it with -send, read only its messages, or manage it with -addmember, -removemember and -invite")
+	flagAddMember := flag.String("addmember", "", "set with -group to a user ID to add to the group or give -role")
+	flagRole := flag.String("role", "member", "role given with -addmember: member or admin")
+	flagRemoveMember := flag.String("removemember", "", "set with -group to a user ID to remove from the group, yourself to leave it")
+	flagInvite := flag.Bool("invite", false, "set with -group to print an invite token others join the group with")
+	flagJoinGroup := flag.String("join", "", "set to an invite token to join its group")
+	flagMLS := flag.Bool("mls", false, "set with -group to use the MLS group of the group: -send encrypts to it, reading reads it and -addmember and -removemember change it too; with -creategroup it starts one")
 	flagMessageTo := flag.String("to", "", "set when sending messages as to field")
 	flagMessageFrom := flag.String("from", "", "set when sending message as from field")
 	flagMessageContent := flag.String("content", "", "set when sending message as content field")
 	flagUsername := flag.String("username", "", "username to use for sending messages")
+	flagKeyType := flag.String("keytype", string(client.KeyTypeRSA), "type of key pair to generate when none exists or when rotating: rsa, p256 or ed25519")
 	flag.Parse()
 	// start the client
 	// the client #1
 	fmt.Println(*flagUsername)
-	cli := client.MakeClient("priv_key.gogob", "http://localhost:8080")
+	// the key file passphrase comes from MESSENGER_PASSPHRASE, the command in
+	// MESSENGER_PASSPHRASE_COMMAND or a prompt
+	cli := client.MakeClientWithPassphrase("priv_key.gogob", "http://localhost:8080", client.KeyType(*flagKeyType), client.DefaultPassphrase)
+	switch *flagPadding {
+	case "none":
+		cli.Padding = client.PadNone
+	case "pow2":
+		cli.Padding = client.PadPowerOfTwo
+	default:
+		cli.Padding = client.PadPadme
+	}
+	cli.JWE = *flagJWE
+	cli.PostQuantum = *flagPostQuantum
 	err := cli.RegisterKey(*flagUsername)
 	if err != nil {
 		log.Println(err)
 	}
+	// keep prekeys available so others can start sessions with us
+	if err := cli.TopUpPrekeys(10, 20); err != nil {
+		log.Println(err)
+	}
+	// and KeyPackages so they can add us to MLS groups
+	if err := cli.TopUpKeyPackages(10, 20); err != nil {
+		log.Println(err)
+	}
 
-	if *flagSendMessages {
-		pubKey := cli.FetchPublicKeyByUserID(*flagMessageTo)
-		message := client.MakeClientMessage(*flagMessageTo, *flagMessageFrom, *flagMessageContent)
-		message, err = message.EncryptContent(&pubKey)
+	if *flagChangePassphrase {
+		fmt.Println("new passphrase")
+		passphrase, err := client.PromptPassphrase(true)
+		if err != nil {
+			panic(err)
+		}
+		if err := cli.ChangePassphrase(passphrase); err != nil {
+			panic(err)
+		}
+		fmt.Println("key file encrypted under the new passphrase")
+	} else if *flagImportKey != "" {
+		data, err := ioutil.ReadFile(*flagImportKey)
+		if err != nil {
+			panic(err)
+		}
+		if err := cli.ImportKey(data, client.PromptPassphrase); err != nil {
+			panic(err)
+		}
+		fmt.Println("imported key pair from", *flagImportKey)
+	} else if *flagExportKey != "" {
+		private, public, err := cli.ExportKeyPair(client.KeyFormat(*flagExportKey))
+		if err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(*flagExportPath, private, 0600); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(*flagExportPath+".pub", public, 0644); err != nil {
+			panic(err)
+		}
+		fmt.Println("exported key pair to", *flagExportPath)
+	} else if *flagRevocation != "" {
+		revocation, err := cli.MakeRevocation(*flagRevocation)
+		if err != nil {
+			panic(err)
+		}
+		data, err := json.MarshalIndent(revocation, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(*flagRevocationPath, data, 0600); err != nil {
+			panic(err)
+		}
+		fmt.Println("wrote revocation of key", revocation.KeyID, "to", *flagRevocationPath)
+	} else if *flagRevokeKey != "" {
+		data, err := ioutil.ReadFile(*flagRevokeKey)
+		if err != nil {
+			panic(err)
+		}
+		var revocation types.Revocation
+		if err := json.Unmarshal(data, &revocation); err != nil {
+			panic(err)
+		}
+		if err := cli.RevokeKey(revocation); err != nil {
+			panic(err)
+		}
+		fmt.Println("revoked key", revocation.KeyID, "of", revocation.UserID)
+	} else if *flagDeliveryToken {
+		token, err := cli.DeliveryToken()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(token)
+	} else if *flagContactToken != "" {
+		parts := strings.SplitN(*flagContactToken, "=", 2)
+		if len(parts) != 2 {
+			panic("-contacttoken must be user=token")
+		}
+		if err := cli.SetContactDeliveryToken(parts[0], parts[1]); err != nil {
+			panic(err)
+		}
+		fmt.Println("recorded the delivery token of", parts[0])
+	} else if *flagRotateKey {
+		if err := cli.RotateKey(client.KeyType(*flagKeyType)); err != nil {
+			panic(err)
+		}
+		fmt.Println("rotated key pair")
+	} else if *flagListDevices {
+		devices, err := cli.FetchDevices(*flagUsername)
+		if err != nil {
+			panic(err)
+		}
+		for _, device := range devices {
+			current := ""
+			if device.ID == cli.DeviceID {
+				current = " (this device)"
+			}
+			fmt.Printf("%s%s: %s\n", device.ID, current, strings.Join(device.KeyIDs, ", "))
+		}
+	} else if *flagSafetyNumber != "" {
+		number, err := cli.SafetyNumber(*flagSafetyNumber)
 		if err != nil {
 			panic(err)
 		}
-		cli.SendMessage(message)
+		fmt.Println(number)
+	} else if *flagVerifyContact != "" {
+		if err := cli.VerifyContact(*flagVerifyContact); err != nil {
+			panic(err)
+		}
+		fmt.Println("marked", *flagVerifyContact, "as verified")
+	} else if *flagTreeHead {
+		head, err := cli.UpdateTreeHead()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("key transparency log of %d entries at %s: %x\n", head.Size, head.Timestamp.Format(time.RFC3339), head.RootHash)
+	} else if *flagAcceptKeys != "" {
+		if err := cli.AcceptKeyChange(*flagAcceptKeys); err != nil {
+			panic(err)
+		}
+		fmt.Println("accepted the current keys of", *flagAcceptKeys)
+	} else if *flagKeyHistory != "" {
+		history, err := cli.KeyHistory(*flagKeyHistory)
+		if err != nil {
+			panic(err)
+		}
+		for _, change := range history {
+			accepted := "pending, accept with -accept"
+			if !change.AcceptedAt.IsZero() {
+				accepted = "accepted " + change.AcceptedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("seen %s (%s): %s\n", change.SeenAt.Format(time.RFC3339), accepted, strings.Join(change.Keys, ", "))
+		}
+	} else if *flagRemoveDevice != "" {
+		if err := cli.RemoveDevice(*flagRemoveDevice); err != nil {
+			panic(err)
+		}
+		fmt.Println("removed device", *flagRemoveDevice)
+	} else if *flagGroups {
+		groups, err := cli.FetchGroups()
+		if err != nil {
+			panic(err)
+		}
+		for _, group := range groups {
+			members := make([]string, 0, len(group.Members))
+			for _, member := range group.Members {
+				members = append(members, member.UserID+" ("+member.Role+")")
+			}
+			fmt.Printf("%s %s: %s\n", group.ID, group.Name, strings.Join(members, ", "))
+		}
+	} else if *flagCreateGroup != "" {
+		var members []string
+		if *flagMembers != "" {
+			members = strings.Split(*flagMembers, ",")
+		}
+		group, err := cli.CreateGroup(*flagCreateGroup, members)
+		if err != nil {
+			panic(err)
+		}
+		if *flagMLS {
+			if err := cli.CreateMLSGroup(group.ID); err != nil {
+				panic(err)
+			}
+			if len(members) != 0 {
+				if err := cli.AddMLSMembers(group.ID, members...); err != nil {
+					panic(err)
+				}
+			}
+		}
+		fmt.Println("created group", group.Name, "with ID", group.ID)
+	} else if *flagJoinGroup != "" {
+		group, err := cli.JoinGroup(*flagJoinGroup)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("joined group", group.Name, "with ID", group.ID)
+	} else if *flagGroup != "" && *flagAddMember != "" {
+		if _, err := cli.SetGroupMember(*flagGroup, *flagAddMember, *flagRole); err != nil {
+			panic(err)
+		}
+		if *flagMLS {
+			if err := cli.AddMLSMembers(*flagGroup, *flagAddMember); err != nil {
+				panic(err)
+			}
+		}
+		fmt.Println("added", *flagAddMember, "to the group as", *flagRole)
+	} else if *flagGroup != "" && *flagRemoveMember != "" {
+		// removed from the MLS group first, while still a member to commit to
+		if *flagMLS {
+			if err := cli.RemoveMLSMembers(*flagGroup, *flagRemoveMember); err != nil {
+				panic(err)
+			}
+		}
+		if err := cli.RemoveGroupMember(*flagGroup, *flagRemoveMember); err != nil {
+			panic(err)
+		}
+		fmt.Println("removed", *flagRemoveMember, "from the group")
+	} else if *flagGroup != "" && *flagInvite {
+		invite, err := cli.CreateGroupInvite(*flagGroup)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("join with -join %s before %s\n", invite.Token, invite.ExpiresAt.Format(time.RFC3339))
+	} else if *flagSendMessages {
+		message := client.MakeClientMessage(*flagMessageTo, *flagMessageFrom, *flagMessageContent)
+		if *flagAttach != "" && *flagMLS {
+			panic("-attach cannot be sent with -mls")
+		}
+		if *flagAttach != "" {
+			file, err := os.Open(*flagAttach)
+			if err != nil {
+				panic(err)
+			}
+			attachment, err := cli.UploadAttachment(filepath.Base(*flagAttach), mime.TypeByExtension(filepath.Ext(*flagAttach)), file)
+			file.Close()
+			if err != nil {
+				panic(err)
+			}
+			if message, err = client.MakeAttachmentMessage(*flagMessageTo, *flagMessageFrom, attachment); err != nil {
+				panic(err)
+			}
+		}
+		if *flagGroup == "" && !cli.HasSession(*flagMessageTo) {
+			if err := cli.StartSession(*flagMessageTo); err != nil {
+				log.Println("unable to start session, encrypting to public key:", err)
+			}
+		}
+		send := cli.SendEncryptedMessageToUser
+		if *flagSealed {
+			send = cli.SendSealedMessageToUser
+		}
+		if *flagGroup != "" {
+			send = func(message client.ClientMessage) error {
+				return cli.SendGroupMessage(*flagGroup, message)
+			}
+		}
+		if *flagGroup != "" && *flagMLS {
+			send = func(message client.ClientMessage) error {
+				return cli.SendMLSMessage(*flagGroup, message.Content)
+			}
+		}
+		if err := send(message); err != nil {
+			var keyChanged client.ErrKeyChanged
+			if errors.As(err, &keyChanged) {
+				fmt.Printf("message not sent: %s, check with -history %s then -accept %s\n", keyChanged, keyChanged.UserID, keyChanged.UserID)
+				return
+			}
+			var keyRevoked client.ErrKeyRevoked
+			if errors.As(err, &keyRevoked) {
+				fmt.Printf("message not sent: %s, wait for %s to register a new key\n", keyRevoked, keyRevoked.UserID)
+				return
+			}
+			panic(err)
+		}
 	} else {
-		messages, err := cli.GetMessages(*flagUsername)
+		var messages []client.ClientMessage
+		var err error
+		if *flagGroup != "" && *flagMLS {
+			messages, err = cli.GetMLSMessages(*flagGroup)
+		} else {
+			messages, err = cli.GetGroupMessages(*flagUsername, *flagGroup)
+		}
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println(messages)
+		for _, message := range messages {
+			if message.KeyChanged {
+				fmt.Printf("WARNING the keys of %s have changed, compare safety numbers before accepting them\n", message.From)
+			}
+			var tampered client.ErrTamperedEnvelope
+			var replayed client.ErrReplayedMessage
+			switch {
+			case errors.As(message.Err, &tampered):
+				fmt.Printf("[%s] %s -> %s: WARNING %s\n", message.Verification, message.From, message.To, tampered)
+			case errors.As(message.Err, &replayed):
+				fmt.Printf("[%s] %s -> %s: WARNING %s\n", message.Verification, message.From, message.To, replayed)
+			case message.Err != nil:
+				fmt.Printf("[%s] %s -> %s: unable to decrypt: %s\n", message.Verification, message.From, message.To, message.Err)
+			case message.Attachment:
+				attachment, err := client.AttachmentOf(message)
+				if err != nil {
+					fmt.Printf("[%s] %s -> %s: WARNING %s\n", message.Verification, message.From, message.To, err)
+					continue
+				}
+				fmt.Printf("[%s] %s -> %s: attachment %s (%s, %d bytes)\n", message.Verification, message.From, message.To, attachment.Name, attachment.MediaType, attachment.Size)
+				if *flagSaveAttachments != "" {
+					if err := saveAttachment(cli, attachment, *flagSaveAttachments); err != nil {
+						fmt.Printf("unable to save %s: %s\n", attachment.Name, err)
+					}
+				}
+			default:
+				fmt.Printf("[%s] %s -> %s: %s\n", message.Verification, message.From, message.To, message.Content)
+			}
+		}
+	}
+}
+
+// saveAttachment downloads the attachment into dir under its name, removing
+// what was written when it does not decrypt.
+func saveAttachment(cli *client.Client, attachment types.Attachment, dir string) error {
+	reader, err := cli.OpenAttachment(attachment)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// only the base of the name, a sender must not pick where it goes
+	name := filepath.Base(attachment.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = attachment.BlobID
+	}
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
 	}
+	fmt.Println("saved", path)
+	return nil
 }
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// MaxBlobSize is the largest blob accepted at /blobs, in bytes.
+	MaxBlobSize = 64 << 20
+	sizeBlobID  = 32
+)
+
+var (
+	ErrBlobDoesNotExist = errors.New("blob does not exist")
+	ErrBlobTooLarge     = errors.New("blob is larger than the server accepts")
+	ErrInvalidBlobID    = errors.New("blob id is not one the server issues")
+)
+
+// BlobStore holds the encrypted attachments clients upload. Blobs are opaque
+// to the server, which only learns their size.
+type BlobStore interface {
+	// PutBlob stores what is read from r under id and returns its size, or
+	// ErrBlobTooLarge when r holds more than maxSize bytes.
+	PutBlob(id string, r io.Reader, maxSize int64) (int64, error)
+	// OpenBlob returns the blob stored under id and its size, or
+	// ErrBlobDoesNotExist.
+	OpenBlob(id string) (io.ReadCloser, int64, error)
+}
+
+// FileBlobStore keeps each blob in a file of its own under a directory.
+type FileBlobStore struct {
+	dir string
+}
+
+// MakeFileBlobStore makes a blob store in dir, creating it when missing.
+func MakeFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (store *FileBlobStore) PutBlob(id string, r io.Reader, maxSize int64) (int64, error) {
+	if !validBlobID(id) {
+		return 0, ErrInvalidBlobID
+	}
+	// written aside and renamed so a blob is never read half written; ids
+	// never start with a dot
+	file, err := ioutil.TempFile(store.dir, ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	size, err := io.Copy(file, io.LimitReader(r, maxSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if size > maxSize {
+		return 0, ErrBlobTooLarge
+	}
+	if err := os.Rename(file.Name(), filepath.Join(store.dir, id)); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (store *FileBlobStore) OpenBlob(id string) (io.ReadCloser, int64, error) {
+	if !validBlobID(id) {
+		return nil, 0, ErrBlobDoesNotExist
+	}
+	file, err := os.Open(filepath.Join(store.dir, id))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrBlobDoesNotExist
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// makeBlobID picks the id of a new blob. Ids are random so only those a
+// message was sent to can find a blob.
+func makeBlobID() (string, error) {
+	id := make([]byte, sizeBlobID)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// validBlobID reports whether id is one makeBlobID could have made, which
+// also keeps it a plain file name.
+func validBlobID(id string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(decoded) == sizeBlobID
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	store, err := MakeFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := makeBlobID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.PutBlob(id, bytes.NewReader([]byte("ciphertext")), 10); err != nil || size != 10 {
+		t.Fatalf("stored %d bytes with %v", size, err)
+	}
+	blob, size, err := store.OpenBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil || size != 10 || string(data) != "ciphertext" {
+		t.Errorf("read %q of %d bytes with %v", data, size, err)
+	}
+
+	other, err := makeBlobID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		id            string
+		expectedError error
+	}{
+		{"Unknown", other, ErrBlobDoesNotExist},
+		{"Path", "../" + id, ErrBlobDoesNotExist},
+		{"Empty", "", ErrBlobDoesNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := store.OpenBlob(test.id)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+
+	// blobs over the limit are not kept
+	if _, err := store.PutBlob(other, bytes.NewReader([]byte("ciphertext")), 9); err != ErrBlobTooLarge {
+		t.Error(sprintFailure(ErrBlobTooLarge, err))
+	}
+	if _, _, err := store.OpenBlob(other); err != ErrBlobDoesNotExist {
+		t.Error(sprintFailure(ErrBlobDoesNotExist, err))
+	}
+	if _, err := store.PutBlob("../escape", bytes.NewReader(nil), 10); err != ErrInvalidBlobID {
+		t.Error(sprintFailure(ErrInvalidBlobID, err))
+	}
+}
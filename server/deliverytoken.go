@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sync"
+)
+
+var ErrInvalidDeliveryToken = errors.New("delivery token is not valid for the recipient")
+
+// DeliveryTokenStore holds the delivery token each user accepts sealed
+// messages with. A user hands their token to contacts and replaces it to cut
+// off anyone abusing it.
+type DeliveryTokenStore interface {
+	SetDeliveryToken(userID string, token []byte) error
+	// CheckDeliveryToken returns ErrInvalidDeliveryToken unless token is the
+	// current token of userID.
+	CheckDeliveryToken(userID string, token []byte) error
+}
+
+// MemoryDeliveryTokenStore keeps the SHA-256 hash of each token rather than
+// the token itself.
+type MemoryDeliveryTokenStore struct {
+	tokens map[string][]byte
+	mutex  *sync.Mutex
+}
+
+func MakeMemoryDeliveryTokenStore() *MemoryDeliveryTokenStore {
+	return &MemoryDeliveryTokenStore{
+		tokens: make(map[string][]byte),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (store *MemoryDeliveryTokenStore) SetDeliveryToken(userID string, token []byte) error {
+	hash := sha256.Sum256(token)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens[userID] = hash[:]
+	return nil
+}
+
+func (store *MemoryDeliveryTokenStore) CheckDeliveryToken(userID string, token []byte) error {
+	hash := sha256.Sum256(token)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	expected, ok := store.tokens[userID]
+	if !ok || len(token) == 0 || subtle.ConstantTimeCompare(expected, hash[:]) != 1 {
+		return ErrInvalidDeliveryToken
+	}
+	return nil
+}
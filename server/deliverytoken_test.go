@@ -0,0 +1,41 @@
+package server
+
+import "testing"
+
+func TestMemoryDeliveryTokenStore(t *testing.T) {
+	store := MakeMemoryDeliveryTokenStore()
+	if err := store.CheckDeliveryToken("MEP", []byte("token")); err != ErrInvalidDeliveryToken {
+		t.Error(sprintFailure(ErrInvalidDeliveryToken, err))
+	}
+	if err := store.SetDeliveryToken("MEP", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		userID        string
+		token         string
+		expectedError error
+	}{
+		{"Valid", "MEP", "token", nil},
+		{"WrongToken", "MEP", "other", ErrInvalidDeliveryToken},
+		{"Empty", "MEP", "", ErrInvalidDeliveryToken},
+		{"OtherUser", "ROOT", "token", ErrInvalidDeliveryToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := store.CheckDeliveryToken(test.userID, []byte(test.token))
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+
+	// a new token replaces the old one
+	if err := store.SetDeliveryToken("MEP", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CheckDeliveryToken("MEP", []byte("token")); err != ErrInvalidDeliveryToken {
+		t.Error(sprintFailure(ErrInvalidDeliveryToken, err))
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+const (
+	// DefaultGroupInviteLifetime is how long an invite link lets users join
+	// its group when no lifetime is given.
+	DefaultGroupInviteLifetime = 7 * 24 * time.Hour
+	sizeGroupID                = 16
+)
+
+var (
+	ErrGroupDoesNotExist  = errors.New("group does not exist")
+	ErrNotGroupMember     = errors.New("user is not a member of the group")
+	ErrNotGroupAdmin      = errors.New("only admins of the group may change it")
+	ErrLastGroupAdmin     = errors.New("group must keep an admin while it has members")
+	ErrInvalidGroupInvite = errors.New("group invite is not valid or expired")
+)
+
+// GroupStore keeps the groups users talk in and who is in them. The server
+// fans messages to a group out to its members.
+type GroupStore interface {
+	// CreateGroup makes a group with admin as its admin and members as its
+	// other members.
+	CreateGroup(name string, admin string, members []string) (types.Group, error)
+	Group(id string) (types.Group, error)
+	// GroupsOf returns the groups userID is a member of.
+	GroupsOf(userID string) ([]types.Group, error)
+	// SetGroupMember adds userID to the group with role, or gives them role
+	// when they are a member already. Taking the role of the last admin
+	// returns ErrLastGroupAdmin.
+	SetGroupMember(groupID string, userID string, role string) (types.Group, error)
+	// RemoveGroupMember removes userID from the group, deleting the group
+	// once nobody is left in it. Removing the last admin while others remain
+	// returns ErrLastGroupAdmin.
+	RemoveGroupMember(groupID string, userID string) error
+	// CreateGroupInvite makes an invite link to the group valid from now.
+	CreateGroupInvite(groupID string, now time.Time) (types.GroupInvite, error)
+	// JoinGroup adds userID as a member of the group of the invite with
+	// token, or returns ErrInvalidGroupInvite when it expired at now.
+	JoinGroup(userID string, token []byte, now time.Time) (types.Group, error)
+}
+
+// MemoryGroupStore keeps groups in memory, with the SHA-256 hash of each
+// invite token rather than the token itself.
+type MemoryGroupStore struct {
+	inviteLifetime time.Duration
+	groups         map[string]*types.Group
+	invites        map[string]groupInvite
+	mutex          *sync.Mutex
+}
+
+type groupInvite struct {
+	groupID   string
+	expiresAt time.Time
+}
+
+// MakeMemoryGroupStore makes a group store whose invites are valid for
+// inviteLifetime, DefaultGroupInviteLifetime when it is not positive.
+func MakeMemoryGroupStore(inviteLifetime time.Duration) *MemoryGroupStore {
+	if inviteLifetime <= 0 {
+		inviteLifetime = DefaultGroupInviteLifetime
+	}
+	return &MemoryGroupStore{
+		inviteLifetime: inviteLifetime,
+		groups:         make(map[string]*types.Group),
+		invites:        make(map[string]groupInvite),
+		mutex:          &sync.Mutex{},
+	}
+}
+
+func (store *MemoryGroupStore) CreateGroup(name string, admin string, members []string) (types.Group, error) {
+	id, err := makeGroupID()
+	if err != nil {
+		return types.Group{}, err
+	}
+	group := &types.Group{ID: id, Name: name}
+	group.Members = append(group.Members, types.GroupMember{UserID: admin, Role: types.GroupRoleAdmin})
+	for _, member := range members {
+		if group.Role(member) == "" {
+			group.Members = append(group.Members, types.GroupMember{UserID: member, Role: types.GroupRoleMember})
+		}
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.groups[id] = group
+	return copyGroup(group), nil
+}
+
+func (store *MemoryGroupStore) Group(id string) (types.Group, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	group, ok := store.groups[id]
+	if !ok {
+		return types.Group{}, ErrGroupDoesNotExist
+	}
+	return copyGroup(group), nil
+}
+
+func (store *MemoryGroupStore) GroupsOf(userID string) ([]types.Group, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	groups := make([]types.Group, 0)
+	for _, group := range store.groups {
+		if group.Role(userID) != "" {
+			groups = append(groups, copyGroup(group))
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Name != groups[j].Name {
+			return groups[i].Name < groups[j].Name
+		}
+		return groups[i].ID < groups[j].ID
+	})
+	return groups, nil
+}
+
+func (store *MemoryGroupStore) SetGroupMember(groupID string, userID string, role string) (types.Group, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	group, ok := store.groups[groupID]
+	if !ok {
+		return types.Group{}, ErrGroupDoesNotExist
+	}
+	for i, member := range group.Members {
+		if member.UserID != userID {
+			continue
+		}
+		if role != types.GroupRoleAdmin && member.Role == types.GroupRoleAdmin && countAdmins(group) == 1 {
+			return types.Group{}, ErrLastGroupAdmin
+		}
+		group.Members[i].Role = role
+		return copyGroup(group), nil
+	}
+	group.Members = append(group.Members, types.GroupMember{UserID: userID, Role: role})
+	return copyGroup(group), nil
+}
+
+func (store *MemoryGroupStore) RemoveGroupMember(groupID string, userID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	group, ok := store.groups[groupID]
+	if !ok {
+		return ErrGroupDoesNotExist
+	}
+	for i, member := range group.Members {
+		if member.UserID != userID {
+			continue
+		}
+		if len(group.Members) == 1 {
+			store.deleteGroup(groupID)
+			return nil
+		}
+		if member.Role == types.GroupRoleAdmin && countAdmins(group) == 1 {
+			return ErrLastGroupAdmin
+		}
+		group.Members = append(group.Members[:i], group.Members[i+1:]...)
+		return nil
+	}
+	return ErrNotGroupMember
+}
+
+func (store *MemoryGroupStore) CreateGroupInvite(groupID string, now time.Time) (types.GroupInvite, error) {
+	token := make([]byte, types.GroupInviteTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return types.GroupInvite{}, err
+	}
+	hash := sha256.Sum256(token)
+	invite := types.GroupInvite{
+		GroupID:   groupID,
+		Token:     base64.RawURLEncoding.EncodeToString(token),
+		ExpiresAt: now.Add(store.inviteLifetime),
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.groups[groupID]; !ok {
+		return types.GroupInvite{}, ErrGroupDoesNotExist
+	}
+	// expired invites are only cleared out as new ones are made
+	for key, other := range store.invites {
+		if !now.Before(other.expiresAt) {
+			delete(store.invites, key)
+		}
+	}
+	store.invites[string(hash[:])] = groupInvite{groupID: groupID, expiresAt: invite.ExpiresAt}
+	return invite, nil
+}
+
+func (store *MemoryGroupStore) JoinGroup(userID string, token []byte, now time.Time) (types.Group, error) {
+	hash := sha256.Sum256(token)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	invite, ok := store.invites[string(hash[:])]
+	if !ok || len(token) == 0 || !now.Before(invite.expiresAt) {
+		return types.Group{}, ErrInvalidGroupInvite
+	}
+	group, ok := store.groups[invite.groupID]
+	if !ok {
+		return types.Group{}, ErrInvalidGroupInvite
+	}
+	if group.Role(userID) == "" {
+		group.Members = append(group.Members, types.GroupMember{UserID: userID, Role: types.GroupRoleMember})
+	}
+	return copyGroup(group), nil
+}
+
+// deleteGroup removes the group along with its invites. The store must be
+// locked.
+func (store *MemoryGroupStore) deleteGroup(groupID string) {
+	delete(store.groups, groupID)
+	for key, invite := range store.invites {
+		if invite.groupID == groupID {
+			delete(store.invites, key)
+		}
+	}
+}
+
+func countAdmins(group *types.Group) int {
+	admins := 0
+	for _, member := range group.Members {
+		if member.Role == types.GroupRoleAdmin {
+			admins++
+		}
+	}
+	return admins
+}
+
+// copyGroup copies a group out of the store, so callers never share its
+// members.
+func copyGroup(group *types.Group) types.Group {
+	copied := *group
+	copied.Members = append([]types.GroupMember{}, group.Members...)
+	return copied
+}
+
+func makeGroupID() (string, error) {
+	id := make([]byte, sizeGroupID)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
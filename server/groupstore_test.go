@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestMemoryGroupStore(t *testing.T) {
+	store := MakeMemoryGroupStore(time.Hour)
+	group, err := store.CreateGroup("team", "MEP", []string{"ROOT", "MEP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert(types.GroupRoleAdmin, group.Role("MEP")) || !assert(types.GroupRoleMember, group.Role("ROOT")) || len(group.Members) != 2 {
+		t.Fatalf("unexpected members %v", group.Members)
+	}
+
+	tests := []struct {
+		name          string
+		change        func() error
+		expectedError error
+	}{
+		{"DemoteLastAdmin", func() error {
+			_, err := store.SetGroupMember(group.ID, "MEP", types.GroupRoleMember)
+			return err
+		}, ErrLastGroupAdmin},
+		{"RemoveLastAdmin", func() error { return store.RemoveGroupMember(group.ID, "MEP") }, ErrLastGroupAdmin},
+		{"RemoveNonMember", func() error { return store.RemoveGroupMember(group.ID, "FOO") }, ErrNotGroupMember},
+		{"UnknownGroup", func() error {
+			_, err := store.SetGroupMember("unknown", "FOO", types.GroupRoleMember)
+			return err
+		}, ErrGroupDoesNotExist},
+		{"AddMember", func() error {
+			_, err := store.SetGroupMember(group.ID, "FOO", types.GroupRoleMember)
+			return err
+		}, nil},
+		{"PromoteMember", func() error {
+			_, err := store.SetGroupMember(group.ID, "ROOT", types.GroupRoleAdmin)
+			return err
+		}, nil},
+		{"RemoveAdmin", func() error { return store.RemoveGroupMember(group.ID, "MEP") }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.change()
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+
+	groups, err := store.GroupsOf("ROOT")
+	if err != nil || len(groups) != 1 || groups[0].Role("ROOT") != types.GroupRoleAdmin {
+		t.Errorf("unexpected groups of ROOT %v with %v", groups, err)
+	}
+	if groups, _ := store.GroupsOf("MEP"); len(groups) != 0 {
+		t.Errorf("MEP left but is still in %v", groups)
+	}
+
+	// the group is gone once its last member leaves
+	if err := store.RemoveGroupMember(group.ID, "FOO"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveGroupMember(group.ID, "ROOT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Group(group.ID); err != ErrGroupDoesNotExist {
+		t.Error(sprintFailure(ErrGroupDoesNotExist, err))
+	}
+}
+
+func TestMemoryGroupStoreInvites(t *testing.T) {
+	store := MakeMemoryGroupStore(time.Hour)
+	group, err := store.CreateGroup("team", "MEP", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	invite, err := store.CreateGroupInvite(group.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := base64.RawURLEncoding.DecodeString(invite.Token)
+	if err != nil || len(token) != types.GroupInviteTokenSize {
+		t.Fatalf("invalid invite token %q", invite.Token)
+	}
+
+	tests := []struct {
+		name          string
+		userID        string
+		token         []byte
+		now           time.Time
+		expectedError error
+	}{
+		{"Valid", "ROOT", token, now, nil},
+		{"Again", "FOO", token, now.Add(time.Minute), nil},
+		{"WrongToken", "BAR", []byte("other"), now, ErrInvalidGroupInvite},
+		{"Empty", "BAR", nil, now, ErrInvalidGroupInvite},
+		{"Expired", "BAR", token, now.Add(time.Hour), ErrInvalidGroupInvite},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			joined, err := store.JoinGroup(test.userID, test.token, test.now)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+			if err == nil && joined.Role(test.userID) != types.GroupRoleMember {
+				t.Errorf("%s joined as %q", test.userID, joined.Role(test.userID))
+			}
+		})
+	}
+
+	if _, err := store.CreateGroupInvite("unknown", now); err != ErrGroupDoesNotExist {
+		t.Error(sprintFailure(ErrGroupDoesNotExist, err))
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/markpotocki/messenger/types"
+)
+
+// ErrInvalidContent is returned for encrypted content that is not in the
+// format the message names. The server cannot decrypt content, only check
+// its headers.
+type ErrInvalidContent struct {
+	Reason string
+}
+
+func (err ErrInvalidContent) Error() string {
+	return fmt.Sprintf("invalid message content: %s", err.Reason)
+}
+
+// jweKeyAlgorithms are the key management algorithms accepted for JWE
+// content, all with A256GCM content encryption.
+var jweKeyAlgorithms = map[jwa.KeyEncryptionAlgorithm]bool{
+	jwa.RSA_OAEP_256: true,
+	jwa.ECDH_ES:      true,
+}
+
+// checkContent checks the content of a message parses in the format named by
+// its ContentType. Envelope content is opaque to the server and not checked.
+func checkContent(message Message) error {
+	switch message.ContentType {
+	case "":
+		return nil
+	case types.ContentTypeJWE:
+		return checkJWE(message.Content)
+	default:
+		return ErrInvalidContent{Reason: fmt.Sprintf("unknown content type %q", message.ContentType)}
+	}
+}
+
+// checkJWE checks content is a JWE in compact serialization with a protected
+// header naming accepted algorithms, without decrypting it.
+func checkJWE(content string) error {
+	if strings.Count(content, ".") != 4 {
+		return ErrInvalidContent{Reason: "JWE is not in compact serialization"}
+	}
+	message, err := jwe.ParseString(content)
+	if err != nil {
+		return ErrInvalidContent{Reason: "JWE does not parse"}
+	}
+	headers := message.ProtectedHeaders()
+	if !jweKeyAlgorithms[headers.Algorithm()] {
+		return ErrInvalidContent{Reason: fmt.Sprintf("JWE key management algorithm %q is not accepted", headers.Algorithm())}
+	}
+	if headers.ContentEncryption() != jwa.A256GCM {
+		return ErrInvalidContent{Reason: fmt.Sprintf("JWE content encryption %q is not accepted", headers.ContentEncryption())}
+	}
+	return nil
+}
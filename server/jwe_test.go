@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestCheckContent(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(alg jwa.KeyEncryptionAlgorithm, enc jwa.ContentEncryptionAlgorithm) string {
+		content, err := jwe.Encrypt([]byte("Hello!"), alg, &key.PublicKey, enc, jwa.NoCompress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	valid := encrypt(jwa.RSA_OAEP_256, jwa.A256GCM)
+
+	tests := []struct {
+		name          string
+		message       Message
+		expectedError error
+	}{
+		{"Envelope", Message{Content: "opaque"}, nil},
+		{"JWE", Message{ContentType: types.ContentTypeJWE, Content: valid}, nil},
+		{"UnknownType", Message{ContentType: "pgp", Content: valid}, ErrInvalidContent{Reason: `unknown content type "pgp"`}},
+		{"NotCompact", Message{ContentType: types.ContentTypeJWE, Content: "opaque"}, ErrInvalidContent{Reason: "JWE is not in compact serialization"}},
+		{"NotJWE", Message{ContentType: types.ContentTypeJWE, Content: "a.b.c.d.e"}, ErrInvalidContent{Reason: "JWE does not parse"}},
+		{"KeyAlgorithm", Message{ContentType: types.ContentTypeJWE, Content: encrypt(jwa.RSA1_5, jwa.A256GCM)}, ErrInvalidContent{Reason: `JWE key management algorithm "RSA1_5" is not accepted`}},
+		{"ContentEncryption", Message{ContentType: types.ContentTypeJWE, Content: encrypt(jwa.RSA_OAEP_256, jwa.A128CBC_HS256)}, ErrInvalidContent{Reason: `JWE content encryption "A128CBC-HS256" is not accepted`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkContent(test.message)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	// DefaultKeyChallengeLifetime is how long a key challenge can be
+	// answered when no lifetime is given.
+	DefaultKeyChallengeLifetime = 5 * time.Minute
+	sizeKeyChallengeNonce       = 32
+)
+
+var ErrInvalidKeyChallenge = errors.New("key challenge was not issued to the device, was already answered or expired")
+
+// ErrKeyPossession is returned when keys are registered without proof that
+// the device holds their private keys.
+type ErrKeyPossession struct {
+	KeyID  string
+	Reason string
+}
+
+func (err ErrKeyPossession) Error() string {
+	return fmt.Sprintf("possession of key %s was not proven: %s", err.KeyID, err.Reason)
+}
+
+// KeyChallengeStore issues the challenges devices answer to register keys.
+type KeyChallengeStore interface {
+	IssueChallenge(userID string, deviceID string, now time.Time) (types.KeyChallenge, error)
+	// ConsumeChallenge returns ErrInvalidKeyChallenge unless nonce was
+	// issued to the device of userID and has neither expired at now nor been
+	// consumed before.
+	ConsumeChallenge(userID string, deviceID string, nonce string, now time.Time) error
+}
+
+// MemoryKeyChallengeStore keeps the challenges issued until they are
+// answered or expire.
+type MemoryKeyChallengeStore struct {
+	lifetime   time.Duration
+	challenges map[string]time.Time
+	mutex      *sync.Mutex
+}
+
+// MakeMemoryKeyChallengeStore makes a store of challenges valid for lifetime,
+// DefaultKeyChallengeLifetime when lifetime is not positive.
+func MakeMemoryKeyChallengeStore(lifetime time.Duration) *MemoryKeyChallengeStore {
+	if lifetime <= 0 {
+		lifetime = DefaultKeyChallengeLifetime
+	}
+	return &MemoryKeyChallengeStore{
+		lifetime:   lifetime,
+		challenges: make(map[string]time.Time),
+		mutex:      &sync.Mutex{},
+	}
+}
+
+func (store *MemoryKeyChallengeStore) IssueChallenge(userID string, deviceID string, now time.Time) (types.KeyChallenge, error) {
+	nonce := make([]byte, sizeKeyChallengeNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return types.KeyChallenge{}, err
+	}
+	challenge := types.KeyChallenge{
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+		ExpiresAt: now.Add(store.lifetime),
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for key, expiresAt := range store.challenges {
+		if !now.Before(expiresAt) {
+			delete(store.challenges, key)
+		}
+	}
+	store.challenges[challengeKey(userID, deviceID, challenge.Nonce)] = challenge.ExpiresAt
+	return challenge, nil
+}
+
+func (store *MemoryKeyChallengeStore) ConsumeChallenge(userID string, deviceID string, nonce string, now time.Time) error {
+	key := challengeKey(userID, deviceID, nonce)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	expiresAt, ok := store.challenges[key]
+	if !ok {
+		return ErrInvalidKeyChallenge
+	}
+	delete(store.challenges, key)
+	if !now.Before(expiresAt) {
+		return ErrInvalidKeyChallenge
+	}
+	return nil
+}
+
+func challengeKey(userID string, deviceID string, nonce string) string {
+	return userID + "/" + deviceID + "/" + nonce
+}
+
+// verifyKeyPossession checks the proof answers a challenge issued to the
+// device with a signature by every signing key in keys, and that every
+// encryption key belongs to one of the signing keys.
+func verifyKeyPossession(challenges KeyChallengeStore, userID string, deviceID string, keys jwk.Set, proof *types.KeyPossessionProof) error {
+	if proof == nil {
+		return ErrKeyPossession{Reason: "no proof was given, answer a challenge from /pubkey/challenge"}
+	}
+	if err := challenges.ConsumeChallenge(userID, deviceID, proof.Nonce, time.Now()); err != nil {
+		return err
+	}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if key.KeyUsage() == utils.UseEncryption {
+			sigKey, ok := utils.FindJWKByID(keys, key.KeyID(), utils.UseSignature)
+			if !ok || !utils.SameKeyPair(key, sigKey) {
+				return ErrKeyPossession{KeyID: key.KeyID(), Reason: "encryption keys must share the key pair and kid of a signing key"}
+			}
+			continue
+		}
+		signature, ok := proof.Signatures[key.KeyID()]
+		if !ok {
+			return ErrKeyPossession{KeyID: key.KeyID(), Reason: "no signature was given"}
+		}
+		publicKey, err := utils.MakePublicKeyFromJWK(key)
+		if err != nil {
+			return ErrKeyPossession{KeyID: key.KeyID(), Reason: err.Error()}
+		}
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return err
+		}
+		if err := utils.Verify(publicKey, types.KeyPossessionBytes(userID, deviceID, proof.Nonce, thumbprint), signature); err != nil {
+			return ErrKeyPossession{KeyID: key.KeyID(), Reason: "signature does not verify"}
+		}
+	}
+	return nil
+}
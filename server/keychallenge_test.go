@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestMemoryKeyChallengeStore(t *testing.T) {
+	store := MakeMemoryKeyChallengeStore(time.Minute)
+	now := time.Now()
+	issue := func() string {
+		challenge, err := store.IssueChallenge("MEP", "laptop", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return challenge.Nonce
+	}
+	answered := issue()
+	if err := store.ConsumeChallenge("MEP", "laptop", answered, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		userID        string
+		deviceID      string
+		nonce         string
+		at            time.Time
+		expectedError error
+	}{
+		{"Valid", "MEP", "laptop", issue(), now, nil},
+		{"Answered", "MEP", "laptop", answered, now, ErrInvalidKeyChallenge},
+		{"Expired", "MEP", "laptop", issue(), now.Add(time.Minute), ErrInvalidKeyChallenge},
+		{"OtherUser", "ROOT", "laptop", issue(), now, ErrInvalidKeyChallenge},
+		{"OtherDevice", "MEP", "phone", issue(), now, ErrInvalidKeyChallenge},
+		{"Unknown", "MEP", "laptop", "nonce", now, ErrInvalidKeyChallenge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := store.ConsumeChallenge(test.userID, test.deviceID, test.nonce, test.at)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+}
+
+func TestVerifyKeyPossession(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := utils.MakeJWKSetFromPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := utils.MakeJWKSetFromPrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigKey, _ := utils.FindJWK(keys, utils.UseSignature)
+	otherEncKey, _ := utils.FindJWK(otherKeys, utils.UseEncryption)
+
+	store := MakeMemoryKeyChallengeStore(DefaultKeyChallengeLifetime)
+	prove := func(signer crypto.Signer, userID string) *types.KeyPossessionProof {
+		challenge, err := store.IssueChallenge("MEP", types.DefaultDeviceID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumbprint, err := sigKey.Thumbprint(crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := utils.Sign(signer, types.KeyPossessionBytes(userID, types.DefaultDeviceID, challenge.Nonce, thumbprint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &types.KeyPossessionProof{Nonce: challenge.Nonce, Signatures: map[string][]byte{sigKey.KeyID(): signature}}
+	}
+
+	// an encryption key of another key pair under the kid of the signing key
+	mixed := jwk.NewSet()
+	mixed.Add(sigKey)
+	swapped, err := otherEncKey.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swapped.Set(jwk.KeyIDKey, sigKey.KeyID()); err != nil {
+		t.Fatal(err)
+	}
+	mixed.Add(swapped)
+
+	tests := []struct {
+		name          string
+		keys          jwk.Set
+		proof         *types.KeyPossessionProof
+		expectedError error
+	}{
+		{"Valid", keys, prove(privateKey, "MEP"), nil},
+		{"NoProof", keys, nil, ErrKeyPossession{Reason: "no proof was given, answer a challenge from /pubkey/challenge"}},
+		{"NoChallenge", keys, &types.KeyPossessionProof{Nonce: "nonce"}, ErrInvalidKeyChallenge},
+		{"OtherSigner", keys, prove(otherKey, "MEP"), ErrKeyPossession{KeyID: sigKey.KeyID(), Reason: "signature does not verify"}},
+		{"OtherUser", keys, prove(privateKey, "ROOT"), ErrKeyPossession{KeyID: sigKey.KeyID(), Reason: "signature does not verify"}},
+		{"MixedKeyPairs", mixed, prove(privateKey, "MEP"), ErrKeyPossession{KeyID: sigKey.KeyID(), Reason: "encryption keys must share the key pair and kid of a signing key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyKeyPossession(store, "MEP", types.DefaultDeviceID, test.keys, test.proof)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// KeyLog is an append-only Merkle tree log of the changes made to the keys of
+// users. Clients check that the keys they are handed are the latest logged
+// for their user, so the server cannot give out a key without recording it
+// where its owner can see it.
+type KeyLog interface {
+	Append(entry types.KeyLogEntry) error
+	// TreeHead returns the signed head of the whole log.
+	TreeHead() (types.SignedTreeHead, error)
+	// ProveLatest proves the latest entry of userID is in the log.
+	ProveLatest(userID string) (types.KeyLogProof, error)
+	// ProveConsistency proves the log at size first is a prefix of the log
+	// at size second.
+	ProveConsistency(first uint64, second uint64) (types.KeyLogConsistency, error)
+	// PublicKey returns the key tree heads are signed with.
+	PublicKey() crypto.PublicKey
+}
+
+type MemoryKeyLog struct {
+	entries [][]byte
+	leaves  [][]byte
+	latest  map[string]int
+	head    *types.SignedTreeHead
+	signer  crypto.Signer
+	mutex   *sync.Mutex
+}
+
+// MakeMemoryKeyLog returns an empty log signing its tree heads with signer.
+func MakeMemoryKeyLog(signer crypto.Signer) *MemoryKeyLog {
+	return &MemoryKeyLog{
+		latest: make(map[string]int),
+		signer: signer,
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (log *MemoryKeyLog) Append(entry types.KeyLogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.entries = append(log.entries, data)
+	log.leaves = append(log.leaves, utils.MerkleLeafHash(data))
+	log.latest[entry.UserID] = len(log.entries) - 1
+	return log.signHead()
+}
+
+func (log *MemoryKeyLog) TreeHead() (types.SignedTreeHead, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.head == nil {
+		if err := log.signHead(); err != nil {
+			return types.SignedTreeHead{}, err
+		}
+	}
+	return *log.head, nil
+}
+
+func (log *MemoryKeyLog) ProveLatest(userID string) (types.KeyLogProof, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	index, ok := log.latest[userID]
+	if !ok {
+		return types.KeyLogProof{}, ErrKeyDoesNotExist{key: userID}
+	}
+	return types.KeyLogProof{
+		Entry:     log.entries[index],
+		Index:     uint64(index),
+		AuditPath: utils.MerkleInclusionProof(log.leaves, index),
+		TreeHead:  *log.head,
+	}, nil
+}
+
+func (log *MemoryKeyLog) ProveConsistency(first uint64, second uint64) (types.KeyLogConsistency, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if first > second || second > uint64(len(log.leaves)) {
+		return types.KeyLogConsistency{}, ErrInvalidTreeSize{First: first, Second: second}
+	}
+	return types.KeyLogConsistency{
+		First:  first,
+		Second: second,
+		Proof:  utils.MerkleConsistencyProof(log.leaves[:second], int(first)),
+	}, nil
+}
+
+func (log *MemoryKeyLog) PublicKey() crypto.PublicKey {
+	return log.signer.Public()
+}
+
+// signHead signs the head of the whole log. The mutex must be held.
+func (log *MemoryKeyLog) signHead() error {
+	head := types.SignedTreeHead{
+		Size:      uint64(len(log.leaves)),
+		RootHash:  utils.MerkleRoot(log.leaves),
+		Timestamp: time.Now().UTC(),
+	}
+	signature, err := utils.Sign(log.signer, types.TreeHeadBytes(head))
+	if err != nil {
+		return err
+	}
+	head.Signature = signature
+	log.head = &head
+	return nil
+}
+
+type ErrInvalidTreeSize struct {
+	First  uint64
+	Second uint64
+}
+
+func (err ErrInvalidTreeSize) Error() string {
+	return fmt.Sprintf("no consistency proof between tree sizes %d and %d", err.First, err.Second)
+}
+
+// LoggedUserKeystore records every change made to the keys of a UserKeystore
+// in a KeyLog.
+type LoggedUserKeystore struct {
+	UserKeystore
+	log   KeyLog
+	mutex *sync.Mutex
+}
+
+func MakeLoggedUserKeystore(keystore UserKeystore, log KeyLog) *LoggedUserKeystore {
+	return &LoggedUserKeystore{
+		UserKeystore: keystore,
+		log:          log,
+		mutex:        &sync.Mutex{},
+	}
+}
+
+func (keystore *LoggedUserKeystore) AddPublicKey(userID string, publicKeys jwk.Set) error {
+	return keystore.AddDevicePublicKey(userID, types.DefaultDeviceID, publicKeys)
+}
+
+// AddDevicePublicKey logs the keys as added when the device had none, and as
+// a rotation otherwise.
+func (keystore *LoggedUserKeystore) AddDevicePublicKey(userID string, deviceID string, publicKeys jwk.Set) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	operation := types.KeyLogAdd
+	if keys, err := keystore.UserKeystore.PublicKeyByUserID(userID); err == nil {
+		if _, ok := utils.JWKSetsByDevice(keys)[deviceID]; ok {
+			operation = types.KeyLogRotate
+		}
+	}
+	if err := keystore.UserKeystore.AddDevicePublicKey(userID, deviceID, publicKeys); err != nil {
+		return err
+	}
+	return keystore.record(operation, userID, deviceID)
+}
+
+func (keystore *LoggedUserKeystore) DeletePublicKeyByUserID(userID string) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	if err := keystore.UserKeystore.DeletePublicKeyByUserID(userID); err != nil {
+		return err
+	}
+	return keystore.record(types.KeyLogDeleteUser, userID, "")
+}
+
+func (keystore *LoggedUserKeystore) DeleteDevicePublicKey(userID string, deviceID string) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	if err := keystore.UserKeystore.DeleteDevicePublicKey(userID, deviceID); err != nil {
+		return err
+	}
+	return keystore.record(types.KeyLogDeleteDevice, userID, deviceID)
+}
+
+// RevokePublicKey logs the revocation against the device of the key.
+func (keystore *LoggedUserKeystore) RevokePublicKey(userID string, keyID string, reason string, revokedAt time.Time) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	var deviceID string
+	if keys, err := keystore.UserKeystore.PublicKeyByUserID(userID); err == nil {
+		if key, ok := keys.LookupKeyID(keyID); ok {
+			deviceID = utils.JWKDevice(key)
+		}
+	}
+	if err := keystore.UserKeystore.RevokePublicKey(userID, keyID, reason, revokedAt); err != nil {
+		return err
+	}
+	return keystore.record(types.KeyLogRevoke, userID, deviceID)
+}
+
+// record appends the keys userID is left with after operation to the log.
+// The mutex must be held.
+func (keystore *LoggedUserKeystore) record(operation string, userID string, deviceID string) error {
+	keys, err := keystore.UserKeystore.PublicKeyByUserID(userID)
+	if _, ok := err.(ErrKeyDoesNotExist); ok {
+		keys = jwk.NewSet()
+	} else if err != nil {
+		return err
+	}
+	loggedKeys, err := utils.LoggedKeys(keys)
+	if err != nil {
+		return err
+	}
+	return keystore.log.Append(types.KeyLogEntry{
+		Operation: operation,
+		UserID:    userID,
+		DeviceID:  deviceID,
+		Keys:      loggedKeys,
+		Time:      time.Now().UTC(),
+	})
+}
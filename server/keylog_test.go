@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	var leaves [][]byte
+	for i := 0; i < 20; i++ {
+		leaves = append(leaves, utils.MerkleLeafHash([]byte(fmt.Sprintf("entry %d", i))))
+	}
+
+	for size := 1; size <= len(leaves); size++ {
+		tree := leaves[:size]
+		root := utils.MerkleRoot(tree)
+		for index := range tree {
+			proof := utils.MerkleInclusionProof(tree, index)
+			if err := utils.VerifyMerkleInclusion(tree[index], uint64(index), uint64(size), proof, root); err != nil {
+				t.Errorf("inclusion of leaf %d in tree of size %d: %s", index, size, err)
+			}
+			other := tree[(index+1)%size]
+			if size > 1 && utils.VerifyMerkleInclusion(other, uint64(index), uint64(size), proof, root) == nil {
+				t.Errorf("leaf %d proven at index %d in tree of size %d", (index+1)%size, index, size)
+			}
+		}
+		for first := 0; first <= size; first++ {
+			proof := utils.MerkleConsistencyProof(tree, first)
+			firstRoot := utils.MerkleRoot(tree[:first])
+			if err := utils.VerifyMerkleConsistency(uint64(first), uint64(size), firstRoot, root, proof); err != nil {
+				t.Errorf("consistency of size %d with size %d: %s", first, size, err)
+			}
+			// a tree that rewrote its history is not consistent
+			if first > 0 && first < size {
+				forked := append([][]byte{utils.MerkleLeafHash([]byte("forged"))}, tree[1:first]...)
+				if utils.VerifyMerkleConsistency(uint64(first), uint64(size), utils.MerkleRoot(forked), root, proof) == nil {
+					t.Errorf("forked tree of size %d consistent with size %d", first, size)
+				}
+			}
+		}
+	}
+}
+
+func TestLoggedUserKeystore(t *testing.T) {
+	_, logKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := MakeMemoryKeyLog(logKey)
+	keystore := MakeLoggedUserKeystore(MakeMemoryUserKeystore(), log)
+
+	addKey := func(deviceID string) {
+		edKey, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := jwk.New(edKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := jwk.NewSet()
+		set.Add(key)
+		if err := keystore.AddDevicePublicKey("MEP", deviceID, set); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		operation string
+		change    func()
+		keys      int
+	}{
+		{types.KeyLogAdd, func() { addKey("laptop") }, 1},
+		{types.KeyLogRotate, func() { addKey("laptop") }, 2},
+		{types.KeyLogAdd, func() { addKey("phone") }, 3},
+		{types.KeyLogDeleteDevice, func() {
+			if err := keystore.DeleteDevicePublicKey("MEP", "phone"); err != nil {
+				t.Fatal(err)
+			}
+		}, 2},
+		{types.KeyLogDeleteUser, func() {
+			if err := keystore.DeletePublicKeyByUserID("MEP"); err != nil {
+				t.Fatal(err)
+			}
+		}, 0},
+	}
+
+	var previous types.SignedTreeHead
+	for i, test := range tests {
+		test.change()
+
+		head, err := log.TreeHead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !assert(uint64(i+1), head.Size) {
+			t.Error(sprintFailure(i+1, head.Size))
+		}
+		if err := utils.Verify(log.PublicKey(), types.TreeHeadBytes(head), head.Signature); err != nil {
+			t.Errorf("tree head of size %d: %s", head.Size, err)
+		}
+		consistency, err := log.ProveConsistency(previous.Size, head.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := utils.VerifyMerkleConsistency(previous.Size, head.Size, previous.RootHash, head.RootHash, consistency.Proof); err != nil {
+			t.Errorf("tree head of size %d not consistent with size %d", head.Size, previous.Size)
+		}
+		previous = head
+
+		proof, err := log.ProveLatest("MEP")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry types.KeyLogEntry
+		if err := json.Unmarshal(proof.Entry, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if !assert(test.operation, entry.Operation) {
+			t.Error(sprintFailure(test.operation, entry.Operation))
+		}
+		if !assert(test.keys, len(entry.Keys)) {
+			t.Error(sprintFailure(test.keys, len(entry.Keys)))
+		}
+		if err := utils.VerifyMerkleInclusion(utils.MerkleLeafHash(proof.Entry), proof.Index, proof.TreeHead.Size, proof.AuditPath, proof.TreeHead.RootHash); err != nil {
+			t.Errorf("latest entry after %s: %s", test.operation, err)
+		}
+	}
+
+	if _, err := log.ProveConsistency(2, previous.Size+1); err == nil {
+		t.Error("proved consistency with a tree larger than the log")
+	}
+}
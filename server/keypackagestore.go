@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+// KeyPackageStore holds the MLS KeyPackages published by each device of a
+// user, next to the keys the device registered in the UserKeystore. Each
+// KeyPackage is handed out once.
+type KeyPackageStore interface {
+	AddKeyPackages(userID string, deviceID string, keyPackages []types.MLSKeyPackage) error
+	CountKeyPackages(userID string, deviceID string, now time.Time) (int, error)
+	// TakeKeyPackage returns a KeyPackage of the device that has not expired
+	// at now and removes it from the store.
+	TakeKeyPackage(userID string, deviceID string, now time.Time) (types.MLSKeyPackage, error)
+	DeleteKeyPackages(userID string, deviceID string) error
+}
+
+type MemoryKeyPackageStore struct {
+	keyPackages map[deviceKey][]types.MLSKeyPackage
+	mutex       *sync.Mutex
+}
+
+func MakeMemoryKeyPackageStore() *MemoryKeyPackageStore {
+	return &MemoryKeyPackageStore{
+		keyPackages: make(map[deviceKey][]types.MLSKeyPackage),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (store *MemoryKeyPackageStore) AddKeyPackages(userID string, deviceID string, keyPackages []types.MLSKeyPackage) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := deviceKey{userID, deviceID}
+	store.keyPackages[key] = append(store.keyPackages[key], keyPackages...)
+	return nil
+}
+
+func (store *MemoryKeyPackageStore) CountKeyPackages(userID string, deviceID string, now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return len(store.unexpired(deviceKey{userID, deviceID}, now)), nil
+}
+
+func (store *MemoryKeyPackageStore) TakeKeyPackage(userID string, deviceID string, now time.Time) (types.MLSKeyPackage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := deviceKey{userID, deviceID}
+	keyPackages := store.unexpired(key, now)
+	if len(keyPackages) == 0 {
+		return types.MLSKeyPackage{}, ErrKeyDoesNotExist{key: userID + "/" + deviceID}
+	}
+	store.keyPackages[key] = keyPackages[1:]
+	return keyPackages[0], nil
+}
+
+func (store *MemoryKeyPackageStore) DeleteKeyPackages(userID string, deviceID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.keyPackages, deviceKey{userID, deviceID})
+	return nil
+}
+
+// unexpired drops the KeyPackages of a device that expired by now and returns
+// the others.
+func (store *MemoryKeyPackageStore) unexpired(key deviceKey, now time.Time) []types.MLSKeyPackage {
+	keyPackages := make([]types.MLSKeyPackage, 0, len(store.keyPackages[key]))
+	for _, keyPackage := range store.keyPackages[key] {
+		lifetime := keyPackage.LeafNode.Lifetime
+		if lifetime != nil && now.After(lifetime.NotAfter) {
+			continue
+		}
+		keyPackages = append(keyPackages, keyPackage)
+	}
+	store.keyPackages[key] = keyPackages
+	return keyPackages
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestMemoryKeyPackageStore(t *testing.T) {
+	store := MakeMemoryKeyPackageStore()
+	now := time.Now()
+	expired := types.MLSKeyPackage{InitKey: []byte("expired"), LeafNode: types.MLSLeafNode{Lifetime: &types.MLSLifetime{NotAfter: now.Add(-time.Minute)}}}
+	valid := types.MLSKeyPackage{InitKey: []byte("valid"), LeafNode: types.MLSLeafNode{Lifetime: &types.MLSLifetime{NotAfter: now.Add(time.Hour)}}}
+	if err := store.AddKeyPackages("MEP", "laptop", []types.MLSKeyPackage{expired, valid}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := store.CountKeyPackages("MEP", "laptop", now); err != nil || count != 1 {
+		t.Errorf("expected 1 unexpired KeyPackage but got %d with %v", count, err)
+	}
+
+	keyPackage, err := store.TakeKeyPackage("MEP", "laptop", now)
+	if err != nil || string(keyPackage.InitKey) != "valid" {
+		t.Errorf("unexpected KeyPackage %q with %v", keyPackage.InitKey, err)
+	}
+	// each is handed out once
+	if _, err := store.TakeKeyPackage("MEP", "laptop", now); err == nil {
+		t.Error("a KeyPackage was handed out twice")
+	}
+
+	if err := store.AddKeyPackages("MEP", "laptop", []types.MLSKeyPackage{valid}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteKeyPackages("MEP", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := store.CountKeyPackages("MEP", "laptop", now); count != 0 {
+		t.Errorf("expected no KeyPackages after deleting the device but got %d", count)
+	}
+}
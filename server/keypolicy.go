@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/utils"
+)
+
+// ErrKeyPolicy is returned for a key the key policy of the server refuses.
+type ErrKeyPolicy struct {
+	KeyID  string
+	Reason string
+}
+
+func (err ErrKeyPolicy) Error() string {
+	return fmt.Sprintf("key %s does not meet the key policy: %s", err.KeyID, err.Reason)
+}
+
+// KeyPolicy decides which keys users may register.
+type KeyPolicy struct {
+	// MinRSABits is the smallest RSA modulus accepted, in bits.
+	MinRSABits int
+	// Algorithms maps each accepted alg to the kinds of key it is accepted
+	// for.
+	Algorithms map[string][]KeyAlgorithm
+	// RequireUse refuses keys that do not say whether they are for
+	// signatures or encryption.
+	RequireUse bool
+}
+
+// KeyAlgorithm is a kind of key an alg is accepted for. Curve is empty for
+// RSA keys.
+type KeyAlgorithm struct {
+	KeyType string
+	Curve   string
+	Use     string
+}
+
+// DefaultKeyPolicy accepts the keys clients generate: RSA keys of 2048 bits
+// or more, P-256, Ed25519 and X25519 keys, each for the use and alg clients
+// advertise them with.
+var DefaultKeyPolicy = KeyPolicy{
+	MinRSABits: 2048,
+	Algorithms: map[string][]KeyAlgorithm{
+		utils.AlgorithmPS256:   {{KeyType: "RSA", Use: utils.UseSignature}},
+		utils.AlgorithmRSAOAEP: {{KeyType: "RSA", Use: utils.UseEncryption}},
+		utils.AlgorithmES256:   {{KeyType: "EC", Curve: "P-256", Use: utils.UseSignature}},
+		utils.AlgorithmEdDSA:   {{KeyType: "OKP", Curve: "Ed25519", Use: utils.UseSignature}},
+		utils.AlgorithmECDHES: {
+			{KeyType: "EC", Curve: "P-256", Use: utils.UseEncryption},
+			{KeyType: "OKP", Curve: "X25519", Use: utils.UseEncryption},
+		},
+	},
+	RequireUse: true,
+}
+
+// Check returns ErrKeyPolicy for a key the policy refuses, saying why.
+func (policy KeyPolicy) Check(key jwk.Key) error {
+	refuse := func(format string, args ...interface{}) error {
+		return ErrKeyPolicy{KeyID: key.KeyID(), Reason: fmt.Sprintf(format, args...)}
+	}
+	use := key.KeyUsage()
+	if use == "" && policy.RequireUse {
+		return refuse("use must be %q or %q", utils.UseSignature, utils.UseEncryption)
+	}
+	alg := utils.JWKAlgorithm(key, use)
+	kinds, ok := policy.Algorithms[alg]
+	if !ok {
+		return refuse("alg %q is not accepted", alg)
+	}
+	curve := ""
+	switch k := key.(type) {
+	case jwk.ECDSAPublicKey:
+		curve = k.Crv().String()
+	case jwk.OKPPublicKey:
+		curve = k.Crv().String()
+	}
+	accepted := false
+	for _, kind := range kinds {
+		if kind.KeyType == string(key.KeyType()) && kind.Curve == curve && (use == "" || kind.Use == use) {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		if curve != "" {
+			return refuse("alg %q is not accepted for kty %q on curve %q with use %q", alg, key.KeyType(), curve, use)
+		}
+		return refuse("alg %q is not accepted for kty %q with use %q", alg, key.KeyType(), use)
+	}
+	if rsaKey, ok := key.(jwk.RSAPublicKey); ok {
+		bits := new(big.Int).SetBytes(rsaKey.N()).BitLen()
+		if bits < policy.MinRSABits {
+			return refuse("RSA keys must be at least %d bits, got %d", policy.MinRSABits, bits)
+		}
+		if len(rsaKey.E()) == 0 {
+			return refuse("RSA key has no public exponent")
+		}
+	}
+	return nil
+}
+
+// keyPolicy returns the key policy of the server, DefaultKeyPolicy when it
+// sets none.
+func (server *Server) keyPolicy() KeyPolicy {
+	if server.KeyPolicy == nil {
+		return DefaultKeyPolicy
+	}
+	return *server.KeyPolicy
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestKeyPolicyCheck(t *testing.T) {
+	keysOf := func(privateKey crypto.Signer) (jwk.Key, jwk.Key) {
+		keys, err := utils.MakeJWKSetFromPrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigKey, _ := utils.FindJWK(keys, utils.UseSignature)
+		encKey, _ := utils.FindJWK(keys, utils.UseEncryption)
+		return sigKey, encKey
+	}
+	set := func(key jwk.Key, name string, value interface{}) jwk.Key {
+		if err := key.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	clone := func(key jwk.Key) jwk.Key {
+		cloned, err := key.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cloned
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, rsaEnc := keysOf(rsaKey)
+	weakSig, _ := keysOf(weakKey)
+	ecSig, ecEnc := keysOf(ecKey)
+	edSig, x25519Enc := keysOf(edKey)
+
+	noUse := clone(rsaSig)
+	if err := noUse.Remove(jwk.KeyUsageKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		key           jwk.Key
+		expectedError error
+	}{
+		{"RSASignature", rsaSig, nil},
+		{"RSAEncryption", rsaEnc, nil},
+		{"P256Signature", ecSig, nil},
+		{"P256Encryption", ecEnc, nil},
+		{"Ed25519", edSig, nil},
+		{"X25519", x25519Enc, nil},
+		{"WeakRSA", weakSig, ErrKeyPolicy{KeyID: weakSig.KeyID(), Reason: "RSA keys must be at least 2048 bits, got 1024"}},
+		{"NoUse", noUse, ErrKeyPolicy{KeyID: rsaSig.KeyID(), Reason: `use must be "sig" or "enc"`}},
+		{"UnknownAlgorithm", set(clone(rsaSig), jwk.AlgorithmKey, "HS256"), ErrKeyPolicy{KeyID: rsaSig.KeyID(), Reason: `alg "HS256" is not accepted`}},
+		{"AlgorithmForOtherKeyType", set(clone(rsaSig), jwk.AlgorithmKey, utils.AlgorithmES256), ErrKeyPolicy{KeyID: rsaSig.KeyID(), Reason: `alg "ES256" is not accepted for kty "RSA" with use "sig"`}},
+		{"AlgorithmForOtherUse", set(clone(rsaEnc), jwk.AlgorithmKey, utils.AlgorithmPS256), ErrKeyPolicy{KeyID: rsaEnc.KeyID(), Reason: `alg "PS256" is not accepted for kty "RSA" with use "enc"`}},
+		{"Ed25519Encryption", set(clone(edSig), jwk.KeyUsageKey, utils.UseEncryption), ErrKeyPolicy{KeyID: edSig.KeyID(), Reason: `alg "EdDSA" is not accepted for kty "OKP" on curve "Ed25519" with use "enc"`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := DefaultKeyPolicy.Check(test.key)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/markpotocki/messenger/types"
@@ -16,6 +17,7 @@ type MessageStore interface {
 	FindReceivedByUserID(userID string) ([]Message, error)
 	FindSentByUserID(userID string) ([]Message, error)
 	FindAllByUserID(userID string) ([]Message, error)
+	FindAllByUserDeviceID(userID string, deviceID string) ([]Message, error)
 }
 
 type MemoryMessageStore struct {
@@ -62,29 +64,62 @@ func (store *MemoryMessageStore) FindReceivedByUserID(userID string) ([]Message,
 			messages = append(messages, message)
 		}
 	}
+	sortMessages(messages)
 	return messages, nil
 }
 
+// FindSentByUserID returns the messages userID sent without sealing them. The
+// sender of a sealed message is unknown to the store.
 func (store *MemoryMessageStore) FindSentByUserID(userID string) ([]Message, error) {
 	messages := make([]Message, 0)
 	for _, message := range store.messages {
-		if message.From == userID {
+		if message.From == userID && !message.Sealed {
 			messages = append(messages, message)
 		}
 	}
+	sortMessages(messages)
 	return messages, nil
 }
 
 func (store *MemoryMessageStore) FindAllByUserID(userID string) ([]Message, error) {
 	messages := make([]Message, 0)
 	for _, message := range store.messages {
-		if message.From == userID || message.To == userID {
+		if (message.From == userID && !message.Sealed) || message.To == userID {
 			messages = append(messages, message)
 		}
 	}
+	sortMessages(messages)
 	return messages, nil
 }
 
+// FindAllByUserDeviceID returns the messages sent by a user and the copies of
+// messages to them meant for deviceID. Messages that name no device are meant
+// for every device.
+func (store *MemoryMessageStore) FindAllByUserDeviceID(userID string, deviceID string) ([]Message, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	messages := make([]Message, 0)
+	for _, message := range store.messages {
+		received := message.To == userID && (message.ToDevice == "" || message.ToDevice == deviceID)
+		if (message.From == userID && !message.Sealed) || received {
+			messages = append(messages, message)
+		}
+	}
+	sortMessages(messages)
+	return messages, nil
+}
+
+// sortMessages orders messages by the time they were sent, breaking ties by
+// ID, so callers see a stable order regardless of map iteration.
+func sortMessages(messages []Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].TimeSent.Equal(messages[j].TimeSent) {
+			return messages[i].TimeSent.Before(messages[j].TimeSent)
+		}
+		return messages[i].ID < messages[j].ID
+	})
+}
+
 type ErrDuplicateID struct {
 	ID     types.MessageID
 	Action string
@@ -217,6 +217,51 @@ func TestMemoryMessageStoreFindAllByUserID(t *testing.T) {
 	}
 }
 
+func TestMemoryMessageStoreFindAllByUserDeviceID(t *testing.T) {
+	user := "MEP"
+	device := "laptop"
+	messages := []Message{
+		{ID: "0", To: user, From: "Who", ToDevice: device},
+		{ID: "1", To: user, From: "Who", ToDevice: "desktop"},
+		{ID: "2", To: user, From: "Where"},
+		{ID: "3", To: "No", From: user, ToDevice: "desktop"},
+		{ID: "4", To: "No", From: "What", ToDevice: device},
+	}
+
+	expectedMessages := []Message{
+		{ID: "0", To: user, From: "Who", ToDevice: device},
+		{ID: "2", To: user, From: "Where"},
+		{ID: "3", To: "No", From: user, ToDevice: "desktop"},
+	}
+	expectedLength := len(expectedMessages)
+
+	messageStore := MemoryMessageStore{
+		messages: map[MessageID]Message{},
+		mutex:    &sync.Mutex{},
+	}
+
+	for _, message := range messages {
+		messageStore.messages[MessageID(message.ID)] = message
+	}
+
+	actualMessages, err := messageStore.FindAllByUserDeviceID(user, device)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// check length
+	if !assert(expectedLength, len(actualMessages)) {
+		t.Error(sprintFailure(expectedLength, len(actualMessages)))
+	}
+
+	// check we only got the copies for our device back
+	for index, msg := range actualMessages {
+		if !assert(expectedMessages[index], msg) {
+			t.Error(sprintFailure(expectedMessages[index], msg))
+		}
+	}
+}
+
 func TestMemoryMessageStoreDeleteByID(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+// ErrMLSEpoch is returned for MLS messages sent in an epoch the group is no
+// longer, or not yet, in. The sender catches up with the group and sends
+// again.
+type ErrMLSEpoch struct {
+	GroupID string
+	Epoch   uint64
+}
+
+func (err ErrMLSEpoch) Error() string {
+	return fmt.Sprintf("MLS group %s is at epoch %d", err.GroupID, err.Epoch)
+}
+
+// ErrMLSNotWelcomed is returned for MLS messages sent by a device the group
+// never welcomed.
+var ErrMLSNotWelcomed = errors.New("device was never welcomed to the MLS group")
+
+// MLSDeliveryService orders the MLS messages of each group into a log every
+// member reads in the same order. The first commit sent in an epoch starts
+// the next epoch and is the only one taken for it, so every member moves to
+// the same next epoch and the devices it welcomes join that one. Commits and
+// application messages of any epoch but the current are refused with
+// ErrMLSEpoch.
+//
+// Only the device that sent the first message of a group and the devices
+// welcomed to it by a commit send to it.
+type MLSDeliveryService interface {
+	// AddMLSMessage appends message, sent by the device from, to the log of
+	// its group, setting its Seq and Received. A commit's welcome is held
+	// for each device in welcomeTo once the commit is accepted.
+	AddMLSMessage(from types.MLSDevice, message types.MLSMessage, welcome []byte, welcomeTo []types.MLSDevice, now time.Time) (types.MLSMessage, error)
+	// MLSMessages returns the messages of the group after Seq after.
+	MLSMessages(groupID string, after uint64) ([]types.MLSMessage, error)
+	// TakeMLSWelcomes returns the welcomes held for a device and removes
+	// them.
+	TakeMLSWelcomes(userID string, deviceID string) ([]types.MLSWelcome, error)
+}
+
+type mlsLog struct {
+	epoch    uint64
+	messages []types.MLSMessage
+	welcomed map[deviceKey]bool
+}
+
+type MemoryMLSDeliveryService struct {
+	logs     map[string]*mlsLog
+	welcomes map[deviceKey][]types.MLSWelcome
+	mutex    *sync.Mutex
+}
+
+func MakeMemoryMLSDeliveryService() *MemoryMLSDeliveryService {
+	return &MemoryMLSDeliveryService{
+		logs:     make(map[string]*mlsLog),
+		welcomes: make(map[deviceKey][]types.MLSWelcome),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (service *MemoryMLSDeliveryService) AddMLSMessage(from types.MLSDevice, message types.MLSMessage, welcome []byte, welcomeTo []types.MLSDevice, now time.Time) (types.MLSMessage, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	sender := deviceKey{from.UserID, from.DeviceID}
+	log, ok := service.logs[message.GroupID]
+	if !ok {
+		// the group is started by whoever sends to it first
+		if message.Epoch != 0 {
+			return types.MLSMessage{}, ErrMLSEpoch{GroupID: message.GroupID, Epoch: 0}
+		}
+		log = &mlsLog{welcomed: map[deviceKey]bool{sender: true}}
+		service.logs[message.GroupID] = log
+	}
+	if !log.welcomed[sender] {
+		return types.MLSMessage{}, ErrMLSNotWelcomed
+	}
+	if message.Epoch != log.epoch {
+		return types.MLSMessage{}, ErrMLSEpoch{GroupID: message.GroupID, Epoch: log.epoch}
+	}
+	message.Seq = uint64(len(log.messages)) + 1
+	message.Received = now
+	log.messages = append(log.messages, message)
+	if message.Handshake {
+		log.epoch++
+		for _, device := range welcomeTo {
+			key := deviceKey{device.UserID, device.DeviceID}
+			log.welcomed[key] = true
+			service.welcomes[key] = append(service.welcomes[key], types.MLSWelcome{GroupID: message.GroupID, Seq: message.Seq, Welcome: welcome})
+		}
+	}
+	return message, nil
+}
+
+func (service *MemoryMLSDeliveryService) MLSMessages(groupID string, after uint64) ([]types.MLSMessage, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	messages := make([]types.MLSMessage, 0)
+	if log, ok := service.logs[groupID]; ok && after < uint64(len(log.messages)) {
+		messages = append(messages, log.messages[after:]...)
+	}
+	return messages, nil
+}
+
+func (service *MemoryMLSDeliveryService) TakeMLSWelcomes(userID string, deviceID string) ([]types.MLSWelcome, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	key := deviceKey{userID, deviceID}
+	welcomes := service.welcomes[key]
+	delete(service.welcomes, key)
+	if welcomes == nil {
+		welcomes = make([]types.MLSWelcome, 0)
+	}
+	return welcomes, nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestMemoryMLSDeliveryService(t *testing.T) {
+	service := MakeMemoryMLSDeliveryService()
+	now := time.Now()
+	alice := types.MLSDevice{UserID: "ALICE", DeviceID: "laptop"}
+	bob := types.MLSDevice{UserID: "BOB", DeviceID: "phone"}
+	carol := types.MLSDevice{UserID: "CAROL", DeviceID: "tablet"}
+
+	tests := []struct {
+		name          string
+		from          types.MLSDevice
+		message       types.MLSMessage
+		welcomeTo     []types.MLSDevice
+		expectedSeq   uint64
+		expectedError error
+	}{
+		{"Application", alice, types.MLSMessage{GroupID: "team", Epoch: 0}, nil, 1, nil},
+		{"NotWelcomed", bob, types.MLSMessage{GroupID: "team", Epoch: 0}, nil, 0, ErrMLSNotWelcomed},
+		{"Commit", alice, types.MLSMessage{GroupID: "team", Epoch: 0, Handshake: true}, []types.MLSDevice{bob}, 2, nil},
+		// only the first commit of an epoch is taken, along with its welcome
+		{"ConflictingCommit", bob, types.MLSMessage{GroupID: "team", Epoch: 0, Handshake: true}, []types.MLSDevice{carol}, 0, ErrMLSEpoch{GroupID: "team", Epoch: 1}},
+		{"StaleApplication", alice, types.MLSMessage{GroupID: "team", Epoch: 0}, nil, 0, ErrMLSEpoch{GroupID: "team", Epoch: 1}},
+		{"FutureApplication", alice, types.MLSMessage{GroupID: "team", Epoch: 2}, nil, 0, ErrMLSEpoch{GroupID: "team", Epoch: 1}},
+		{"NotWelcomedByConflictingCommit", carol, types.MLSMessage{GroupID: "team", Epoch: 1}, nil, 0, ErrMLSNotWelcomed},
+		{"NextEpoch", bob, types.MLSMessage{GroupID: "team", Epoch: 1}, nil, 3, nil},
+		{"NextCommit", bob, types.MLSMessage{GroupID: "team", Epoch: 1, Handshake: true}, nil, 4, nil},
+		{"StaleCommit", alice, types.MLSMessage{GroupID: "team", Epoch: 0, Handshake: true}, nil, 0, ErrMLSEpoch{GroupID: "team", Epoch: 2}},
+		{"OtherGroup", bob, types.MLSMessage{GroupID: "other", Epoch: 0}, nil, 1, nil},
+		{"NewGroupInLaterEpoch", bob, types.MLSMessage{GroupID: "late", Epoch: 1}, nil, 0, ErrMLSEpoch{GroupID: "late", Epoch: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := service.AddMLSMessage(test.from, test.message, []byte("welcome"), test.welcomeTo, now)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+			if !assert(test.expectedSeq, message.Seq) {
+				t.Error(sprintFailure(test.expectedSeq, message.Seq))
+			}
+		})
+	}
+
+	messages, err := service.MLSMessages("team", 1)
+	if err != nil || len(messages) != 3 || messages[0].Seq != 2 || messages[2].Seq != 4 {
+		t.Errorf("unexpected messages after 1 %v with %v", messages, err)
+	}
+	// only the welcomes of accepted commits are delivered, once
+	welcomes, err := service.TakeMLSWelcomes(bob.UserID, bob.DeviceID)
+	if err != nil || len(welcomes) != 1 || welcomes[0].Seq != 2 || welcomes[0].GroupID != "team" {
+		t.Errorf("unexpected welcomes %v with %v", welcomes, err)
+	}
+	if welcomes, _ := service.TakeMLSWelcomes(bob.UserID, bob.DeviceID); len(welcomes) != 0 {
+		t.Errorf("welcomes %v were delivered twice", welcomes)
+	}
+	if welcomes, _ := service.TakeMLSWelcomes(carol.UserID, carol.DeviceID); len(welcomes) != 0 {
+		t.Errorf("welcomes %v of a refused commit were delivered", welcomes)
+	}
+}
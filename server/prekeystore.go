@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+// PrekeyStore holds the prekeys published by each device of a user.
+type PrekeyStore interface {
+	// AddPrekeys replaces the identity key and signed prekey of a device when
+	// signedPrekey is given and adds the one-time prekeys, storing nothing
+	// when any of them is refused.
+	AddPrekeys(userID string, deviceID string, identityKey []byte, signedPrekey *types.SignedPrekey, oneTimePrekeys []types.Prekey) error
+	CountOneTimePrekeys(userID string, deviceID string) (int, error)
+	TakeBundle(userID string, deviceID string) (types.PrekeyBundle, error)
+	DeletePrekeys(userID string, deviceID string) error
+}
+
+type deviceKey struct {
+	userID   string
+	deviceID string
+}
+
+type userPrekeys struct {
+	identityKey    []byte
+	signedPrekey   *types.SignedPrekey
+	oneTimePrekeys []types.Prekey
+}
+
+type MemoryPrekeyStore struct {
+	prekeys map[deviceKey]*userPrekeys
+	mutex   *sync.Mutex
+}
+
+func MakeMemoryPrekeyStore() *MemoryPrekeyStore {
+	return &MemoryPrekeyStore{
+		prekeys: make(map[deviceKey]*userPrekeys),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (store *MemoryPrekeyStore) AddPrekeys(userID string, deviceID string, identityKey []byte, signedPrekey *types.SignedPrekey, oneTimePrekeys []types.Prekey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry := store.entry(deviceKey{userID, deviceID})
+	// one-time prekeys belong to the identity that published them
+	replaced := signedPrekey != nil && entry.identityKey != nil && string(entry.identityKey) != string(identityKey)
+	ids := make(map[uint32]bool)
+	if !replaced {
+		for _, existing := range entry.oneTimePrekeys {
+			ids[existing.ID] = true
+		}
+	}
+	for _, prekey := range oneTimePrekeys {
+		if ids[prekey.ID] {
+			return ErrDuplicatePrekey{UserID: userID, DeviceID: deviceID, ID: prekey.ID}
+		}
+		ids[prekey.ID] = true
+	}
+	if signedPrekey != nil {
+		if replaced {
+			entry.oneTimePrekeys = nil
+		}
+		prekey := *signedPrekey
+		entry.identityKey = identityKey
+		entry.signedPrekey = &prekey
+	}
+	entry.oneTimePrekeys = append(entry.oneTimePrekeys, oneTimePrekeys...)
+	return nil
+}
+
+func (store *MemoryPrekeyStore) CountOneTimePrekeys(userID string, deviceID string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if entry, ok := store.prekeys[deviceKey{userID, deviceID}]; ok {
+		return len(entry.oneTimePrekeys), nil
+	}
+	return 0, nil
+}
+
+// TakeBundle returns the prekey bundle of a device, using up one of its
+// one-time prekeys if any are left.
+func (store *MemoryPrekeyStore) TakeBundle(userID string, deviceID string) (types.PrekeyBundle, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.prekeys[deviceKey{userID, deviceID}]
+	if !ok || entry.signedPrekey == nil {
+		return types.PrekeyBundle{}, ErrKeyDoesNotExist{key: userID + "/" + deviceID}
+	}
+	bundle := types.PrekeyBundle{
+		UserID:       userID,
+		DeviceID:     deviceID,
+		IdentityKey:  entry.identityKey,
+		SignedPrekey: *entry.signedPrekey,
+	}
+	if len(entry.oneTimePrekeys) > 0 {
+		prekey := entry.oneTimePrekeys[0]
+		entry.oneTimePrekeys = entry.oneTimePrekeys[1:]
+		bundle.OneTimePrekey = &prekey
+	}
+	return bundle, nil
+}
+
+// DeletePrekeys removes everything a device has published.
+func (store *MemoryPrekeyStore) DeletePrekeys(userID string, deviceID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.prekeys, deviceKey{userID, deviceID})
+	return nil
+}
+
+func (store *MemoryPrekeyStore) entry(key deviceKey) *userPrekeys {
+	entry, ok := store.prekeys[key]
+	if !ok {
+		entry = &userPrekeys{}
+		store.prekeys[key] = entry
+	}
+	return entry
+}
+
+type ErrDuplicatePrekey struct {
+	UserID   string
+	DeviceID string
+	ID       uint32
+}
+
+func (err ErrDuplicatePrekey) Error() string {
+	return fmt.Sprintf("prekey %d of device %s of user %s already exists", err.ID, err.DeviceID, err.UserID)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/markpotocki/messenger/types"
+)
+
+func TestMemoryPrekeyStore(t *testing.T) {
+	store := MakeMemoryPrekeyStore()
+	first := types.SignedPrekey{Prekey: types.Prekey{ID: 1, Key: []byte("first")}}
+	if err := store.AddPrekeys("MEP", "laptop", []byte("identity"), &first, []types.Prekey{{ID: 1, Key: []byte("one")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an upload with a duplicate one-time prekey stores nothing
+	second := types.SignedPrekey{Prekey: types.Prekey{ID: 2, Key: []byte("second")}}
+	if err := store.AddPrekeys("MEP", "laptop", []byte("identity"), &second, []types.Prekey{{ID: 1, Key: []byte("again")}}); err == nil {
+		t.Error("a duplicate one-time prekey was accepted")
+	}
+	bundle, err := store.TakeBundle("MEP", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.SignedPrekey.ID != first.ID {
+		t.Errorf("expected signed prekey %d to be kept but got %d", first.ID, bundle.SignedPrekey.ID)
+	}
+	if bundle.OneTimePrekey == nil || string(bundle.OneTimePrekey.Key) != "one" {
+		t.Errorf("unexpected one-time prekey %v", bundle.OneTimePrekey)
+	}
+
+	// one-time prekeys of a replaced identity are dropped, so their IDs are
+	// free again
+	if err := store.AddPrekeys("MEP", "laptop", []byte("identity"), nil, []types.Prekey{{ID: 2, Key: []byte("two")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddPrekeys("MEP", "laptop", []byte("new identity"), &second, []types.Prekey{{ID: 2, Key: []byte("new two")}}); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := store.CountOneTimePrekeys("MEP", "laptop"); count != 1 {
+		t.Errorf("expected 1 one-time prekey after replacing the identity but got %d", count)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultReplayWindow is how long a MemoryReplayCache remembers messages
+// when no window is given.
+const DefaultReplayWindow = 24 * time.Hour
+
+var (
+	ErrMissingNonce = errors.New("message carries no nonce")
+	ErrStaleMessage = errors.New("message was sent outside the replay window")
+)
+
+// ErrReplayedMessage is returned for a message whose nonce, or sequence from
+// its sending device, was already accepted within the replay window. The
+// nonce of a sealed message is checked per recipient.
+type ErrReplayedMessage struct {
+	From     string
+	Sequence uint64
+}
+
+func (err ErrReplayedMessage) Error() string {
+	return fmt.Sprintf("message %d from %s was already received", err.Sequence, err.From)
+}
+
+// ReplayCache rejects messages posted more than once.
+type ReplayCache interface {
+	// Check records messages, sent together by the authenticated device
+	// deviceID of userID, as received at now. It returns ErrReplayedMessage
+	// when one of them was received before, or appears twice, and
+	// ErrStaleMessage when one was sent too long before, or after, now to
+	// tell. Nothing is recorded unless every message passes. The sender of a
+	// sealed message is unknown, so userID and deviceID are ignored for it.
+	Check(userID string, deviceID string, messages []Message, now time.Time) error
+}
+
+// MemoryReplayCache remembers the nonce and sequence of the messages sent
+// within a window of time around now. Messages sent outside the window are
+// refused, so no message is accepted twice however long ago it was seen.
+type MemoryReplayCache struct {
+	window time.Duration
+	seen   map[string]time.Time
+	mutex  *sync.Mutex
+}
+
+// MakeMemoryReplayCache makes a cache over window, DefaultReplayWindow when
+// window is not positive.
+func MakeMemoryReplayCache(window time.Duration) *MemoryReplayCache {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	return &MemoryReplayCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (cache *MemoryReplayCache) Check(userID string, deviceID string, messages []Message, now time.Time) error {
+	for _, message := range messages {
+		if message.Nonce == "" {
+			return ErrMissingNonce
+		}
+		if message.TimeSent.Before(now.Add(-cache.window)) || message.TimeSent.After(now.Add(cache.window)) {
+			return ErrStaleMessage
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key, timeSent := range cache.seen {
+		if timeSent.Before(now.Add(-cache.window)) {
+			delete(cache.seen, key)
+		}
+	}
+	received := make(map[string]time.Time)
+	for _, message := range messages {
+		sender, keys := replayKeys(userID, deviceID, message)
+		for _, key := range keys {
+			_, seen := cache.seen[key]
+			_, repeated := received[key]
+			if seen || repeated {
+				return ErrReplayedMessage{From: sender, Sequence: message.Sequence}
+			}
+			received[key] = message.TimeSent
+		}
+	}
+	for key, timeSent := range received {
+		cache.seen[key] = timeSent
+	}
+	return nil
+}
+
+// replayKeys returns who sent the message and the keys it is remembered by.
+func replayKeys(userID string, deviceID string, message Message) (string, []string) {
+	if message.Sealed {
+		// the sender of a sealed message is unknown, its sequence is kept
+		// inside with the rest of the message
+		return "sealed to " + message.To, []string{"sealed/" + message.To + "/" + message.Nonce}
+	}
+	// keyed on who sent the message rather than who it claims to be from, so
+	// no one can use up the nonces and sequences of another
+	sender := userID + "/" + deviceID
+	return sender, []string{
+		"nonce/" + sender + "/" + message.Nonce,
+		fmt.Sprintf("sequence/%s/%d", sender, message.Sequence),
+	}
+}
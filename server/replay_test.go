@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	now := time.Now()
+	cache := MakeMemoryReplayCache(time.Hour)
+	message := Message{From: "MEP", FromDevice: "phone", TimeSent: now, Nonce: "n1", Sequence: 1}
+
+	tests := []struct {
+		name          string
+		message       Message
+		now           time.Time
+		expectedError error
+	}{
+		{"First", message, now, nil},
+		{"SameMessage", message, now.Add(time.Minute), ErrReplayedMessage{From: "MEP/phone", Sequence: 1}},
+		{"SameNonce", Message{From: "MEP", FromDevice: "phone", TimeSent: now, Nonce: "n1", Sequence: 2}, now, ErrReplayedMessage{From: "MEP/phone", Sequence: 2}},
+		{"SameSequence", Message{From: "MEP", FromDevice: "phone", TimeSent: now, Nonce: "n2", Sequence: 1}, now, ErrReplayedMessage{From: "MEP/phone", Sequence: 1}},
+		{"OtherDevice", Message{From: "MEP", FromDevice: "laptop", TimeSent: now, Nonce: "n1", Sequence: 1}, now, nil},
+		{"NextSequence", Message{From: "MEP", FromDevice: "phone", TimeSent: now, Nonce: "n3", Sequence: 2}, now, nil},
+		{"NoNonce", Message{From: "MEP", FromDevice: "phone", TimeSent: now, Sequence: 3}, now, ErrMissingNonce},
+		{"Stale", Message{From: "MEP", FromDevice: "phone", TimeSent: now.Add(-2 * time.Hour), Nonce: "n4", Sequence: 4}, now, ErrStaleMessage},
+		{"Future", Message{From: "MEP", FromDevice: "phone", TimeSent: now.Add(2 * time.Hour), Nonce: "n5", Sequence: 5}, now, ErrStaleMessage},
+		// once the window passed the message is stale rather than forgotten
+		{"AfterWindow", message, now.Add(2 * time.Hour), ErrStaleMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := cache.Check(test.message.From, test.message.FromDevice, []Message{test.message}, test.now)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+}
+
+func TestMemoryReplayCacheBatch(t *testing.T) {
+	now := time.Now()
+	cache := MakeMemoryReplayCache(time.Hour)
+	first := Message{From: "MEP", FromDevice: "phone", TimeSent: now, Nonce: "n1", Sequence: 1}
+	second := Message{From: "MEP", FromDevice: "phone", TimeSent: now, Nonce: "n2", Sequence: 2}
+	if err := cache.Check("MEP", "phone", []Message{first}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch with a replayed copy records none of its copies
+	expected := ErrReplayedMessage{From: "MEP/phone", Sequence: 1}
+	if err := cache.Check("MEP", "phone", []Message{second, first}, now); !assert(expected, err) {
+		t.Error(sprintFailure(expected, err))
+	}
+	// nor does a batch repeating a copy
+	expected = ErrReplayedMessage{From: "MEP/phone", Sequence: 2}
+	if err := cache.Check("MEP", "phone", []Message{second, second}, now); !assert(expected, err) {
+		t.Error(sprintFailure(expected, err))
+	}
+	if err := cache.Check("MEP", "phone", []Message{second}, now); err != nil {
+		t.Errorf("copy of a refused batch was recorded: %v", err)
+	}
+}
@@ -3,11 +3,20 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/markpotocki/messenger/types"
@@ -18,153 +27,1651 @@ import (
 type Server struct {
 	UserStore    UserStore
 	Keystore     UserKeystore
+	PrekeyStore  PrekeyStore
 	MessageStore MessageStore
+	// KeyLog is optional. When set, the keys handed out at /pubkey come with
+	// a proof they are the latest logged for their user.
+	KeyLog KeyLog
+	// ReplayCache is optional. When set, messages must carry a nonce and are
+	// refused when posted again.
+	ReplayCache ReplayCache
+	// DeliveryTokens is optional. When set, sealed messages are accepted for
+	// users who registered a delivery token.
+	DeliveryTokens DeliveryTokenStore
+	// KeyPolicy decides which keys users may register, DefaultKeyPolicy when
+	// it is nil.
+	KeyPolicy *KeyPolicy
+	// KeyChallenges is optional. When set, keys are only registered with a
+	// proof the device holds them, answering a challenge from
+	// /pubkey/challenge.
+	KeyChallenges KeyChallengeStore
+	// Blobs is optional. When set, clients upload the encrypted files they
+	// attach to messages to /blobs.
+	Blobs BlobStore
+	// Uploads is optional. When set along with Blobs, large blobs are
+	// uploaded to /uploads in chunks, so a transfer that is cut off resumes
+	// where it stopped.
+	Uploads UploadStore
+	// Groups is optional. When set, users talk in groups managed at /groups,
+	// and messages posted to /groups/messages are fanned out to the members.
+	Groups GroupStore
+	// KeyPackages and MLS are optional. When both are set along with
+	// Groups, devices publish MLS KeyPackages to /mls/keypackages and the
+	// members of a group exchange MLS messages through /mls/messages, which
+	// orders them for the group.
+	KeyPackages KeyPackageStore
+	MLS         MLSDeliveryService
 }
 
+const (
+	sizePrekey = 32 // X25519
+	// sizeMLSKey is the size of the X25519 and Ed25519 keys of MLS leaves.
+	sizeMLSKey = 32
+)
+
 type ServerConfig struct {
 	Address string
 	Port    int
 	TLS     bool
 }
 
-func (server *Server) AddUser(w http.ResponseWriter, r *http.Request) {
-	// check if it is POST
+func (server *Server) AddUser(w http.ResponseWriter, r *http.Request) {
+	// check if it is POST
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// register the user
+	keyData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.LogDebug("server.AddUser failed to read request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// accepts a single JWK or a JWK set
+	keys, err := jwk.Parse(keyData)
+	if err != nil {
+		utils.LogDebug("server.AddUser failed to parse JWK")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the proof of possession is an extra member of the set, parsed apart
+	var registration struct {
+		Proof *types.KeyPossessionProof `json:"proof"`
+	}
+	if err := json.Unmarshal(keyData, &registration); err != nil {
+		utils.LogDebug("server.AddUser failed to parse proof of possession")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy := server.keyPolicy()
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		// a single JWK keeps unknown members as parameters
+		_ = key.Remove(types.MemberKeyPossession)
+		if err := policy.Check(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// get the user from context
+	user := GetUserFromContext(r.Context())
+
+	if server.KeyChallenges != nil {
+		if err := verifyKeyPossession(server.KeyChallenges, user.Username, deviceFromRequest(r), keys, registration.Proof); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	registerRequest := types.UserRegisterRequest{
+		UserID:     user.Username,
+		PublicKeys: keys,
+	}
+
+	if err := server.Keystore.AddDevicePublicKey(registerRequest.UserID, deviceFromRequest(r), registerRequest.PublicKeys); err != nil {
+		utils.LogError("failed to register new user")
+		utils.LogError(err.Error())
+		switch err.(type) {
+		case utils.ErrUnsupportedKey:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case ErrKeyAlreadyExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.LogDebug("added new user")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// IssueKeyChallenge issues the authenticated device a challenge to answer
+// when it next registers keys.
+func (server *Server) IssueKeyChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyChallenges == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	challenge, err := server.KeyChallenges.IssueChallenge(user.Username, deviceFromRequest(r), time.Now())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.IssueKeyChallenge %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(challenge); err != nil {
+		utils.LogError(fmt.Sprintf("server.IssueKeyChallenge %s", err.Error()))
+	}
+}
+
+func (server *Server) GetPublicKeyByUser(w http.ResponseWriter, r *http.Request) {
+	// find the query param for userID
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		// cannot be blank
+		utils.LogDebug("blank userIDs cannot be used")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// find the user
+	pubKeys, err := server.Keystore.PublicKeyByUserID(userID)
+	if err != nil {
+		utils.LogError("could not retrieve users public key")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// return the pub keys as a JWK set, with the proof they were logged as an
+	// extra member
+	response := publicKeyResponse{Keys: make([]jwk.Key, 0, pubKeys.Len())}
+	for i := 0; i < pubKeys.Len(); i++ {
+		key, _ := pubKeys.Get(i)
+		response.Keys = append(response.Keys, key)
+	}
+	if server.KeyLog != nil {
+		proof, err := server.KeyLog.ProveLatest(userID)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("server.GetPublicKeyByUser %s", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response.Log = &proof
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		utils.LogError("failed to encode JWK to json")
+		utils.LogError(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buffer := bytes.NewBuffer(data)
+	io.Copy(w, buffer)
+}
+
+// publicKeyResponse is a JWK set with the key transparency log proof of its
+// keys alongside. Parsers of plain JWK sets ignore the extra member.
+type publicKeyResponse struct {
+	Keys []jwk.Key          `json:"keys"`
+	Log  *types.KeyLogProof `json:"log,omitempty"`
+}
+
+// RevokePublicKey revokes a key of a user. The revocation must be signed by
+// the key being revoked, so a lost device can be cut off with a revocation
+// made ahead of time, unless it is sent unsigned by an admin.
+func (server *Server) RevokePublicKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var revocation types.Revocation
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&revocation); err != nil {
+		utils.LogDebug("server.RevokePublicKey failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if revocation.UserID == "" || revocation.KeyID == "" {
+		http.Error(w, "userID and keyID must be given", http.StatusBadRequest)
+		return
+	}
+	if revocation.Reason == "" {
+		revocation.Reason = types.RevocationUnspecified
+	}
+	if !types.IsRevocationReason(revocation.Reason) {
+		http.Error(w, fmt.Sprintf("unknown revocation reason %q", revocation.Reason), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := server.Keystore.PublicKeyByUserID(revocation.UserID)
+	if err != nil {
+		utils.LogDebug(fmt.Sprintf("server.RevokePublicKey %s", err.Error()))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(revocation.Signature) == 0 {
+		if !GetUserFromContext(r.Context()).Admin {
+			http.Error(w, "only admins may revoke keys without a signature", http.StatusForbidden)
+			return
+		}
+	} else if err := verifyRevocation(keys, revocation); err != nil {
+		utils.LogDebug(fmt.Sprintf("server.RevokePublicKey rejected revocation: %s", err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := server.Keystore.RevokePublicKey(revocation.UserID, revocation.KeyID, revocation.Reason, time.Now().UTC()); err != nil {
+		utils.LogDebug(fmt.Sprintf("server.RevokePublicKey %s", err.Error()))
+		switch err.(type) {
+		case ErrKeyDoesNotExist:
+			w.WriteHeader(http.StatusNotFound)
+		case ErrKeyRevoked:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyRevocation checks the revocation is signed by the signing key it
+// revokes. A key that was already revoked is still accepted here, the
+// keystore reports it.
+func verifyRevocation(keys jwk.Set, revocation types.Revocation) error {
+	jwkKey, ok := utils.FindJWKByID(keys, revocation.KeyID, utils.UseSignature)
+	if !ok {
+		return errors.New("no signing key " + revocation.KeyID)
+	}
+	signingKey, err := utils.MakePublicKeyFromJWK(jwkKey)
+	if err != nil {
+		return err
+	}
+	return utils.Verify(signingKey, types.RevocationBytes(revocation), revocation.Signature)
+}
+
+// GetTreeHead returns the signed head of the key transparency log.
+func (server *Server) GetTreeHead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyLog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	head, err := server.KeyLog.TreeHead()
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.GetTreeHead %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(head); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetTreeHead %s", err.Error()))
+	}
+}
+
+// GetConsistencyProof proves the key transparency log at size first is a
+// prefix of the log at size second.
+func (server *Server) GetConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyLog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	first, err := strconv.ParseUint(r.URL.Query().Get("first"), 10, 64)
+	if err != nil {
+		http.Error(w, "first must be a tree size", http.StatusBadRequest)
+		return
+	}
+	second, err := strconv.ParseUint(r.URL.Query().Get("second"), 10, 64)
+	if err != nil {
+		http.Error(w, "second must be a tree size", http.StatusBadRequest)
+		return
+	}
+	proof, err := server.KeyLog.ProveConsistency(first, second)
+	if err != nil {
+		utils.LogDebug(fmt.Sprintf("server.GetConsistencyProof %s", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(proof); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetConsistencyProof %s", err.Error()))
+	}
+}
+
+// GetLogKey returns the key the key transparency log signs its tree heads
+// with, as a JWK.
+func (server *Server) GetLogKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyLog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key, err := jwk.New(server.KeyLog.PublicKey())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.GetLogKey %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(key); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetLogKey %s", err.Error()))
+	}
+}
+
+// AddPrekeys publishes a signed prekey and/or a batch of one-time prekeys for
+// the device of the authenticated user making the request. The signed prekey
+// must be signed by the signing key the device registered at /pubkey.
+func (server *Server) AddPrekeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var upload types.PrekeyUpload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&upload); err != nil {
+		utils.LogDebug("server.AddPrekeys failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	deviceID := deviceFromRequest(r)
+
+	// the whole upload is checked before anything is stored
+	for _, prekey := range upload.OneTimePrekeys {
+		if len(prekey.Key) != sizePrekey {
+			http.Error(w, fmt.Sprintf("one-time prekey %d is not an X25519 key", prekey.ID), http.StatusBadRequest)
+			return
+		}
+	}
+	if upload.SignedPrekey != nil {
+		if err := server.verifySignedPrekey(user.Username, deviceID, upload.IdentityKey, *upload.SignedPrekey); err != nil {
+			utils.LogDebug(fmt.Sprintf("server.AddPrekeys rejected signed prekey: %s", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := server.PrekeyStore.AddPrekeys(user.Username, deviceID, upload.IdentityKey, upload.SignedPrekey, upload.OneTimePrekeys); err != nil {
+		if _, ok := err.(ErrDuplicatePrekey); ok {
+			utils.LogDebug(fmt.Sprintf("server.AddPrekeys %s", err.Error()))
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		utils.LogError(fmt.Sprintf("server.AddPrekeys %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// CountPrekeys reports how many one-time prekeys the device making the
+// request has left so the client knows when to publish more.
+func (server *Server) CountPrekeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	count, err := server.PrekeyStore.CountOneTimePrekeys(user.Username, deviceFromRequest(r))
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.CountPrekeys %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(types.PrekeyCount{OneTimePrekeys: count}); err != nil {
+		utils.LogError(fmt.Sprintf("server.CountPrekeys %s", err.Error()))
+	}
+}
+
+// GetPrekeyBundle hands out the prekey bundle of a device of userID, using up
+// one of its one-time prekeys. The device is the default device unless
+// deviceID is given.
+func (server *Server) GetPrekeyBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		utils.LogDebug("blank userIDs cannot be used")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	deviceID := r.URL.Query().Get("deviceID")
+	if deviceID == "" {
+		deviceID = types.DefaultDeviceID
+	}
+
+	bundle, err := server.PrekeyStore.TakeBundle(userID, deviceID)
+	if err != nil {
+		utils.LogDebug(fmt.Sprintf("server.GetPrekeyBundle %s", err.Error()))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(bundle); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetPrekeyBundle %s", err.Error()))
+	}
+}
+
+func (server *Server) verifySignedPrekey(userID string, deviceID string, identityKey []byte, prekey types.SignedPrekey) error {
+	if len(identityKey) != sizePrekey || len(prekey.Key) != sizePrekey {
+		return errors.New("identity key and signed prekey must be X25519 keys")
+	}
+	signingKey, err := server.deviceSigningKey(userID, deviceID)
+	if err != nil {
+		return err
+	}
+	return utils.Verify(signingKey, types.SignedPrekeyBytes(identityKey, prekey.Prekey), prekey.Signature)
+}
+
+// deviceSigningKey returns the signing key deviceID of userID registered at
+// /pubkey.
+func (server *Server) deviceSigningKey(userID string, deviceID string) (crypto.PublicKey, error) {
+	keys, err := server.Keystore.PublicKeyByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	deviceKeys, ok := utils.JWKSetsByDevice(keys)[deviceID]
+	if !ok {
+		return nil, errors.New("no keys registered for device " + deviceID)
+	}
+	jwkKey, ok := utils.FindJWK(deviceKeys, utils.UseSignature)
+	if !ok {
+		return nil, errors.New("no signing key registered")
+	}
+	return utils.MakePublicKeyFromJWK(jwkKey)
+}
+
+// GetDevices lists the devices of userID, or of the authenticated user when
+// no userID is given.
+func (server *Server) GetDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		userID = GetUserFromContext(r.Context()).Username
+	}
+
+	keys, err := server.Keystore.PublicKeyByUserID(userID)
+	if err != nil {
+		utils.LogDebug(fmt.Sprintf("server.GetDevices %s", err.Error()))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	devices := make([]types.Device, 0)
+	for deviceID, deviceKeys := range utils.JWKSetsByDevice(keys) {
+		device := types.Device{ID: deviceID}
+		for i := 0; i < deviceKeys.Len(); i++ {
+			key, _ := deviceKeys.Get(i)
+			device.KeyIDs = append(device.KeyIDs, key.KeyID())
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(devices); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetDevices %s", err.Error()))
+	}
+}
+
+// DeleteDevice removes deviceID from the devices of the authenticated user,
+// along with its keys, prekeys and KeyPackages.
+func (server *Server) DeleteDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	deviceID := r.URL.Query().Get("deviceID")
+	if deviceID == "" {
+		utils.LogDebug("blank deviceIDs cannot be used")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+
+	if err := server.Keystore.DeleteDevicePublicKey(user.Username, deviceID); err != nil {
+		utils.LogDebug(fmt.Sprintf("server.DeleteDevice %s", err.Error()))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := server.PrekeyStore.DeletePrekeys(user.Username, deviceID); err != nil {
+		utils.LogError(fmt.Sprintf("server.DeleteDevice %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if server.KeyPackages != nil {
+		if err := server.KeyPackages.DeleteKeyPackages(user.Username, deviceID); err != nil {
+			utils.LogError(fmt.Sprintf("server.DeleteDevice %s", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler returns the HTTP handler serving every endpoint of the server.
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pubkey", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.GetPublicKeyByUser,
+		"POST": server.AddUser,
+	})))
+	mux.HandleFunc("/pubkey/challenge", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.IssueKeyChallenge,
+	})))
+	mux.HandleFunc("/pubkey/revoke", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.RevokePublicKey,
+	})))
+	mux.HandleFunc("/pubkey/prekeys", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.CountPrekeys,
+		"POST": server.AddPrekeys,
+	})))
+	mux.HandleFunc("/pubkey/bundle", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET": server.GetPrekeyBundle,
+	})))
+	mux.HandleFunc("/devices", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":    server.GetDevices,
+		"DELETE": server.DeleteDevice,
+	})))
+	mux.HandleFunc("/log/head", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET": server.GetTreeHead,
+	})))
+	mux.HandleFunc("/log/consistency", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET": server.GetConsistencyProof,
+	})))
+	mux.HandleFunc("/log/key", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET": server.GetLogKey,
+	})))
+	mux.HandleFunc("/messages", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.GetMessages,
+		"POST": server.AddMessage,
+	})))
+	// sealed messages are sent without authenticating, so the sender stays
+	// unknown to the server
+	mux.Handle("/messages/sealed", route(map[string]http.HandlerFunc{
+		"POST": server.AddSealedMessage,
+	}))
+	mux.HandleFunc("/blobs", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.GetBlob,
+		"POST": server.AddBlob,
+	})))
+	mux.HandleFunc("/uploads", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":   server.GetUpload,
+		"POST":  server.CreateUpload,
+		"PATCH": server.PatchUpload,
+	})))
+	mux.HandleFunc("/uploads/finish", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.FinishUpload,
+	})))
+	mux.HandleFunc("/groups", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.GetGroups,
+		"POST": server.CreateGroup,
+	})))
+	mux.HandleFunc("/groups/members", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST":   server.SetGroupMember,
+		"DELETE": server.RemoveGroupMember,
+	})))
+	mux.HandleFunc("/groups/invites", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.CreateGroupInvite,
+	})))
+	mux.HandleFunc("/groups/join", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.JoinGroup,
+	})))
+	mux.HandleFunc("/groups/messages", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.AddGroupMessages,
+	})))
+	mux.HandleFunc("/mls/keypackages", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.CountKeyPackages,
+		"POST": server.AddKeyPackages,
+	})))
+	mux.HandleFunc("/mls/keypackage", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET": server.GetKeyPackage,
+	})))
+	mux.HandleFunc("/mls/messages", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET":  server.GetMLSMessages,
+		"POST": server.AddMLSMessage,
+	})))
+	mux.HandleFunc("/mls/welcomes", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"GET": server.TakeMLSWelcomes,
+	})))
+	mux.HandleFunc("/delivery", server.AuthenticateMiddleware(route(map[string]http.HandlerFunc{
+		"POST": server.SetDeliveryToken,
+	})))
+	return mux
+}
+
+func (server *Server) Start(ctx context.Context, config ServerConfig) chan error {
+	handler := server.Handler()
+	utils.LogInfo(fmt.Sprintf("starting http server on %s:%d", config.Address, config.Port))
+	errChan := make(chan error, 1)
+	// listen before returning so callers can connect as soon as Start returns
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Address, config.Port))
+	if err != nil {
+		errChan <- err
+		return errChan
+	}
+	if server.Uploads != nil {
+		go server.expireUploads(ctx)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			utils.LogInfo("shutting down http server")
+			listener.Close()
+			return
+		default:
+			errChan <- http.Serve(listener, handler)
+		}
+	}()
+	return errChan
+}
+
+func (server *Server) AddMessage(w http.ResponseWriter, r *http.Request) {
+	// must be post
+	if r.Method != http.MethodPost {
+		utils.LogDebug(fmt.Sprintf("server.AddMessage %s is not allowed must be POST", r.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// decode
+	var message Message
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&message); err != nil {
+		utils.LogDebug("server.AddMessage failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if message.Sealed {
+		http.Error(w, "sealed messages are sent to /messages/sealed", http.StatusBadRequest)
+		return
+	}
+	if message.GroupID != "" {
+		http.Error(w, "group messages are sent to /groups/messages", http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	deviceID := deviceFromRequest(r)
+	if message.From != user.Username || !sentFromDevice(message, deviceID) {
+		http.Error(w, "message must be sent from the authenticated user and device", http.StatusBadRequest)
+		return
+	}
+	server.storeMessage(w, "server.AddMessage", user.Username, deviceID, message)
+}
+
+// AddSealedMessage stores a sealed message. The sender does not authenticate,
+// so the server never learns who sent it; the delivery token of the
+// recipient in HeaderDeliveryToken stands in for it.
+func (server *Server) AddSealedMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.DeliveryTokens == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var message Message
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&message); err != nil {
+		utils.LogDebug("server.AddSealedMessage failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !message.Sealed || message.To == "" {
+		http.Error(w, "message is not sealed", http.StatusBadRequest)
+		return
+	}
+	if message.From != "" || message.FromDevice != "" || message.Signature != "" || message.SignatureKeyID != "" {
+		http.Error(w, "sealed messages must not name their sender", http.StatusBadRequest)
+		return
+	}
+	if message.GroupID != "" {
+		http.Error(w, "group messages cannot be sealed", http.StatusBadRequest)
+		return
+	}
+	token, err := base64.RawURLEncoding.DecodeString(r.Header.Get(types.HeaderDeliveryToken))
+	if err != nil {
+		http.Error(w, "delivery token is not base64url encoded", http.StatusBadRequest)
+		return
+	}
+	if err := server.DeliveryTokens.CheckDeliveryToken(message.To, token); err != nil {
+		utils.LogDebug(fmt.Sprintf("server.AddSealedMessage %s", err.Error()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	server.storeMessage(w, "server.AddSealedMessage", "", "", message)
+}
+
+// storeMessage adds a message that was not seen before to the message store,
+// once its content is checked.
+func (server *Server) storeMessage(w http.ResponseWriter, handler string, userID string, deviceID string, message Message) {
+	if status, err := server.checkMessages(userID, deviceID, []Message{message}); err != nil {
+		utils.LogDebug(fmt.Sprintf("%s %s", handler, err.Error()))
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// add
+	if err := server.MessageStore.Add(message); err != nil {
+		utils.LogDebug("unable to add message to store")
+		utils.LogError(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// checkMessages checks the content of messages sent together by the device
+// deviceID of userID and that none was seen before, returning the status to
+// refuse them with. They are only recorded as seen once all of them pass.
+func (server *Server) checkMessages(userID string, deviceID string, messages []Message) (int, error) {
+	for _, message := range messages {
+		if err := checkContent(message); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if err := server.checkReplay(userID, deviceID, messages); err != nil {
+		switch err.(type) {
+		case ErrReplayedMessage:
+			return http.StatusConflict, err
+		default:
+			return http.StatusBadRequest, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// SetDeliveryToken replaces the delivery token contacts of the authenticated
+// user send them sealed messages with.
+func (server *Server) SetDeliveryToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.DeliveryTokens == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.DeliveryToken
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.SetDeliveryToken failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := base64.RawURLEncoding.DecodeString(request.Token)
+	if err != nil || len(token) != types.DeliveryTokenSize {
+		http.Error(w, fmt.Sprintf("delivery token must be %d bytes, base64url encoded", types.DeliveryTokenSize), http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	if err := server.DeliveryTokens.SetDeliveryToken(user.Username, token); err != nil {
+		utils.LogError(fmt.Sprintf("server.SetDeliveryToken %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddBlob stores the request body, an encrypted attachment, as a new blob
+// and returns its reference.
+func (server *Server) AddBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Blobs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := makeBlobID()
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.AddBlob %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	size, err := server.Blobs.PutBlob(id, r.Body, MaxBlobSize)
+	if err != nil {
+		if err == ErrBlobTooLarge {
+			http.Error(w, fmt.Sprintf("blobs must be at most %d bytes", MaxBlobSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		utils.LogError(fmt.Sprintf("server.AddBlob %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(types.BlobReference{ID: id, Size: size}); err != nil {
+		utils.LogError(fmt.Sprintf("server.AddBlob %s", err.Error()))
+	}
+}
+
+// GetBlob streams the blob named by the id query parameter.
+func (server *Server) GetBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Blobs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	blob, size, err := server.Blobs.OpenBlob(r.URL.Query().Get("id"))
+	if err == ErrBlobDoesNotExist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.GetBlob %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if _, err := io.Copy(w, blob); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetBlob %s", err.Error()))
+	}
+}
+
+// CreateUpload starts an upload of a blob in chunks.
+func (server *Server) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Uploads == nil || server.Blobs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.UploadRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.CreateUpload failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.Size < 0 {
+		http.Error(w, "upload size must not be negative", http.StatusBadRequest)
+		return
+	}
+	if request.Size > MaxBlobSize {
+		http.Error(w, fmt.Sprintf("blobs must be at most %d bytes", MaxBlobSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	upload, err := server.Uploads.CreateUpload(user.Username, request.Size, time.Now())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.CreateUpload %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeUpload(w, http.StatusCreated, upload)
+}
+
+// GetUpload returns the upload named by the id query parameter, with the
+// offset to resume it from.
+func (server *Server) GetUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Uploads == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	upload, err := server.Uploads.Upload(user.Username, r.URL.Query().Get("id"), time.Now())
+	if err == ErrUploadDoesNotExist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.GetUpload %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeUpload(w, http.StatusOK, upload)
+}
+
+// PatchUpload writes the request body into the upload named by the id query
+// parameter, from the offset in types.HeaderUploadOffset. The offset reached
+// is returned even when the body was cut off.
+func (server *Server) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Uploads == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(types.HeaderUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, types.HeaderUploadOffset+" must be the offset the chunk starts at", http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	upload, err := server.Uploads.WriteUpload(user.Username, r.URL.Query().Get("id"), offset, r.Body, time.Now())
+	if offsetErr, ok := err.(ErrUploadOffset); ok {
+		w.Header().Set(types.HeaderUploadOffset, strconv.FormatInt(offsetErr.Offset, 10))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	switch err {
+	case nil:
+		w.Header().Set(types.HeaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+	case ErrUploadDoesNotExist:
+		w.WriteHeader(http.StatusNotFound)
+	case ErrUploadTooLarge:
+		w.Header().Set(types.HeaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		// most likely the connection dropped, the client resumes from the
+		// offset it asks for
+		utils.LogDebug(fmt.Sprintf("server.PatchUpload %s", err.Error()))
+		w.Header().Set(types.HeaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// FinishUpload moves an upload that received every byte into the blob store
+// once its digest checks, and returns the reference of the blob.
+func (server *Server) FinishUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Uploads == nil || server.Blobs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.FinishUploadRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.FinishUpload failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	reference, err := server.finishUpload(user.Username, request)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusCreated)
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(reference); err != nil {
+			utils.LogError(fmt.Sprintf("server.FinishUpload %s", err.Error()))
+		}
+	case ErrUploadDoesNotExist:
+		w.WriteHeader(http.StatusNotFound)
+	case ErrUploadIncomplete:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrUploadDigest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		utils.LogError(fmt.Sprintf("server.FinishUpload %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (server *Server) finishUpload(userID string, request types.FinishUploadRequest) (types.BlobReference, error) {
+	// checked before anything reaches the blob store, which cannot take
+	// blobs back
+	blob, err := server.Uploads.OpenUpload(userID, request.ID, time.Now())
+	if err != nil {
+		return types.BlobReference{}, err
+	}
+	digest := sha256.New()
+	_, err = io.Copy(digest, blob)
+	blob.Close()
+	if err != nil {
+		return types.BlobReference{}, err
+	}
+	if subtle.ConstantTimeCompare(digest.Sum(nil), request.Digest) != 1 {
+		return types.BlobReference{}, ErrUploadDigest
+	}
+
+	if blob, err = server.Uploads.OpenUpload(userID, request.ID, time.Now()); err != nil {
+		return types.BlobReference{}, err
+	}
+	defer blob.Close()
+	id, err := makeBlobID()
+	if err != nil {
+		return types.BlobReference{}, err
+	}
+	size, err := server.Blobs.PutBlob(id, blob, MaxBlobSize)
+	if err != nil {
+		return types.BlobReference{}, err
+	}
+	if err := server.Uploads.DeleteUpload(userID, request.ID); err != nil {
+		utils.LogError(fmt.Sprintf("server.FinishUpload %s", err.Error()))
+	}
+	return types.BlobReference{ID: id, Size: size}, nil
+}
+
+// writeUpload responds with the upload, its offset also in
+// types.HeaderUploadOffset.
+func writeUpload(w http.ResponseWriter, status int, upload types.Upload) {
+	w.Header().Set(types.HeaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(upload); err != nil {
+		utils.LogError(fmt.Sprintf("server.writeUpload %s", err.Error()))
+	}
+}
+
+// GetGroups lists the groups of the authenticated user, or returns the group
+// named by the id query parameter when they are a member of it.
+func (server *Server) GetGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	var response interface{}
+	if id := r.URL.Query().Get("id"); id != "" {
+		group, err := server.memberGroup(user.Username, id)
+		if err != nil {
+			writeGroupError(w, "server.GetGroups", err)
+			return
+		}
+		response = group
+	} else {
+		groups, err := server.Groups.GroupsOf(user.Username)
+		if err != nil {
+			writeGroupError(w, "server.GetGroups", err)
+			return
+		}
+		response = groups
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetGroups %s", err.Error()))
+	}
+}
+
+// CreateGroup makes a group with the authenticated user as its admin.
+func (server *Server) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.GroupRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.CreateGroup failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "groups must be named", http.StatusBadRequest)
+		return
+	}
+	for _, member := range request.Members {
+		if _, err := server.UserStore.Find(member); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	user := GetUserFromContext(r.Context())
+	group, err := server.Groups.CreateGroup(request.Name, user.Username, request.Members)
+	if err != nil {
+		writeGroupError(w, "server.CreateGroup", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(group); err != nil {
+		utils.LogError(fmt.Sprintf("server.CreateGroup %s", err.Error()))
+	}
+}
+
+// SetGroupMember adds a user to a group, or changes their role in it. Only
+// admins of the group may.
+func (server *Server) SetGroupMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.GroupMemberRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.SetGroupMember failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.Role == "" {
+		request.Role = types.GroupRoleMember
+	}
+	if !types.IsGroupRole(request.Role) {
+		http.Error(w, fmt.Sprintf("unknown group role %q", request.Role), http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	if _, err := server.adminGroup(user.Username, request.GroupID); err != nil {
+		writeGroupError(w, "server.SetGroupMember", err)
+		return
+	}
+	if _, err := server.UserStore.Find(request.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	group, err := server.Groups.SetGroupMember(request.GroupID, request.UserID, request.Role)
+	if err != nil {
+		writeGroupError(w, "server.SetGroupMember", err)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(group); err != nil {
+		utils.LogError(fmt.Sprintf("server.SetGroupMember %s", err.Error()))
+	}
+}
+
+// RemoveGroupMember removes userID from groupID. Admins may remove anyone,
+// members only themselves; without a userID the authenticated user leaves.
+func (server *Server) RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	groupID := r.URL.Query().Get("groupID")
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		userID = user.Username
+	}
+	var err error
+	if userID == user.Username {
+		_, err = server.memberGroup(user.Username, groupID)
+	} else {
+		_, err = server.adminGroup(user.Username, groupID)
+	}
+	if err == nil {
+		err = server.Groups.RemoveGroupMember(groupID, userID)
+	}
+	if err != nil {
+		writeGroupError(w, "server.RemoveGroupMember", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateGroupInvite makes an invite link to a group. Only admins of the group
+// may.
+func (server *Server) CreateGroupInvite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.GroupInvite
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.CreateGroupInvite failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	if _, err := server.adminGroup(user.Username, request.GroupID); err != nil {
+		writeGroupError(w, "server.CreateGroupInvite", err)
+		return
+	}
+	invite, err := server.Groups.CreateGroupInvite(request.GroupID, time.Now())
+	if err != nil {
+		writeGroupError(w, "server.CreateGroupInvite", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(invite); err != nil {
+		utils.LogError(fmt.Sprintf("server.CreateGroupInvite %s", err.Error()))
+	}
+}
 
-	// register the user
-	keyData, err := ioutil.ReadAll(r.Body)
+// JoinGroup adds the authenticated user to the group of an invite link.
+func (server *Server) JoinGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request types.JoinGroupRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		utils.LogDebug("server.JoinGroup failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := base64.RawURLEncoding.DecodeString(request.Token)
 	if err != nil {
-		panic(err) // TODO handle it
+		http.Error(w, "invite token is not base64url encoded", http.StatusBadRequest)
+		return
 	}
-	key, err := jwk.ParseKey(keyData)
+	user := GetUserFromContext(r.Context())
+	group, err := server.Groups.JoinGroup(user.Username, token, time.Now())
 	if err != nil {
-		panic(err) // TODO handle it
+		writeGroupError(w, "server.JoinGroup", err)
+		return
 	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(group); err != nil {
+		utils.LogError(fmt.Sprintf("server.JoinGroup %s", err.Error()))
+	}
+}
 
-	jwkKey := key.(jwk.RSAPublicKey)
-
-	// get the user from context
+// AddGroupMessages fans a message out to the members of its group. Content
+// is encrypted end to end, so the sender posts the copies they made for each
+// device of each member and the server delivers them to each member's inbox.
+// The copies are refused together unless the sender and every recipient are
+// members of the group.
+func (server *Server) AddGroupMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var messages []Message
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&messages); err != nil {
+		utils.LogDebug("server.AddGroupMessages failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(messages) == 0 {
+		http.Error(w, "no copies of the message were given", http.StatusBadRequest)
+		return
+	}
 	user := GetUserFromContext(r.Context())
+	deviceID := deviceFromRequest(r)
+	group, err := server.memberGroup(user.Username, messages[0].GroupID)
+	if err != nil {
+		writeGroupError(w, "server.AddGroupMessages", err)
+		return
+	}
+	for _, message := range messages {
+		if message.GroupID != group.ID {
+			http.Error(w, "copies must all be sent to the same group", http.StatusBadRequest)
+			return
+		}
+		if message.Sealed || message.From != user.Username || !sentFromDevice(message, deviceID) {
+			http.Error(w, "copies must be sent from the authenticated user and device", http.StatusBadRequest)
+			return
+		}
+		if group.Role(message.To) == "" {
+			http.Error(w, fmt.Sprintf("%s is not a member of the group", message.To), http.StatusBadRequest)
+			return
+		}
+	}
+	// seen only once every copy is accepted, so a refused batch can be sent
+	// again as it was
+	if status, err := server.checkMessages(user.Username, deviceID, messages); err != nil {
+		utils.LogDebug(fmt.Sprintf("server.AddGroupMessages %s", err.Error()))
+		http.Error(w, err.Error(), status)
+		return
+	}
+	for _, message := range messages {
+		if err := server.MessageStore.Add(message); err != nil {
+			utils.LogError(fmt.Sprintf("server.AddGroupMessages %s", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+}
 
-	registerRequest := types.UserRegisterRequest{
-		UserID:    user.Username,
-		PublicKey: jwkKey,
+// memberGroup returns the group with id when userID is a member of it. To
+// anyone else the group does not exist.
+func (server *Server) memberGroup(userID string, id string) (types.Group, error) {
+	group, err := server.Groups.Group(id)
+	if err != nil {
+		return group, err
+	}
+	if group.Role(userID) == "" {
+		return types.Group{}, ErrGroupDoesNotExist
 	}
+	return group, nil
+}
 
-	if err := server.Keystore.AddPublicKey(registerRequest.UserID, registerRequest.PublicKey); err != nil {
-		utils.LogError("failed to register new user")
-		utils.LogError(err.Error())
+// adminGroup returns the group with id when userID is an admin of it.
+func (server *Server) adminGroup(userID string, id string) (types.Group, error) {
+	group, err := server.memberGroup(userID, id)
+	if err != nil {
+		return group, err
+	}
+	if group.Role(userID) != types.GroupRoleAdmin {
+		return types.Group{}, ErrNotGroupAdmin
+	}
+	return group, nil
+}
+
+// writeGroupError responds with the status a group store error stands for.
+func writeGroupError(w http.ResponseWriter, handler string, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrGroupDoesNotExist, ErrNotGroupMember:
+		status = http.StatusNotFound
+	case ErrNotGroupAdmin, ErrInvalidGroupInvite:
+		status = http.StatusForbidden
+	case ErrLastGroupAdmin:
+		status = http.StatusConflict
+	default:
+		utils.LogError(fmt.Sprintf("%s %s", handler, err.Error()))
+		w.WriteHeader(status)
+		return
+	}
+	utils.LogDebug(fmt.Sprintf("%s %s", handler, err.Error()))
+	http.Error(w, err.Error(), status)
+}
+
+// AddKeyPackages publishes MLS KeyPackages for the device of the
+// authenticated user making the request. Their credentials must name the
+// device and be signed by the signing key it registered at /pubkey.
+func (server *Server) AddKeyPackages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyPackages == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var keyPackages []types.MLSKeyPackage
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&keyPackages); err != nil {
+		utils.LogDebug("server.AddKeyPackages failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	deviceID := deviceFromRequest(r)
+	for _, keyPackage := range keyPackages {
+		if err := server.verifyKeyPackage(user.Username, deviceID, keyPackage); err != nil {
+			utils.LogDebug(fmt.Sprintf("server.AddKeyPackages rejected KeyPackage: %s", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := server.KeyPackages.AddKeyPackages(user.Username, deviceID, keyPackages); err != nil {
+		utils.LogError(fmt.Sprintf("server.AddKeyPackages %s", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	utils.LogDebug("added new user")
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (server *Server) GetPublicKeyByUser(w http.ResponseWriter, r *http.Request) {
-	// find the query param for userID
+// CountKeyPackages reports how many unexpired KeyPackages the device making
+// the request has left so the client knows when to publish more.
+func (server *Server) CountKeyPackages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyPackages == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	count, err := server.KeyPackages.CountKeyPackages(user.Username, deviceFromRequest(r), time.Now())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.CountKeyPackages %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(types.KeyPackageCount{KeyPackages: count}); err != nil {
+		utils.LogError(fmt.Sprintf("server.CountKeyPackages %s", err.Error()))
+	}
+}
+
+// GetKeyPackage hands out a KeyPackage of a device of userID, the default
+// device unless deviceID is given, so it can be added to an MLS group.
+func (server *Server) GetKeyPackage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.KeyPackages == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	userID := r.URL.Query().Get("userID")
 	if userID == "" {
-		// cannot be blank
 		utils.LogDebug("blank userIDs cannot be used")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	deviceID := r.URL.Query().Get("deviceID")
+	if deviceID == "" {
+		deviceID = types.DefaultDeviceID
+	}
 
-	// find the user
-	pubKey, err := server.Keystore.PublicKeyByUserID(userID)
+	keyPackage, err := server.KeyPackages.TakeKeyPackage(userID, deviceID, time.Now())
 	if err != nil {
-		utils.LogError("could not retrieve users public key")
-		w.WriteHeader(http.StatusInternalServerError)
+		utils.LogDebug(fmt.Sprintf("server.GetKeyPackage %s", err.Error()))
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(keyPackage); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetKeyPackage %s", err.Error()))
+	}
+}
 
-	// return the pub key
-	jwkKey, err := utils.MakeJWKSetFromRSAPublicKey(&pubKey)
+// verifyKeyPackage checks that a KeyPackage was issued by deviceID of userID.
+// The rest of it is checked by the clients using it.
+func (server *Server) verifyKeyPackage(userID string, deviceID string, keyPackage types.MLSKeyPackage) error {
+	leaf := keyPackage.LeafNode
+	if len(keyPackage.InitKey) != sizeMLSKey || len(leaf.EncryptionKey) != sizeMLSKey || len(leaf.SignatureKey) != sizeMLSKey {
+		return errors.New("KeyPackage keys must be X25519 and Ed25519 keys")
+	}
+	if leaf.Source != types.MLSLeafNodeKeyPackage || leaf.Lifetime == nil {
+		return errors.New("KeyPackage leaf must have a lifetime")
+	}
+	if leaf.Credential.UserID != userID || leaf.Credential.DeviceID != deviceID {
+		return errors.New("KeyPackage credential must name the device publishing it")
+	}
+	signingKey, err := server.deviceSigningKey(userID, deviceID)
 	if err != nil {
-		utils.LogError("error converting JWK to RSAPublicKey")
-		utils.LogError(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
+	return utils.Verify(signingKey, types.MLSCredentialBytes(userID, deviceID, leaf.SignatureKey), leaf.Credential.Signature)
+}
 
-	data, err := json.Marshal(jwkKey)
+// AddMLSMessage orders an MLS message of a group the authenticated user is a
+// member of. A commit comes with the welcome for the devices it adds, which
+// must belong to members of the group. Messages sent in an epoch the group
+// left are refused with 409 Conflict, and messages from a device the group
+// never welcomed with 403 Forbidden.
+func (server *Server) AddMLSMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.MLS == nil || server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var post types.MLSPost
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&post); err != nil {
+		utils.LogDebug("server.AddMLSMessage failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := GetUserFromContext(r.Context())
+	group, err := server.memberGroup(user.Username, post.Message.GroupID)
 	if err != nil {
-		utils.LogError("failed to encode JWK to json")
-		utils.LogError(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeGroupError(w, "server.AddMLSMessage", err)
 		return
 	}
-	buffer := bytes.NewBuffer(data)
-	io.Copy(w, buffer)
-}
-
-func (server *Server) Start(ctx context.Context, config ServerConfig) chan error {
-	// register handlers
-	var keyHandler http.Handler = mutliMethodHandler{
-		handlers: map[string]http.HandlerFunc{
-			"GET":  server.GetPublicKeyByUser,
-			"POST": server.AddUser,
-		},
+	if len(post.Message.Message) == 0 {
+		http.Error(w, "MLS message is empty", http.StatusBadRequest)
+		return
 	}
-	var messageHandler http.Handler = mutliMethodHandler{
-		handlers: map[string]http.HandlerFunc{
-			"GET":  server.GetMessages,
-			"POST": server.AddMessage,
-		},
+	if (len(post.Welcome) != 0 || len(post.WelcomeTo) != 0) && (!post.Message.Handshake || len(post.Welcome) == 0 || len(post.WelcomeTo) == 0) {
+		http.Error(w, "welcomes are sent with the commit adding their devices", http.StatusBadRequest)
+		return
 	}
-
-	keyHandler = coorsHandler{
-		next: keyHandler,
+	for _, device := range post.WelcomeTo {
+		if group.Role(device.UserID) == "" {
+			http.Error(w, fmt.Sprintf("%s is not a member of the group", device.UserID), http.StatusBadRequest)
+			return
+		}
 	}
-
-	messageHandler = coorsHandler{
-		next: messageHandler,
+	post.Message.Sender = user.Username
+	from := types.MLSDevice{UserID: user.Username, DeviceID: deviceFromRequest(r)}
+	message, err := server.MLS.AddMLSMessage(from, post.Message, post.Welcome, post.WelcomeTo, time.Now())
+	if _, ok := err.(ErrMLSEpoch); ok {
+		utils.LogDebug(fmt.Sprintf("server.AddMLSMessage %s", err.Error()))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == ErrMLSNotWelcomed {
+		utils.LogDebug(fmt.Sprintf("server.AddMLSMessage %s", err.Error()))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.AddMLSMessage %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(message); err != nil {
+		utils.LogError(fmt.Sprintf("server.AddMLSMessage %s", err.Error()))
 	}
+}
 
-	http.HandleFunc("/pubkey", server.AuthenticateMiddleware(keyHandler))
-	http.HandleFunc("/messages", server.AuthenticateMiddleware(messageHandler))
-	utils.LogInfo(fmt.Sprintf("starting http server on %s:%d", config.Address, config.Port))
-	errChan := make(chan error, 1)
-	go func() {
-		select {
-		case <-ctx.Done():
-			utils.LogInfo("shutting down http server")
+// GetMLSMessages returns the MLS messages of groupID ordered after the Seq
+// given as after, to members of the group.
+func (server *Server) GetMLSMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.MLS == nil || server.Groups == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var after uint64
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "after must be a sequence number", http.StatusBadRequest)
 			return
-		default:
-			errChan <- http.ListenAndServe(fmt.Sprintf("%s:%d", config.Address, config.Port), nil)
 		}
-	}()
-	return errChan
+	}
+	user := GetUserFromContext(r.Context())
+	group, err := server.memberGroup(user.Username, r.URL.Query().Get("groupID"))
+	if err != nil {
+		writeGroupError(w, "server.GetMLSMessages", err)
+		return
+	}
+	messages, err := server.MLS.MLSMessages(group.ID, after)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.GetMLSMessages %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(messages); err != nil {
+		utils.LogError(fmt.Sprintf("server.GetMLSMessages %s", err.Error()))
+	}
 }
 
-func (server *Server) AddMessage(w http.ResponseWriter, r *http.Request) {
-	// must be post
-	if r.Method != http.MethodPost {
-		utils.LogDebug(fmt.Sprintf("server.AddMessage %s is not allowed must be POST", r.Method))
+// TakeMLSWelcomes hands the device making the request the welcomes to the
+// MLS groups it was added to, once.
+func (server *Server) TakeMLSWelcomes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-
-	// decode
-	var message Message
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&message); err != nil {
-		utils.LogDebug("server.AddMessage failed to decode request body")
-		w.WriteHeader(http.StatusBadRequest)
+	if server.MLS == nil {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-
-	// add
-	if err := server.MessageStore.Add(message); err != nil {
-		utils.LogDebug("unable to add message to store")
-		utils.LogError(err.Error())
+	user := GetUserFromContext(r.Context())
+	welcomes, err := server.MLS.TakeMLSWelcomes(user.Username, deviceFromRequest(r))
+	if err != nil {
+		utils.LogError(fmt.Sprintf("server.TakeMLSWelcomes %s", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(welcomes); err != nil {
+		utils.LogError(fmt.Sprintf("server.TakeMLSWelcomes %s", err.Error()))
+	}
+}
+
+// checkReplay refuses messages the replay cache, when there is one, saw
+// before.
+func (server *Server) checkReplay(userID string, deviceID string, messages []Message) error {
+	if server.ReplayCache == nil {
+		return nil
+	}
+	return server.ReplayCache.Check(userID, deviceID, messages, time.Now())
+}
+
+// sentFromDevice reports whether a message names deviceID as the device it
+// was sent from, or names none.
+func sentFromDevice(message Message, deviceID string) bool {
+	return message.FromDevice == "" || message.FromDevice == deviceID
 }
 
 func (server *Server) GetMessages(w http.ResponseWriter, r *http.Request) {
@@ -174,14 +1681,22 @@ func (server *Server) GetMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ID is query as userID
-	id := r.URL.Query().Get("userID")
-	messages, err := server.MessageStore.FindAllByUserID(id)
+	// only the copies for the calling user and device are returned, of the
+	// messages to groupID when it is given; userID may only name the caller
+	user := GetUserFromContext(r.Context())
+	if id := r.URL.Query().Get("userID"); id != "" && id != user.Username {
+		http.Error(w, "messages may only be read by their recipient", http.StatusForbidden)
+		return
+	}
+	messages, err := server.MessageStore.FindAllByUserDeviceID(user.Username, deviceFromRequest(r))
 	if err != nil {
 		utils.LogError(fmt.Sprintf("server.GetMessages %s", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if groupID := r.URL.Query().Get("groupID"); groupID != "" {
+		messages = messagesToGroup(messages, groupID)
+	}
 
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(messages); err != nil {
@@ -191,19 +1706,30 @@ func (server *Server) GetMessages(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// messagesToGroup returns the messages sent to groupID.
+func messagesToGroup(messages []Message, groupID string) []Message {
+	filtered := make([]Message, 0)
+	for _, message := range messages {
+		if message.GroupID == groupID {
+			filtered = append(filtered, message)
+		}
+	}
+	return filtered
+}
+
 func (server *Server) WebSocketMessageHandler(ws *websocket.Conn) {
-	// read inbound messages and save them
+	// read inbound messages, refused until the connection is authenticated
+	// since there is no sender to check them against
 	go func() {
 		var message Message
 		decoder := json.NewDecoder(ws)
 		if err := decoder.Decode(&message); err != nil {
 			utils.LogError(err.Error())
 			ws.WriteClose(500)
+			return
 		}
-		if err := server.MessageStore.Add(message); err != nil {
-			utils.LogError(err.Error())
-			ws.WriteClose(500)
-		}
+		utils.LogDebug("server.WebSocketMessageHandler refused a message on an unauthenticated connection")
+		ws.WriteClose(401)
 	}()
 
 	// outbound messages
@@ -224,6 +1750,16 @@ func (handler mutliMethodHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusMethodNotAllowed)
 }
 
+// route dispatches on the request method and answers CORS preflight
+// requests.
+func route(handlers map[string]http.HandlerFunc) http.Handler {
+	return coorsHandler{
+		next: mutliMethodHandler{
+			handlers: handlers,
+		},
+	}
+}
+
 type coorsHandler struct {
 	next http.Handler
 }
@@ -231,8 +1767,9 @@ type coorsHandler struct {
 func (handler coorsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	if r.Method == http.MethodOptions {
-		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, PATCH, DELETE, OPTIONS")
+		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, "+types.HeaderDeviceID+", "+types.HeaderDeliveryToken+", "+types.HeaderUploadOffset)
+		w.Header().Add("Access-Control-Expose-Headers", types.HeaderUploadOffset)
 		w.Header().Add("Access-Control-Max-Age", "86400")
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -240,6 +1777,14 @@ func (handler coorsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.next.ServeHTTP(w, r)
 }
 
+// deviceFromRequest returns the device a request is made from.
+func deviceFromRequest(r *http.Request) string {
+	if deviceID := r.Header.Get(types.HeaderDeviceID); deviceID != "" {
+		return deviceID
+	}
+	return types.DefaultDeviceID
+}
+
 func (server *Server) AuthenticateMiddleware(next http.Handler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// authenticate user now
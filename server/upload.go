@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+const (
+	// DefaultUploadLifetime is how long an upload is kept without anything
+	// written to it when no lifetime is given.
+	DefaultUploadLifetime = 24 * time.Hour
+	// uploadSweepInterval is how often the server removes expired uploads.
+	uploadSweepInterval = time.Minute
+)
+
+var (
+	ErrUploadDoesNotExist = errors.New("upload does not exist or expired")
+	ErrUploadIncomplete   = errors.New("upload has not received every byte of its blob")
+	ErrUploadTooLarge     = errors.New("upload is longer than the size it was started with")
+	ErrUploadDigest       = errors.New("upload does not match the digest given")
+)
+
+// ErrUploadOffset is returned for a chunk that does not start where the
+// upload is at, or that is written while another one is.
+type ErrUploadOffset struct {
+	Offset int64
+}
+
+func (err ErrUploadOffset) Error() string {
+	return fmt.Sprintf("upload is at offset %d", err.Offset)
+}
+
+// UploadStore keeps blobs uploaded in chunks until they are finished and
+// moved to the blob store. Uploads belong to the user who started them.
+type UploadStore interface {
+	CreateUpload(userID string, size int64, now time.Time) (types.Upload, error)
+	// Upload returns the upload with id of userID, or
+	// ErrUploadDoesNotExist.
+	Upload(userID string, id string, now time.Time) (types.Upload, error)
+	// WriteUpload writes what is read from r into the upload from offset,
+	// which must be the offset it is at, and returns the upload. What was
+	// read before an error is kept, so the upload is resumed from there.
+	WriteUpload(userID string, id string, offset int64, r io.Reader, now time.Time) (types.Upload, error)
+	// OpenUpload returns the blob of an upload that received every byte.
+	OpenUpload(userID string, id string, now time.Time) (io.ReadCloser, error)
+	DeleteUpload(userID string, id string) error
+	// ExpireUploads removes the uploads that expired at now.
+	ExpireUploads(now time.Time) error
+}
+
+// FileUploadStore writes each upload to a file of its own under a directory
+// and keeps track of them in memory, so uploads do not survive a restart.
+type FileUploadStore struct {
+	dir      string
+	lifetime time.Duration
+	uploads  map[string]*fileUpload
+	mutex    *sync.Mutex
+}
+
+type fileUpload struct {
+	userID  string
+	upload  types.Upload
+	writing bool
+}
+
+// MakeFileUploadStore makes an upload store in dir, creating it when missing
+// and removing the uploads left from before a restart. Uploads expire
+// lifetime after they were last written to, DefaultUploadLifetime when
+// lifetime is not positive.
+func MakeFileUploadStore(dir string, lifetime time.Duration) (*FileUploadStore, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultUploadLifetime
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	leftover, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range leftover {
+		if validBlobID(file.Name()) {
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &FileUploadStore{
+		dir:      dir,
+		lifetime: lifetime,
+		uploads:  make(map[string]*fileUpload),
+		mutex:    &sync.Mutex{},
+	}, nil
+}
+
+func (store *FileUploadStore) CreateUpload(userID string, size int64, now time.Time) (types.Upload, error) {
+	id, err := makeBlobID()
+	if err != nil {
+		return types.Upload{}, err
+	}
+	file, err := os.OpenFile(store.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return types.Upload{}, err
+	}
+	if err := file.Close(); err != nil {
+		return types.Upload{}, err
+	}
+	upload := types.Upload{ID: id, Size: size, ExpiresAt: now.Add(store.lifetime)}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.uploads[id] = &fileUpload{userID: userID, upload: upload}
+	return upload, nil
+}
+
+func (store *FileUploadStore) Upload(userID string, id string, now time.Time) (types.Upload, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	upload, err := store.find(userID, id, now)
+	if err != nil {
+		return types.Upload{}, err
+	}
+	return upload.upload, nil
+}
+
+func (store *FileUploadStore) WriteUpload(userID string, id string, offset int64, r io.Reader, now time.Time) (types.Upload, error) {
+	store.mutex.Lock()
+	upload, err := store.find(userID, id, now)
+	if err == nil && (upload.writing || upload.upload.Offset != offset) {
+		err = ErrUploadOffset{Offset: upload.upload.Offset}
+	}
+	if err != nil {
+		store.mutex.Unlock()
+		return types.Upload{}, err
+	}
+	// written without holding the lock, a chunk can take long to arrive
+	upload.writing = true
+	remaining := upload.upload.Size - offset
+	store.mutex.Unlock()
+
+	written, err := store.write(id, offset, r, remaining)
+	// anything past the size the upload was started with is refused, looked
+	// for before taking the lock again as it waits on the client too
+	tooLarge := false
+	if err == nil && written == remaining {
+		var extra [1]byte
+		n, _ := io.ReadFull(r, extra[:])
+		tooLarge = n > 0
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	upload.writing = false
+	upload.upload.Offset += written
+	upload.upload.ExpiresAt = now.Add(store.lifetime)
+	if err != nil {
+		return upload.upload, err
+	}
+	if tooLarge {
+		return upload.upload, ErrUploadTooLarge
+	}
+	return upload.upload, nil
+}
+
+func (store *FileUploadStore) write(id string, offset int64, r io.Reader, remaining int64) (int64, error) {
+	file, err := os.OpenFile(store.path(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return 0, err
+	}
+	written, err := io.Copy(file, io.LimitReader(r, remaining))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+func (store *FileUploadStore) OpenUpload(userID string, id string, now time.Time) (io.ReadCloser, error) {
+	store.mutex.Lock()
+	upload, err := store.find(userID, id, now)
+	if err == nil && (upload.writing || upload.upload.Offset != upload.upload.Size) {
+		err = ErrUploadIncomplete
+	}
+	store.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(store.path(id))
+}
+
+func (store *FileUploadStore) DeleteUpload(userID string, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	upload, ok := store.uploads[id]
+	if !ok || upload.userID != userID {
+		return ErrUploadDoesNotExist
+	}
+	delete(store.uploads, id)
+	return os.Remove(store.path(id))
+}
+
+func (store *FileUploadStore) ExpireUploads(now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for id, upload := range store.uploads {
+		if upload.writing || now.Before(upload.upload.ExpiresAt) {
+			continue
+		}
+		delete(store.uploads, id)
+		if err := os.Remove(store.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the upload with id of userID unless it expired. The store
+// must be locked.
+func (store *FileUploadStore) find(userID string, id string, now time.Time) (*fileUpload, error) {
+	upload, ok := store.uploads[id]
+	if !ok || upload.userID != userID || (!upload.writing && !now.Before(upload.upload.ExpiresAt)) {
+		return nil, ErrUploadDoesNotExist
+	}
+	return upload, nil
+}
+
+func (store *FileUploadStore) path(id string) string {
+	return filepath.Join(store.dir, id)
+}
+
+// expireUploads removes expired uploads every uploadSweepInterval until ctx
+// is done.
+func (server *Server) expireUploads(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := server.Uploads.ExpireUploads(now); err != nil {
+				utils.LogError(fmt.Sprintf("server.expireUploads %s", err.Error()))
+			}
+		}
+	}
+}
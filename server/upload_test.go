@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFileUploadStore(t *testing.T) {
+	store, err := MakeFileUploadStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	upload, err := store.CreateUpload("MEP", 10, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.OpenUpload("MEP", upload.ID, now); err != ErrUploadIncomplete {
+		t.Error(sprintFailure(ErrUploadIncomplete, err))
+	}
+	if upload, err = store.WriteUpload("MEP", upload.ID, 0, bytes.NewReader([]byte("cipher")), now); err != nil || upload.Offset != 6 {
+		t.Fatalf("upload at offset %d with %v", upload.Offset, err)
+	}
+
+	tests := []struct {
+		name          string
+		userID        string
+		offset        int64
+		chunk         string
+		expectedError error
+	}{
+		{"OtherUser", "ROOT", 6, "text", ErrUploadDoesNotExist},
+		{"Behind", "MEP", 0, "ciphertext", ErrUploadOffset{Offset: 6}},
+		{"Ahead", "MEP", 8, "xt", ErrUploadOffset{Offset: 6}},
+		{"TooLarge", "MEP", 6, "textual", ErrUploadTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := store.WriteUpload(test.userID, upload.ID, test.offset, bytes.NewReader([]byte(test.chunk)), now)
+			if !assert(test.expectedError, err) {
+				t.Error(sprintFailure(test.expectedError, err))
+			}
+		})
+	}
+
+	// the chunk too large filled the upload, the rest was refused
+	blob, err := store.OpenUpload("MEP", upload.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(data) != "ciphertext" {
+		t.Errorf("upload holds %q with %v", data, err)
+	}
+
+	// uploads expire an hour after they were last written to
+	if err := store.ExpireUploads(now.Add(59 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Upload("MEP", upload.ID, now); err != nil {
+		t.Error(sprintFailure(nil, err))
+	}
+	if err := store.ExpireUploads(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Upload("MEP", upload.ID, now); err != ErrUploadDoesNotExist {
+		t.Error(sprintFailure(ErrUploadDoesNotExist, err))
+	}
+}
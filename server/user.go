@@ -73,6 +73,8 @@ type User struct {
 	Username string
 	Password []byte
 	Email    string
+	// Admin users may revoke the keys of any user.
+	Admin bool
 }
 
 func MakeUser(username, password, email string) User {
@@ -84,6 +86,13 @@ func MakeUser(username, password, email string) User {
 	}
 }
 
+// MakeAdminUser makes a user allowed to administer the keys of other users.
+func MakeAdminUser(username, password, email string) User {
+	user := MakeUser(username, password, email)
+	user.Admin = true
+	return user
+}
+
 func (user User) Authenticate(password string) bool {
 	return validatePassword(password, user.Password)
 }
@@ -1,66 +1,200 @@
 package server
 
 import (
-	"crypto/rsa"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/markpotocki/messenger/types"
 	"github.com/markpotocki/messenger/utils"
 )
 
+// UserKeystore holds the public keys of each device of a user.
 type UserKeystore interface {
-	PublicKeyByUserID(userID string) (rsa.PublicKey, error)
-	AddPublicKey(userID string, publicKey jwk.RSAPublicKey) error
+	// PublicKeyByUserID returns the keys of every device of the user, each
+	// key naming its device.
+	PublicKeyByUserID(userID string) (jwk.Set, error)
+	// AddPublicKey adds keys to the default device of the user.
+	AddPublicKey(userID string, publicKeys jwk.Set) error
+	AddDevicePublicKey(userID string, deviceID string, publicKeys jwk.Set) error
 	DeletePublicKeyByUserID(userID string) error
+	DeleteDevicePublicKey(userID string, deviceID string) error
+	// RevokePublicKey marks the keys of the user with the kid keyID revoked
+	// for reason at revokedAt. Revoked keys are still handed out, so senders
+	// learn of the revocation, but are never used again.
+	RevokePublicKey(userID string, keyID string, reason string, revokedAt time.Time) error
 }
 
 type MemoryUserKeystore struct {
-	keys  map[string]rsa.PublicKey
+	keys  map[string]map[string]jwk.Set
 	mutex *sync.Mutex
 }
 
 func MakeMemoryUserKeystore() *MemoryUserKeystore {
 	return &MemoryUserKeystore{
-		keys:  make(map[string]rsa.PublicKey),
+		keys:  make(map[string]map[string]jwk.Set),
 		mutex: &sync.Mutex{},
 	}
 }
 
-func (keystore MemoryUserKeystore) PublicKeyByUserID(userID string) (rsa.PublicKey, error) {
-	if key, ok := keystore.keys[userID]; ok {
-		return key, nil
+func (keystore MemoryUserKeystore) PublicKeyByUserID(userID string) (jwk.Set, error) {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	devices, ok := keystore.keys[userID]
+	if !ok {
+		// no key found
+		return nil, ErrKeyDoesNotExist{key: userID}
+	}
+	deviceIDs := make([]string, 0, len(devices))
+	for deviceID := range devices {
+		deviceIDs = append(deviceIDs, deviceID)
 	}
-	// no key found
-	return rsa.PublicKey{}, ErrKeyDoesNotExist{key: userID}
+	sort.Strings(deviceIDs)
+	keys := jwk.NewSet()
+	for _, deviceID := range deviceIDs {
+		deviceKeys, err := cloneKeySet(devices[deviceID])
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < deviceKeys.Len(); i++ {
+			key, _ := deviceKeys.Get(i)
+			keys.Add(key)
+		}
+	}
+	return keys, nil
 }
 
-func (keystore MemoryUserKeystore) AddPublicKey(userID string, publicKey jwk.RSAPublicKey) error {
-	if _, ok := keystore.keys[userID]; ok {
-		return ErrKeyAlreadyExists{key: userID}
+func (keystore MemoryUserKeystore) AddPublicKey(userID string, publicKeys jwk.Set) error {
+	return keystore.AddDevicePublicKey(userID, types.DefaultDeviceID, publicKeys)
+}
+
+// AddDevicePublicKey stores the keys a device advertises. Each key must be a
+// public RSA, P-256, Ed25519 or X25519 key. Keys without a kid are given their
+// thumbprint as kid.
+//
+// Adding keys to a device that already has some rotates its keys: the new
+// keys become the active ones and the previous keys are kept, no longer
+// active, so messages sent to or signed with them can still be handled.
+// Adding a kid the user already has is an error.
+func (keystore MemoryUserKeystore) AddDevicePublicKey(userID string, deviceID string, publicKeys jwk.Set) error {
+	if publicKeys.Len() == 0 {
+		return utils.ErrUnsupportedKey{Reason: "no keys provided"}
 	}
-	// decode to rsa key
-	rsaKey, err := utils.MakePublicKeyFromJWK(publicKey)
+	keys, err := cloneKeySet(publicKeys)
 	if err != nil {
 		return err
 	}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		if err := utils.ValidatePublicJWK(key); err != nil {
+			return err
+		}
+		if key.KeyID() == "" {
+			if err := jwk.AssignKeyID(key); err != nil {
+				return err
+			}
+		}
+		if err := key.Set(utils.ParameterActive, true); err != nil {
+			return err
+		}
+		if err := key.Set(utils.ParameterDevice, deviceID); err != nil {
+			return err
+		}
+	}
 
 	keystore.mutex.Lock()
 	defer keystore.mutex.Unlock()
-	keystore.keys[userID] = *rsaKey
+	devices, ok := keystore.keys[userID]
+	if !ok {
+		devices = make(map[string]jwk.Set)
+		keystore.keys[userID] = devices
+	}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		for _, deviceKeys := range devices {
+			if _, ok := deviceKeys.LookupKeyID(key.KeyID()); ok {
+				return ErrKeyAlreadyExists{key: userID}
+			}
+		}
+	}
+	if previous, ok := devices[deviceID]; ok {
+		for i := 0; i < previous.Len(); i++ {
+			key, _ := previous.Get(i)
+			if err := key.Remove(utils.ParameterActive); err != nil {
+				return err
+			}
+			keys.Add(key)
+		}
+	}
+	devices[deviceID] = keys
 	return nil
 }
 
 func (keystore MemoryUserKeystore) DeletePublicKeyByUserID(userID string) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
 	if _, ok := keystore.keys[userID]; ok {
-		keystore.mutex.Lock()
-		defer keystore.mutex.Unlock()
 		delete(keystore.keys, userID)
 		return nil
 	}
 	return ErrKeyDoesNotExist{key: userID}
 }
 
+// DeleteDevicePublicKey removes a device and its keys. The user is removed
+// along with their last device.
+func (keystore MemoryUserKeystore) DeleteDevicePublicKey(userID string, deviceID string) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	devices, ok := keystore.keys[userID]
+	if !ok {
+		return ErrKeyDoesNotExist{key: userID}
+	}
+	if _, ok := devices[deviceID]; !ok {
+		return ErrKeyDoesNotExist{key: userID + "/" + deviceID}
+	}
+	delete(devices, deviceID)
+	if len(devices) == 0 {
+		delete(keystore.keys, userID)
+	}
+	return nil
+}
+
+// RevokePublicKey revokes every key of the user with the kid, the signing
+// and encryption keys of a device sharing one.
+func (keystore MemoryUserKeystore) RevokePublicKey(userID string, keyID string, reason string, revokedAt time.Time) error {
+	keystore.mutex.Lock()
+	defer keystore.mutex.Unlock()
+	devices, ok := keystore.keys[userID]
+	if !ok {
+		return ErrKeyDoesNotExist{key: userID}
+	}
+	var revoked []jwk.Key
+	for _, deviceKeys := range devices {
+		for i := 0; i < deviceKeys.Len(); i++ {
+			key, _ := deviceKeys.Get(i)
+			if key.KeyID() != keyID {
+				continue
+			}
+			if utils.IsRevokedJWK(key) {
+				return ErrKeyRevoked{key: userID + "/" + keyID}
+			}
+			revoked = append(revoked, key)
+		}
+	}
+	if len(revoked) == 0 {
+		return ErrKeyDoesNotExist{key: userID + "/" + keyID}
+	}
+	for _, key := range revoked {
+		if err := utils.RevokeJWK(key, reason, revokedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type ErrKeyDoesNotExist struct {
 	key string
 }
@@ -76,3 +210,21 @@ type ErrKeyAlreadyExists struct {
 func (err ErrKeyAlreadyExists) Error() string {
 	return fmt.Sprintf("key %s already exists", err.key)
 }
+
+type ErrKeyRevoked struct {
+	key string
+}
+
+func (err ErrKeyRevoked) Error() string {
+	return fmt.Sprintf("key %s is already revoked", err.key)
+}
+
+// cloneKeySet copies a key set along with its keys, so the stored keys are
+// never shared with callers.
+func cloneKeySet(set jwk.Set) (jwk.Set, error) {
+	data, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	return jwk.Parse(data)
+}
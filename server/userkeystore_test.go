@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+	"github.com/markpotocki/messenger/utils"
+)
+
+func TestMemoryUserKeystoreAddPublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xPub, _, err := x25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		keys        []interface{}
+		expectError bool
+	}{
+		{"RSA", []interface{}{&rsaKey.PublicKey}, false},
+		{"P256", []interface{}{&p256Key.PublicKey}, false},
+		{"Ed25519AndX25519", []interface{}{edPub, xPub}, false},
+		{"P384", []interface{}{&p384Key.PublicKey}, true},
+		{"RSAPrivate", []interface{}{rsaKey}, true},
+		{"Symmetric", []interface{}{[]byte("secret")}, true},
+		{"Empty", []interface{}{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := jwk.NewSet()
+			for _, raw := range test.keys {
+				key, err := jwk.New(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				set.Add(key)
+			}
+
+			keystore := MakeMemoryUserKeystore()
+			err := keystore.AddPublicKey("MEP", set)
+			if test.expectError {
+				if _, ok := err.(utils.ErrUnsupportedKey); !ok {
+					t.Error(sprintFailure(utils.ErrUnsupportedKey{}, err))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := keystore.PublicKeyByUserID("MEP")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !assert(len(test.keys), stored.Len()) {
+				t.Error(sprintFailure(len(test.keys), stored.Len()))
+			}
+
+			// a second registration is rejected
+			if err := keystore.AddPublicKey("MEP", set); err != (ErrKeyAlreadyExists{key: "MEP"}) {
+				t.Error(sprintFailure(ErrKeyAlreadyExists{key: "MEP"}, err))
+			}
+		})
+	}
+}
+
+func TestMemoryUserKeystoreRotatePublicKey(t *testing.T) {
+	keystore := MakeMemoryUserKeystore()
+	var keyIDs []string
+	for i := 0; i < 3; i++ {
+		edKey, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := jwk.New(edKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := jwk.NewSet()
+		set.Add(key)
+		if err := keystore.AddPublicKey("MEP", set); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := keystore.PublicKeyByUserID("MEP")
+		if err != nil {
+			t.Fatal(err)
+		}
+		active, ok := utils.FindJWK(stored, utils.UseSignature)
+		if !ok {
+			t.Fatal("no active key after adding a key")
+		}
+		keyIDs = append(keyIDs, active.KeyID())
+
+		if len(keyIDs) > 1 && keyIDs[i] == keyIDs[i-1] {
+			t.Error("rotated key has the kid of the previous key")
+		}
+		if !assert(i+1, stored.Len()) {
+			t.Error(sprintFailure(i+1, stored.Len()))
+		}
+		// previous keys are kept but no longer active
+		for _, keyID := range keyIDs[:i] {
+			previous, ok := stored.LookupKeyID(keyID)
+			if !ok {
+				t.Errorf("previous key %s was dropped", keyID)
+				continue
+			}
+			if utils.IsActiveJWK(previous) {
+				t.Errorf("previous key %s is still active", keyID)
+			}
+		}
+	}
+
+	// the keys handed out are copies
+	stored, err := keystore.PublicKeyByUserID("MEP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, _ := utils.FindJWK(stored, utils.UseSignature)
+	active.Remove(utils.ParameterActive)
+	stored, err = keystore.PublicKeyByUserID("MEP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, ok := utils.FindJWK(stored, utils.UseSignature); !ok || active.KeyID() != keyIDs[len(keyIDs)-1] {
+		t.Error("stored keys were changed through a returned set")
+	}
+}
+
+func TestMemoryUserKeystoreRevokePublicKey(t *testing.T) {
+	keystore := MakeMemoryUserKeystore()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := utils.MakeJWKSetFromPrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keystore.AddPublicKey("MEP", set); err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := utils.KeyID(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revokedAt := time.Now().UTC()
+	if err := keystore.RevokePublicKey("MEP", keyID, types.RevocationCompromised, revokedAt); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := keystore.PublicKeyByUserID("MEP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the signing and encryption keys share the kid and are both revoked
+	for i := 0; i < stored.Len(); i++ {
+		key, _ := stored.Get(i)
+		at, reason, ok := utils.JWKRevocation(key)
+		if !ok {
+			t.Errorf("key %d was not revoked", i)
+			continue
+		}
+		if !assert(types.RevocationCompromised, reason) {
+			t.Error(sprintFailure(types.RevocationCompromised, reason))
+		}
+		if !at.Equal(revokedAt) {
+			t.Error(sprintFailure(revokedAt, at))
+		}
+	}
+	if _, ok := utils.FindJWK(stored, utils.UseEncryption); ok {
+		t.Error("a revoked key is still found for use")
+	}
+
+	if err := keystore.RevokePublicKey("MEP", keyID, types.RevocationCompromised, revokedAt); err != (ErrKeyRevoked{key: "MEP/" + keyID}) {
+		t.Error(sprintFailure(ErrKeyRevoked{key: "MEP/" + keyID}, err))
+	}
+	if err := keystore.RevokePublicKey("MEP", "unknown", types.RevocationCompromised, revokedAt); err != (ErrKeyDoesNotExist{key: "MEP/unknown"}) {
+		t.Error(sprintFailure(ErrKeyDoesNotExist{key: "MEP/unknown"}, err))
+	}
+	if err := keystore.RevokePublicKey("ROOT", keyID, types.RevocationCompromised, revokedAt); err != (ErrKeyDoesNotExist{key: "ROOT"}) {
+		t.Error(sprintFailure(ErrKeyDoesNotExist{key: "ROOT"}, err))
+	}
+}
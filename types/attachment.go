@@ -0,0 +1,24 @@
+package types
+
+// Attachment refers to a file uploaded encrypted to the blob store. It is
+// sent as the content of a message with Attachment set, so only the
+// recipient learns the key.
+type Attachment struct {
+	BlobID    string
+	Name      string
+	MediaType string
+	// Size is the size of the file, Digest the SHA-256 of the blob holding
+	// it encrypted.
+	Size   int64
+	Digest []byte
+	// Key is the AES-256-GCM key the file was encrypted with, in chunks of
+	// ChunkSize bytes.
+	Key       []byte
+	ChunkSize int
+}
+
+// BlobReference is returned for a blob uploaded to /blobs.
+type BlobReference struct {
+	ID   string
+	Size int64
+}
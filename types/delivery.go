@@ -0,0 +1,14 @@
+package types
+
+const (
+	// HeaderDeliveryToken carries the delivery token of the recipient of a
+	// sealed message, standing in for the authentication of its sender.
+	HeaderDeliveryToken = "X-Delivery-Token"
+	DeliveryTokenSize   = 32
+)
+
+// DeliveryToken is a secret a user hands to their contacts so they can send
+// them sealed messages. The server keeps only its hash.
+type DeliveryToken struct {
+	Token string
+}
@@ -0,0 +1,15 @@
+package types
+
+const (
+	// HeaderDeviceID names the device a request is made from. Requests
+	// without it act for DefaultDeviceID.
+	HeaderDeviceID  = "X-Device-ID"
+	DefaultDeviceID = "default"
+)
+
+// Device is one of the devices registered to an account, each with its own
+// keys. KeyIDs lists the kids of its keys, the active ones first.
+type Device struct {
+	ID     string
+	KeyIDs []string
+}
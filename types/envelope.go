@@ -0,0 +1,53 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	hybridKeySignatureContext = "messenger hybrid KEM key"
+)
+
+// Versions of the envelope holding encrypted message content.
+const (
+	// EnvelopeVersionLegacy is the version of messages from before versions
+	// were recorded: content encrypted whole with RSA PKCS #1 v1.5 by the
+	// first clients, or the envelope without its version and algorithm bound
+	// to the message.
+	EnvelopeVersionLegacy = 0
+	// EnvelopeVersion1 binds the version and algorithm to the message along
+	// with the rest of its metadata.
+	EnvelopeVersion1 = 1
+	// EnvelopeVersion is the version clients send.
+	EnvelopeVersion = EnvelopeVersion1
+)
+
+// Algorithms message content is encrypted with, named for the key management
+// and the content encryption.
+const (
+	// AlgorithmRSAPKCS1v15 is RSA PKCS #1 v1.5 of the content itself, as the
+	// first clients sent it. Content is only ever decrypted with it.
+	AlgorithmRSAPKCS1v15    = "RSA1_5"
+	AlgorithmRSAOAEPA256GCM = "RSA-OAEP-256+A256GCM"
+	AlgorithmECDHESA256GCM  = "ECDH-ES+A256GCM"
+	// AlgorithmHybridA256GCM derives the content key from both X25519 and
+	// ML-KEM-768, so it stays secret unless both are broken.
+	AlgorithmHybridA256GCM = "X25519MLKEM768+A256GCM"
+	// AlgorithmRatchet is a double ratchet session started with X3DH.
+	AlgorithmRatchet = "X3DH+DR+A256GCM"
+)
+
+// HybridKeyBytes is the data a user's signing key signs to vouch for the
+// hybrid KEM key published with their encryption key with thumbprint.
+func HybridKeyBytes(thumbprint []byte, hybridKey []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(hybridKeySignatureContext)
+	for _, field := range [][]byte{thumbprint, hybridKey} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		buffer.Write(length)
+		buffer.Write(field)
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,70 @@
+package types
+
+import "time"
+
+const (
+	// GroupRoleAdmin members manage who is in a group, GroupRoleMember
+	// members only send to it.
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+	// GroupInviteTokenSize is the size of the secret in an invite link.
+	GroupInviteTokenSize = 32
+)
+
+// Group is a conversation between its members, kept by the server. Messages
+// to the group are sent as a copy to each member.
+type Group struct {
+	ID      string
+	Name    string
+	Members []GroupMember
+}
+
+type GroupMember struct {
+	UserID string
+	Role   string
+}
+
+// Role returns the role of userID in the group, or "" when they are not a
+// member.
+func (group Group) Role(userID string) string {
+	for _, member := range group.Members {
+		if member.UserID == userID {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// IsGroupRole reports whether role is one of the group roles.
+func IsGroupRole(role string) bool {
+	return role == GroupRoleAdmin || role == GroupRoleMember
+}
+
+// GroupRequest creates a group named Name, its creator its admin and Members
+// its other members.
+type GroupRequest struct {
+	Name    string
+	Members []string
+}
+
+// GroupMemberRequest adds UserID to a group with Role, GroupRoleMember when
+// it is empty.
+type GroupMemberRequest struct {
+	GroupID string
+	UserID  string
+	Role    string
+}
+
+// GroupInvite is an invite link to a group. Anyone holding Token, base64url
+// encoded, joins the group as a member until ExpiresAt. The server keeps only
+// its hash.
+type GroupInvite struct {
+	GroupID   string
+	Token     string
+	ExpiresAt time.Time
+}
+
+// JoinGroupRequest joins the group of the invite with Token.
+type JoinGroupRequest struct {
+	Token string
+}
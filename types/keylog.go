@@ -0,0 +1,85 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	treeHeadSignatureContext = "messenger signed tree head"
+)
+
+// Operations recorded in the key transparency log.
+const (
+	KeyLogAdd          = "add"
+	KeyLogRotate       = "rotate"
+	KeyLogDeleteDevice = "delete-device"
+	KeyLogDeleteUser   = "delete-user"
+	KeyLogRevoke       = "revoke"
+)
+
+// LoggedKey is a key of a user as recorded in the key transparency log.
+// HybridKey is the SHA-256 hash of the hybrid KEM key published with it, if
+// any, which the thumbprint does not cover. Algorithms are those the key
+// advertises, so they cannot be stripped to force a weaker envelope.
+type LoggedKey struct {
+	Thumbprint string
+	Device     string
+	Active     bool
+	Revoked    bool
+	HybridKey  string   `json:",omitempty"`
+	Algorithms []string `json:",omitempty"`
+}
+
+// KeyLogEntry records a change to the keys of a user. Keys holds every key of
+// the user once the change applied, sorted by thumbprint, so the latest entry
+// of a user describes the keys the server hands out for them.
+type KeyLogEntry struct {
+	Operation string
+	UserID    string
+	DeviceID  string
+	Keys      []LoggedKey
+	Time      time.Time
+}
+
+// SignedTreeHead commits the key transparency log to its first Size entries.
+// It is signed by the log's key.
+type SignedTreeHead struct {
+	Size      uint64
+	RootHash  []byte
+	Timestamp time.Time
+	Signature []byte
+}
+
+// KeyLogProof is returned along with the keys of a user at /pubkey. It proves
+// that Entry, the JSON encoded latest entry of the user, is the leaf at Index
+// of the tree committed to by TreeHead.
+type KeyLogProof struct {
+	Entry     []byte
+	Index     uint64
+	AuditPath [][]byte
+	TreeHead  SignedTreeHead
+}
+
+// KeyLogConsistency proves that the tree of the log at size First is a prefix
+// of the tree at size Second.
+type KeyLogConsistency struct {
+	First  uint64
+	Second uint64
+	Proof  [][]byte
+}
+
+// TreeHeadBytes is the data covered by a tree head signature.
+func TreeHeadBytes(head SignedTreeHead) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(treeHeadSignatureContext)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, head.Size)
+	buffer.Write(size)
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(head.Timestamp.UnixNano()))
+	buffer.Write(timestamp)
+	buffer.Write(head.RootHash)
+	return buffer.Bytes()
+}
@@ -0,0 +1,55 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+const (
+	// MemberKeyPossession is the member of the JWK set posted to /pubkey
+	// holding the KeyPossessionProof.
+	MemberKeyPossession = "proof"
+
+	keyPossessionSignatureContext = "messenger key possession"
+)
+
+// KeyChallenge is issued to a device about to register keys. The device
+// proves it holds the private keys by signing the nonce with them before the
+// challenge expires.
+type KeyChallenge struct {
+	Nonce     string
+	ExpiresAt time.Time
+}
+
+// KeyPossessionProof goes along with keys posted to /pubkey. Signatures holds,
+// by kid, the signature of KeyPossessionBytes made by each signing key
+// registered. Encryption keys are covered by the signing key sharing their
+// kid, which holds the same key material.
+type KeyPossessionProof struct {
+	Nonce      string
+	Signatures map[string][]byte
+}
+
+// KeyPossessionBytes is the data the signing key with thumbprint signs to
+// prove possession when registering it for deviceID of userID.
+func KeyPossessionBytes(userID string, deviceID string, nonce string, thumbprint []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(keyPossessionSignatureContext)
+	for _, field := range [][]byte{[]byte(userID), []byte(deviceID), []byte(nonce), thumbprint} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		buffer.Write(length)
+		buffer.Write(field)
+	}
+	return buffer.Bytes()
+}
+
+// KeyRegistration is the JWK set posted to /pubkey, with the proof of
+// possession alongside. Parsers of plain JWK sets ignore the extra member.
+type KeyRegistration struct {
+	Keys  []jwk.Key           `json:"keys,omitempty"`
+	Proof *KeyPossessionProof `json:"proof,omitempty"`
+}
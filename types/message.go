@@ -7,7 +7,11 @@ import (
 )
 
 const (
-	MessageIDSize = 64
+	MessageIDSize    = 64
+	MessageNonceSize = 16
+	// ContentTypeJWE marks encrypted Content held as a JWE in compact
+	// serialization.
+	ContentTypeJWE = "jwe"
 )
 
 type Message struct {
@@ -17,6 +21,38 @@ type Message struct {
 	ID        MessageID
 	Content   string
 	Encrypted bool
+	Signature string
+	// KeyID is the kid of the recipient key the content was encrypted to.
+	KeyID string
+	// SignatureKeyID is the kid of the sender key that made Signature.
+	SignatureKeyID string
+	// FromDevice and ToDevice name the sending and receiving devices. A copy
+	// of each message is sent to every device of the recipient.
+	FromDevice string
+	ToDevice   string
+	// Nonce, base64url encoded, and Sequence are chosen by the sending
+	// device for each copy it sends, the sequence counting up from 1. Both
+	// are covered by the signature and the encryption so a copy posted again
+	// is told apart from a new message.
+	Nonce    string
+	Sequence uint64
+	// Sealed messages carry the whole message, From and its signature
+	// included, encrypted to the recipient device in Content, so the server
+	// only learns who they are for.
+	Sealed bool
+	// ContentType names the format of encrypted Content: ContentTypeJWE, or
+	// empty for the messenger envelope.
+	ContentType string
+	// EnvelopeVersion and Algorithm record how Content was encrypted, so
+	// messages keep decrypting as the algorithms clients send change.
+	EnvelopeVersion int
+	Algorithm       string
+	// Attachment is set when Content is an Attachment in JSON rather than
+	// text.
+	Attachment bool
+	// GroupID names the group a message was sent to. Each member is sent a
+	// copy of their own, To naming them.
+	GroupID string
 }
 
 func MakeMessage(from string, to string, content string) Message {
@@ -0,0 +1,111 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	mlsCredentialContext = "messenger MLS credential"
+)
+
+// MLSCredential names the device a member of an MLS group is. Signature,
+// made with the signing key the device registered at /pubkey, vouches for
+// the MLS signature key of its leaf, so MLS identities rest on the keys
+// users already verify.
+type MLSCredential struct {
+	UserID    string
+	DeviceID  string
+	Signature []byte
+}
+
+// MLSLifetime bounds when a KeyPackage may be used.
+type MLSLifetime struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// MLSLeafNode is a member of an MLS group as it appears in the ratchet tree.
+// Source is MLSLeafNodeKeyPackage, MLSLeafNodeUpdate or MLSLeafNodeCommit;
+// Lifetime is only set on leaves in KeyPackages and ParentHash only on
+// leaves in commits.
+type MLSLeafNode struct {
+	EncryptionKey []byte
+	SignatureKey  []byte
+	Credential    MLSCredential
+	Source        uint8
+	Lifetime      *MLSLifetime `json:",omitempty"`
+	ParentHash    []byte       `json:",omitempty"`
+	Signature     []byte
+}
+
+const (
+	MLSLeafNodeKeyPackage uint8 = 1
+	MLSLeafNodeUpdate     uint8 = 2
+	MLSLeafNodeCommit     uint8 = 3
+)
+
+// MLSKeyPackage is published ahead of time so a device can be added to MLS
+// groups while it is offline. Each is used once.
+type MLSKeyPackage struct {
+	InitKey   []byte
+	LeafNode  MLSLeafNode
+	Signature []byte
+}
+
+// KeyPackageCount reports how many unused KeyPackages a device has left.
+type KeyPackageCount struct {
+	KeyPackages int
+}
+
+// MLSMessage is an MLS message of a group as the delivery service orders it.
+// Message is opaque to the server: a commit when Handshake is set, otherwise
+// an encrypted application message. Seq, Sender and Received are set by the
+// server.
+type MLSMessage struct {
+	Seq       uint64
+	GroupID   string
+	Epoch     uint64
+	Handshake bool
+	Sender    string
+	Received  time.Time
+	Message   []byte
+}
+
+// MLSWelcome lets a device that was added to a group join it. Seq is the
+// message that made the epoch the welcome is for.
+type MLSWelcome struct {
+	GroupID string
+	Seq     uint64
+	Welcome []byte
+}
+
+// MLSDevice names a device of a user.
+type MLSDevice struct {
+	UserID   string
+	DeviceID string
+}
+
+// MLSPost is the body posted to the delivery service. A commit that adds
+// members comes with the Welcome for the devices in WelcomeTo, delivered
+// only when the commit is accepted.
+type MLSPost struct {
+	Message   MLSMessage
+	Welcome   []byte      `json:",omitempty"`
+	WelcomeTo []MLSDevice `json:",omitempty"`
+}
+
+// MLSCredentialBytes is the data covered by the signature of an
+// MLSCredential.
+func MLSCredentialBytes(userID string, deviceID string, signatureKey []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(mlsCredentialContext)
+	for _, field := range [][]byte{[]byte(userID), []byte(deviceID), signatureKey} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		buffer.Write(length)
+		buffer.Write(field)
+	}
+	return buffer.Bytes()
+}
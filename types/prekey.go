@@ -0,0 +1,60 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	prekeySignatureContext = "messenger signed prekey"
+)
+
+// Prekey is an X25519 public key published ahead of time so that others can
+// start a session with a user while they are offline.
+type Prekey struct {
+	ID  uint32
+	Key []byte
+}
+
+// SignedPrekey is the medium term prekey of a user. Its signature, made with
+// the user's long term signing key, also covers their X3DH identity key.
+type SignedPrekey struct {
+	Prekey
+	Signature []byte
+}
+
+// PrekeyUpload is the body posted by a device to publish prekeys. A signed
+// prekey replaces the previous one; one-time prekeys are added to those
+// already published.
+type PrekeyUpload struct {
+	IdentityKey    []byte
+	SignedPrekey   *SignedPrekey
+	OneTimePrekeys []Prekey
+}
+
+// PrekeyBundle is what a sender needs to run X3DH with a device of a user.
+// OneTimePrekey is nil once the device has run out of one-time prekeys.
+type PrekeyBundle struct {
+	UserID        string
+	DeviceID      string
+	IdentityKey   []byte
+	SignedPrekey  SignedPrekey
+	OneTimePrekey *Prekey
+}
+
+// PrekeyCount reports how many unused one-time prekeys a device has left.
+type PrekeyCount struct {
+	OneTimePrekeys int
+}
+
+// SignedPrekeyBytes is the data covered by a signed prekey signature.
+func SignedPrekeyBytes(identityKey []byte, prekey Prekey) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(prekeySignatureContext)
+	buffer.Write(identityKey)
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, prekey.ID)
+	buffer.Write(id)
+	buffer.Write(prekey.Key)
+	return buffer.Bytes()
+}
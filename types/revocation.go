@@ -0,0 +1,50 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	revocationSignatureContext = "messenger key revocation"
+)
+
+// Reasons a key is revoked for.
+const (
+	RevocationUnspecified = "unspecified"
+	RevocationCompromised = "compromised"
+	RevocationSuperseded  = "superseded"
+)
+
+// Revocation asks the server to revoke the key KeyID of UserID. It is signed
+// by the key being revoked, so it can be made ahead of time and kept
+// somewhere safe in case the key is lost. An admin may send it unsigned.
+type Revocation struct {
+	UserID    string
+	KeyID     string
+	Reason    string
+	Signature []byte
+}
+
+// IsRevocationReason reports whether reason is one of the known reasons.
+func IsRevocationReason(reason string) bool {
+	switch reason {
+	case RevocationUnspecified, RevocationCompromised, RevocationSuperseded:
+		return true
+	default:
+		return false
+	}
+}
+
+// RevocationBytes is the data covered by a revocation signature.
+func RevocationBytes(revocation Revocation) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(revocationSignatureContext)
+	for _, field := range []string{revocation.UserID, revocation.KeyID, revocation.Reason} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		buffer.Write(length)
+		buffer.WriteString(field)
+	}
+	return buffer.Bytes()
+}
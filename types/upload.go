@@ -0,0 +1,31 @@
+package types
+
+import "time"
+
+const (
+	// HeaderUploadOffset carries the offset a chunk patched into an upload
+	// starts at, and in responses the offset the upload reached.
+	HeaderUploadOffset = "X-Upload-Offset"
+)
+
+// Upload is a blob uploaded to /uploads in chunks, which can be resumed from
+// Offset when a transfer is cut off. It expires when nothing is written to
+// it before ExpiresAt.
+type Upload struct {
+	ID        string
+	Size      int64
+	Offset    int64
+	ExpiresAt time.Time
+}
+
+// UploadRequest starts an upload of a blob of Size bytes.
+type UploadRequest struct {
+	Size int64
+}
+
+// FinishUploadRequest finishes an upload into a blob once every byte was
+// received. Digest is the SHA-256 of the whole blob, checked by the server.
+type FinishUploadRequest struct {
+	ID     string
+	Digest []byte
+}
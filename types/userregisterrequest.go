@@ -5,6 +5,6 @@ import (
 )
 
 type UserRegisterRequest struct {
-	UserID    string
-	PublicKey jwk.RSAPublicKey
+	UserID     string
+	PublicKeys jwk.Set
 }
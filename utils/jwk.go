@@ -1,10 +1,67 @@
 package utils
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/mlkem"
 	"crypto/rsa"
-	"errors"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
 
+	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/x25519"
+	"github.com/markpotocki/messenger/types"
+)
+
+const (
+	UseSignature  = "sig"
+	UseEncryption = "enc"
+
+	AlgorithmPS256   = "PS256"
+	AlgorithmES256   = "ES256"
+	AlgorithmEdDSA   = "EdDSA"
+	AlgorithmRSAOAEP = "RSA-OAEP-256"
+	AlgorithmECDHES  = "ECDH-ES"
+
+	// ParameterActive marks the keys a user currently advertises. Keys
+	// replaced by a rotation stay in the user's set without it, so messages
+	// sent to or signed with them can still be handled.
+	ParameterActive = "active"
+	// ParameterDevice names the device of the user a key belongs to.
+	ParameterDevice = "device"
+	// ParameterRevokedAt and ParameterRevocationReason mark a key that was
+	// revoked, when and why. Revoked keys are never used again.
+	ParameterRevokedAt        = "revoked_at"
+	ParameterRevocationReason = "revocation_reason"
+	// ParameterAlgorithms lists the algorithms the holder of an encryption
+	// key decrypts content with, so senders can pick one both sides
+	// support. Keys without it belong to clients from before algorithms
+	// were negotiated.
+	ParameterAlgorithms = "algs"
+	// ParameterHybridKey holds the public key of the hybrid KEM published
+	// with an encryption key, base64url encoded: an ML-KEM-768 encapsulation
+	// key followed by an X25519 public key.
+	ParameterHybridKey = "kem"
+	// ParameterHybridKeySignature holds the signature of the user's signing
+	// key over the hybrid KEM key, base64url encoded. Hybrid KEM keys it does
+	// not vouch for are never encapsulated to.
+	ParameterHybridKeySignature = "kem_sig"
+
+	// SizeHybridKey is the size of a hybrid KEM public key.
+	SizeHybridKey = mlkem.EncapsulationKeySize768 + x25519.PublicKeySize
+
+	keyTypeRSA          = "RSA"
+	keyTypeEC           = "EC"
+	keyTypeOctetKeyPair = "OKP"
 )
 
 type JWKSet struct {
@@ -19,21 +76,517 @@ type JWKSet struct {
 	KeyID          string `json:"kid"`
 }
 
-func MakeJWKSetFromRSAPublicKey(publicKey *rsa.PublicKey) (jwk.RSAPublicKey, error) {
-	key, err := jwk.New(publicKey)
+// ErrUnsupportedKey is returned for keys of a type, curve or algorithm the
+// messenger does not handle.
+type ErrUnsupportedKey struct {
+	Reason string
+}
+
+func (err ErrUnsupportedKey) Error() string {
+	return fmt.Sprintf("unsupported key: %s", err.Reason)
+}
+
+// MakeJWKSetFromPrivateKey builds the public key set a user advertises for a
+// private key: one key used to verify their signatures and one key used to
+// encrypt to them, each naming the algorithm it accepts. Both keys share the
+// thumbprint of the signing key as their kid.
+//
+// RSA and P-256 keys are advertised twice with different uses. Ed25519 keys
+// are paired with the X25519 key derived from the same seed. The encryption
+// key lists the content algorithms it is used with in ParameterAlgorithms.
+func MakeJWKSetFromPrivateKey(privateKey crypto.Signer) (jwk.Set, error) {
+	var sigRaw, encRaw interface{}
+	var sigAlg, encAlg, contentAlg string
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		sigRaw, encRaw = &key.PublicKey, &key.PublicKey
+		sigAlg, encAlg = AlgorithmPS256, AlgorithmRSAOAEP
+		contentAlg = types.AlgorithmRSAOAEPA256GCM
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedKey{Reason: "only P-256 is supported for EC keys"}
+		}
+		sigRaw, encRaw = &key.PublicKey, &key.PublicKey
+		sigAlg, encAlg = AlgorithmES256, AlgorithmECDHES
+		contentAlg = types.AlgorithmECDHESA256GCM
+	case ed25519.PrivateKey:
+		sigRaw = key.Public()
+		encRaw = X25519PrivateKeyFromEd25519(key).Public()
+		sigAlg, encAlg = AlgorithmEdDSA, AlgorithmECDHES
+		contentAlg = types.AlgorithmECDHESA256GCM
+	default:
+		return nil, ErrUnsupportedKey{Reason: fmt.Sprintf("private key type %T", privateKey)}
+	}
+
+	keyID, err := KeyID(sigRaw)
+	if err != nil {
+		return nil, err
+	}
+	sigKey, err := jwk.New(sigRaw)
 	if err != nil {
 		return nil, err
 	}
-	if jwkRSAKey, ok := key.(jwk.RSAPublicKey); ok {
-		return jwkRSAKey, nil
+	encKey, err := jwk.New(encRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	set := jwk.NewSet()
+	for _, entry := range []struct {
+		key jwk.Key
+		use string
+		alg string
+	}{
+		{sigKey, UseSignature, sigAlg},
+		{encKey, UseEncryption, encAlg},
+	} {
+		if err := entry.key.Set(jwk.KeyIDKey, keyID); err != nil {
+			return nil, err
+		}
+		if err := entry.key.Set(jwk.KeyUsageKey, entry.use); err != nil {
+			return nil, err
+		}
+		if err := entry.key.Set(jwk.AlgorithmKey, entry.alg); err != nil {
+			return nil, err
+		}
+		set.Add(entry.key)
+	}
+	if err := encKey.Set(ParameterAlgorithms, []string{types.AlgorithmRatchet, contentAlg}); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// KeyID returns the kid of the keys advertised for a public signing key, its
+// JWK thumbprint.
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	key, err := jwk.New(publicKey)
+	if err != nil {
+		return "", err
+	}
+	if err := jwk.AssignKeyID(key); err != nil {
+		return "", err
 	}
-	return nil, errors.New("rsa public key could not be cast to jwk public key")
+	return key.KeyID(), nil
 }
 
-func MakePublicKeyFromJWK(key jwk.Key) (*rsa.PublicKey, error) {
-	var rsaKey rsa.PublicKey
-	if err := key.Raw(&rsaKey); err != nil {
+// MakePublicKeyFromJWK returns the raw public key held by a JWK. The result
+// is one of *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or
+// x25519.PublicKey.
+func MakePublicKeyFromJWK(key jwk.Key) (crypto.PublicKey, error) {
+	if err := ValidatePublicJWK(key); err != nil {
 		return nil, err
 	}
-	return &rsaKey, nil
+	var raw interface{}
+	if err := key.Raw(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// FindJWK returns the active key in the set suitable for use, either sig or
+// enc. Keys that do not declare a use are suitable for both. When no key is
+// marked active the first suitable key is returned. Revoked keys are never
+// returned.
+func FindJWK(set jwk.Set, use string) (jwk.Key, bool) {
+	var found jwk.Key
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		if !isJWKForUse(key, use) || IsRevokedJWK(key) {
+			continue
+		}
+		if IsActiveJWK(key) {
+			return key, true
+		}
+		if found == nil {
+			found = key
+		}
+	}
+	if found == nil || hasActiveJWK(set) {
+		return nil, false
+	}
+	return found, true
+}
+
+// FindJWKByID returns the key in the set with the kid suitable for use,
+// whether or not it is still active.
+func FindJWKByID(set jwk.Set, keyID string, use string) (jwk.Key, bool) {
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		if key.KeyID() == keyID && isJWKForUse(key, use) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// IsActiveJWK reports whether the key is marked as one the user currently
+// advertises.
+func IsActiveJWK(key jwk.Key) bool {
+	active, ok := key.Get(ParameterActive)
+	return ok && active == true
+}
+
+// FindRevokedJWK returns the active key in the set suitable for use when it
+// was revoked, which FindJWK skips.
+func FindRevokedJWK(set jwk.Set, use string) (jwk.Key, bool) {
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		if isJWKForUse(key, use) && IsActiveJWK(key) && IsRevokedJWK(key) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// IsRevokedJWK reports whether the key was revoked.
+func IsRevokedJWK(key jwk.Key) bool {
+	_, _, ok := JWKRevocation(key)
+	return ok
+}
+
+// JWKRevocation returns when and why the key was revoked, ok is false when it
+// was not.
+func JWKRevocation(key jwk.Key) (revokedAt time.Time, reason string, ok bool) {
+	value, found := key.Get(ParameterRevokedAt)
+	if !found {
+		return time.Time{}, "", false
+	}
+	text, _ := value.(string)
+	revokedAt, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		// a key marked revoked stays revoked even if the time is unreadable
+		return time.Time{}, "", true
+	}
+	if value, found := key.Get(ParameterRevocationReason); found {
+		reason, _ = value.(string)
+	}
+	return revokedAt, reason, true
+}
+
+// RevokeJWK marks the key revoked at revokedAt for reason.
+func RevokeJWK(key jwk.Key, reason string, revokedAt time.Time) error {
+	if err := key.Set(ParameterRevokedAt, revokedAt.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	return key.Set(ParameterRevocationReason, reason)
+}
+
+// JWKAlgorithms returns the content algorithms advertised with an encryption
+// key, nil when it advertises none.
+func JWKAlgorithms(key jwk.Key) []string {
+	value, ok := key.Get(ParameterAlgorithms)
+	if !ok {
+		return nil
+	}
+	switch algorithms := value.(type) {
+	case []string:
+		return algorithms
+	case []interface{}:
+		// parsed keys hold the list as decoded JSON
+		names := make([]string, 0, len(algorithms))
+		for _, algorithm := range algorithms {
+			if name, ok := algorithm.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// JWKHybridKey returns the hybrid KEM public key published with a key, nil
+// when it publishes none.
+func JWKHybridKey(key jwk.Key) ([]byte, error) {
+	value, ok := key.Get(ParameterHybridKey)
+	if !ok {
+		return nil, nil
+	}
+	encoded, _ := value.(string)
+	hybridKey, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(hybridKey) != SizeHybridKey {
+		return nil, ErrUnsupportedKey{Reason: "hybrid KEM key is not an ML-KEM-768 and X25519 public key"}
+	}
+	if _, err := mlkem.NewEncapsulationKey768(hybridKey[:mlkem.EncapsulationKeySize768]); err != nil {
+		return nil, ErrUnsupportedKey{Reason: "hybrid KEM key holds an invalid ML-KEM-768 key"}
+	}
+	return hybridKey, nil
+}
+
+// SetJWKHybridKey publishes a hybrid KEM public key with an encryption key,
+// signed by signer, and advertises types.AlgorithmHybridA256GCM.
+func SetJWKHybridKey(key jwk.Key, hybridKey []byte, signer crypto.Signer) error {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	signature, err := Sign(signer, types.HybridKeyBytes(thumbprint, hybridKey))
+	if err != nil {
+		return err
+	}
+	if err := key.Set(ParameterHybridKey, base64.RawURLEncoding.EncodeToString(hybridKey)); err != nil {
+		return err
+	}
+	if err := key.Set(ParameterHybridKeySignature, base64.RawURLEncoding.EncodeToString(signature)); err != nil {
+		return err
+	}
+	algorithms := JWKAlgorithms(key)
+	for _, algorithm := range algorithms {
+		if algorithm == types.AlgorithmHybridA256GCM {
+			return nil
+		}
+	}
+	return key.Set(ParameterAlgorithms, append([]string{types.AlgorithmHybridA256GCM}, algorithms...))
+}
+
+// VerifyJWKHybridKey checks that a signing key of set, of the same device as
+// key, signed the hybrid KEM key published with key. It returns
+// ErrInvalidSignature when none did.
+func VerifyJWKHybridKey(set jwk.Set, key jwk.Key) error {
+	hybridKey, err := JWKHybridKey(key)
+	if err != nil || hybridKey == nil {
+		return err
+	}
+	value, _ := key.Get(ParameterHybridKeySignature)
+	encoded, _ := value.(string)
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(signature) == 0 {
+		return ErrInvalidSignature
+	}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	signed := types.HybridKeyBytes(thumbprint, hybridKey)
+	for i := 0; i < set.Len(); i++ {
+		signingKey, _ := set.Get(i)
+		if !isJWKForUse(signingKey, UseSignature) || IsRevokedJWK(signingKey) || JWKDevice(signingKey) != JWKDevice(key) {
+			continue
+		}
+		publicKey, err := MakePublicKeyFromJWK(signingKey)
+		if err != nil {
+			continue
+		}
+		if Verify(publicKey, signed, signature) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// JWKDevice returns the device a key belongs to, empty when it names none.
+func JWKDevice(key jwk.Key) string {
+	device, ok := key.Get(ParameterDevice)
+	if !ok {
+		return ""
+	}
+	deviceID, _ := device.(string)
+	return deviceID
+}
+
+// JWKSetsByDevice splits the keys of a user by the device they belong to.
+// Keys that name no device are grouped under the empty device.
+func JWKSetsByDevice(set jwk.Set) map[string]jwk.Set {
+	devices := make(map[string]jwk.Set)
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		deviceID := JWKDevice(key)
+		if _, ok := devices[deviceID]; !ok {
+			devices[deviceID] = jwk.NewSet()
+		}
+		devices[deviceID].Add(key)
+	}
+	return devices
+}
+
+// LoggedKeys describes every key of a user the way the key transparency log
+// records them, sorted by thumbprint.
+func LoggedKeys(set jwk.Set) ([]types.LoggedKey, error) {
+	keys := make([]types.LoggedKey, 0, set.Len())
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		loggedKey := types.LoggedKey{
+			Thumbprint: base64.RawURLEncoding.EncodeToString(thumbprint),
+			Device:     JWKDevice(key),
+			Active:     IsActiveJWK(key),
+			Revoked:    IsRevokedJWK(key),
+		}
+		if hybridKey, err := JWKHybridKey(key); err == nil && hybridKey != nil {
+			hash := sha256.Sum256(hybridKey)
+			loggedKey.HybridKey = base64.RawURLEncoding.EncodeToString(hash[:])
+		}
+		if algorithms := JWKAlgorithms(key); len(algorithms) > 0 {
+			loggedKey.Algorithms = algorithms
+		}
+		keys = append(keys, loggedKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Thumbprint < keys[j].Thumbprint
+	})
+	return keys, nil
+}
+
+func hasActiveJWK(set jwk.Set) bool {
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		if IsActiveJWK(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJWKForUse(key jwk.Key, use string) bool {
+	if key.KeyUsage() != "" && key.KeyUsage() != use {
+		return false
+	}
+	return use != UseSignature || !IsKeyAgreementJWK(key)
+}
+
+// JWKAlgorithm returns the algorithm a key accepts for use, falling back to
+// the default for its type when the key does not name one.
+func JWKAlgorithm(key jwk.Key, use string) string {
+	if alg := key.Algorithm(); alg != "" {
+		return alg
+	}
+	switch string(key.KeyType()) {
+	case keyTypeRSA:
+		if use == UseSignature {
+			return AlgorithmPS256
+		}
+		return AlgorithmRSAOAEP
+	case keyTypeEC:
+		if use == UseSignature {
+			return AlgorithmES256
+		}
+		return AlgorithmECDHES
+	case keyTypeOctetKeyPair:
+		if IsKeyAgreementJWK(key) {
+			return AlgorithmECDHES
+		}
+		return AlgorithmEdDSA
+	}
+	return ""
+}
+
+// IsKeyAgreementJWK reports whether the key can only be used for key
+// agreement, as is the case for X25519.
+func IsKeyAgreementJWK(key jwk.Key) bool {
+	okpKey, ok := key.(jwk.OKPPublicKey)
+	return ok && okpKey.Crv() == jwa.X25519
+}
+
+// ValidatePublicJWK checks that a key is a public RSA, P-256, Ed25519 or
+// X25519 key, and that the hybrid KEM key published with it, if any, is
+// well formed.
+func ValidatePublicJWK(key jwk.Key) error {
+	if _, err := JWKHybridKey(key); err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case jwk.RSAPrivateKey, jwk.ECDSAPrivateKey, jwk.OKPPrivateKey:
+		return ErrUnsupportedKey{Reason: "private key material must not be shared"}
+	case jwk.RSAPublicKey:
+		return nil
+	case jwk.ECDSAPublicKey:
+		if k.Crv() != jwa.P256 {
+			return ErrUnsupportedKey{Reason: fmt.Sprintf("EC curve %s", k.Crv())}
+		}
+		return nil
+	case jwk.OKPPublicKey:
+		if k.Crv() != jwa.Ed25519 && k.Crv() != jwa.X25519 {
+			return ErrUnsupportedKey{Reason: fmt.Sprintf("OKP curve %s", k.Crv())}
+		}
+		return nil
+	default:
+		return ErrUnsupportedKey{Reason: fmt.Sprintf("key type %s", key.KeyType())}
+	}
+}
+
+// X25519PrivateKeyFromEd25519 derives the X25519 key matching an Ed25519
+// key, the same way the Ed25519 signing scalar is derived from its seed.
+func X25519PrivateKeyFromEd25519(privateKey ed25519.PrivateKey) x25519.PrivateKey {
+	digest := sha512.Sum512(privateKey.Seed())
+	scalar := digest[:x25519.SeedSize]
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+	key, err := x25519.NewKeyFromSeed(scalar)
+	if err != nil {
+		// the scalar is always SeedSize bytes
+		panic(err)
+	}
+	return key
+}
+
+// X25519PublicKeyFromEd25519 maps an Ed25519 public key to the X25519 public
+// key of X25519PrivateKeyFromEd25519, the Montgomery u = (1 + y) / (1 - y) of
+// the Edwards point.
+func X25519PublicKeyFromEd25519(publicKey ed25519.PublicKey) (x25519.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrUnsupportedKey{Reason: "Ed25519 public key is not 32 bytes"}
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	// y is little-endian with the sign of x in the top bit
+	encoded := make([]byte, len(publicKey))
+	for i, b := range publicKey {
+		encoded[len(publicKey)-1-i] = b
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 {
+		return nil, ErrUnsupportedKey{Reason: "Ed25519 public key has no X25519 equivalent"}
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, p))
+	u.Mod(u, p)
+	out := make([]byte, x25519.PublicKeySize)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return x25519.PublicKey(out), nil
+}
+
+// SameKeyPair reports whether an encryption key is advertised for the same
+// private key as a signing key: the same RSA or P-256 key, or the X25519 key
+// of an Ed25519 key.
+func SameKeyPair(encKey jwk.Key, sigKey jwk.Key) bool {
+	encThumbprint, err := encKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return false
+	}
+	sigThumbprint, err := sigKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(encThumbprint, sigThumbprint) {
+		return true
+	}
+	if !IsKeyAgreementJWK(encKey) {
+		return false
+	}
+	var sigRaw, encRaw interface{}
+	if err := sigKey.Raw(&sigRaw); err != nil {
+		return false
+	}
+	if err := encKey.Raw(&encRaw); err != nil {
+		return false
+	}
+	edKey, ok := sigRaw.(ed25519.PublicKey)
+	if !ok {
+		return false
+	}
+	x25519Key, err := X25519PublicKeyFromEd25519(edKey)
+	if err != nil {
+		return false
+	}
+	encX25519, ok := encRaw.(x25519.PublicKey)
+	return ok && bytes.Equal(x25519Key, encX25519)
 }
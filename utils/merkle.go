@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// The Merkle tree follows RFC 6962: leaves and nodes are hashed with distinct
+// prefixes so a node can never pass for a leaf.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+var (
+	ErrInvalidInclusionProof   = errors.New("merkle inclusion proof is not valid")
+	ErrInvalidConsistencyProof = errors.New("merkle consistency proof is not valid")
+)
+
+// MerkleLeafHash hashes the data of a leaf of the tree.
+func MerkleLeafHash(data []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleLeafPrefix})
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// MerkleRoot returns the root hash of the tree over the leaf hashes.
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// MerkleInclusionProof returns the audit path proving the leaf at index is in
+// the tree over the leaf hashes.
+func MerkleInclusionProof(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(MerkleInclusionProof(leaves[:k], index), MerkleRoot(leaves[k:]))
+	}
+	return append(MerkleInclusionProof(leaves[k:], index-k), MerkleRoot(leaves[:k]))
+}
+
+// MerkleConsistencyProof returns the proof that the tree over the first size
+// leaf hashes is a prefix of the tree over all of them.
+func MerkleConsistencyProof(leaves [][]byte, size int) [][]byte {
+	if size == 0 || size >= len(leaves) {
+		return nil
+	}
+	return merkleSubproof(leaves, size, true)
+}
+
+func merkleSubproof(leaves [][]byte, size int, complete bool) [][]byte {
+	if size == len(leaves) {
+		if complete {
+			return nil
+		}
+		return [][]byte{MerkleRoot(leaves)}
+	}
+	k := merkleSplit(len(leaves))
+	if size <= k {
+		return append(merkleSubproof(leaves[:k], size, complete), MerkleRoot(leaves[k:]))
+	}
+	return append(merkleSubproof(leaves[k:], size-k, false), MerkleRoot(leaves[:k]))
+}
+
+// merkleSplit returns the largest power of two smaller than n.
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// VerifyMerkleInclusion checks that leafHash is at index in the tree of size
+// leaves with the given root, following RFC 9162 section 2.1.3.2.
+func VerifyMerkleInclusion(leafHash []byte, index uint64, size uint64, proof [][]byte, root []byte) error {
+	if index >= size {
+		return ErrInvalidInclusionProof
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidInclusionProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidInclusionProof
+	}
+	return nil
+}
+
+// VerifyMerkleConsistency checks that the tree of size1 leaves with root1 is
+// a prefix of the tree of size2 leaves with root2, following RFC 9162 section
+// 2.1.4.2.
+func VerifyMerkleConsistency(size1 uint64, size2 uint64, root1 []byte, root2 []byte, proof [][]byte) error {
+	switch {
+	case size1 > size2:
+		return ErrInvalidConsistencyProof
+	case size1 == size2:
+		if len(proof) != 0 || !bytes.Equal(root1, root2) {
+			return ErrInvalidConsistencyProof
+		}
+		return nil
+	case size1 == 0:
+		// the empty tree is a prefix of every tree
+		return nil
+	case len(proof) == 0:
+		return ErrInvalidConsistencyProof
+	}
+
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidConsistencyProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, root1) || !bytes.Equal(sr, root2) {
+		return ErrInvalidConsistencyProof
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidSignature = errors.New("signature is not valid")
+
+// Sign signs data with the algorithm matching the key type: PS256 for RSA,
+// ES256 for P-256 and EdDSA for Ed25519.
+func Sign(privateKey crypto.Signer, data []byte) ([]byte, error) {
+	switch privateKey.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		return privateKey.Sign(rand.Reader, digest[:], &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthAuto,
+			Hash:       crypto.SHA256,
+		})
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		return privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PrivateKey:
+		return privateKey.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		return nil, ErrUnsupportedKey{Reason: fmt.Sprintf("signing key type %T", privateKey)}
+	}
+}
+
+// Verify checks a signature made by Sign.
+func Verify(publicKey crypto.PublicKey, data []byte, signature []byte) error {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return ErrUnsupportedKey{Reason: fmt.Sprintf("verification key type %T", publicKey)}
+	}
+}